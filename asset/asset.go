@@ -1,6 +1,7 @@
 package asset
 
 import (
+	"io/fs"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -10,8 +11,9 @@ type Asset interface {
 	zerolog.LogObjectMarshaler
 	Path() string
 	Name() string // base name of the file
-	Size() int64  // length in bytes for regular files
+	Size() int64  // length in bytes for regular files, of the target for symbolic links, zero for directories
 	ModTime() time.Time
+	Attributes() Attributes
 	// compute hash from the filesystem
 	ComputeHash() (uint64, error)
 }
@@ -22,3 +24,106 @@ type ArchivedAsset interface {
 	StoredHash() uint64  // hash of the asset stored in the archive
 	ArchivePath() string // path of the archive containing the file
 }
+
+// Attributes are the file system attributes of an asset.
+type Attributes struct {
+	Mode  fs.FileMode // zero if unknown
+	UID   int
+	GID   int
+	User  string // name of the owner user, can be empty
+	Group string // name of the owner group, can be empty
+	// Target of a symbolic link, empty for other assets.
+	LinkTarget string
+}
+
+// A part of a file split across several archives.
+type Chunk struct {
+	ArchivePath string // path of the archive containing the part
+	Offset      int64  // position of the part in the file
+	Size        int64
+}
+
+// ChunkedAsset is implemented by archived assets that can be split across
+// several archives. ArchivePath is then the archive containing the last part.
+type ChunkedAsset interface {
+	ArchivedAsset
+	Chunks() []Chunk // in file order, empty if the asset is in a single archive
+}
+
+// The parts of an archived asset, empty if it is in a single archive.
+func ChunksOf(a ArchivedAsset) []Chunk {
+	if c, ok := a.(ChunkedAsset); ok {
+		return c.Chunks()
+	}
+	return nil
+}
+
+// The location of contents already archived for another asset.
+type ContentRef struct {
+	ArchivePath string // path of the archive containing the contents
+	Entry       string // name of the entry in the archive
+}
+
+// ReferencingAsset is implemented by archived assets whose contents can be
+// stored once for several identical files. ArchivePath is then the archive
+// recording the asset, and the contents are in another entry.
+type ReferencingAsset interface {
+	ArchivedAsset
+	ContentRef() (ContentRef, bool) // false if the contents are stored with the asset
+}
+
+// The location of the contents of an archived asset, if not stored with it.
+func ContentRefOf(a ArchivedAsset) (ContentRef, bool) {
+	if r, ok := a.(ReferencingAsset); ok {
+		return r.ContentRef()
+	}
+	return ContentRef{}, false
+}
+
+// MovedAsset is an asset with the same contents as an archived asset that is
+// no longer in the source, as when a file is renamed or moved.
+type MovedAsset interface {
+	Asset
+	MovedFrom() ArchivedAsset
+}
+
+// RepairedAsset is an unchanged asset archived again because the contents
+// archived for it were damaged. Its contents are always written again.
+type RepairedAsset interface {
+	Asset
+	Repairs() ArchivedAsset
+}
+
+// MovedArchivedAsset is implemented by archived assets recorded as moved.
+type MovedArchivedAsset interface {
+	ArchivedAsset
+	PreviousPath() string // empty if the asset was not moved
+}
+
+// StrongHashedAsset is implemented by archived assets that can have a
+// cryptographic hash of their contents, along with the stored hash.
+type StrongHashedAsset interface {
+	ArchivedAsset
+	StrongHash() string // "<algorithm>:<hexadecimal sum>", empty if not computed
+}
+
+// The cryptographic hash of the contents of an archived asset, if computed.
+func StrongHashOf(a ArchivedAsset) (string, bool) {
+	if s, ok := a.(StrongHashedAsset); ok && s.StrongHash() != "" {
+		return s.StrongHash(), true
+	}
+	return "", false
+}
+
+// EncryptedAsset is implemented by archived assets that can be recorded in
+// encrypted archives.
+type EncryptedAsset interface {
+	ArchivedAsset
+	Encrypted() bool
+}
+
+// Whether the archive recording the asset is encrypted.
+func IsEncrypted(a ArchivedAsset) bool {
+	e, ok := a.(EncryptedAsset)
+	return ok && e.Encrypted()
+}
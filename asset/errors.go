@@ -1,5 +0,0 @@
-package asset
-
-import "errors"
-
-var ErrMaxSizeExceeded = errors.New("asset maximum size exceeded")
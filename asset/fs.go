@@ -2,24 +2,21 @@ package asset
 
 import (
 	"errors"
-	"fmt"
 	"io/fs"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/stupid-simple/backup/fileutils"
 )
 
-const fourGiB = 2 << 31
-
+// NewFromFS returns an asset for a regular file, a symbolic link or a directory.
+// Symbolic links are not followed, the link itself is the asset.
 func NewFromFS(path string, info fs.FileInfo) (Asset, error) {
 	mode := info.Mode()
-	if !mode.IsRegular() {
-		return nil, errors.New("not a regular file")
-	}
-
-	if info.Size() > fourGiB {
-		return nil, fmt.Errorf("%w: current size %d, maximum %d", ErrMaxSizeExceeded, info.Size(), fourGiB)
+	if !mode.IsRegular() && !mode.IsDir() && mode&fs.ModeSymlink == 0 {
+		return nil, errors.New("not a regular file, symbolic link or directory")
 	}
 
 	asset := &fsAsset{
@@ -27,12 +24,21 @@ func NewFromFS(path string, info fs.FileInfo) (Asset, error) {
 		info: info,
 	}
 
+	if mode&fs.ModeSymlink != 0 {
+		var err error
+		asset.linkTarget, err = os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return asset, nil
 }
 
 type fsAsset struct {
-	path string
-	info fs.FileInfo
+	path       string
+	info       fs.FileInfo
+	linkTarget string
 }
 
 // Name implements Asset.
@@ -42,7 +48,14 @@ func (a *fsAsset) Name() string {
 
 // Size implements Asset.
 func (a *fsAsset) Size() int64 {
-	return a.info.Size()
+	switch {
+	case a.info.IsDir():
+		return 0
+	case a.linkTarget != "":
+		return int64(len(a.linkTarget))
+	default:
+		return a.info.Size()
+	}
 }
 
 // ModTime implements Asset.
@@ -54,7 +67,10 @@ func (a *fsAsset) ModTime() time.Time {
 func (a *fsAsset) MarshalZerologObject(e *zerolog.Event) {
 	e.Str("path", a.path)
 	e.Str("name", a.info.Name())
-	e.Int64("size", a.info.Size())
+	e.Int64("size", a.Size())
+	if a.linkTarget != "" {
+		e.Str("link_target", a.linkTarget)
+	}
 }
 
 // Path implements Asset.
@@ -62,6 +78,29 @@ func (a *fsAsset) Path() string {
 	return a.path
 }
 
+// Attributes implements Asset.
+func (a *fsAsset) Attributes() Attributes {
+	attrs := Attributes{Mode: a.info.Mode(), LinkTarget: a.linkTarget}
+	if uid, gid, ok := fileutils.FileOwner(a.info); ok {
+		attrs.UID = uid
+		attrs.GID = gid
+		attrs.User = fileutils.UserName(uid)
+		attrs.Group = fileutils.GroupName(gid)
+	}
+	return attrs
+}
+
 func (a *fsAsset) ComputeHash() (uint64, error) {
-	return fileutils.ComputeFileHash(a.path)
+	switch {
+	case a.info.IsDir():
+		return fileutils.ComputeHash(strings.NewReader(""))
+	case a.info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(a.path)
+		if err != nil {
+			return 0, err
+		}
+		return fileutils.ComputeHash(strings.NewReader(target))
+	default:
+		return fileutils.ComputeFileHash(a.path)
+	}
 }
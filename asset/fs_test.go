@@ -1,7 +1,6 @@
 package asset_test
 
 import (
-	"errors"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -49,22 +48,33 @@ func TestNewFromFS(t *testing.T) {
 	if hash != 5020219685658847592 {
 		t.Errorf("expected hash 5020219685658847592, got %d", hash)
 	}
+
+	attrs := a.Attributes()
+	if attrs.Mode != info.Mode() {
+		t.Errorf("expected mode %s, got %s", info.Mode(), attrs.Mode)
+	}
+	if attrs.UID != os.Getuid() {
+		t.Errorf("expected uid %d, got %d", os.Getuid(), attrs.UID)
+	}
+	if attrs.GID != os.Getgid() {
+		t.Errorf("expected gid %d, got %d", os.Getgid(), attrs.GID)
+	}
 }
 
-func TestNewFromFS_TooLarge(t *testing.T) {
-	testPath := filepath.Join(t.TempDir(), "hello.txt")
+func TestNewFromFS_Large(t *testing.T) {
+	testPath := filepath.Join(t.TempDir(), "disk.img")
 	err := os.WriteFile(testPath, data, 0600)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var fourGiB int64 = 4 * 1024 * 1024 * 1024
-	a, err := asset.NewFromFS(testPath, fakeFileInfo{name: "hello.txt", size: fourGiB + 1})
-	if !errors.Is(err, asset.ErrMaxSizeExceeded) {
-		t.Error("expected error")
+	var size int64 = 5 * 1024 * 1024 * 1024
+	a, err := asset.NewFromFS(testPath, fakeFileInfo{name: "disk.img", size: size})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if a != nil {
-		t.Error("expected nil")
+	if a.Size() != size {
+		t.Errorf("expected size %d, got %d", size, a.Size())
 	}
 }
 
@@ -2,15 +2,39 @@ package asset
 
 import (
 	"context"
+	"errors"
+	"io"
 	"io/fs"
 	"iter"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
 )
 
-func ScanDirectory(ctx context.Context, dirPath string, logger zerolog.Logger) (iter.Seq[Asset], error) {
+type ScanOption func(o *scanOptions)
+
+type scanOptions struct {
+	followSymlinks bool
+}
+
+// Follow symbolic links instead of scanning the links themselves.
+// Links pointing back to a directory containing them are stored as links.
+func WithFollowSymlinks(follow bool) ScanOption {
+	return func(o *scanOptions) {
+		o.followSymlinks = follow
+	}
+}
+
+// ScanDirectory scans dirPath recursively for regular files, symbolic links and empty directories.
+func ScanDirectory(ctx context.Context, dirPath string, logger zerolog.Logger, opts ...ScanOption) (iter.Seq[Asset], error) {
+	o := scanOptions{}
+	for _, applyOpt := range opts {
+		applyOpt(&o)
+	}
+
 	return func(yield func(Asset) bool) {
 		var scannedCount int
 		var statFiles int
@@ -29,58 +53,149 @@ func ScanDirectory(ctx context.Context, dirPath string, logger zerolog.Logger) (
 			Burst:  1,
 			Period: 1 * time.Second,
 		})
-		err := filepath.WalkDir(dirPath, func(path string, d fs.DirEntry, err error) error {
-			if ctx.Err() != nil {
-				return nil
-			}
 
-			if err != nil {
-				logger.Warn().Err(err).Str("path", path).Msg("could not scan path")
-				return nil
-			}
-			if d.IsDir() {
-				return nil
-			}
+		// Real paths of the links followed to reach the directory being walked,
+		// and of their targets, used to detect symbolic link loops.
+		var ancestors []string
+		var stopped bool
 
-			info, err := d.Info()
-			if err != nil {
-				logger.Warn().Err(err).Str("path", path).Msg("could not stat path")
-				return nil
-			}
+		// Walk realDir, reporting the assets as if they were found under dir.
+		var walk func(dir string, realDir string) error
+		walk = func(dir string, realDir string) error {
+			return filepath.WalkDir(realDir, func(path string, d fs.DirEntry, err error) error {
+				if ctx.Err() != nil {
+					return nil
+				}
+				if stopped {
+					return filepath.SkipAll
+				}
 
-			mode := info.Mode()
-			if !mode.IsRegular() {
-				return nil
-			}
+				realPath := path
+				path = dir + strings.TrimPrefix(path, realDir)
 
-			// Check if the file is readable.
-			if mode&0444 == 0 {
-				logger.Warn().Str("path", path).Msg("file is not readable")
-				return nil
-			}
+				if err != nil {
+					logger.Warn().Err(err).Str("path", path).Msg("could not scan path")
+					return nil
+				}
+
+				var info fs.FileInfo
+				switch {
+				case d.IsDir():
+					if path == dir {
+						return nil
+					}
+					empty, err := isEmptyDir(path)
+					if err != nil || !empty {
+						// Errors are reported when walking the directory.
+						return nil
+					}
+				case d.Type()&fs.ModeSymlink != 0 && o.followSymlinks:
+					targetInfo, err := os.Stat(path)
+					if err != nil {
+						logger.Warn().Err(err).Str("path", path).Msg("could not follow symbolic link, the link will be stored")
+						break
+					}
+					if !targetInfo.IsDir() {
+						info = targetInfo
+						break
+					}
 
-			statFiles++
+					realTarget, err := filepath.EvalSymlinks(path)
+					if err != nil {
+						logger.Warn().Err(err).Str("path", path).Msg("could not follow symbolic link")
+						return nil
+					}
+					if isLoop(append(ancestors, realPath), realTarget) {
+						logger.Warn().Str("path", path).Str("target", realTarget).Msg("symbolic link loop, the link will be stored")
+						break
+					}
+					ancestors = append(ancestors, realPath, realTarget)
+					err = walk(path, realTarget)
+					ancestors = ancestors[:len(ancestors)-2]
+					if err != nil {
+						logger.Error().Err(err).Str("path", path).Msg("could not scan path")
+					}
+					return nil
+				}
+
+				if info == nil {
+					info, err = d.Info()
+					if err != nil {
+						logger.Warn().Err(err).Str("path", path).Msg("could not stat path")
+						return nil
+					}
+				}
+
+				mode := info.Mode()
+				if !mode.IsRegular() && !mode.IsDir() && mode&fs.ModeSymlink == 0 {
+					return nil
+				}
+
+				// Check if the file is readable.
+				if mode.IsRegular() && mode&0444 == 0 {
+					logger.Warn().Str("path", path).Msg("file is not readable")
+					return nil
+				}
+
+				statFiles++
+
+				newAsset, err := NewFromFS(path, info)
+				if err != nil {
+					logger.Warn().Err(err).Str("path", path).Msg("could not create asset")
+					return nil
+				}
+
+				if !yield(newAsset) {
+					stopped = true
+					return filepath.SkipAll
+				}
+				scannedCount++
+				logger.Debug().Object("asset", newAsset).Msg("scanned asset")
+				throttledLogger.Info().
+					Int("scanned", statFiles).
+					Int("scanned_success", scannedCount).
+					Str("dir", dirPath).Msg("scanning assets")
 
-			newAsset, err := NewFromFS(path, info)
-			if err != nil {
-				logger.Warn().Err(err).Str("path", path).Msg("could not create asset")
 				return nil
-			}
+			})
+		}
 
-			if !yield(newAsset) {
-				return filepath.SkipAll
+		realDir := dirPath
+		if o.followSymlinks {
+			if resolved, err := filepath.EvalSymlinks(dirPath); err == nil {
+				realDir = resolved
 			}
-			scannedCount++
-			logger.Debug().Object("asset", newAsset).Msg("scanned asset")
-			throttledLogger.Info().
-				Int("scanned", statFiles).
-				Int("scanned_success", scannedCount).
-				Str("dir", dirPath).Msg("scanning assets")
-
-			return nil
-		})
+		}
+		err := walk(dirPath, realDir)
 		if err != nil {
 			logger.Error().Err(err).Str("path", dirPath).Msg("could not scan path")
 		}
 	}, nil
 }
+
+func isEmptyDir(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	_, err = f.Readdirnames(1)
+	if errors.Is(err, io.EOF) {
+		return true, nil
+	}
+	return false, err
+}
+
+// A directory loops if it contains one of the paths leading to it. Links to
+// other directories of the same tree are not loops.
+func isLoop(ancestors []string, dir string) bool {
+	for _, ancestor := range ancestors {
+		if ancestor == dir || strings.HasPrefix(ancestor, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -147,3 +147,89 @@ func TestScanDirectoryErrors(t *testing.T) {
 		t.Skip("Skipping permission test on Windows")
 	}
 }
+
+func TestScanDirectorySymlinksAndEmptyDirs(t *testing.T) {
+	tempDir := t.TempDir()
+	outsideDir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "file.txt"), []byte("content"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(tempDir, "empty"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(tempDir, "subdir", "nested_empty"), 0755))
+	require.NoError(t, os.Symlink("file.txt", filepath.Join(tempDir, "link.txt")))
+	require.NoError(t, os.Symlink("missing.txt", filepath.Join(tempDir, "dangling.txt")))
+	// Links to directories, one of them loops back to the scanned directory.
+	require.NoError(t, os.WriteFile(filepath.Join(outsideDir, "outside.txt"), []byte("outside"), 0644))
+	require.NoError(t, os.Symlink(outsideDir, filepath.Join(tempDir, "outside")))
+	require.NoError(t, os.Symlink("..", filepath.Join(tempDir, "subdir", "loop")))
+	require.NoError(t, os.Symlink("subdir", filepath.Join(tempDir, "latest")))
+
+	logger := zerolog.New(zerolog.NewTestWriter(t))
+
+	scan := func(opts ...asset.ScanOption) map[string]asset.Asset {
+		seq, err := asset.ScanDirectory(context.Background(), tempDir, logger, opts...)
+		require.NoError(t, err)
+		found := map[string]asset.Asset{}
+		for a := range seq {
+			rel, err := filepath.Rel(tempDir, a.Path())
+			require.NoError(t, err)
+			found[rel] = a
+		}
+		return found
+	}
+
+	t.Run("store links", func(t *testing.T) {
+		found := scan()
+		assert.ElementsMatch(t, []string{
+			"file.txt",
+			"empty",
+			"subdir/nested_empty",
+			"link.txt",
+			"dangling.txt",
+			"outside",
+			"subdir/loop",
+			"latest",
+		}, mapKeys(found))
+
+		link := found["link.txt"]
+		assert.NotZero(t, link.Attributes().Mode&os.ModeSymlink)
+		assert.Equal(t, "file.txt", link.Attributes().LinkTarget)
+		assert.Equal(t, int64(len("file.txt")), link.Size())
+
+		dir := found["empty"]
+		assert.True(t, dir.Attributes().Mode.IsDir())
+		assert.Zero(t, dir.Size())
+	})
+
+	t.Run("follow links", func(t *testing.T) {
+		found := scan(asset.WithFollowSymlinks(true))
+		assert.ElementsMatch(t, []string{
+			"file.txt",
+			"empty",
+			"subdir/nested_empty",
+			"link.txt",
+			"dangling.txt",
+			"outside/outside.txt",
+			"subdir/loop",
+			"latest/nested_empty",
+			"latest/loop",
+		}, mapKeys(found))
+
+		link := found["link.txt"]
+		assert.True(t, link.Attributes().Mode.IsRegular())
+		assert.Empty(t, link.Attributes().LinkTarget)
+		assert.Equal(t, int64(len("content")), link.Size())
+
+		// Links that can't be followed or loop are stored as links.
+		assert.NotZero(t, found["dangling.txt"].Attributes().Mode&os.ModeSymlink)
+		assert.NotZero(t, found["subdir/loop"].Attributes().Mode&os.ModeSymlink)
+		assert.NotZero(t, found["latest/loop"].Attributes().Mode&os.ModeSymlink)
+	})
+}
+
+func mapKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
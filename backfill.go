@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/database"
+	"github.com/stupid-simple/backup/fileutils"
+	"github.com/stupid-simple/backup/ziparchiver"
+)
+
+func backfillHashesCommand(ctx context.Context, args BackfillHashesCommand, logger zerolog.Logger) error {
+	alg, err := fileutils.ParseHashAlgorithm(args.Algorithm)
+	if err != nil {
+		return err
+	}
+	if args.DryRun {
+		logger = logger.With().Bool("dryrun", true).Logger()
+	}
+
+	startTime := time.Now()
+	logger.Info().Str("algorithm", string(alg)).Msg("starting backfill of strong hashes")
+	defer func() {
+		tookSeconds := time.Since(startTime).Seconds()
+		if ctx.Err() != nil {
+			logger.Info().Float64("seconds", tookSeconds).Msg("backfill cancelled")
+		} else {
+			logger.Info().Float64("seconds", tookSeconds).Msg("backfill done")
+		}
+	}()
+
+	password, err := readPassword(args.PasswordFile, args.PasswordEnv)
+	if err != nil {
+		return err
+	}
+
+	dbCli, err := newSQLite(args.Database, logger)
+	if err != nil {
+		return err
+	}
+
+	db := &database.Database{
+		Cli:    dbCli,
+		Logger: logger,
+		DryRun: args.DryRun,
+	}
+
+	sources, err := db.IterSources(ctx)
+	if err != nil {
+		return err
+	}
+
+	var found bool
+	var hashed, failed int
+	for src := range sources {
+		if args.Source != "" && src.Path() != args.Source {
+			continue
+		}
+		found = true
+		h, f, err := backfillSource(ctx, src, alg, password, logger.With().Str("source", src.Path()).Logger())
+		hashed += h
+		failed += f
+		if err != nil {
+			return err
+		}
+	}
+	if args.Source != "" && !found {
+		return fmt.Errorf("source not found: %s", args.Source)
+	}
+
+	logger.Info().Int("hashed", hashed).Int("failed", failed).Msg("backfilled strong hashes")
+	if failed > 0 {
+		return fmt.Errorf("could not hash %d archived files", failed)
+	}
+	return nil
+}
+
+// Hash the archived files of the source that have no strong hash yet, reading
+// them from the archives, decrypted with the password if encrypted. Returns the
+// number of files hashed and failed.
+func backfillSource(ctx context.Context, src *database.BackupSource, alg fileutils.HashAlgorithm, password []byte, logger zerolog.Logger) (int, int, error) {
+	archives, err := src.FindArchives(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var hashed, failed int
+	for archive := range archives {
+		if ctx.Err() != nil {
+			return hashed, failed, nil
+		}
+		assets, err := src.FindArchiveAssets(ctx, archive.Path)
+		if err != nil {
+			return hashed, failed, err
+		}
+
+		readers := ziparchiver.Open(ziparchiver.WithPassword(password))
+		strongHashes := make(map[string]string)
+		for _, a := range assets {
+			mode := a.Attributes().Mode
+			if !mode.IsRegular() && mode&fs.ModeSymlink == 0 {
+				continue
+			}
+			if _, ok := asset.StrongHashOf(a); ok {
+				continue
+			}
+			strongHash, err := readers.StrongHash(a, alg)
+			if err != nil {
+				logger.Error().Err(err).Str("archive", archive.Path).Str("path", a.Path()).Msg("could not hash archived file")
+				failed++
+				continue
+			}
+			strongHashes[a.Path()] = strongHash
+		}
+		if err := readers.Close(); err != nil {
+			logger.Warn().Err(err).Str("archive", archive.Path).Msg("failed to close archives")
+		}
+
+		if len(strongHashes) == 0 {
+			continue
+		}
+		if err := src.SetStrongHashes(ctx, archive.Path, strongHashes); err != nil {
+			return hashed, failed, err
+		}
+		hashed += len(strongHashes)
+		logger.Debug().Str("archive", archive.Path).Int("hashed", len(strongHashes)).Msg("hashed archived files")
+	}
+	return hashed, failed, nil
+}
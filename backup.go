@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
+	"iter"
 	"os"
 	"time"
 
@@ -10,6 +12,7 @@ import (
 	"github.com/stupid-simple/backup/asset"
 	"github.com/stupid-simple/backup/database"
 	"github.com/stupid-simple/backup/fileutils"
+	"github.com/stupid-simple/backup/signing"
 	"github.com/stupid-simple/backup/ziparchiver"
 )
 
@@ -21,6 +24,28 @@ func backupCommand(ctx context.Context, args BackupCommand, logger zerolog.Logge
 	if args.MaxSize.Size > 0 && args.MaxSize.Size < 1024 {
 		return fmt.Errorf("max size must be at least 1024 bytes")
 	}
+	if args.Workers < 1 {
+		return fmt.Errorf("workers must be at least 1")
+	}
+	if args.Parity < 0 || args.Parity > 100 {
+		return fmt.Errorf("parity must be between 0 and 100")
+	}
+	strongHash, err := fileutils.ParseHashAlgorithm(args.StrongHash)
+	if err != nil {
+		return err
+	}
+	var signingKey ed25519.PrivateKey
+	if args.SigningKey != "" {
+		signingKey, err = signing.LoadPrivateKey(args.SigningKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	password, err := readPassword(args.PasswordFile, args.PasswordEnv)
+	if err != nil {
+		return err
+	}
 
 	srcPath := args.Source
 
@@ -35,6 +60,15 @@ func backupCommand(ctx context.Context, args BackupCommand, logger zerolog.Logge
 		}
 	}()
 
+	compression, err := ziparchiver.ParseCompression(args.Compression, args.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	compressionPolicy, err := ziparchiver.NewCompressionPolicy(args.CompressionStore, args.CompressionAuto)
+	if err != nil {
+		return err
+	}
+
 	db, err := newSQLite(args.Database, logger)
 	if err != nil {
 		return err
@@ -49,8 +83,21 @@ func backupCommand(ctx context.Context, args BackupCommand, logger zerolog.Logge
 			maxFileBytes:      args.MaxSize.Size,
 			fullBackup:        args.Full,
 			includeLargeFiles: args.IncludeLargeFiles,
+			splitLargeFiles:   args.SplitLargeFiles,
+			followSymlinks:    args.FollowSymlinks,
+			checksums:         args.Checksums,
+			format:            ziparchiver.Format(args.Format),
+			compression:       compression,
+			compressionPolicy: compressionPolicy,
+			workers:           args.Workers,
+			deduplicate:       args.Deduplicate,
+			parity:            args.Parity,
+			strongHash:        strongHash,
+			signingKey:        signingKey,
+			password:          password,
 			db:                &database.Database{Cli: db, Logger: logger, DryRun: args.DryRun},
 			dryRun:            args.DryRun,
+			trigger:           "manual",
 			logger:            logger,
 		},
 	)
@@ -63,14 +110,45 @@ type backupParams struct {
 	maxFileBytes      int64
 	fullBackup        bool
 	includeLargeFiles bool
+	splitLargeFiles   bool
+	followSymlinks    bool
+	checksums         bool
+	format            ziparchiver.Format
+	compression       ziparchiver.Compression
+	compressionPolicy *ziparchiver.CompressionPolicy
+	workers           int
+	deduplicate       bool
+	parity            float64                 // Percentage of the archive size, zero for no parity file.
+	strongHash        fileutils.HashAlgorithm // Empty for no strong hash.
+	signingKey        ed25519.PrivateKey      // Nil to not sign the archives.
+	password          []byte                  // Nil to not encrypt the archives.
 	db                *database.Database
 	dryRun            bool
+	trigger           string // What started the backup, recorded with the run.
 	logger            zerolog.Logger
 }
 
+// Backup the source and record the run, whether it succeeds or not.
 func backupFiles(
 	ctx context.Context,
 	p backupParams,
+) error {
+	run, err := p.db.StartBackupRun(ctx, p.sourcePath, p.trigger)
+	if err != nil {
+		return fmt.Errorf("could not record backup run: %w", err)
+	}
+
+	err = runBackup(ctx, p, run)
+	if finishErr := p.db.FinishBackupRun(ctx, run, err); finishErr != nil {
+		p.logger.Error().Err(finishErr).Msg("could not record backup run")
+	}
+	return err
+}
+
+func runBackup(
+	ctx context.Context,
+	p backupParams,
+	run *database.BackupRun,
 ) error {
 	startTime := time.Now()
 	p.logger.Info().Str("source", p.sourcePath).Str("dest", p.destPath).Msg("starting backup")
@@ -104,7 +182,7 @@ func backupFiles(
 		return err
 	}
 
-	scanned, err := asset.ScanDirectory(ctx, p.sourcePath, p.logger)
+	scanned, err := asset.ScanDirectory(ctx, p.sourcePath, p.logger, asset.WithFollowSymlinks(p.followSymlinks))
 	if err != nil {
 		return err
 	}
@@ -113,27 +191,74 @@ func backupFiles(
 		return nil
 	}
 
+	var stats ziparchiver.Stats
 	storeAssetsOptions := []ziparchiver.StoreOption{
+		ziparchiver.WithStats(&stats),
 		ziparchiver.WithDryRun(p.dryRun),
 		ziparchiver.WithRegisterArchivedAssets(src),
 		ziparchiver.WithMaxFileBytes(p.maxFileBytes),
 		ziparchiver.WithIncludeLargeFiles(p.includeLargeFiles),
+		ziparchiver.WithSplitLargeFiles(p.splitLargeFiles),
+		ziparchiver.WithVersion(Version),
+		ziparchiver.WithChecksums(p.checksums),
+		ziparchiver.WithFormat(p.format),
+		ziparchiver.WithCompression(p.compression),
+		ziparchiver.WithCompressionPolicy(p.compressionPolicy),
+		ziparchiver.WithWorkers(p.workers),
+		ziparchiver.WithParity(p.parity),
+		ziparchiver.WithStrongHash(p.strongHash),
+		ziparchiver.WithSigningKey(p.signingKey),
+		ziparchiver.WithEncryption(p.password),
 	}
 
+	if p.deduplicate {
+		storeAssetsOptions = append(storeAssetsOptions, ziparchiver.WithDeduplication(src))
+	}
 	if !p.fullBackup {
 		storeAssetsOptions = append(storeAssetsOptions, ziparchiver.WithOnlyNewAssets(src))
 	}
 
-	return ziparchiver.StoreAssets(
+	err = ziparchiver.StoreAssets(
 		ctx,
 		p.sourcePath,
 		ziparchiver.ArchiveDescriptor{
 			Dir:    p.destPath,
 			Prefix: p.archivePrefix,
 		},
-		scanned,
+		countAssets(scanned, &run.Scanned),
 		p.logger,
 		storeAssetsOptions...,
 	)
+	found := src.FoundAssets()
+	run.New, run.Modified, run.Moved, run.Repaired = found.New, found.Modified, found.Moved, found.Repaired
+	run.Unchanged = found.Unchanged
+	run.Stored, run.Size, run.Written = stats.Stored, stats.Size, stats.Written
+	// Large files, files that could not be read or compared, and cancelled ones.
+	run.Skipped = max(run.Scanned-run.Unchanged-stats.Stored, 0)
+	if err != nil || ctx.Err() != nil {
+		return err
+	}
 
+	// Files deleted since the last backup are only recorded once the run is complete.
+	snapshot, deleted, err := src.RecordSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if snapshot.ID != 0 {
+		run.SnapshotID = &snapshot.ID
+	}
+	run.Deleted = deleted
+	return nil
+}
+
+// Count the assets of the sequence into count, as they are consumed.
+func countAssets(assets iter.Seq[asset.Asset], count *int) iter.Seq[asset.Asset] {
+	return func(yield func(asset.Asset) bool) {
+		for a := range assets {
+			*count++
+			if !yield(a) {
+				return
+			}
+		}
+	}
 }
@@ -8,6 +8,7 @@ import (
 
 	"github.com/rs/zerolog"
 	"github.com/stupid-simple/backup/database"
+	"github.com/stupid-simple/backup/signing"
 )
 
 func cleanCommand(ctx context.Context, args CleanCommand, logger zerolog.Logger) error {
@@ -118,6 +119,8 @@ func cleanOldBackupFiles(ctx context.Context, p cleanParams) error {
 				logger.Info().Str("path", archive.Path).Int64("size", stat.Size()).Msg("deleted old backup file")
 				totalSizeFreed += stat.Size()
 				filesDeleted++
+				totalSizeFreed += removeParityFile(archive, logger)
+				totalSizeFreed += removeSignatureFile(archive, logger)
 			}
 		}
 	}
@@ -131,3 +134,36 @@ func cleanOldBackupFiles(ctx context.Context, p cleanParams) error {
 
 	return nil
 }
+
+// Delete the parity file of a deleted archive. Returns the bytes freed.
+func removeParityFile(archive database.BackupArchive, logger zerolog.Logger) int64 {
+	if archive.ParityPath == "" {
+		return 0
+	}
+	stat, err := os.Stat(archive.ParityPath)
+	if err != nil {
+		logger.Warn().Err(err).Str("path", archive.ParityPath).Msg("failed to stat parity file")
+		return 0
+	}
+	if err := os.Remove(archive.ParityPath); err != nil {
+		logger.Error().Err(err).Str("path", archive.ParityPath).Msg("failed to delete parity file")
+		return 0
+	}
+	logger.Info().Str("path", archive.ParityPath).Int64("size", stat.Size()).Msg("deleted parity file")
+	return stat.Size()
+}
+
+// Delete the signature file of a deleted archive, if any. Returns the bytes freed.
+func removeSignatureFile(archive database.BackupArchive, logger zerolog.Logger) int64 {
+	path := signing.PathOf(archive.Path)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	if err := os.Remove(path); err != nil {
+		logger.Error().Err(err).Str("path", path).Msg("failed to delete signature file")
+		return 0
+	}
+	logger.Info().Str("path", path).Int64("size", stat.Size()).Msg("deleted signature file")
+	return stat.Size()
+}
@@ -1,13 +1,26 @@
 package main
 
-import "github.com/stupid-simple/backup/config"
+import (
+	"time"
+
+	"github.com/stupid-simple/backup/config"
+)
 
 type Command struct {
-	Version struct{}       `cmd:"" help:"Print version information."`
-	Backup  BackupCommand  `cmd:"" help:"Manually backup directory files."`
-	Restore RestoreCommand `cmd:"" help:"Manually restore directory files."`
-	Clean   CleanCommand   `cmd:"" help:"Manually clean up old backup files ."`
-	Daemon  DaemonCommand  `cmd:"" help:"Run the backup service."`
+	Version        struct{}              `cmd:"" help:"Print version information."`
+	Backup         BackupCommand         `cmd:"" help:"Manually backup directory files."`
+	Restore        RestoreCommand        `cmd:"" help:"Manually restore directory files."`
+	Clean          CleanCommand          `cmd:"" help:"Manually clean up old backup files ."`
+	Reindex        ReindexCommand        `cmd:"" help:"Rebuild the database from the backup archives."`
+	Deleted        DeletedCommand        `cmd:"" help:"List the files deleted from a source directory and when."`
+	Runs           RunsCommand           `cmd:"" help:"List the backup runs and their results."`
+	Status         StatusCommand         `cmd:"" help:"Check that the configured sources are backed up. Fails if any is stale or failing."`
+	Verify         VerifyCommand         `cmd:"" help:"Check that the archives match the database. Fails if any problem is found."`
+	Repair         RepairCommand         `cmd:"" help:"Rebuild the damaged blocks of an archive from its parity file."`
+	BackfillHashes BackfillHashesCommand `cmd:"" help:"Compute the strong hash of the files archived without one, reading them from the archives."`
+	Keygen         KeygenCommand         `cmd:"" help:"Generate an ed25519 key pair to sign the archives."`
+	CheckSignature CheckSignatureCommand `cmd:"" help:"Check the signatures of archives with a public key, without the database."`
+	Daemon         DaemonCommand         `cmd:"" help:"Run the backup service."`
 }
 
 type BackupCommand struct {
@@ -19,12 +32,40 @@ type BackupCommand struct {
 	ArchivePrefix     string              `help:"archive prefix"`
 	MaxSize           config.SizeArgument `help:"maximum stored bytes per archive in bytes"`
 	IncludeLargeFiles bool                `help:"include large files in backup, will be skipped otherwise"`
+	SplitLargeFiles   bool                `help:"split files larger than the maximum archive size across several archives"`
+	FollowSymlinks    bool                `help:"backup the files that symbolic links point to instead of the links"`
+	Checksums         bool                `help:"write a sha256sum compatible checksum file in each archive"`
+	Format            string              `help:"archive format: ${enum}" enum:"zip,tar.zst" default:"zip"`
+	Compression       string              `help:"compression of the zip archive entries: ${enum}. Zstd entries can't be read by all unzip tools" enum:"deflate,zstd,store" default:"deflate"`
+	CompressionLevel  int                 `help:"compression level, 1 to 9 for deflate and 1 to 22 for zstd. Zstd levels are grouped in 4 speeds: 1-2, 3-5, 6-9 and 10-22. By default, the default level of the method"`
+	CompressionStore  []string            `help:"store files with this extension (.jpg) or MIME type (video/*) without compression in zip archives. Can be repeated" sep:"none"`
+	CompressionAuto   bool                `help:"store files without compression in zip archives when their first bytes don't compress well"`
+	Workers           int                 `help:"number of files compressed at the same time in zip archives" default:"1"`
+	Deduplicate       bool                `help:"store the contents of identical files once, in any source, and reference them"`
+	Parity            float64             `help:"write a parity file next to each archive, of this percentage of the archive size, to repair it with the repair command. None by default"`
+	StrongHash        string              `help:"also store a strong hash of the contents of the files, checked when verifying and restoring: sha256 or blake3. None by default"`
+	SigningKey        string              `help:"sign each archive with this private key file, in a signature file next to it. See the keygen command"`
+	PasswordFile      string              `help:"encrypt the zip archives with AES-256 and the password in this file. Not encrypted by default" xor:"password"`
+	PasswordEnv       string              `help:"encrypt the zip archives with AES-256 and the password in this environment variable. Not encrypted by default" xor:"password"`
 }
 
 type RestoreCommand struct {
-	Dest     string `help:"destination directory path where files will be restored" short:"D" required:""`
-	Database string `help:"database path" short:"d" required:""`
-	DryRun   bool   `help:"don't write any files, just print the output"`
+	Source         string    `help:"source directory path that was backed up" short:"s" required:"" xor:"source"`
+	Dest           string    `help:"deprecated, same as --source" short:"D" hidden:"" required:"" xor:"source"`
+	Target         string    `help:"directory path where files will be restored. By default, files are restored to their original paths" short:"t"`
+	AsOf           time.Time `help:"restore the latest version of each file archived at or before this time (RFC3339). By default, the latest version is restored"`
+	Snapshot       uint      `help:"restore the files as they were at the end of this backup run, see the deleted command for run ids"`
+	IncludeDeleted bool      `help:"also restore the files deleted from the source. By default, they are skipped"`
+	Path           string    `help:"only restore files under this path, relative to the source directory"`
+	Include        []string  `help:"only restore files matching this glob pattern, relative to the source directory. Can be repeated" sep:"none"`
+	Exclude        []string  `help:"don't restore files matching this glob pattern, relative to the source directory. Can be repeated" sep:"none"`
+	OnConflict     string    `help:"what to do with existing files that differ from the backup: ${enum}" enum:"skip,overwrite,keep-newer,rename" default:"skip"`
+	PublicKey      string    `help:"only restore files from archives with a valid signature for this public key file"`
+	Config         string    `help:"config file path, to check the signature of the archives with the signing key of the source when --public-key is not given" short:"c"`
+	PasswordFile   string    `help:"read the password of the encrypted archives from this file" xor:"password"`
+	PasswordEnv    string    `help:"read the password of the encrypted archives from this environment variable" xor:"password"`
+	Database       string    `help:"database path" short:"d" required:""`
+	DryRun         bool      `help:"don't write any files, just print the output"`
 }
 
 type CleanCommand struct {
@@ -34,6 +75,69 @@ type CleanCommand struct {
 	DryRun       bool   `help:"don't write any files, just print the output"`
 }
 
+type ReindexCommand struct {
+	Archives     string `help:"directory path containing the backup archives" short:"a" required:""`
+	Source       string `help:"source directory path of the archives without manifest" short:"s"`
+	PasswordFile string `help:"read the password of the encrypted archives from this file" xor:"password"`
+	PasswordEnv  string `help:"read the password of the encrypted archives from this environment variable" xor:"password"`
+	Database     string `help:"database path" short:"d" required:""`
+	DryRun       bool   `help:"don't write any files, just print the output"`
+}
+
+type DeletedCommand struct {
+	Source   string    `help:"source directory path that was backed up" short:"s" required:""`
+	Path     string    `help:"only list files under this path, relative to the source directory"`
+	Since    time.Time `help:"only list files deleted at or after this time (RFC3339)"`
+	Database string    `help:"database path" short:"d" required:""`
+}
+
+type RunsCommand struct {
+	Source   string    `help:"only list the runs of this source directory path" short:"s"`
+	Since    time.Time `help:"only list the runs started at or after this time (RFC3339)"`
+	Format   string    `help:"output format: ${enum}" enum:"table,json" default:"table"`
+	Database string    `help:"database path" short:"d" required:""`
+}
+
+type StatusCommand struct {
+	Config   string `help:"config file path" short:"c" required:""`
+	Database string `help:"database path" short:"d" required:""`
+	Format   string `help:"output format: ${enum}" enum:"table,json" default:"table"`
+}
+
+type VerifyCommand struct {
+	Source       string `help:"only verify the archives of this source directory path" short:"s"`
+	Sample       string `help:"only verify this share of the archives, picked at random, like 5%. By default, every archive is verified"`
+	Deep         bool   `help:"also compute the hash of the archived files and compare it to the database"`
+	PublicKey    string `help:"also check the signature of each archive with this public key file"`
+	PasswordFile string `help:"read the password of the encrypted archives from this file" xor:"password"`
+	PasswordEnv  string `help:"read the password of the encrypted archives from this environment variable" xor:"password"`
+	Database     string `help:"database path" short:"d" required:""`
+}
+
+type RepairCommand struct {
+	Archive  string `arg:"" help:"archive path"`
+	Database string `help:"database path, to record that the files of the archive can be restored again" short:"d"`
+	DryRun   bool   `help:"don't write any files, just print the output"`
+}
+
+type BackfillHashesCommand struct {
+	Source       string `help:"only hash the files of this source directory path" short:"s"`
+	Algorithm    string `help:"strong hash algorithm: ${enum}" enum:"sha256,blake3" default:"sha256"`
+	PasswordFile string `help:"read the password of the encrypted archives from this file" xor:"password"`
+	PasswordEnv  string `help:"read the password of the encrypted archives from this environment variable" xor:"password"`
+	Database     string `help:"database path" short:"d" required:""`
+	DryRun       bool   `help:"don't write any files, just print the output"`
+}
+
+type KeygenCommand struct {
+	Key string `arg:"" help:"private key file path. The public key is written next to it, with a .pub suffix"`
+}
+
+type CheckSignatureCommand struct {
+	Archives  []string `arg:"" help:"archive paths"`
+	PublicKey string   `help:"public key file path" short:"k" required:""`
+}
+
 type DaemonCommand struct {
 	Config   string `help:"config file path" short:"c" required:""`
 	Database string `help:"database path" short:"d" required:""`
@@ -0,0 +1,12 @@
+package config
+
+import "time"
+
+type DurationArgument struct {
+	Duration time.Duration `arg:"" help:"duration, like 26h or 90m"`
+}
+
+func (d *DurationArgument) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
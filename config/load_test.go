@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stupid-simple/backup/config"
 )
@@ -20,6 +21,12 @@ var goodConfig = `
 		{
 			"source_dir": "test3",
 			"archive_dir": "test4",
+			"format": "tar.zst",
+			"max_age": "26h",
+			"parity": 5,
+			"strong_hash": "blake3",
+			"signing_key": "ssbak.key",
+			"password_file": "ssbak.password",
 			"enable": false,
 			"cron": "10 * * * *"
 		}
@@ -62,6 +69,38 @@ func TestLoad_Good(t *testing.T) {
 	if cfg.Sources[1].ArchiveDir != "test4" {
 		t.Errorf("expected dest test2, got %s", cfg.Sources[1].ArchiveDir)
 	}
+
+	if cfg.Sources[0].Format != "" {
+		t.Errorf("expected default format, got %s", cfg.Sources[0].Format)
+	}
+
+	if cfg.Sources[1].Format != "tar.zst" {
+		t.Errorf("expected format tar.zst, got %s", cfg.Sources[1].Format)
+	}
+
+	if cfg.Sources[0].MaxAge.Duration != 0 {
+		t.Errorf("expected no max age, got %s", cfg.Sources[0].MaxAge.Duration)
+	}
+
+	if cfg.Sources[1].MaxAge.Duration != 26*time.Hour {
+		t.Errorf("expected max age 26h, got %s", cfg.Sources[1].MaxAge.Duration)
+	}
+
+	if cfg.Sources[1].Parity != 5 {
+		t.Errorf("expected parity 5, got %v", cfg.Sources[1].Parity)
+	}
+
+	if cfg.Sources[1].StrongHash != "blake3" {
+		t.Errorf("expected strong hash blake3, got %q", cfg.Sources[1].StrongHash)
+	}
+
+	if cfg.Sources[1].SigningKey != "ssbak.key" {
+		t.Errorf("expected signing key ssbak.key, got %q", cfg.Sources[1].SigningKey)
+	}
+
+	if cfg.Sources[1].PasswordFile != "ssbak.password" {
+		t.Errorf("expected password file ssbak.password, got %q", cfg.Sources[1].PasswordFile)
+	}
 }
 
 func TestLoad_Bad(t *testing.T) {
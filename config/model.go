@@ -7,13 +7,32 @@ type Config struct {
 }
 
 type ConfigSource struct {
-	SourceDir                string       `json:"source_dir"`
-	ArchiveDir               string       `json:"archive_dir"`
-	ArchivePrefix            string       `json:"archive_prefix,omitempty"`
-	ArchiveMaxFileSize       SizeArgument `json:"archive_max_sum_size,omitempty"`
-	ArchiveIncludeLargeFiles bool         `json:"archive_include_large_files,omitempty"`
-	Enable                   bool         `json:"enable"`
-	Schedule                 string       `json:"cron"`
+	SourceDir                string           `json:"source_dir"`
+	ArchiveDir               string           `json:"archive_dir"`
+	ArchivePrefix            string           `json:"archive_prefix,omitempty"`
+	ArchiveMaxFileSize       SizeArgument     `json:"archive_max_sum_size,omitempty"`
+	ArchiveIncludeLargeFiles bool             `json:"archive_include_large_files,omitempty"`
+	ArchiveSplitLargeFiles   bool             `json:"archive_split_large_files,omitempty"`
+	FollowSymlinks           bool             `json:"follow_symlinks,omitempty"`
+	ArchiveChecksums         bool             `json:"archive_checksums,omitempty"`
+	Format                   string           `json:"format,omitempty"`
+	Compression              string           `json:"compression,omitempty"`
+	CompressionLevel         int              `json:"compression_level,omitempty"`
+	CompressionStore         []string         `json:"compression_store,omitempty"`
+	CompressionAuto          bool             `json:"compression_auto,omitempty"`
+	Workers                  int              `json:"workers,omitempty"`
+	Deduplicate              bool             `json:"deduplicate,omitempty"`
+	Parity                   float64          `json:"parity,omitempty"`
+	StrongHash               string           `json:"strong_hash,omitempty"`
+	SigningKey               string           `json:"signing_key,omitempty"`
+	PasswordFile             string           `json:"password_file,omitempty"`
+	PasswordEnv              string           `json:"password_env,omitempty"`
+	MaxAge                   DurationArgument `json:"max_age,omitempty"`
+	Scrub                    string           `json:"scrub,omitempty"`
+	ScrubPercent             float64          `json:"scrub_percent,omitempty"`
+	ScrubMaxSize             SizeArgument     `json:"scrub_max_size,omitempty"`
+	Enable                   bool             `json:"enable"`
+	Schedule                 string           `json:"cron"`
 }
 
 func (s ConfigSource) MarshalZerologObject(e *zerolog.Event) {
@@ -28,5 +47,60 @@ func (s ConfigSource) MarshalZerologObject(e *zerolog.Event) {
 	if s.ArchiveMaxFileSize.Size > 0 {
 		e.Int64("archive_max_sum_size", s.ArchiveMaxFileSize.Size)
 		e.Bool("archive_include_large_files", s.ArchiveIncludeLargeFiles)
+		e.Bool("archive_split_large_files", s.ArchiveSplitLargeFiles)
+	}
+	if s.FollowSymlinks {
+		e.Bool("follow_symlinks", s.FollowSymlinks)
+	}
+	if s.ArchiveChecksums {
+		e.Bool("archive_checksums", s.ArchiveChecksums)
+	}
+	if s.Format != "" {
+		e.Str("format", s.Format)
+	}
+	if s.Compression != "" {
+		e.Str("compression", s.Compression)
+	}
+	if s.CompressionLevel != 0 {
+		e.Int("compression_level", s.CompressionLevel)
+	}
+	if len(s.CompressionStore) > 0 {
+		e.Strs("compression_store", s.CompressionStore)
+	}
+	if s.CompressionAuto {
+		e.Bool("compression_auto", s.CompressionAuto)
+	}
+	if s.Workers > 0 {
+		e.Int("workers", s.Workers)
+	}
+	if s.Deduplicate {
+		e.Bool("deduplicate", s.Deduplicate)
+	}
+	if s.Parity > 0 {
+		e.Float64("parity", s.Parity)
+	}
+	if s.StrongHash != "" {
+		e.Str("strong_hash", s.StrongHash)
+	}
+	if s.SigningKey != "" {
+		e.Str("signing_key", s.SigningKey)
+	}
+	if s.PasswordFile != "" {
+		e.Str("password_file", s.PasswordFile)
+	}
+	if s.PasswordEnv != "" {
+		e.Str("password_env", s.PasswordEnv)
+	}
+	if s.MaxAge.Duration > 0 {
+		e.Dur("max_age", s.MaxAge.Duration)
+	}
+	if s.Scrub != "" {
+		e.Str("scrub", s.Scrub)
+		if s.ScrubPercent > 0 {
+			e.Float64("scrub_percent", s.ScrubPercent)
+		}
+		if s.ScrubMaxSize.Size > 0 {
+			e.Int64("scrub_max_size", s.ScrubMaxSize.Size)
+		}
 	}
 }
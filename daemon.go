@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -10,8 +12,13 @@ import (
 	"github.com/stupid-simple/backup/database"
 	"github.com/stupid-simple/backup/fileutils"
 	"github.com/stupid-simple/backup/scheduler"
+	"github.com/stupid-simple/backup/signing"
+	"github.com/stupid-simple/backup/ziparchiver"
 )
 
+// How often the daemon checks that the sources are backed up.
+const healthCheckInterval = 15 * time.Minute
+
 func daemonCommand(ctx context.Context, args DaemonCommand, logger zerolog.Logger) error {
 	if args.DryRun {
 		logger = logger.With().Bool("dryrun", true).Logger()
@@ -46,9 +53,14 @@ func daemonCommand(ctx context.Context, args DaemonCommand, logger zerolog.Logge
 		return fmt.Errorf("could not add sync jobs: %w", err)
 	}
 
+	var currentCfg atomic.Pointer[config.Config]
+	currentCfg.Store(cfg)
+	startHealthChecks(ctx, healthCheckInterval, currentCfg.Load, db, logger)
+
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 	startConfigFileWatcher(ctx, args.Config, logger, ticker, func(cfg *config.Config) {
+		currentCfg.Store(cfg)
 		scheduler.RemoveJobs()
 		err := addSyncJobsFromConfig(ctx, scheduler, cfg, db, logger, args.DryRun)
 		if err != nil {
@@ -107,6 +119,51 @@ func addSyncJobsFromConfig(
 		logger.Info().
 			Object("source", source).
 			Msg("added sync job")
+
+		if source.Scrub == "" {
+			continue
+		}
+		percent, maxBytes, err := scrubBudget(source.ScrubPercent, source.ScrubMaxSize.Size)
+		if err != nil {
+			logger.Error().Err(err).Str("source", source.SourceDir).Msg("could not add scrub job")
+			continue
+		}
+		// The archives are signed with the private key, checked with its public key.
+		var publicKey ed25519.PublicKey
+		if source.SigningKey != "" {
+			publicKey, err = signing.LoadPublicKey(source.SigningKey)
+			if err != nil {
+				logger.Error().Err(err).Str("source", source.SourceDir).Msg("could not add scrub job")
+				continue
+			}
+		}
+		password, err := readPassword(source.PasswordFile, source.PasswordEnv)
+		if err != nil {
+			logger.Error().Err(err).Str("source", source.SourceDir).Msg("could not add scrub job")
+			continue
+		}
+		scrub := &scrubJob{
+			ctx: ctx,
+			params: scrubParams{
+				sourcePath: source.SourceDir,
+				percent:    percent,
+				maxBytes:   maxBytes,
+				publicKey:  publicKey,
+				password:   password,
+				db:         db,
+				logger:     logger,
+			},
+		}
+		if err := scheduler.AddBackupJob(ctx, source.Scrub, scrub); err != nil {
+			logger.Error().Err(err).Str("source", source.SourceDir).Msg("could not add scrub job")
+			continue
+		}
+		logger.Info().
+			Str("source", source.SourceDir).
+			Str("scrub", source.Scrub).
+			Float64("percent", percent).
+			Int64("max_bytes", maxBytes).
+			Msg("added scrub job")
 	}
 	return nil
 }
@@ -127,6 +184,40 @@ func configSourceToBackupJob(
 	if cfgSource.Schedule == "" {
 		return nil, fmt.Errorf("source must have a schedule")
 	}
+	format, err := ziparchiver.ParseFormat(cfgSource.Format)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := ziparchiver.ParseCompression(cfgSource.Compression, cfgSource.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	compressionPolicy, err := ziparchiver.NewCompressionPolicy(cfgSource.CompressionStore, cfgSource.CompressionAuto)
+	if err != nil {
+		return nil, err
+	}
+	// Workers left out, or 0, compress the files one at a time.
+	if cfgSource.Workers < 0 {
+		return nil, fmt.Errorf("workers must not be negative")
+	}
+	if cfgSource.Parity < 0 || cfgSource.Parity > 100 {
+		return nil, fmt.Errorf("parity must be between 0 and 100")
+	}
+	strongHash, err := fileutils.ParseHashAlgorithm(cfgSource.StrongHash)
+	if err != nil {
+		return nil, err
+	}
+	var signingKey ed25519.PrivateKey
+	if cfgSource.SigningKey != "" {
+		signingKey, err = signing.LoadPrivateKey(cfgSource.SigningKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	password, err := readPassword(cfgSource.PasswordFile, cfgSource.PasswordEnv)
+	if err != nil {
+		return nil, err
+	}
 
 	return &backupJob{
 		ctx:               ctx,
@@ -136,6 +227,18 @@ func configSourceToBackupJob(
 		archivePrefix:     cfgSource.ArchivePrefix,
 		maxFileBytes:      cfgSource.ArchiveMaxFileSize.Size,
 		includeLargeFiles: cfgSource.ArchiveIncludeLargeFiles,
+		splitLargeFiles:   cfgSource.ArchiveSplitLargeFiles,
+		followSymlinks:    cfgSource.FollowSymlinks,
+		checksums:         cfgSource.ArchiveChecksums,
+		format:            format,
+		compression:       compression,
+		compressionPolicy: compressionPolicy,
+		workers:           cfgSource.Workers,
+		deduplicate:       cfgSource.Deduplicate,
+		parity:            cfgSource.Parity,
+		strongHash:        strongHash,
+		signingKey:        signingKey,
+		password:          password,
 		db:                db,
 		logger:            logger,
 	}, nil
@@ -188,6 +291,18 @@ type backupJob struct {
 	archivePrefix     string
 	maxFileBytes      int64
 	includeLargeFiles bool
+	splitLargeFiles   bool
+	followSymlinks    bool
+	checksums         bool
+	format            ziparchiver.Format
+	compression       ziparchiver.Compression
+	compressionPolicy *ziparchiver.CompressionPolicy
+	workers           int
+	deduplicate       bool
+	parity            float64
+	strongHash        fileutils.HashAlgorithm
+	signingKey        ed25519.PrivateKey
+	password          []byte
 	ctx               context.Context
 	logger            zerolog.Logger
 	db                *database.Database
@@ -203,8 +318,21 @@ func (b *backupJob) Run() {
 			archivePrefix:     b.archivePrefix,
 			maxFileBytes:      b.maxFileBytes,
 			includeLargeFiles: b.includeLargeFiles,
+			splitLargeFiles:   b.splitLargeFiles,
+			followSymlinks:    b.followSymlinks,
+			checksums:         b.checksums,
+			format:            b.format,
+			compression:       b.compression,
+			compressionPolicy: b.compressionPolicy,
+			workers:           b.workers,
+			deduplicate:       b.deduplicate,
+			parity:            b.parity,
+			strongHash:        b.strongHash,
+			signingKey:        b.signingKey,
+			password:          b.password,
 			db:                b.db,
 			dryRun:            b.dryRun,
+			trigger:           "daemon",
 			logger:            b.logger,
 		},
 	)
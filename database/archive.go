@@ -7,4 +7,6 @@ type BackupArchive struct {
 	CreatedAt time.Time
 	Size      int64
 	AssetCount  int
+	ParityPath string // Empty if the archive has no parity file.
+	Encrypted  bool
 }
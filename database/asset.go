@@ -1,9 +1,11 @@
 package database
 
 import (
+	"io/fs"
 	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/asset"
 	"github.com/stupid-simple/backup/fileutils"
 )
 
@@ -23,10 +25,41 @@ func (d dbAsset) ComputeHash() (uint64, error) {
 	return fileutils.ComputeFileHash(d.record.Path)
 }
 
+func (d dbAsset) Chunks() []asset.Chunk {
+	var chunks []asset.Chunk
+	for _, c := range d.record.Chunks {
+		chunks = append(chunks, asset.Chunk{
+			ArchivePath: c.ChunkArchivePath,
+			Offset:      c.Offset,
+			Size:        c.Size,
+		})
+	}
+	return chunks
+}
+
+func (d dbAsset) ContentRef() (asset.ContentRef, bool) {
+	if d.record.ContentArchivePath == "" {
+		return asset.ContentRef{}, false
+	}
+	return asset.ContentRef{ArchivePath: d.record.ContentArchivePath, Entry: d.record.ContentEntry}, true
+}
+
+func (d dbAsset) PreviousPath() string {
+	return d.record.MovedFrom
+}
+
 func (d dbAsset) StoredHash() uint64 {
 	return uint64(d.record.Hash)
 }
 
+func (d dbAsset) Encrypted() bool {
+	return d.record.Archive.Encrypted
+}
+
+func (d dbAsset) StrongHash() string {
+	return d.record.StrongHash
+}
+
 func (d dbAsset) MarshalZerologObject(e *zerolog.Event) {
 	e.Str("path", d.record.Path)
 	e.Str("name", d.record.Name)
@@ -40,6 +73,17 @@ func (d dbAsset) ModTime() time.Time {
 	return d.record.ModTime
 }
 
+func (d dbAsset) Attributes() asset.Attributes {
+	return asset.Attributes{
+		Mode:       fs.FileMode(d.record.Mode),
+		UID:        d.record.UID,
+		GID:        d.record.GID,
+		User:       d.record.UserName,
+		Group:      d.record.GroupName,
+		LinkTarget: d.record.LinkTarget,
+	}
+}
+
 func (d dbAsset) Name() string {
 	return d.record.Name
 }
@@ -51,3 +95,23 @@ func (d dbAsset) Path() string {
 func (d dbAsset) Size() int64 {
 	return d.record.Size
 }
+
+// movedAsset is a new asset with the contents of an archived file no longer in the source.
+type movedAsset struct {
+	asset.Asset
+	from asset.ArchivedAsset
+}
+
+func (m movedAsset) MovedFrom() asset.ArchivedAsset {
+	return m.from
+}
+
+// repairedAsset is an unchanged asset whose archived contents were damaged.
+type repairedAsset struct {
+	asset.Asset
+	damaged asset.ArchivedAsset
+}
+
+func (r repairedAsset) Repairs() asset.ArchivedAsset {
+	return r.damaged
+}
@@ -2,6 +2,8 @@ package database
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"iter"
 	"sync"
 
@@ -9,6 +11,8 @@ import (
 	"gorm.io/gorm"
 )
 
+var ErrArchiveNotFound = errors.New("archive not found")
+
 type Database struct {
 	Lock   sync.Mutex
 	Cli    *gorm.DB
@@ -56,3 +60,32 @@ func (d *Database) IterSources(ctx context.Context) (iter.Seq[*BackupSource], er
 		}
 	}, nil
 }
+
+// Whether an archive is registered, for any source.
+func (d *Database) HasArchive(ctx context.Context, path string) (bool, error) {
+	d.Lock.Lock()
+	defer d.Lock.Unlock()
+
+	var count int64
+	err := d.Cli.WithContext(ctx).Model(&Archive{}).Where("path = ?", path).Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Find a registered archive by its path, for any source.
+func (d *Database) GetArchive(ctx context.Context, path string) (*Archive, error) {
+	d.Lock.Lock()
+	defer d.Lock.Unlock()
+
+	archive := &Archive{}
+	err := d.Cli.WithContext(ctx).Where("path = ?", path).First(archive).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrArchiveNotFound, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
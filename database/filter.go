@@ -0,0 +1,112 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"gorm.io/gorm"
+)
+
+// ValidatePathPatterns returns an error if any of the patterns is not a valid doublestar pattern.
+func ValidatePathPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if !doublestar.ValidatePattern(pattern) {
+			return fmt.Errorf("invalid path pattern: %s", pattern)
+		}
+	}
+	return nil
+}
+
+// pathFilter selects assets by their path relative to the source path.
+type pathFilter struct {
+	sourcePath string
+	prefix     string
+	include    []string
+	exclude    []string
+}
+
+func newPathFilter(sourcePath string, o findArchivedAssetsOptions) pathFilter {
+	return pathFilter{
+		sourcePath: sourcePath,
+		prefix:     o.pathPrefix,
+		include:    o.include,
+		exclude:    o.exclude,
+	}
+}
+
+// Narrow the query on archive_asset.path as much as the filter allows.
+// Patterns are only partially applied, Match must still be checked on the results.
+func (f pathFilter) applyQuery(query *gorm.DB) *gorm.DB {
+	if f.prefix != "" {
+		query = whereUnderPaths(query, []string{filepath.Join(f.sourcePath, f.prefix)})
+	}
+
+	if len(f.include) == 0 {
+		return query
+	}
+
+	// The static part of every include pattern can be used as a prefix.
+	bases := make([]string, 0, len(f.include))
+	for _, pattern := range f.include {
+		base, _ := doublestar.SplitPattern(pattern)
+		if base == "." || base == "/" {
+			return query
+		}
+		bases = append(bases, filepath.Join(f.sourcePath, base))
+	}
+
+	return whereUnderPaths(query, bases)
+}
+
+// Match returns true if the asset path passes the filter.
+func (f pathFilter) Match(path string) bool {
+	rel, err := filepath.Rel(f.sourcePath, path)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	if f.prefix != "" {
+		prefix := filepath.ToSlash(filepath.Clean(f.prefix))
+		if rel != prefix && !strings.HasPrefix(rel, prefix+"/") {
+			return false
+		}
+	}
+
+	for _, pattern := range f.exclude {
+		if doublestar.MatchUnvalidated(pattern, rel) {
+			return false
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if doublestar.MatchUnvalidated(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f pathFilter) isEmpty() bool {
+	return f.prefix == "" && len(f.include) == 0 && len(f.exclude) == 0
+}
+
+// Restrict archive_asset.path to any of the paths or their descendants.
+func whereUnderPaths(query *gorm.DB, paths []string) *gorm.DB {
+	conditions := make([]string, 0, len(paths))
+	args := make([]any, 0, 2*len(paths))
+	for _, path := range paths {
+		conditions = append(conditions, `(archive_asset.path = ? OR archive_asset.path LIKE ? ESCAPE '\')`)
+		args = append(args, path, escapeLike(strings.TrimSuffix(path, "/"))+"/%")
+	}
+	return query.Where(strings.Join(conditions, " OR "), args...)
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -14,6 +14,12 @@ type Archive struct {
 	SourcePath string
 	Source     Source `gorm:"foreignKey:SourcePath"`
 	CreatedAt  time.Time
+	// Last time the contents of the archive were read back. Nil if never.
+	ScrubbedAt *time.Time
+	// Parity file written next to the archive to repair it. Empty if none.
+	ParityPath string
+	// Whether the entries of the archive are encrypted.
+	Encrypted bool
 }
 
 type ArchiveAsset struct {
@@ -21,8 +27,77 @@ type ArchiveAsset struct {
 	Path        string  `gorm:"primaryKey"`
 	Archive     Archive `gorm:"foreignKey:ArchivePath"`
 	Name        string
-	Hash        int64
+	Hash        int64 `gorm:"index:idx_archive_asset_content"`
 	ModTime     time.Time
 	CreatedAt   time.Time
-	Size        int64
+	Size        int64 `gorm:"index:idx_archive_asset_content;index:idx_archive_asset_size"`
+	Mode        uint32
+	UID         int
+	GID         int
+	UserName    string
+	GroupName   string
+	LinkTarget  string
+	// Set when the contents are not stored with the asset, but in the entry
+	// of an identical file, usually in another archive.
+	ContentArchivePath string `gorm:"index"`
+	ContentEntry       string
+	// Previous path of an asset recorded as moved.
+	MovedFrom string
+	// Cryptographic hash of the contents, as "<algorithm>:<hexadecimal sum>".
+	// Empty if not computed.
+	StrongHash string
+	// Set when the contents could not be read back from the archive.
+	DamagedAt *time.Time          `gorm:"index"`
+	Chunks    []ArchiveAssetChunk `gorm:"foreignKey:ArchivePath,Path;references:ArchivePath,Path"`
+}
+
+// A part of an asset split across several archives. The asset belongs to
+// the archive with its last part.
+type ArchiveAssetChunk struct {
+	ArchivePath      string `gorm:"primaryKey"`
+	Path             string `gorm:"primaryKey"`
+	Index            int    `gorm:"primaryKey"`
+	ChunkArchivePath string `gorm:"index"`
+	Offset           int64
+	Size             int64
+}
+
+// A backup run of a source.
+type Snapshot struct {
+	ID         uint   `gorm:"primaryKey"`
+	SourcePath string `gorm:"index"`
+	Source     Source `gorm:"foreignKey:SourcePath"`
+	CreatedAt  time.Time
+}
+
+// A path archived before a backup run and no longer in the source during the run.
+type Tombstone struct {
+	SnapshotID uint   `gorm:"primaryKey"`
+	Path       string `gorm:"primaryKey"`
+	SourcePath string `gorm:"index:idx_tombstone_source_path"`
+	CreatedAt  time.Time
+}
+
+// A backup of a source, recorded when it starts and updated when it ends.
+type BackupRun struct {
+	ID         uint   `gorm:"primaryKey"`
+	SourcePath string `gorm:"index"`
+	// What started the backup: manual or daemon.
+	Trigger    string
+	StartedAt  time.Time `gorm:"index"`
+	FinishedAt time.Time
+	Status     BackupRunStatus
+	Error      string
+	Scanned    int // Files found in the source.
+	New        int
+	Modified   int
+	Moved      int
+	Repaired   int   // Unchanged files archived again since their contents were damaged.
+	Unchanged  int   // Files already archived and not modified since.
+	Skipped    int   // Files found in the source that were not stored, other than the unchanged ones.
+	Stored     int   // Files stored in the archives.
+	Size       int64 // Size of the stored files.
+	Written    int64 // Bytes written to the archives.
+	Deleted    int   // Files recorded as deleted from the source.
+	SnapshotID *uint
 }
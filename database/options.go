@@ -1,5 +1,7 @@
 package database
 
+import "time"
+
 type findArchivesOptions struct {
 	limit             int
 	order             *FindArchivesOrderBy
@@ -44,3 +46,74 @@ func WithFindArchivesOnlyFullyBackedUp() FindArchivesOptions {
 		o.onlyFullyBackedUp = true
 	}
 }
+
+type findArchivedAssetsOptions struct {
+	asOf           time.Time
+	pathPrefix     string
+	include        []string
+	exclude        []string
+	includeDeleted bool
+}
+
+type FindArchivedAssetsOptions func(*findArchivedAssetsOptions)
+
+// Find the latest version of each asset archived at or before asOf.
+func WithFindArchivedAssetsAsOf(asOf time.Time) FindArchivedAssetsOptions {
+	return func(o *findArchivedAssetsOptions) {
+		o.asOf = asOf
+	}
+}
+
+// Find only assets under pathPrefix. The prefix is relative to the source path.
+func WithFindArchivedAssetsPathPrefix(pathPrefix string) FindArchivedAssetsOptions {
+	return func(o *findArchivedAssetsOptions) {
+		o.pathPrefix = pathPrefix
+	}
+}
+
+// Find only assets matching any of the include patterns and none of the exclude patterns.
+// Patterns use doublestar syntax and are matched against the path relative to the source path.
+// An empty include list matches every asset.
+func WithFindArchivedAssetsMatch(include []string, exclude []string) FindArchivedAssetsOptions {
+	return func(o *findArchivedAssetsOptions) {
+		o.include = include
+		o.exclude = exclude
+	}
+}
+
+// Also find the assets deleted from the source. By default, assets recorded as
+// deleted by a backup after their latest version was archived are not returned.
+func WithFindArchivedAssetsIncludeDeleted(include bool) FindArchivedAssetsOptions {
+	return func(o *findArchivedAssetsOptions) {
+		o.includeDeleted = include
+	}
+}
+
+type findBackupRunsOptions struct {
+	sourcePath string
+	since      time.Time
+	limit      int
+}
+
+type FindBackupRunsOptions func(*findBackupRunsOptions)
+
+// Find only the runs of the source.
+func WithFindBackupRunsSource(sourcePath string) FindBackupRunsOptions {
+	return func(o *findBackupRunsOptions) {
+		o.sourcePath = sourcePath
+	}
+}
+
+// Find only the runs started at or after since.
+func WithFindBackupRunsSince(since time.Time) FindBackupRunsOptions {
+	return func(o *findBackupRunsOptions) {
+		o.since = since
+	}
+}
+
+// Limit the number of runs returned.
+func WithFindBackupRunsLimit(limit int) FindBackupRunsOptions {
+	return func(o *findBackupRunsOptions) {
+		o.limit = limit
+	}
+}
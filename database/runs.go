@@ -0,0 +1,159 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type BackupRunStatus string
+
+const (
+	BackupRunRunning   BackupRunStatus = "running"
+	BackupRunSucceeded BackupRunStatus = "succeeded"
+	BackupRunFailed    BackupRunStatus = "failed"
+	BackupRunCancelled BackupRunStatus = "cancelled"
+)
+
+// How long the run took, or has been running.
+func (r *BackupRun) Duration() time.Duration {
+	if r.FinishedAt.IsZero() {
+		return time.Since(r.StartedAt)
+	}
+	return r.FinishedAt.Sub(r.StartedAt)
+}
+
+// Record the start of a backup of the source. The run is not recorded in dry run.
+func (d *Database) StartBackupRun(ctx context.Context, sourcePath string, trigger string) (*BackupRun, error) {
+	run := &BackupRun{
+		SourcePath: sourcePath,
+		Trigger:    trigger,
+		StartedAt:  time.Now().UTC(),
+		Status:     BackupRunRunning,
+	}
+	if d.DryRun {
+		return run, nil
+	}
+
+	d.Lock.Lock()
+	defer d.Lock.Unlock()
+	if err := d.Cli.WithContext(ctx).Create(run).Error; err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// Record the end of a backup run with its counters. err is the error the run
+// failed with, if any. A run whose context is done is recorded as cancelled.
+func (d *Database) FinishBackupRun(ctx context.Context, run *BackupRun, err error) error {
+	run.FinishedAt = time.Now().UTC()
+	switch {
+	case err != nil:
+		run.Status = BackupRunFailed
+		run.Error = err.Error()
+	case ctx.Err() != nil:
+		run.Status = BackupRunCancelled
+	default:
+		run.Status = BackupRunSucceeded
+	}
+	if d.DryRun {
+		return nil
+	}
+
+	d.Lock.Lock()
+	defer d.Lock.Unlock()
+	// The run is recorded even if it was cancelled.
+	return d.Cli.WithContext(context.WithoutCancel(ctx)).Save(run).Error
+}
+
+// Find the backup runs, latest first.
+func (d *Database) FindBackupRuns(ctx context.Context, opts ...FindBackupRunsOptions) ([]BackupRun, error) {
+	o := findBackupRunsOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	query := d.Cli.WithContext(ctx)
+	if o.sourcePath != "" {
+		query = query.Where("source_path = ?", o.sourcePath)
+	}
+	if !o.since.IsZero() {
+		query = query.Where("started_at >= ?", o.since.UTC())
+	}
+	if o.limit > 0 {
+		query = query.Limit(o.limit)
+	}
+
+	d.Lock.Lock()
+	defer d.Lock.Unlock()
+	var runs []BackupRun
+	err := query.Order("started_at DESC, id DESC").Find(&runs).Error
+	return runs, err
+}
+
+// Health of the backups of a source.
+type BackupStatus struct {
+	// End of the last successful backup. Sources without successful runs, backed
+	// up before runs were recorded, use the creation of their latest archive.
+	LastSuccess time.Time
+	LastRun     *BackupRun // Nil if the source never ran.
+	Failures    int        // Failed runs since the last successful one.
+}
+
+// Find when the source was last backed up and how its runs went since.
+func (d *Database) GetBackupStatus(ctx context.Context, sourcePath string) (BackupStatus, error) {
+	d.Lock.Lock()
+	defer d.Lock.Unlock()
+
+	status := BackupStatus{}
+	lastRun := &BackupRun{}
+	err := d.Cli.WithContext(ctx).
+		Where("source_path = ?", sourcePath).
+		Order("started_at DESC, id DESC").
+		First(lastRun).Error
+	if err == nil {
+		status.LastRun = lastRun
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return status, err
+	}
+
+	lastSuccess := &BackupRun{}
+	err = d.Cli.WithContext(ctx).
+		Where("source_path = ? AND status = ?", sourcePath, BackupRunSucceeded).
+		Order("started_at DESC, id DESC").
+		First(lastSuccess).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return status, err
+	}
+	failures := d.Cli.WithContext(ctx).
+		Model(&BackupRun{}).
+		Where("source_path = ? AND status = ?", sourcePath, BackupRunFailed)
+	if err == nil {
+		status.LastSuccess = lastSuccess.FinishedAt
+		failures = failures.Where("started_at > ?", lastSuccess.StartedAt)
+	}
+	var count int64
+	if err := failures.Count(&count).Error; err != nil {
+		return status, err
+	}
+	status.Failures = int(count)
+
+	if !status.LastSuccess.IsZero() {
+		return status, nil
+	}
+	latest := &Archive{}
+	err = d.Cli.WithContext(ctx).
+		Where("source_path = ?", sourcePath).
+		Order("created_at DESC").
+		First(latest).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	status.LastSuccess = latest.CreatedAt
+	return status, nil
+}
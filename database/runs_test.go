@@ -0,0 +1,113 @@
+package database_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stupid-simple/backup/database"
+)
+
+func TestDatabase_BackupRuns(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	succeeded, err := db.StartBackupRun(ctx, "source1", "manual")
+	require.NoError(t, err)
+	assert.Equal(t, database.BackupRunRunning, succeeded.Status)
+	succeeded.New = 3
+	succeeded.Written = 1000
+	require.NoError(t, db.FinishBackupRun(ctx, succeeded, nil))
+
+	failed, err := db.StartBackupRun(ctx, "source2", "daemon")
+	require.NoError(t, err)
+	require.NoError(t, db.FinishBackupRun(ctx, failed, errors.New("disk full")))
+
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancelled, err := db.StartBackupRun(cancelledCtx, "source1", "daemon")
+	require.NoError(t, err)
+	cancel()
+	require.NoError(t, db.FinishBackupRun(cancelledCtx, cancelled, nil))
+
+	runs, err := db.FindBackupRuns(ctx)
+	require.NoError(t, err)
+	require.Len(t, runs, 3)
+	assert.Equal(t, cancelled.ID, runs[0].ID)
+	assert.Equal(t, database.BackupRunCancelled, runs[0].Status)
+	assert.Equal(t, database.BackupRunFailed, runs[1].Status)
+	assert.Equal(t, "disk full", runs[1].Error)
+	assert.Equal(t, "daemon", runs[1].Trigger)
+	assert.Equal(t, database.BackupRunSucceeded, runs[2].Status)
+	assert.Equal(t, 3, runs[2].New)
+	assert.Equal(t, int64(1000), runs[2].Written)
+	assert.False(t, runs[2].FinishedAt.IsZero())
+
+	runs, err = db.FindBackupRuns(ctx, database.WithFindBackupRunsSource("source1"))
+	require.NoError(t, err)
+	require.Len(t, runs, 2)
+
+	runs, err = db.FindBackupRuns(ctx, database.WithFindBackupRunsSince(time.Now().Add(time.Hour)))
+	require.NoError(t, err)
+	assert.Empty(t, runs)
+}
+
+func TestDatabase_BackupRunsDryRun(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	db.DryRun = true
+
+	run, err := db.StartBackupRun(ctx, "source1", "manual")
+	require.NoError(t, err)
+	require.NoError(t, db.FinishBackupRun(ctx, run, nil))
+	assert.Equal(t, database.BackupRunSucceeded, run.Status)
+
+	runs, err := db.FindBackupRuns(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, runs)
+}
+
+func TestDatabase_GetBackupStatus(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	status, err := db.GetBackupStatus(ctx, "source1")
+	require.NoError(t, err)
+	assert.True(t, status.LastSuccess.IsZero())
+	assert.Nil(t, status.LastRun)
+
+	// Sources backed up before runs were recorded use their latest archive.
+	archivedAt := time.Now().Add(-time.Hour).UTC()
+	registerArchivedAsset(t, db, "source1", "archive1", "path1", 1, archivedAt)
+	require.NoError(t, db.Cli.Model(&database.Archive{}).Where("path = ?", "archive1").Update("created_at", archivedAt).Error)
+	status, err = db.GetBackupStatus(ctx, "source1")
+	require.NoError(t, err)
+	assert.WithinDuration(t, archivedAt, status.LastSuccess, time.Second)
+
+	succeeded, err := db.StartBackupRun(ctx, "source1", "daemon")
+	require.NoError(t, err)
+	require.NoError(t, db.FinishBackupRun(ctx, succeeded, nil))
+	for range 2 {
+		failed, err := db.StartBackupRun(ctx, "source1", "daemon")
+		require.NoError(t, err)
+		require.NoError(t, db.FinishBackupRun(ctx, failed, errors.New("disk full")))
+	}
+
+	status, err = db.GetBackupStatus(ctx, "source1")
+	require.NoError(t, err)
+	assert.WithinDuration(t, succeeded.FinishedAt, status.LastSuccess, time.Millisecond)
+	assert.Equal(t, 2, status.Failures)
+	require.NotNil(t, status.LastRun)
+	assert.Equal(t, database.BackupRunFailed, status.LastRun.Status)
+	assert.Equal(t, "disk full", status.LastRun.Error)
+
+	succeeded, err = db.StartBackupRun(ctx, "source1", "manual")
+	require.NoError(t, err)
+	require.NoError(t, db.FinishBackupRun(ctx, succeeded, nil))
+	status, err = db.GetBackupStatus(ctx, "source1")
+	require.NoError(t, err)
+	assert.Equal(t, 0, status.Failures)
+	assert.Equal(t, database.BackupRunSucceeded, status.LastRun.Status)
+}
@@ -0,0 +1,113 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Find the next archives of the source to scrub: the ones never scrubbed first,
+// then the ones scrubbed the longest time ago. Archives are added until percent
+// of the archives or maxBytes of archived files is reached, zero being no limit.
+// At least one archive is returned, unless the source has none.
+func (bs *BackupSource) FindArchivesToScrub(ctx context.Context, percent float64, maxBytes int64) ([]BackupArchive, error) {
+	type archiveWithSize struct {
+		Path             string
+		CreatedAt        time.Time
+		ParityPath       string
+		Encrypted        bool
+		UncompressedSize int64
+		AssetCount       int
+	}
+
+	var archives []archiveWithSize
+	bs.db.Lock.Lock()
+	err := bs.db.Cli.WithContext(ctx).Table("archive").
+		Select("archive.path, archive.created_at, archive.parity_path, archive.encrypted, COALESCE(SUM(archive_asset.size), 0) as uncompressed_size, COUNT(archive_asset.path) as asset_count").
+		Joins("LEFT JOIN archive_asset ON archive.path = archive_asset.archive_path").
+		Where("archive.source_path = ?", bs.record.Path).
+		Group("archive.path, archive.created_at, archive.scrubbed_at, archive.parity_path, archive.encrypted").
+		Order("archive.scrubbed_at IS NOT NULL, archive.scrubbed_at, archive.created_at").
+		Find(&archives).Error
+	bs.db.Lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	count := len(archives)
+	if percent > 0 {
+		count = int(math.Ceil(float64(len(archives)) * percent / 100))
+	}
+
+	var out []BackupArchive
+	var size int64
+	for _, a := range archives[:count] {
+		if len(out) > 0 && maxBytes > 0 && size+a.UncompressedSize > maxBytes {
+			break
+		}
+		size += a.UncompressedSize
+		out = append(out, BackupArchive{
+			Path:       a.Path,
+			CreatedAt:  a.CreatedAt,
+			Size:       a.UncompressedSize,
+			AssetCount: a.AssetCount,
+			ParityPath: a.ParityPath,
+			Encrypted:  a.Encrypted,
+		})
+	}
+	return out, nil
+}
+
+// Record that an archive was scrubbed, and that the contents of the assets at
+// the given paths could not be read back from it.
+func (bs *BackupSource) MarkScrubbed(ctx context.Context, archivePath string, damagedPaths []string) error {
+	if bs.db.DryRun {
+		bs.logger.Info().Str("archive", archivePath).Int("damaged", len(damagedPaths)).Msg("would record scrubbed archive (dry run)")
+		return nil
+	}
+
+	bs.db.Lock.Lock()
+	defer bs.db.Lock.Unlock()
+
+	now := time.Now().UTC()
+	return bs.db.Cli.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Archive{}).
+			Where("path = ? AND source_path = ?", archivePath, bs.record.Path).
+			Update("scrubbed_at", now).Error
+		if err != nil {
+			return fmt.Errorf("could not record scrubbed archive: %w", err)
+		}
+		if len(damagedPaths) == 0 {
+			return nil
+		}
+		err = tx.Model(&ArchiveAsset{}).
+			Where("archive_path = ? AND path IN ? AND damaged_at IS NULL", archivePath, damagedPaths).
+			Update("damaged_at", now).Error
+		if err != nil {
+			return fmt.Errorf("could not record damaged assets: %w", err)
+		}
+		return nil
+	})
+}
+
+// Record that a damaged archive was repaired. Its assets can be restored again.
+func (bs *BackupSource) MarkRepaired(ctx context.Context, archivePath string) error {
+	if bs.db.DryRun {
+		bs.logger.Info().Str("archive", archivePath).Msg("would record repaired archive (dry run)")
+		return nil
+	}
+
+	bs.db.Lock.Lock()
+	defer bs.db.Lock.Unlock()
+
+	err := bs.db.Cli.WithContext(ctx).Model(&ArchiveAsset{}).
+		Where("archive_path = ? AND damaged_at IS NOT NULL", archivePath).
+		Update("damaged_at", nil).Error
+	if err != nil {
+		return fmt.Errorf("could not record repaired archive: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package database_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/database"
+)
+
+func TestBackupSource_FindArchivesToScrub(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	source, err := db.GetSource(ctx, "test/source/path")
+	require.NoError(t, err)
+
+	now := time.Now()
+	for i, archive := range []string{"archive1", "archive2", "archive3", "archive4"} {
+		registerArchivedAsset(t, db, "test/source/path", archive, "path", int64(i), now.Add(time.Duration(i-4)*time.Hour))
+	}
+	require.NoError(t, db.Cli.Model(&database.ArchiveAsset{}).Where("1 = 1").Update("size", 100).Error)
+
+	archivePaths := func(archives []database.BackupArchive) []string {
+		var paths []string
+		for _, a := range archives {
+			paths = append(paths, a.Path)
+		}
+		return paths
+	}
+
+	archives, err := source.FindArchivesToScrub(ctx, 50, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"archive1", "archive2"}, archivePaths(archives))
+
+	// The scrubbed archives come last.
+	for _, a := range archives {
+		require.NoError(t, source.MarkScrubbed(ctx, a.Path, nil))
+	}
+	archives, err = source.FindArchivesToScrub(ctx, 50, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"archive3", "archive4"}, archivePaths(archives))
+	for _, a := range archives {
+		require.NoError(t, source.MarkScrubbed(ctx, a.Path, nil))
+	}
+	archives, err = source.FindArchivesToScrub(ctx, 25, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"archive1"}, archivePaths(archives))
+
+	archives, err = source.FindArchivesToScrub(ctx, 0, 250)
+	require.NoError(t, err)
+	assert.Len(t, archives, 2)
+
+	// One archive is scrubbed even if larger than the budget.
+	archives, err = source.FindArchivesToScrub(ctx, 0, 10)
+	require.NoError(t, err)
+	assert.Len(t, archives, 1)
+}
+
+func TestBackupSource_ScrubDamagedAssets(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	source, err := db.GetSource(ctx, "test/source/path")
+	require.NoError(t, err)
+
+	require.NoError(t, source.Register(ctx, slices.Values([]asset.ArchivedAsset{
+		newTestArchivedAsset("test/source/path", "archive1", "path1", 1),
+		newTestArchivedAsset("test/source/path", "archive1", "path2", 2),
+	})))
+	// A copy of path2 referencing its contents.
+	copied := &testReferencingArchivedAsset{
+		testArchivedAsset: *newTestArchivedAsset("test/source/path", "archive0", "copy2", 2).(*testArchivedAsset),
+		ref:               asset.ContentRef{ArchivePath: "archive1", Entry: "path2"},
+	}
+	require.NoError(t, source.Register(ctx, slices.Values([]asset.ArchivedAsset{copied})))
+
+	findMissing := func() []string {
+		out, err := source.FindMissingAssets(ctx, slices.Values([]asset.Asset{
+			newTestAsset("path1", 1),
+			newTestAsset("path2", 2),
+			newTestAsset("copy2", 2),
+		}))
+		require.NoError(t, err)
+		var paths []string
+		for a := range out {
+			paths = append(paths, a.Path())
+			// Repaired files are written again, never deduplicated.
+			_, repaired := a.(asset.RepairedAsset)
+			assert.True(t, repaired)
+		}
+		return paths
+	}
+	assert.Empty(t, findMissing())
+
+	require.NoError(t, source.MarkScrubbed(ctx, "archive1", []string{"path2"}))
+	var archive database.Archive
+	require.NoError(t, db.Cli.Where("path = ?", "archive1").First(&archive).Error)
+	assert.NotNil(t, archive.ScrubbedAt)
+
+	// The unchanged file is archived again, and its damaged contents are not
+	// reused, even through the file referencing them.
+	assert.Equal(t, []string{"path2"}, findMissing())
+	assert.Equal(t, 1, source.FoundAssets().Repaired)
+	_, found, err := source.FindArchivedContent(ctx, 2, 1000)
+	require.NoError(t, err)
+	assert.False(t, found)
+	_, found, err = source.FindArchivedContent(ctx, 1, 1000)
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	require.NoError(t, source.Register(ctx, slices.Values([]asset.ArchivedAsset{
+		newTestArchivedAsset("test/source/path", "archive2", "path2", 2),
+	})))
+	assert.Empty(t, findMissing())
+}
+
+func TestBackupSource_MarkRepaired(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	source, err := db.GetSource(ctx, "test/source/path")
+	require.NoError(t, err)
+
+	require.NoError(t, source.Register(ctx, slices.Values([]asset.ArchivedAsset{
+		newTestArchivedAsset("test/source/path", "archive1", "path1", 1),
+	})))
+	require.NoError(t, source.MarkScrubbed(ctx, "archive1", []string{"path1"}))
+	_, found, err := source.FindArchivedContent(ctx, 1, 1000)
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	archive, err := db.GetArchive(ctx, "archive1")
+	require.NoError(t, err)
+	assert.Equal(t, "test/source/path", archive.SourcePath)
+	_, err = db.GetArchive(ctx, "archive2")
+	assert.Error(t, err)
+
+	require.NoError(t, source.MarkRepaired(ctx, "archive1"))
+	_, found, err = source.FindArchivedContent(ctx, 1, 1000)
+	require.NoError(t, err)
+	assert.True(t, found)
+}
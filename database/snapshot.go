@@ -0,0 +1,138 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A path that disappeared from the source.
+type Deletion struct {
+	Path       string
+	SnapshotID uint
+	DeletedAt  time.Time // time of the backup that no longer found the path
+}
+
+// Condition on archive_asset rows keeping the paths not recorded as deleted
+// after the given time column. Deletions after asOf are ignored, unless zero.
+func notDeletedSince(column string, sourcePath string, asOf time.Time) clause.Expr {
+	query := "NOT EXISTS (SELECT 1 FROM tombstone t " +
+		"WHERE t.source_path = ? AND t.path = archive_asset.path AND t.created_at > " + column
+	args := []any{sourcePath}
+	if !asOf.IsZero() {
+		query += " AND t.created_at <= ?"
+		args = append(args, asOf.UTC())
+	}
+	return gorm.Expr(query+")", args...)
+}
+
+// Record a backup run of the source. The archived paths that are no longer in
+// the source are recorded as deleted by this run.
+func (bs *BackupSource) RecordSnapshot(ctx context.Context) (*Snapshot, int, error) {
+	assets, err := bs.FindArchivedAssets(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	var deleted []string
+	for a := range assets {
+		if _, err := os.Lstat(a.Path()); os.IsNotExist(err) {
+			deleted = append(deleted, a.Path())
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, 0, ctx.Err()
+	}
+
+	snapshot := &Snapshot{SourcePath: bs.record.Path}
+	if bs.db.DryRun {
+		bs.logger.Info().Int("deleted", len(deleted)).Msg("would record snapshot (dry run)")
+		return snapshot, len(deleted), nil
+	}
+
+	bs.db.Lock.Lock()
+	defer bs.db.Lock.Unlock()
+	err = bs.db.Cli.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Source").Create(snapshot).Error; err != nil {
+			return err
+		}
+		for _, path := range deleted {
+			tombstone := &Tombstone{
+				SnapshotID: snapshot.ID,
+				Path:       path,
+				SourcePath: bs.record.Path,
+				CreatedAt:  snapshot.CreatedAt,
+			}
+			if err := tx.Create(tombstone).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not record snapshot: %w", err)
+	}
+
+	bs.logger.Info().Uint("snapshot", snapshot.ID).Int("deleted", len(deleted)).Msg("recorded snapshot")
+	return snapshot, len(deleted), nil
+}
+
+// Find a backup run of the source by its id.
+func (bs *BackupSource) FindSnapshot(ctx context.Context, id uint) (*Snapshot, error) {
+	bs.db.Lock.Lock()
+	defer bs.db.Lock.Unlock()
+
+	snapshot := &Snapshot{}
+	err := bs.db.Cli.WithContext(ctx).
+		Where("id = ? AND source_path = ?", id, bs.record.Path).
+		First(snapshot).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("snapshot %d not found for source %s", id, bs.record.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Find when the paths of the source disappeared, oldest first. A path deleted,
+// archived again and deleted again has several deletions.
+func (bs *BackupSource) FindDeletions(ctx context.Context, opts ...FindArchivedAssetsOptions) (iter.Seq[Deletion], error) {
+	o := findArchivedAssetsOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	filter := newPathFilter(bs.record.Path, o)
+
+	query := bs.db.Cli.WithContext(ctx).Where("source_path = ?", bs.record.Path)
+	if !o.asOf.IsZero() {
+		query = query.Where("created_at <= ?", o.asOf.UTC())
+	}
+
+	var tombstones []Tombstone
+	bs.db.Lock.Lock()
+	err := query.Order("created_at, path").Find(&tombstones).Error
+	bs.db.Lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(yield func(Deletion) bool) {
+		for _, t := range tombstones {
+			if ctx.Err() != nil {
+				return
+			}
+			if !filter.isEmpty() && !filter.Match(t.Path) {
+				continue
+			}
+			if !yield(Deletion{Path: t.Path, SnapshotID: t.SnapshotID, DeletedAt: t.CreatedAt}) {
+				return
+			}
+		}
+	}, nil
+}
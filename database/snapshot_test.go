@@ -0,0 +1,129 @@
+package database_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/database"
+)
+
+func TestBackupSource_RecordSnapshot(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	source, err := db.GetSource(ctx, dir)
+	require.NoError(t, err)
+
+	kept := filepath.Join(dir, "kept.txt")
+	deleted := filepath.Join(dir, "deleted.txt")
+	require.NoError(t, os.WriteFile(kept, nil, 0644))
+	require.NoError(t, os.WriteFile(deleted, nil, 0644))
+	registerArchivedAsset(t, db, dir, "archive1", kept, 1, time.Now().Add(-time.Hour))
+	registerArchivedAsset(t, db, dir, "archive1", deleted, 2, time.Now().Add(-time.Hour))
+
+	first, count, err := source.RecordSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	require.NoError(t, os.Remove(deleted))
+	second, count, err := source.RecordSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.NotEqual(t, first.ID, second.ID)
+
+	// A deleted path is only recorded once.
+	_, count, err = source.RecordSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	findPaths := func(opts ...database.FindArchivedAssetsOptions) []string {
+		out, err := source.FindArchivedAssets(ctx, opts...)
+		require.NoError(t, err)
+		var paths []string
+		for a := range out {
+			paths = append(paths, a.Path())
+		}
+		slices.Sort(paths)
+		return paths
+	}
+	assert.Equal(t, []string{kept}, findPaths())
+	assert.Equal(t, []string{deleted, kept}, findPaths(database.WithFindArchivedAssetsIncludeDeleted(true)))
+	assert.Equal(t, []string{deleted, kept}, findPaths(database.WithFindArchivedAssetsAsOf(first.CreatedAt)))
+	assert.Equal(t, []string{kept}, findPaths(database.WithFindArchivedAssetsAsOf(second.CreatedAt)))
+
+	found, err := source.FindSnapshot(ctx, second.ID)
+	require.NoError(t, err)
+	assert.Equal(t, second.ID, found.ID)
+	_, err = source.FindSnapshot(ctx, second.ID+10)
+	assert.Error(t, err)
+
+	deletions, err := source.FindDeletions(ctx)
+	require.NoError(t, err)
+	var recorded []database.Deletion
+	for d := range deletions {
+		recorded = append(recorded, d)
+	}
+	require.Len(t, recorded, 1)
+	assert.Equal(t, deleted, recorded[0].Path)
+	assert.Equal(t, second.ID, recorded[0].SnapshotID)
+}
+
+func TestBackupSource_RecordSnapshotRestored(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	source, err := db.GetSource(ctx, dir)
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "file.txt")
+	registerArchivedAsset(t, db, dir, "archive1", path, 1, time.Now().Add(-time.Hour))
+	_, count, err := source.RecordSnapshot(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	// The file comes back with the same contents: it is archived again.
+	out, err := source.FindMissingAssets(ctx, slices.Values([]asset.Asset{newTestAsset(path, 1)}))
+	require.NoError(t, err)
+	var missing []asset.Asset
+	for a := range out {
+		missing = append(missing, a)
+	}
+	require.Len(t, missing, 1)
+
+	registerArchivedAsset(t, db, dir, "archive2", path, 1, time.Now().Add(time.Second))
+	out2, err := source.FindArchivedAssets(ctx)
+	require.NoError(t, err)
+	var archived []string
+	for a := range out2 {
+		archived = append(archived, a.ArchivePath())
+	}
+	assert.Equal(t, []string{"archive2"}, archived)
+}
+
+func TestBackupSource_RecordSnapshotDryRun(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	source, err := db.GetSource(ctx, dir)
+	require.NoError(t, err)
+
+	registerArchivedAsset(t, db, dir, "archive1", filepath.Join(dir, "file.txt"), 1, time.Now())
+	db.DryRun = true
+	_, count, err := source.RecordSnapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	db.DryRun = false
+	deletions, err := source.FindDeletions(ctx)
+	require.NoError(t, err)
+	for d := range deletions {
+		t.Errorf("unexpected deletion %s", d.Path)
+	}
+}
@@ -3,12 +3,18 @@ package database
 import (
 	"context"
 	"fmt"
+	"io/fs"
 	"iter"
+	"os"
+	"slices"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/fileutils"
+	"github.com/stupid-simple/backup/parity"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 const iterateBatchSize = 50
@@ -17,12 +23,28 @@ type BackupSource struct {
 	db     *Database
 	record *Source
 	logger zerolog.Logger
+	found  FoundAssets
+}
+
+// Number of assets found by FindMissingAssets, by kind.
+type FoundAssets struct {
+	New      int
+	Modified int
+	Moved    int
+	Repaired int
+	// Already archived and not modified since.
+	Unchanged int
 }
 
 func (bs *BackupSource) Path() string {
 	return bs.record.Path
 }
 
+// The assets found by the last FindMissingAssets, once its sequence is consumed.
+func (bs *BackupSource) FoundAssets() FoundAssets {
+	return bs.found
+}
+
 // Find assets that are not in the provided sequence.
 func (bs *BackupSource) FindMissingAssets(
 	ctx context.Context,
@@ -57,8 +79,8 @@ func (bs *BackupSource) FindMissingAssets(
 	}, nil
 }
 
+// Register the archived assets. All of them are recorded in a single transaction.
 func (bs *BackupSource) Register(ctx context.Context, from iter.Seq[asset.ArchivedAsset]) error {
-
 	bs.logger.Info().Msg("register backup assets")
 
 	var count int
@@ -73,7 +95,7 @@ func (bs *BackupSource) Register(ctx context.Context, from iter.Seq[asset.Archiv
 	}()
 
 	var err error
-	count, err = bs.recordAssetsInBatches(ctx, from, bs.logger)
+	count, err = bs.recordAssets(ctx, from, bs.logger)
 	if err != nil {
 		return err
 	}
@@ -81,7 +103,14 @@ func (bs *BackupSource) Register(ctx context.Context, from iter.Seq[asset.Archiv
 }
 
 // Find archived assets for this source. Only new versions are returned.
-func (bs *BackupSource) FindArchivedAssets(ctx context.Context) (iter.Seq[asset.ArchivedAsset], error) {
+func (bs *BackupSource) FindArchivedAssets(ctx context.Context, opts ...FindArchivedAssetsOptions) (iter.Seq[asset.ArchivedAsset], error) {
+	o := findArchivedAssetsOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	filter := newPathFilter(bs.record.Path, o)
+
 	return func(yield func(asset.ArchivedAsset) bool) {
 		offset := 0
 
@@ -91,7 +120,17 @@ func (bs *BackupSource) FindArchivedAssets(ctx context.Context) (iter.Seq[asset.
 			subQuery := bs.db.Cli.WithContext(ctx).
 				Select("archive_asset.path, MAX(archive_asset.created_at) AS max_created_at").
 				Joins("JOIN archive ON archive.path = archive_asset.archive_path").
-				Where("archive.source_path = ?", bs.record.Path).
+				Where("archive.source_path = ?", bs.record.Path)
+			if !o.asOf.IsZero() {
+				subQuery = subQuery.Where("archive_asset.created_at <= ?", o.asOf.UTC())
+			}
+			if !o.includeDeleted {
+				// Every version of a deleted path is older than its tombstone,
+				// unless it was archived again since.
+				subQuery = subQuery.Where(notDeletedSince("archive_asset.created_at", bs.record.Path, o.asOf))
+			}
+			subQuery = filter.applyQuery(subQuery)
+			subQuery = subQuery.
 				Group("archive_asset.path").
 				Order("archive_asset.created_at DESC").
 				Limit(iterateBatchSize).
@@ -104,6 +143,9 @@ func (bs *BackupSource) FindArchivedAssets(ctx context.Context) (iter.Seq[asset.
 				Joins("JOIN (?) AS latest ON latest.path = archive_asset.path "+
 					"AND latest.max_created_at = archive_asset.created_at", subQuery).
 				Joins("Archive").
+				Preload("Chunks", func(db *gorm.DB) *gorm.DB {
+					return db.Order("archive_asset_chunk.`index`")
+				}).
 				Order("archive_asset.created_at DESC").
 				Find(&assets).Error
 
@@ -119,6 +161,9 @@ func (bs *BackupSource) FindArchivedAssets(ctx context.Context) (iter.Seq[asset.
 				if ctx.Err() != nil {
 					return
 				}
+				if !filter.isEmpty() && !filter.Match(assets[i].Path) {
+					continue
+				}
 				if !yield(dbAsset{&assets[i]}) {
 					return
 				}
@@ -147,14 +192,17 @@ func (bs *BackupSource) FindArchives(ctx context.Context, opts ...FindArchivesOp
 			}
 
 			query := bs.db.Cli.WithContext(ctx).Table("archive").
-				Select("archive.path, archive.created_at, COALESCE(SUM(archive_asset.size), 0) as uncompressed_size, COUNT(archive_asset.path) as asset_count").
+				Select("archive.path, archive.created_at, archive.parity_path, archive.encrypted, COALESCE(SUM(archive_asset.size), 0) as uncompressed_size, COUNT(archive_asset.path) as asset_count").
 				Joins("LEFT JOIN archive_asset ON archive.path = archive_asset.archive_path").
 				Where("archive.source_path = ?", bs.record.Path).
 				Where("archive.created_at < ?", now).
-				Group("archive.path, archive.created_at")
+				Group("archive.path, archive.created_at, archive.parity_path, archive.encrypted")
 
 			if o.onlyFullyBackedUp {
 				// Find archives where all assets are also backed up in newer archives.
+				// Archives holding parts of split files are kept until the file
+				// is also backed up in a newer archive, and archives holding the
+				// contents of other assets are kept while these assets are.
 				query = query.Where(`
 					NOT EXISTS (
 						SELECT 1
@@ -170,6 +218,28 @@ func (bs *BackupSource) FindArchives(ctx context.Context, opts ...FindArchivesOp
 						)
 						LIMIT 1
 					)
+					AND NOT EXISTS (
+						SELECT 1
+						FROM archive_asset_chunk c
+						JOIN archive a3 ON c.archive_path = a3.path
+						WHERE c.chunk_archive_path = archive.path
+						AND NOT EXISTS (
+							SELECT 1
+							FROM archive_asset aa3
+							JOIN archive a4 ON aa3.archive_path = a4.path
+							WHERE aa3.path = c.path
+							AND a4.source_path = a3.source_path
+							AND a4.created_at > a3.created_at
+						)
+						LIMIT 1
+					)
+					AND NOT EXISTS (
+						SELECT 1
+						FROM archive_asset r
+						WHERE r.content_archive_path = archive.path
+						AND r.archive_path != archive.path
+						LIMIT 1
+					)
 				`)
 			}
 
@@ -188,6 +258,8 @@ func (bs *BackupSource) FindArchives(ctx context.Context, opts ...FindArchivesOp
 			type ArchiveWithSize struct {
 				Path             string
 				CreatedAt        time.Time
+				ParityPath       string
+				Encrypted        bool
 				UncompressedSize int64
 				AssetCount       int
 			}
@@ -213,6 +285,8 @@ func (bs *BackupSource) FindArchives(ctx context.Context, opts ...FindArchivesOp
 					CreatedAt:  archive.CreatedAt,
 					Size:       archive.UncompressedSize,
 					AssetCount: archive.AssetCount,
+					ParityPath: archive.ParityPath,
+					Encrypted:  archive.Encrypted,
 				}) {
 					return
 				}
@@ -230,6 +304,92 @@ func (bs *BackupSource) FindArchives(ctx context.Context, opts ...FindArchivesOp
 	}, nil
 }
 
+// Excludes the assets referencing contents stored in an entry that was found
+// damaged. The entry holding the contents has the same hash and size, and is
+// not a reference itself.
+const contentNotDamaged = "NOT EXISTS (SELECT 1 FROM archive_asset d " +
+	"WHERE d.archive_path = archive_asset.content_archive_path " +
+	"AND d.hash = archive_asset.hash AND d.size = archive_asset.size " +
+	"AND COALESCE(d.content_archive_path, '') = '' AND d.damaged_at IS NOT NULL)"
+
+// Find an archived regular file with the given contents, in any source. Files
+// split across archives, damaged, or referencing damaged contents are not
+// returned. The latest archived file is returned.
+func (bs *BackupSource) FindArchivedContent(ctx context.Context, hash uint64, size int64) (asset.ArchivedAsset, bool, error) {
+	bs.db.Lock.Lock()
+	defer bs.db.Lock.Unlock()
+
+	var records []ArchiveAsset
+	err := bs.db.Cli.WithContext(ctx).
+		Joins("Archive").
+		Where("archive_asset.hash = ? AND archive_asset.size = ?", int64(hash), size).
+		Where("archive_asset.mode & ? = 0", uint32(fs.ModeType)).
+		Where("archive_asset.damaged_at IS NULL").
+		Where(contentNotDamaged).
+		Where("NOT EXISTS (SELECT 1 FROM archive_asset_chunk c " +
+			"WHERE c.archive_path = archive_asset.archive_path AND c.path = archive_asset.path)").
+		Order("archive_asset.created_at DESC").
+		Limit(1).
+		Find(&records).Error
+	if err != nil {
+		return nil, false, err
+	}
+	if len(records) == 0 {
+		return nil, false, nil
+	}
+	return dbAsset{&records[0]}, true, nil
+}
+
+// Find every asset registered in an archive of the source, by path.
+func (bs *BackupSource) FindArchiveAssets(ctx context.Context, archivePath string) ([]asset.ArchivedAsset, error) {
+	bs.db.Lock.Lock()
+	defer bs.db.Lock.Unlock()
+
+	var records []ArchiveAsset
+	err := bs.db.Cli.WithContext(ctx).
+		Joins("Archive").
+		Preload("Chunks", func(db *gorm.DB) *gorm.DB {
+			return db.Order("archive_asset_chunk.`index`")
+		}).
+		Where("archive_asset.archive_path = ? AND Archive.source_path = ?", archivePath, bs.record.Path).
+		Order("archive_asset.path").
+		Find(&records).Error
+	if err != nil {
+		return nil, err
+	}
+
+	assets := make([]asset.ArchivedAsset, 0, len(records))
+	for i := range records {
+		assets = append(assets, dbAsset{&records[i]})
+	}
+	return assets, nil
+}
+
+// Record the strong hashes of the contents of assets of an archive, by path.
+// Assets that already have one are left as they are.
+func (bs *BackupSource) SetStrongHashes(ctx context.Context, archivePath string, strongHashes map[string]string) error {
+	if bs.db.DryRun {
+		bs.logger.Info().Str("archive", archivePath).Int("assets", len(strongHashes)).Msg("would record strong hashes (dry run)")
+		return nil
+	}
+
+	bs.db.Lock.Lock()
+	defer bs.db.Lock.Unlock()
+
+	return bs.db.Cli.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for path, strongHash := range strongHashes {
+			err := tx.Model(&ArchiveAsset{}).
+				Where("archive_path = ? AND path = ?", archivePath, path).
+				Where("strong_hash IS NULL OR strong_hash = ''").
+				Update("strong_hash", strongHash).Error
+			if err != nil {
+				return fmt.Errorf("could not record strong hash: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
 func (bs *BackupSource) DeleteArchive(ctx context.Context, archivePath string) error {
 	bs.db.Lock.Lock()
 	defer bs.db.Lock.Unlock()
@@ -240,7 +400,10 @@ func (bs *BackupSource) DeleteArchive(ctx context.Context, archivePath string) e
 	}
 
 	return bs.db.Cli.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
-		// First delete all assets belonging to these archives
+		// First delete all assets belonging to these archives, and their parts
+		if err := tx.Where("archive_path = ?", archivePath).Delete(&ArchiveAssetChunk{}).Error; err != nil {
+			return fmt.Errorf("failed to delete archive asset chunks: %w", err)
+		}
 		if err := tx.Where("archive_path = ?", archivePath).Delete(&ArchiveAsset{}).Error; err != nil {
 			return fmt.Errorf("failed to delete archive assets: %w", err)
 		}
@@ -264,20 +427,23 @@ func (bs *BackupSource) findMissingAssetsInBatches(
 ) {
 	bs.logger.Info().Msg("start finding missing assets in batches")
 
-	var countModified, countNew int
+	var countModified, countNew, countMoved, countRepaired, countUnchanged int
 
 	nextAsset, stop := iter.Pull(from)
 	defer stop()
 	defer func() {
+		bs.found = FoundAssets{New: countNew, Modified: countModified, Moved: countMoved, Repaired: countRepaired, Unchanged: countUnchanged}
 		if ctx.Err() != nil {
 			bs.logger.Info().Str("source", bs.record.Path).Msg("cancelled finding assets")
-		} else if countModified+countNew == 0 {
+		} else if countModified+countNew+countMoved+countRepaired == 0 {
 			bs.logger.Info().Str("source", bs.record.Path).Msg("no new or modified assets found")
 		} else {
 			bs.logger.Info().
 				Str("source", bs.record.Path).
 				Int("new", countNew).
 				Int("modified", countModified).
+				Int("moved", countMoved).
+				Int("repaired", countRepaired).
 				Msg("done finding new or modified assets")
 		}
 	}()
@@ -296,6 +462,8 @@ func (bs *BackupSource) findMissingAssetsInBatches(
 			Int("batch", len(findBatch)).
 			Int("new", countNew).
 			Int("modified", countModified).
+			Int("moved", countMoved).
+			Int("repaired", countRepaired).
 			Msg("finding missing assets in batches")
 		if ctx.Err() != nil {
 			break
@@ -332,6 +500,8 @@ func (bs *BackupSource) findMissingAssetsInBatches(
 				"AND latest.max_created_at = archive_asset.created_at", subQuery).
 			Joins("Archive").
 			Where("archive_asset.path IN ?", lookForPaths).
+			// Files deleted then found again are archived again.
+			Where(notDeletedSince("archive_asset.created_at", bs.record.Path, time.Time{})).
 			Find(&results).Error
 		bs.db.Lock.Unlock()
 		if err != nil {
@@ -345,8 +515,26 @@ func (bs *BackupSource) findMissingAssetsInBatches(
 			r := &results[i]
 			archivedByPath[r.Path] = r
 		}
+
+		var newAssets []asset.Asset
+		for _, a := range findBatch {
+			if _, ok := archivedByPath[a.Path()]; !ok {
+				newAssets = append(newAssets, a)
+			}
+		}
+		moves, err := bs.findMoves(ctx, newAssets)
+		if err != nil {
+			bs.db.Logger.Warn().Err(err).Msg("could not look for moved assets")
+		}
+
 		for _, a := range findBatch {
 			archivedAsset, ok := archivedByPath[a.Path()]
+			if from, moved := moves[a.Path()]; !ok && moved {
+				bs.db.Logger.Info().Object("asset", a).Str("moved_from", from.Path()).Msg("asset was moved")
+				countMoved++
+				*missing = append(*missing, movedAsset{Asset: a, from: from})
+				continue
+			}
 			if !ok {
 				bs.db.Logger.Debug().Object("asset", a).Msg("asset not archived")
 				countNew++
@@ -367,7 +555,21 @@ func (bs *BackupSource) findMissingAssetsInBatches(
 				bs.db.Logger.Info().Object("asset", a).Msg("asset was modified")
 				countModified++
 				*missing = append(*missing, a)
+				continue
+			}
+			if archivedAsset.DamagedAt == nil {
+				countUnchanged++
+				continue
+			}
+			// Archive the file again only if it still has the contents that were lost.
+			h, err := a.ComputeHash()
+			if err != nil || h != uint64(archivedAsset.Hash) {
+				bs.db.Logger.Warn().Err(err).Object("asset", a).Msg("archived asset is damaged and the file no longer matches its hash. Skipping...")
+				continue
 			}
+			bs.db.Logger.Info().Object("asset", a).Time("damaged_at", *archivedAsset.DamagedAt).Msg("archived asset is damaged, archiving it again")
+			countRepaired++
+			*missing = append(*missing, repairedAsset{Asset: a, damaged: dbAsset{archivedAsset}})
 		}
 		if len(*missing) > 0 {
 			bs.logger.Debug().Msg("found missing assets batch")
@@ -382,77 +584,279 @@ func (bs *BackupSource) findMissingAssetsInBatches(
 	}
 }
 
-func (bs *BackupSource) recordAssetsInBatches(
+// Find the new assets with the same contents as an archived file that is no
+// longer in the source. Returns the archived files by path of the new assets.
+// Only the archived files with the size and hash of a new asset are looked at.
+func (bs *BackupSource) findMoves(ctx context.Context, newAssets []asset.Asset) (map[string]asset.ArchivedAsset, error) {
+	var sizes []int64
+	for _, a := range newAssets {
+		// Moving empty files saves nothing.
+		if a.Attributes().Mode.IsRegular() && a.Size() > 0 {
+			sizes = append(sizes, a.Size())
+		}
+	}
+	if len(sizes) == 0 {
+		return nil, nil
+	}
+
+	// Only the new assets with the size of an archived file are hashed.
+	var archivedSizes []int64
+	bs.db.Lock.Lock()
+	err := bs.db.Cli.WithContext(ctx).
+		Model(&ArchiveAsset{}).
+		Distinct("size").
+		Where("size IN ?", sizes).
+		Pluck("size", &archivedSizes).Error
+	bs.db.Lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := map[string]uint64{}
+	var hashValues []int64
+	for _, a := range newAssets {
+		if !a.Attributes().Mode.IsRegular() || !slices.Contains(archivedSizes, a.Size()) {
+			continue
+		}
+		h, err := a.ComputeHash()
+		if err != nil {
+			bs.db.Logger.Warn().Err(err).Object("asset", a).Msg("could not hash new asset")
+			continue
+		}
+		hashes[a.Path()] = h
+		hashValues = append(hashValues, int64(h))
+	}
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+
+	// Latest version of the paths that had the contents of a new asset.
+	subQuery := bs.db.Cli.WithContext(ctx).
+		Select("archive_asset.path, MAX(archive_asset.created_at) AS max_created_at").
+		Joins("JOIN archive ON archive.path = archive_asset.archive_path").
+		Where("archive.source_path = ?", bs.record.Path).
+		Where("archive_asset.path IN (?)", bs.db.Cli.
+			Table("archive_asset").
+			Select("path").
+			Where("hash IN ? AND size IN ?", hashValues, sizes)).
+		Group("archive_asset.path").
+		Table("archive_asset")
+
+	var candidates []ArchiveAsset
+	bs.db.Lock.Lock()
+	err = bs.db.Cli.WithContext(ctx).
+		Select("archive_asset.*").
+		Joins("JOIN (?) AS latest ON latest.path = archive_asset.path "+
+			"AND latest.max_created_at = archive_asset.created_at", subQuery).
+		Joins("Archive").
+		Where("archive_asset.hash IN ? AND archive_asset.size IN ?", hashValues, sizes).
+		Where("archive_asset.mode & ? = 0", uint32(fs.ModeType)).
+		Where("archive_asset.damaged_at IS NULL").
+		Where(contentNotDamaged).
+		Where("NOT EXISTS (SELECT 1 FROM archive_asset_chunk c " +
+			"WHERE c.archive_path = archive_asset.archive_path AND c.path = archive_asset.path)").
+		Find(&candidates).Error
+	bs.db.Lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only files that disappeared from the source were moved.
+	type contentKey struct {
+		size int64
+		hash uint64
+	}
+	disappeared := map[contentKey]*ArchiveAsset{}
+	for i := range candidates {
+		c := &candidates[i]
+		if _, err := os.Lstat(c.Path); !os.IsNotExist(err) {
+			continue
+		}
+		disappeared[contentKey{c.Size, uint64(c.Hash)}] = c
+	}
+
+	moves := map[string]asset.ArchivedAsset{}
+	for _, a := range newAssets {
+		h, ok := hashes[a.Path()]
+		if !ok {
+			continue
+		}
+		if c, ok := disappeared[contentKey{a.Size(), h}]; ok {
+			moves[a.Path()] = dbAsset{c}
+		}
+	}
+	return moves, nil
+}
+
+func (bs *BackupSource) recordAssets(
 	ctx context.Context,
 	from iter.Seq[asset.ArchivedAsset],
 	logger zerolog.Logger,
 ) (int, error) {
-	var countRecorded int
-
-	nextAsset, stop := iter.Pull(from)
-	defer stop()
-	hasNext := true
-	for hasNext {
+	var archiveAssets []asset.ArchivedAsset
+	for a := range from {
 		if ctx.Err() != nil {
-			break
+			return 0, ctx.Err()
+		}
+		if a.SourcePath() != bs.record.Path {
+			logger.Warn().Object("asset", a).Msg("skipping asset from different source")
+			continue
 		}
+		archiveAssets = append(archiveAssets, a)
+	}
 
-		archiveAssets := make([]asset.ArchivedAsset, 0, iterateBatchSize)
+	if len(archiveAssets) == 0 || bs.db.DryRun {
+		return len(archiveAssets), nil
+	}
 
-		for range iterateBatchSize {
-			var a asset.ArchivedAsset
-			a, hasNext = nextAsset()
-			if !hasNext {
-				break
+	logger.Debug().Int("size", len(archiveAssets)).Msg("record archive assets")
+
+	bs.db.Lock.Lock()
+	defer bs.db.Lock.Unlock()
+	err := bs.db.Cli.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, a := range archiveAssets {
+			if err := bs.createChunkArchives(tx, a); err != nil {
+				return err
 			}
-			if a.SourcePath() != bs.record.Path {
-				logger.Warn().Object("asset", a).Msg("skipping asset from different source")
-				continue
+			if err := tx.Create(newArchiveAssetRecord(a, time.Time{})).Error; err != nil {
+				return err
 			}
-
-			archiveAssets = append(archiveAssets, a)
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
 
-		if len(archiveAssets) == 0 {
-			break
+	logger.Debug().Msg("done record archive assets")
+
+	return len(archiveAssets), nil
+}
+
+// Record the archives holding only parts of a split asset. They are complete
+// once the asset is.
+func (bs *BackupSource) createChunkArchives(tx *gorm.DB, a asset.ArchivedAsset) error {
+	for _, c := range asset.ChunksOf(a) {
+		if c.ArchivePath == a.ArchivePath() {
+			continue
+		}
+		record := &Archive{
+			Path:       c.ArchivePath,
+			SourcePath: bs.record.Path,
+			ParityPath: findParityPath(c.ArchivePath),
+			Encrypted:  asset.IsEncrypted(a),
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(record).Error; err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		logger.Debug().Int("size", len(archiveAssets)).Msg("record archive assets batch")
+// Register the assets of an archive created at the given time, in a single transaction.
+// Used to rebuild the catalog from existing archives.
+func (bs *BackupSource) RegisterArchive(ctx context.Context, archivePath string, createdAt time.Time, from iter.Seq[asset.ArchivedAsset]) (int, error) {
+	record := &Archive{
+		Path:       archivePath,
+		SourcePath: bs.record.Path,
+		CreatedAt:  createdAt,
+		ParityPath: findParityPath(archivePath),
+	}
 
-		bs.db.Lock.Lock()
-		err := bs.db.Cli.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
-			for _, a := range archiveAssets {
-				if bs.db.DryRun {
-					countRecorded++
-					continue
-				}
+	var archiveAssets []*ArchiveAsset
+	for a := range from {
+		if a.SourcePath() != bs.record.Path || a.ArchivePath() != archivePath {
+			bs.logger.Warn().Object("asset", a).Msg("skipping asset from different archive")
+			continue
+		}
+		archiveAssets = append(archiveAssets, newArchiveAssetRecord(a, createdAt))
+		record.Encrypted = record.Encrypted || asset.IsEncrypted(a)
+	}
 
-				if err := tx.Create(&ArchiveAsset{
-					Archive: Archive{
-						SourcePath: a.SourcePath(),
-						Path:       a.ArchivePath(),
-					},
-					Path:    a.Path(),
-					Size:    a.Size(),
-					Hash:    int64(a.StoredHash()),
-					ModTime: a.ModTime(),
-					Name:    a.Name(),
-				}).Error; err != nil {
-					return err
-				}
-				countRecorded++
+	if bs.db.DryRun {
+		return len(archiveAssets), nil
+	}
+
+	bs.db.Lock.Lock()
+	defer bs.db.Lock.Unlock()
+	err := bs.db.Cli.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(record).Error; err != nil {
+			return err
+		}
+		for _, r := range archiveAssets {
+			if err := tx.Omit("Archive").Create(r).Error; err != nil {
+				return err
 			}
-			return nil
-		})
-		bs.db.Lock.Unlock()
-		if err != nil {
-			return 0, err
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(archiveAssets), nil
+}
 
-		logger.Debug().Msg("done record archive assets batch")
+// Build the record of an archived asset. The creation time is set by the database when zero.
+func newArchiveAssetRecord(a asset.ArchivedAsset, createdAt time.Time) *ArchiveAsset {
+	attrs := a.Attributes()
+	record := &ArchiveAsset{
+		Archive: Archive{
+			SourcePath: a.SourcePath(),
+			Path:       a.ArchivePath(),
+			CreatedAt:  createdAt,
+			ParityPath: findParityPath(a.ArchivePath()),
+			Encrypted:  asset.IsEncrypted(a),
+		},
+		ArchivePath: a.ArchivePath(),
+		Path:        a.Path(),
+		Size:        a.Size(),
+		Hash:        int64(a.StoredHash()),
+		ModTime:     a.ModTime(),
+		CreatedAt:   createdAt,
+		Name:        a.Name(),
+		Mode:        uint32(attrs.Mode),
+		UID:         attrs.UID,
+		GID:         attrs.GID,
+		UserName:    attrs.User,
+		GroupName:   attrs.Group,
+		LinkTarget:  attrs.LinkTarget,
+		Chunks:      newArchiveAssetChunkRecords(a),
 	}
+	if ref, ok := asset.ContentRefOf(a); ok {
+		record.ContentArchivePath = ref.ArchivePath
+		record.ContentEntry = ref.Entry
+	}
+	if m, ok := a.(asset.MovedArchivedAsset); ok {
+		record.MovedFrom = m.PreviousPath()
+	}
+	if strongHash, ok := asset.StrongHashOf(a); ok {
+		record.StrongHash = strongHash
+	}
+	return record
+}
 
-	return countRecorded, nil
+// Path of the parity file written next to the archive, empty if there is none.
+func findParityPath(archivePath string) string {
+	path := parity.PathOf(archivePath)
+	if !fileutils.Exists(path) {
+		return ""
+	}
+	return path
+}
+
+func newArchiveAssetChunkRecords(a asset.ArchivedAsset) []ArchiveAssetChunk {
+	var records []ArchiveAssetChunk
+	for i, c := range asset.ChunksOf(a) {
+		records = append(records, ArchiveAssetChunk{
+			ArchivePath:      a.ArchivePath(),
+			Path:             a.Path(),
+			Index:            i,
+			ChunkArchivePath: c.ArchivePath,
+			Offset:           c.Offset,
+			Size:             c.Size,
+		})
+	}
+	return records
 }
 
 func isAssetModified(asset asset.Asset, archivedAsset *ArchiveAsset) (bool, error) {
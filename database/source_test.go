@@ -2,7 +2,11 @@ package database_test
 
 import (
 	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -13,6 +17,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/stupid-simple/backup/asset"
 	"github.com/stupid-simple/backup/database"
+	"github.com/stupid-simple/backup/parity"
 	"gorm.io/gorm"
 	"gorm.io/gorm/schema"
 )
@@ -27,7 +32,7 @@ func setupTestDB(t *testing.T) *database.Database {
 	require.NoError(t, err)
 
 	// Perform database migrations
-	err = gormDB.AutoMigrate(&database.Source{}, &database.Archive{}, &database.ArchiveAsset{})
+	err = gormDB.AutoMigrate(&database.Source{}, &database.Archive{}, &database.ArchiveAsset{}, &database.ArchiveAssetChunk{}, &database.Snapshot{}, &database.Tombstone{}, &database.BackupRun{})
 	require.NoError(t, err)
 
 	return &database.Database{
@@ -112,6 +117,82 @@ func TestBackupSource_FindMissingAssetsWithVersions(t *testing.T) {
 	}
 }
 
+func TestBackupSource_FindMissingAssetsMoved(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	source, err := db.GetSource(ctx, dir)
+	require.NoError(t, err)
+
+	oldPath := filepath.Join(dir, "old.jpg")
+	copiedPath := filepath.Join(dir, "copied.jpg")
+	require.NoError(t, os.WriteFile(copiedPath, nil, 0644))
+	require.NoError(t, source.Register(ctx, slices.Values([]asset.ArchivedAsset{
+		newTestArchivedAsset(dir, "archive.zip", oldPath, 42),
+		newTestArchivedAsset(dir, "archive.zip", copiedPath, 43),
+	})))
+
+	out, err := source.FindMissingAssets(ctx, slices.Values([]asset.Asset{
+		newTestAsset(filepath.Join(dir, "photos", "old.jpg"), 42), // old.jpg was moved.
+		newTestAsset(filepath.Join(dir, "copy.jpg"), 43),          // copied.jpg is still there.
+		newTestAsset(copiedPath, 43),
+	}))
+	require.NoError(t, err)
+
+	var missing []asset.Asset
+	for a := range out {
+		missing = append(missing, a)
+	}
+	require.Len(t, missing, 2)
+
+	moved, ok := missing[0].(asset.MovedAsset)
+	require.True(t, ok)
+	assert.Equal(t, filepath.Join(dir, "photos", "old.jpg"), moved.Path())
+	assert.Equal(t, oldPath, moved.MovedFrom().Path())
+	assert.Equal(t, "archive.zip", moved.MovedFrom().ArchivePath())
+
+	_, ok = missing[1].(asset.MovedAsset)
+	assert.False(t, ok)
+	assert.Equal(t, filepath.Join(dir, "copy.jpg"), missing[1].Path())
+	assert.Equal(t, database.FoundAssets{New: 1, Moved: 1, Unchanged: 1}, source.FoundAssets())
+}
+
+func TestBackupSource_FindMissingAssetsMovedLatestVersion(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	source, err := db.GetSource(ctx, dir)
+	require.NoError(t, err)
+
+	// old.jpg was modified, then moved.
+	oldPath := filepath.Join(dir, "old.jpg")
+	require.NoError(t, source.Register(ctx, slices.Values([]asset.ArchivedAsset{
+		newTestArchivedAsset(dir, "archive1.zip", oldPath, 42),
+	})))
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, source.Register(ctx, slices.Values([]asset.ArchivedAsset{
+		newTestArchivedAsset(dir, "archive2.zip", oldPath, 44),
+	})))
+
+	out, err := source.FindMissingAssets(ctx, slices.Values([]asset.Asset{
+		newTestAsset(filepath.Join(dir, "photos", "previous.jpg"), 42),
+		newTestAsset(filepath.Join(dir, "photos", "latest.jpg"), 44),
+	}))
+	require.NoError(t, err)
+
+	var missing []asset.Asset
+	for a := range out {
+		missing = append(missing, a)
+	}
+	require.Len(t, missing, 2)
+	_, ok := missing[0].(asset.MovedAsset)
+	assert.False(t, ok, "only the latest version of a path can be moved")
+	moved, ok := missing[1].(asset.MovedAsset)
+	require.True(t, ok)
+	assert.Equal(t, "archive2.zip", moved.MovedFrom().ArchivePath())
+	assert.Equal(t, database.FoundAssets{New: 1, Moved: 1}, source.FoundAssets())
+}
+
 func TestBackupSource_FindMissingAssetsComplex(t *testing.T) {
 	db := setupTestDB(t)
 	ctx := context.Background()
@@ -176,6 +257,156 @@ func TestBackupSource_Register(t *testing.T) {
 	require.NoError(t, err)
 	assert.Len(t, assets, 2)
 	assert.Equal(t, "path1", assets[0].Path)
+	assert.Equal(t, uint32(0640), assets[0].Mode)
+	assert.Equal(t, 1000, assets[0].UID)
+	assert.Equal(t, 100, assets[0].GID)
+	assert.Equal(t, "user", assets[0].UserName)
+	assert.Equal(t, "users", assets[0].GroupName)
+
+	out, err := source.FindArchivedAssets(ctx)
+	require.NoError(t, err)
+	for a := range out {
+		assert.Equal(t, asset.Attributes{Mode: 0640, UID: 1000, GID: 100, User: "user", Group: "users"}, a.Attributes())
+	}
+}
+
+func TestBackupSource_RegisterParity(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	source, err := db.GetSource(ctx, "test/source/path")
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	withParity := filepath.Join(dir, "archive1.zip")
+	withoutParity := filepath.Join(dir, "archive2.zip")
+	require.NoError(t, os.WriteFile(parity.PathOf(withParity), nil, 0600))
+
+	err = source.Register(ctx, slices.Values([]asset.ArchivedAsset{
+		newTestArchivedAsset("test/source/path", withParity, "path1", 123),
+		newTestArchivedAsset("test/source/path", withoutParity, "path2", 456),
+	}))
+	require.NoError(t, err)
+
+	archives, err := source.FindArchives(ctx)
+	require.NoError(t, err)
+	parityPaths := map[string]string{}
+	for a := range archives {
+		parityPaths[a.Path] = a.ParityPath
+	}
+	assert.Equal(t, map[string]string{
+		withParity:    parity.PathOf(withParity),
+		withoutParity: "",
+	}, parityPaths)
+}
+
+func TestBackupSource_FindArchiveAssets(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	source, err := db.GetSource(ctx, "test/source/path")
+	require.NoError(t, err)
+	other, err := db.GetSource(ctx, "other/source/path")
+	require.NoError(t, err)
+
+	oldTime := time.Now().Add(-time.Hour)
+	registerArchivedAsset(t, db, "test/source/path", "archive1", "path2", 1, oldTime)
+	registerArchivedAsset(t, db, "test/source/path", "archive1", "path1", 2, oldTime)
+	registerArchivedAsset(t, db, "test/source/path", "archive2", "path1", 3, time.Now())
+
+	// Every version is found, not only the latest ones.
+	assets, err := source.FindArchiveAssets(ctx, "archive1")
+	require.NoError(t, err)
+	require.Len(t, assets, 2)
+	assert.Equal(t, "path1", assets[0].Path())
+	assert.Equal(t, uint64(2), assets[0].StoredHash())
+	assert.Equal(t, "path2", assets[1].Path())
+	assert.Equal(t, "archive1", assets[1].ArchivePath())
+
+	assets, err = other.FindArchiveAssets(ctx, "archive1")
+	require.NoError(t, err)
+	assert.Empty(t, assets)
+}
+
+func TestBackupSource_RegisterSymlink(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	source, err := db.GetSource(ctx, "test/source/path")
+	require.NoError(t, err)
+
+	link := &testLinkArchivedAsset{
+		testArchivedAsset: testArchivedAsset{
+			testAsset:   testAsset{path: "link", hash: 123},
+			sourcePath:  "test/source/path",
+			archivePath: "archive1",
+		},
+		target: "target.txt",
+	}
+	err = source.Register(ctx, slices.Values([]asset.ArchivedAsset{link}))
+	require.NoError(t, err)
+
+	var assets []database.ArchiveAsset
+	err = db.Cli.Find(&assets).Error
+	require.NoError(t, err)
+	require.Len(t, assets, 1)
+	assert.Equal(t, "target.txt", assets[0].LinkTarget)
+	assert.Equal(t, uint32(fs.ModeSymlink|0777), assets[0].Mode)
+
+	out, err := source.FindArchivedAssets(ctx)
+	require.NoError(t, err)
+	for a := range out {
+		assert.Equal(t, link.Attributes(), a.Attributes())
+	}
+}
+
+func TestBackupSource_RegisterArchive(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	source, err := db.GetSource(ctx, "test/source/path")
+	require.NoError(t, err)
+
+	oldTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newTime := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	// Registered out of order, as if rebuilding the database.
+	count, err := source.RegisterArchive(ctx, "archive2", newTime, slices.Values([]asset.ArchivedAsset{
+		newTestArchivedAsset("test/source/path", "archive2", "path1", 200),
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = source.RegisterArchive(ctx, "archive1", oldTime, slices.Values([]asset.ArchivedAsset{
+		newTestArchivedAsset("test/source/path", "archive1", "path1", 100),
+		newTestArchivedAsset("test/source/path", "archive1", "path2", 300),
+		newTestArchivedAsset("test/source/path", "other", "path3", 400),
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	has, err := db.HasArchive(ctx, "archive1")
+	require.NoError(t, err)
+	assert.True(t, has)
+	has, err = db.HasArchive(ctx, "other")
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	var archive database.Archive
+	require.NoError(t, db.Cli.Where("path = ?", "archive1").First(&archive).Error)
+	assert.True(t, oldTime.Equal(archive.CreatedAt))
+
+	// The latest version is found by creation time.
+	out, err := source.FindArchivedAssets(ctx)
+	require.NoError(t, err)
+	found := map[string]uint64{}
+	for a := range out {
+		found[a.Path()] = a.StoredHash()
+	}
+	assert.Equal(t, map[string]uint64{"path1": 200, "path2": 300}, found)
+
+	out, err = source.FindArchivedAssets(ctx, database.WithFindArchivedAssetsAsOf(oldTime))
+	require.NoError(t, err)
+	found = map[string]uint64{}
+	for a := range out {
+		found[a.Path()] = a.StoredHash()
+	}
+	assert.Equal(t, map[string]uint64{"path1": 100, "path2": 300}, found)
 }
 
 func TestBackupSource_FindArchivedAssets(t *testing.T) {
@@ -198,6 +429,178 @@ func TestBackupSource_FindArchivedAssets(t *testing.T) {
 	assert.Equal(t, "archived/path1", archivedAssets[0].Path())
 }
 
+func TestBackupSource_FindArchivedAssetsAsOf(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	source, err := db.GetSource(ctx, "test/source/path")
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	oldest := now.Add(-2 * time.Hour)
+	older := now.Add(-time.Hour)
+
+	registerArchivedAsset(t, db, "test/source/path", "archive1", "path1", 100, oldest)
+	registerArchivedAsset(t, db, "test/source/path", "archive2", "path1", 200, older)
+	registerArchivedAsset(t, db, "test/source/path", "archive3", "path1", 300, now)
+	registerArchivedAsset(t, db, "test/source/path", "archive3", "path2", 400, now)
+
+	testCases := []struct {
+		name     string
+		asOf     time.Time
+		expected map[string]uint64
+	}{
+		{
+			name:     "before any archive",
+			asOf:     oldest.Add(-time.Minute),
+			expected: map[string]uint64{},
+		},
+		{
+			name:     "exactly at the oldest archive",
+			asOf:     oldest,
+			expected: map[string]uint64{"path1": 100},
+		},
+		{
+			name:     "between archives",
+			asOf:     older.Add(time.Minute),
+			expected: map[string]uint64{"path1": 200},
+		},
+		{
+			name:     "after the newest archive",
+			asOf:     now.Add(time.Minute),
+			expected: map[string]uint64{"path1": 300, "path2": 400},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := source.FindArchivedAssets(ctx, database.WithFindArchivedAssetsAsOf(tc.asOf))
+			require.NoError(t, err)
+
+			found := map[string]uint64{}
+			for a := range out {
+				found[a.Path()] = a.StoredHash()
+			}
+			assert.Equal(t, tc.expected, found)
+		})
+	}
+}
+
+func TestBackupSource_FindArchivedAssetsFiltered(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	source, err := db.GetSource(ctx, "/source")
+	require.NoError(t, err)
+	now := time.Now()
+
+	paths := []string{
+		"/source/photos/2024/a.jpg",
+		"/source/photos/2024/b.png",
+		"/source/photos/2025/c.jpg",
+		"/source/photos_old/d.jpg",
+		"/source/photosX/e.jpg",
+		"/source/docs/f.txt",
+		"/source/docs/nested/g.txt",
+	}
+	for i, path := range paths {
+		registerArchivedAsset(t, db, "/source", "archive1", path, int64(i), now)
+	}
+	// Same relative paths in another source must never be returned.
+	registerArchivedAsset(t, db, "/other", "archive2", "/other/photos/2024/a.jpg", 100, now)
+
+	testCases := []struct {
+		name     string
+		opts     []database.FindArchivedAssetsOptions
+		expected []string
+	}{
+		{
+			name: "path prefix",
+			opts: []database.FindArchivedAssetsOptions{
+				database.WithFindArchivedAssetsPathPrefix("photos"),
+			},
+			expected: []string{
+				"/source/photos/2024/a.jpg",
+				"/source/photos/2024/b.png",
+				"/source/photos/2025/c.jpg",
+			},
+		},
+		{
+			name: "path prefix with like wildcard",
+			opts: []database.FindArchivedAssetsOptions{
+				database.WithFindArchivedAssetsPathPrefix("photos_old"),
+			},
+			expected: []string{"/source/photos_old/d.jpg"},
+		},
+		{
+			name: "path prefix to a file",
+			opts: []database.FindArchivedAssetsOptions{
+				database.WithFindArchivedAssetsPathPrefix("docs/f.txt"),
+			},
+			expected: []string{"/source/docs/f.txt"},
+		},
+		{
+			name: "include pattern",
+			opts: []database.FindArchivedAssetsOptions{
+				database.WithFindArchivedAssetsMatch([]string{"**/*.jpg"}, nil),
+			},
+			expected: []string{
+				"/source/photos/2024/a.jpg",
+				"/source/photos/2025/c.jpg",
+				"/source/photos_old/d.jpg",
+				"/source/photosX/e.jpg",
+			},
+		},
+		{
+			name: "include pattern with static base",
+			opts: []database.FindArchivedAssetsOptions{
+				database.WithFindArchivedAssetsMatch([]string{"photos/{2024,2025}/*.jpg"}, nil),
+			},
+			expected: []string{
+				"/source/photos/2024/a.jpg",
+				"/source/photos/2025/c.jpg",
+			},
+		},
+		{
+			name: "include and exclude patterns",
+			opts: []database.FindArchivedAssetsOptions{
+				database.WithFindArchivedAssetsMatch([]string{"docs/**", "photos/**"}, []string{"**/2024/**", "docs/nested/*"}),
+			},
+			expected: []string{
+				"/source/photos/2025/c.jpg",
+				"/source/docs/f.txt",
+			},
+		},
+		{
+			name: "path prefix and exclude pattern",
+			opts: []database.FindArchivedAssetsOptions{
+				database.WithFindArchivedAssetsPathPrefix("photos/"),
+				database.WithFindArchivedAssetsMatch(nil, []string{"**/*.png"}),
+			},
+			expected: []string{
+				"/source/photos/2024/a.jpg",
+				"/source/photos/2025/c.jpg",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := source.FindArchivedAssets(ctx, tc.opts...)
+			require.NoError(t, err)
+
+			var found []string
+			for a := range out {
+				found = append(found, a.Path())
+			}
+			assert.ElementsMatch(t, tc.expected, found)
+		})
+	}
+}
+
+func TestValidatePathPatterns(t *testing.T) {
+	assert.NoError(t, database.ValidatePathPatterns([]string{"**/*.jpg", "photos/{a,b}/*"}))
+	assert.Error(t, database.ValidatePathPatterns([]string{"photos/[a"}))
+}
+
 func TestBackupSource_DeleteArchives(t *testing.T) {
 	db := setupTestDB(t)
 	ctx := context.Background()
@@ -402,6 +805,204 @@ func TestBackupSource_FindArchivesOnlyFullyBackedUp(t *testing.T) {
 	assert.Equal(t, "archive1", results[0].Path)
 }
 
+func TestBackupSource_RegisterChunks(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	source, err := db.GetSource(ctx, "test/source/path")
+	require.NoError(t, err)
+
+	split := &testChunkedArchivedAsset{
+		testArchivedAsset: testArchivedAsset{
+			testAsset:   testAsset{path: "test/source/path/disk.img", hash: 42},
+			sourcePath:  "test/source/path",
+			archivePath: "archive.2.zip",
+		},
+		chunks: []asset.Chunk{
+			{ArchivePath: "archive.zip", Offset: 0, Size: 400},
+			{ArchivePath: "archive.1.zip", Offset: 400, Size: 400},
+			{ArchivePath: "archive.2.zip", Offset: 800, Size: 200},
+		},
+	}
+	err = source.Register(ctx, slices.Values([]asset.ArchivedAsset{split}))
+	require.NoError(t, err)
+
+	assets, err := source.FindArchivedAssets(ctx)
+	require.NoError(t, err)
+	var found []asset.ArchivedAsset
+	for a := range assets {
+		found = append(found, a)
+	}
+	require.Len(t, found, 1)
+	assert.Equal(t, "archive.2.zip", found[0].ArchivePath())
+	assert.Equal(t, split.chunks, asset.ChunksOf(found[0]))
+
+	findArchives := func() []string {
+		archives, err := source.FindArchives(ctx, database.WithFindArchivesOnlyFullyBackedUp())
+		require.NoError(t, err)
+		var paths []string
+		for a := range archives {
+			paths = append(paths, a.Path)
+		}
+		slices.Sort(paths)
+		return paths
+	}
+
+	// The archives holding the parts are kept while the file is the latest version.
+	assert.Empty(t, findArchives())
+
+	registerArchivedAsset(t, db, "test/source/path", "archive-new.zip", "test/source/path/disk.img", 43, time.Now())
+	assert.Equal(t, []string{"archive.1.zip", "archive.2.zip", "archive.zip"}, findArchives())
+
+	require.NoError(t, source.DeleteArchive(ctx, "archive.2.zip"))
+	var count int64
+	require.NoError(t, db.Cli.Model(&database.ArchiveAssetChunk{}).Count(&count).Error)
+	assert.Zero(t, count)
+}
+
+func TestBackupSource_FindArchivedContent(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	photos, err := db.GetSource(ctx, "photos")
+	require.NoError(t, err)
+	phone, err := db.GetSource(ctx, "phone")
+	require.NoError(t, err)
+
+	err = photos.Register(ctx, slices.Values([]asset.ArchivedAsset{
+		newTestArchivedAsset("photos", "photos.zip", "photos/a.jpg", 42),
+	}))
+	require.NoError(t, err)
+
+	// Found from any source.
+	found, ok, err := phone.FindArchivedContent(ctx, 42, 1000)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "photos.zip", found.ArchivePath())
+	assert.Equal(t, "photos/a.jpg", found.Path())
+
+	_, ok, err = phone.FindArchivedContent(ctx, 42, 999)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// A copy references the archived contents.
+	copied := &testReferencingArchivedAsset{
+		testArchivedAsset: testArchivedAsset{
+			testAsset:   testAsset{path: "phone/b.jpg", hash: 42},
+			sourcePath:  "phone",
+			archivePath: "phone.zip",
+		},
+		ref: asset.ContentRef{ArchivePath: "photos.zip", Entry: "a.jpg"},
+	}
+	require.NoError(t, phone.Register(ctx, slices.Values([]asset.ArchivedAsset{copied})))
+
+	assets, err := phone.FindArchivedAssets(ctx)
+	require.NoError(t, err)
+	var archived []asset.ArchivedAsset
+	for a := range assets {
+		archived = append(archived, a)
+	}
+	require.Len(t, archived, 1)
+	ref, ok := asset.ContentRefOf(archived[0])
+	require.True(t, ok)
+	assert.Equal(t, copied.ref, ref)
+
+	// The archive holding the contents is kept, even once its own files are backed up again.
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, photos.Register(ctx, slices.Values([]asset.ArchivedAsset{
+		newTestArchivedAsset("photos", "photos-new.zip", "photos/a.jpg", 43),
+	})))
+	findArchives := func(src *database.BackupSource) int {
+		seq, err := src.FindArchives(ctx, database.WithFindArchivesOnlyFullyBackedUp())
+		require.NoError(t, err)
+		var count int
+		for range seq {
+			count++
+		}
+		return count
+	}
+	assert.Zero(t, findArchives(photos))
+
+	require.NoError(t, phone.DeleteArchive(ctx, "phone.zip"))
+	assert.Equal(t, 1, findArchives(photos))
+}
+
+func TestBackupSource_SetStrongHashes(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	source, err := db.GetSource(ctx, "test/source/path")
+	require.NoError(t, err)
+
+	hashed := &testStrongHashedArchivedAsset{
+		testArchivedAsset: testArchivedAsset{
+			testAsset:   testAsset{path: "path2", hash: 2},
+			sourcePath:  "test/source/path",
+			archivePath: "archive1",
+		},
+		strongHash: "sha256:" + strings.Repeat("ab", 32),
+	}
+	require.NoError(t, source.Register(ctx, slices.Values([]asset.ArchivedAsset{
+		newTestArchivedAsset("test/source/path", "archive1", "path1", 1),
+		hashed,
+	})))
+
+	strongHashes := func() map[string]string {
+		assets, err := source.FindArchiveAssets(ctx, "archive1")
+		require.NoError(t, err)
+		found := map[string]string{}
+		for _, a := range assets {
+			found[a.Path()], _ = asset.StrongHashOf(a)
+		}
+		return found
+	}
+	assert.Equal(t, map[string]string{"path1": "", "path2": hashed.strongHash}, strongHashes())
+
+	// Only the assets without a strong hash are updated.
+	backfilled := "blake3:" + strings.Repeat("cd", 32)
+	require.NoError(t, source.SetStrongHashes(ctx, "archive1", map[string]string{"path1": backfilled, "path2": backfilled}))
+	assert.Equal(t, map[string]string{"path1": backfilled, "path2": hashed.strongHash}, strongHashes())
+}
+
+func TestBackupSource_Encrypted(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	source, err := db.GetSource(ctx, "test/source/path")
+	require.NoError(t, err)
+
+	encrypted := func(archivePath, path string, hash uint64) asset.ArchivedAsset {
+		return &testEncryptedArchivedAsset{
+			testArchivedAsset: testArchivedAsset{
+				testAsset:   testAsset{path: path, hash: hash},
+				sourcePath:  "test/source/path",
+				archivePath: archivePath,
+			},
+		}
+	}
+	require.NoError(t, source.Register(ctx, slices.Values([]asset.ArchivedAsset{
+		newTestArchivedAsset("test/source/path", "archive1", "path1", 1),
+		encrypted("archive2", "path2", 2),
+	})))
+	_, err = source.RegisterArchive(ctx, "archive3", time.Now(), slices.Values([]asset.ArchivedAsset{
+		encrypted("archive3", "path3", 3),
+	}))
+	require.NoError(t, err)
+
+	archives, err := source.FindArchives(ctx)
+	require.NoError(t, err)
+	found := map[string]bool{}
+	for a := range archives {
+		found[a.Path] = a.Encrypted
+	}
+	assert.Equal(t, map[string]bool{"archive1": false, "archive2": true, "archive3": true}, found)
+
+	assets, err := source.FindArchiveAssets(ctx, "archive2")
+	require.NoError(t, err)
+	require.Len(t, assets, 1)
+	assert.True(t, asset.IsEncrypted(assets[0]))
+	assets, err = source.FindArchiveAssets(ctx, "archive1")
+	require.NoError(t, err)
+	require.Len(t, assets, 1)
+	assert.False(t, asset.IsEncrypted(assets[0]))
+}
+
 func registerArchivedAsset(t *testing.T, db *database.Database, sourcePath, archivePath, assetPath string, hash int64, createdAt time.Time) {
 	err := db.Cli.Create(&database.ArchiveAsset{
 		Archive:   database.Archive{SourcePath: sourcePath, Path: archivePath},
@@ -438,6 +1039,9 @@ func (a *testAsset) StoredHash() uint64 { return a.hash }
 func (a *testAsset) Name() string       { return "name_" + a.path }
 func (a *testAsset) Size() int64        { return 1000 }
 func (a *testAsset) ModTime() time.Time { return time.Now() }
+func (a *testAsset) Attributes() asset.Attributes {
+	return asset.Attributes{Mode: 0640, UID: 1000, GID: 100, User: "user", Group: "users"}
+}
 func (a *testAsset) MarshalZerologObject(e *zerolog.Event) {
 	e.Str("path", a.path).Uint64("hash", a.hash)
 }
@@ -455,3 +1059,44 @@ type testArchivedAsset struct {
 func (a *testArchivedAsset) SourcePath() string  { return a.sourcePath }
 func (a *testArchivedAsset) ArchivePath() string { return a.archivePath }
 func (a *testArchivedAsset) ArchivedSize() int64 { return 100 }
+
+// testChunkedArchivedAsset is a testArchivedAsset split across archives.
+type testChunkedArchivedAsset struct {
+	testArchivedAsset
+	chunks []asset.Chunk
+}
+
+func (a *testChunkedArchivedAsset) Chunks() []asset.Chunk { return a.chunks }
+
+// testReferencingArchivedAsset is a testArchivedAsset whose contents are in another entry.
+type testReferencingArchivedAsset struct {
+	testArchivedAsset
+	ref asset.ContentRef
+}
+
+func (a *testReferencingArchivedAsset) ContentRef() (asset.ContentRef, bool) { return a.ref, true }
+
+// testStrongHashedArchivedAsset is a testArchivedAsset with a strong hash of its contents.
+type testStrongHashedArchivedAsset struct {
+	testArchivedAsset
+	strongHash string
+}
+
+func (a *testStrongHashedArchivedAsset) StrongHash() string { return a.strongHash }
+
+// testEncryptedArchivedAsset is a testArchivedAsset recorded in an encrypted archive.
+type testEncryptedArchivedAsset struct {
+	testArchivedAsset
+}
+
+func (a *testEncryptedArchivedAsset) Encrypted() bool { return true }
+
+// testLinkArchivedAsset is a testArchivedAsset for a symbolic link.
+type testLinkArchivedAsset struct {
+	testArchivedAsset
+	target string
+}
+
+func (a *testLinkArchivedAsset) Attributes() asset.Attributes {
+	return asset.Attributes{Mode: fs.ModeSymlink | 0777, UID: 1000, GID: 100, LinkTarget: a.target}
+}
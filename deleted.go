@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/database"
+)
+
+func deletedCommand(ctx context.Context, args DeletedCommand, logger zerolog.Logger) error {
+	if args.Path != "" && !filepath.IsLocal(args.Path) {
+		return fmt.Errorf("path must be relative to the source directory: %s", args.Path)
+	}
+
+	dbCli, err := newSQLite(args.Database, logger)
+	if err != nil {
+		return err
+	}
+
+	db := &database.Database{
+		Cli:    dbCli,
+		Logger: logger,
+	}
+
+	src, err := db.GetSource(ctx, args.Source)
+	if err != nil {
+		return err
+	}
+
+	findOpts := []database.FindArchivedAssetsOptions{}
+	if args.Path != "" {
+		findOpts = append(findOpts, database.WithFindArchivedAssetsPathPrefix(args.Path))
+	}
+
+	deletions, err := src.FindDeletions(ctx, findOpts...)
+	if err != nil {
+		return err
+	}
+
+	// One line per deletion: time of the backup run that no longer found the file, run id, path.
+	for d := range deletions {
+		if d.DeletedAt.Before(args.Since) {
+			continue
+		}
+		fmt.Printf("%s\t%d\t%s\n", d.DeletedAt.Local().Format(time.RFC3339), d.SnapshotID, d.Path)
+	}
+	return ctx.Err()
+}
@@ -1,8 +1,23 @@
 package fileutils
 
-import "os"
+import (
+	"io"
+	"os"
+)
 
 func Exists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
 }
+
+// CountingWriter counts the bytes written to W.
+type CountingWriter struct {
+	W     io.Writer
+	Count int64
+}
+
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	n, err := c.W.Write(p)
+	c.Count += int64(n)
+	return n, err
+}
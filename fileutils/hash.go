@@ -1,22 +1,34 @@
 package fileutils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/cespare/xxhash"
+	"github.com/zeebo/blake3"
 )
 
+// NewHash returns a hash computing the same sums as ComputeHash, for contents
+// written in several steps.
+func NewHash() hash.Hash64 {
+	return xxhash.New()
+}
+
 // ComputeHash returns the hash of the reader.
 // It will read the entire contents of the reader. It will not close the reader.
 func ComputeHash(r io.Reader) (uint64, error) {
-	hash := xxhash.New()
-	_, err := io.Copy(hash, r)
+	h := NewHash()
+	_, err := io.Copy(h, r)
 	if err != nil {
 		return 0, err
 	}
-	return hash.Sum64(), nil
+	return h.Sum64(), nil
 }
 
 // ComputeFileHash returns the hash of the file at path.
@@ -37,3 +49,66 @@ func ComputeFileHash(path string) (uint64, error) {
 
 	return hash, err
 }
+
+// A cryptographic hash of the contents, for tamper evidence and for trusting
+// identical contents. xxHash64 only detects changes.
+type HashAlgorithm string
+
+const (
+	HashSHA256 HashAlgorithm = "sha256"
+	HashBLAKE3 HashAlgorithm = "blake3"
+)
+
+// Parse the name of a strong hash algorithm. Empty for none.
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	switch alg := HashAlgorithm(name); alg {
+	case "", HashSHA256, HashBLAKE3:
+		return alg, nil
+	default:
+		return "", fmt.Errorf("unknown hash algorithm %q, must be %s or %s", name, HashSHA256, HashBLAKE3)
+	}
+}
+
+// NewStrongHash returns a hash of the algorithm, whose sum is formatted with FormatStrongHash.
+func NewStrongHash(alg HashAlgorithm) (hash.Hash, error) {
+	switch alg {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashBLAKE3:
+		return blake3.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown hash algorithm %q", alg)
+	}
+}
+
+// Format a strong hash as "<algorithm>:<hexadecimal sum>", so it can be
+// checked whatever the algorithm configured now.
+func FormatStrongHash(alg HashAlgorithm, h hash.Hash) string {
+	return string(alg) + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// The algorithm of a strong hash formatted by FormatStrongHash.
+func StrongHashAlgorithm(strongHash string) (HashAlgorithm, error) {
+	name, _, ok := strings.Cut(strongHash, ":")
+	if !ok {
+		return "", fmt.Errorf("invalid strong hash %q", strongHash)
+	}
+	alg, err := ParseHashAlgorithm(name)
+	if err != nil || alg == "" {
+		return "", fmt.Errorf("invalid strong hash %q", strongHash)
+	}
+	return alg, nil
+}
+
+// ComputeStrongHash returns the strong hash of the reader, formatted with FormatStrongHash.
+// It will read the entire contents of the reader. It will not close the reader.
+func ComputeStrongHash(alg HashAlgorithm, r io.Reader) (string, error) {
+	h, err := NewStrongHash(alg)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return FormatStrongHash(alg, h), nil
+}
@@ -1,6 +1,7 @@
 package fileutils_test
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
 	"strings"
@@ -40,3 +41,44 @@ func TestComputeFileHash(t *testing.T) {
 		t.Errorf("expected hash 0x45ab6734b21e6968, got %x", hash)
 	}
 }
+
+func TestComputeStrongHash(t *testing.T) {
+	tests := []struct {
+		alg      fileutils.HashAlgorithm
+		data     []byte
+		expected string
+	}{
+		{fileutils.HashSHA256, data, "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"},
+		{fileutils.HashBLAKE3, nil, "blake3:af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{fileutils.HashBLAKE3, []byte("abc"), "blake3:6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		// Official test vectors, with inputs of bytes 0, 1, ..., 250, 0, 1...
+		{fileutils.HashBLAKE3, testInput(1024), "blake3:42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{fileutils.HashBLAKE3, testInput(2048), "blake3:e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+		{fileutils.HashBLAKE3, testInput(102400), "blake3:bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085"},
+	}
+	for _, test := range tests {
+		sum, err := fileutils.ComputeStrongHash(test.alg, bytes.NewReader(test.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum != test.expected {
+			t.Errorf("expected %s hash of %d bytes %s, got %s", test.alg, len(test.data), test.expected, sum)
+		}
+		alg, err := fileutils.StrongHashAlgorithm(sum)
+		if err != nil || alg != test.alg {
+			t.Errorf("expected algorithm %s, got %s (%v)", test.alg, alg, err)
+		}
+	}
+
+	if _, err := fileutils.ParseHashAlgorithm("md5"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func testInput(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
@@ -0,0 +1,76 @@
+package fileutils
+
+import (
+	"io/fs"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// FileOwner returns the numeric user and group ids owning the file.
+// ok is false if the file information doesn't include ownership.
+func FileOwner(info fs.FileInfo) (uid int, gid int, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+var (
+	userNames  sync.Map
+	groupNames sync.Map
+)
+
+// UserName returns the name of the user with id uid, or an empty string if it is unknown.
+func UserName(uid int) string {
+	if name, ok := userNames.Load(uid); ok {
+		return name.(string)
+	}
+	var name string
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		name = u.Username
+	}
+	userNames.Store(uid, name)
+	return name
+}
+
+// GroupName returns the name of the group with id gid, or an empty string if it is unknown.
+func GroupName(gid int) string {
+	if name, ok := groupNames.Load(gid); ok {
+		return name.(string)
+	}
+	var name string
+	if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+		name = g.Name
+	}
+	groupNames.Store(gid, name)
+	return name
+}
+
+// LookupUserID returns the id of the user named name in this system.
+func LookupUserID(name string) (int, bool) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, false
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, false
+	}
+	return uid, true
+}
+
+// LookupGroupID returns the id of the group named name in this system.
+func LookupGroupID(name string) (int, bool) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, false
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, false
+	}
+	return gid, true
+}
@@ -0,0 +1,100 @@
+package fileutils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Suffix of the temporary file a file is written to until it is complete.
+const PartialSuffix = ".partial"
+
+// Temporary files modified more recently may have just been created, before
+// their writer could lock them.
+const stalePartialAge = time.Minute
+
+// Create the temporary file used to write path. Fails if path already exists.
+// The file is locked until closed, so it isn't taken for a leftover of an
+// interrupted write, see RemoveStalePartialFile.
+func CreatePartialFile(path string) (*os.File, error) {
+	if Exists(path) {
+		return nil, fmt.Errorf("file or directory already exists with this name: %s", path)
+	}
+
+	f, err := os.OpenFile(path+PartialSuffix, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path + PartialSuffix)
+		return nil, fmt.Errorf("could not lock %s: %w", path+PartialSuffix, err)
+	}
+	return f, nil
+}
+
+// Flush and close the temporary file created for path, and move it into place.
+func CommitPartialFile(f *os.File, path string) error {
+	if err := f.Sync(); err != nil {
+		return errors.Join(err, f.Close())
+	}
+	if Exists(path) {
+		return errors.Join(fmt.Errorf("file or directory already exists with this name: %s", path), f.Close())
+	}
+	// Moved while still locked, so it can't be removed as a leftover meanwhile.
+	if err := os.Rename(path+PartialSuffix, path); err != nil {
+		return errors.Join(err, f.Close())
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Remove the temporary file created for path.
+func RemovePartialFile(path string) error {
+	return os.Remove(path + PartialSuffix)
+}
+
+// Remove a temporary file left behind by an interrupted write. Files still
+// being written, by this process or another one, are kept. Returns whether
+// the file was removed.
+func RemoveStalePartialFile(partialPath string) (bool, error) {
+	f, err := os.Open(partialPath)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if time.Since(info.ModTime()) < stalePartialAge {
+		return false, nil
+	}
+	if err := os.Remove(partialPath); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Flushes the directory entries, so a rename survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return errors.Join(d.Sync(), d.Close())
+}
@@ -26,7 +26,7 @@ func newSQLite(path string, logger zerolog.Logger) (*gorm.DB, error) {
 		return nil, err
 	}
 
-	err = cli.AutoMigrate(&database.Source{}, &database.Archive{}, &database.ArchiveAsset{})
+	err = cli.AutoMigrate(&database.Source{}, &database.Archive{}, &database.ArchiveAsset{}, &database.ArchiveAssetChunk{}, &database.Snapshot{}, &database.Tombstone{}, &database.BackupRun{})
 	if err != nil {
 		return nil, err
 	}
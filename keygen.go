@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/signing"
+)
+
+func keygenCommand(args KeygenCommand, logger zerolog.Logger) error {
+	publicPath, err := signing.GenerateKey(args.Key)
+	if err != nil {
+		return err
+	}
+	logger.Info().
+		Str("private_key", args.Key).
+		Str("public_key", publicPath).
+		Msg("generated signing key, keep the private key secret and a copy of the public key away from the archives")
+	return nil
+}
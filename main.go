@@ -77,6 +77,60 @@ func main() {
 			logger.Error().Err(err).Msg("clean error")
 			cli.Exit(1)
 		}
+	case "reindex":
+		err := reindexCommand(ctx, args.Reindex, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("reindex error")
+			cli.Exit(1)
+		}
+	case "deleted":
+		err := deletedCommand(ctx, args.Deleted, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("deleted error")
+			cli.Exit(1)
+		}
+	case "runs":
+		err := runsCommand(ctx, args.Runs, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("runs error")
+			cli.Exit(1)
+		}
+	case "status":
+		err := statusCommand(ctx, args.Status, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("status error")
+			cli.Exit(1)
+		}
+	case "verify":
+		err := verifyCommand(ctx, args.Verify, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("verify error")
+			cli.Exit(1)
+		}
+	case "repair <archive>":
+		err := repairCommand(ctx, args.Repair, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("repair error")
+			cli.Exit(1)
+		}
+	case "backfill-hashes":
+		err := backfillHashesCommand(ctx, args.BackfillHashes, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("backfill-hashes error")
+			cli.Exit(1)
+		}
+	case "keygen <key>":
+		err := keygenCommand(args.Keygen, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("keygen error")
+			cli.Exit(1)
+		}
+	case "check-signature <archives>":
+		err := checkSignatureCommand(args.CheckSignature, logger)
+		if err != nil {
+			logger.Error().Err(err).Msg("check-signature error")
+			cli.Exit(1)
+		}
 	case "daemon":
 		err := daemonCommand(ctx, args.Daemon, logger)
 		if err != nil {
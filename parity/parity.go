@@ -0,0 +1,450 @@
+// Package parity writes Reed-Solomon parity files next to archives, and uses
+// them to repair the archives when some of their blocks are damaged.
+//
+// An archive is cut in blocks, grouped in stripes of consecutive blocks. Each
+// stripe gets parity blocks, and any of its blocks can be rebuilt as long as
+// no more blocks of the stripe are damaged than it has intact parity blocks.
+// The parity file also holds the checksum of every block, to find the damaged ones.
+package parity
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/stupid-simple/backup/fileutils"
+)
+
+// Suffix of the parity file of an archive.
+const Suffix = ".par"
+
+const (
+	magic         = "SSBAKPAR"
+	formatVersion = 1
+	blockSize     = 4096
+	// Data blocks per stripe. Parity blocks per stripe are a percentage of it.
+	maxStripeBlocks = 128
+	headerSize      = len(magic) + 4 + 4 + 8 + 4 + 4
+)
+
+// The parity file itself is damaged, its checksums can't be trusted.
+var ErrCorrupted = errors.New("corrupted parity file")
+
+// Path of the parity file of the archive.
+func PathOf(archivePath string) string {
+	return archivePath + Suffix
+}
+
+// Result of checking an archive against its parity file.
+type Report struct {
+	Blocks        int64   // Blocks of the archive.
+	DamagedBlocks []int64 // Indexes of the damaged blocks of the archive.
+	DamagedParity int     // Damaged blocks of the parity file.
+	SizeMismatch  bool    // The archive doesn't have the size it had when the parity was written.
+	Repairable    bool    // All the damaged blocks of the archive can be rebuilt.
+}
+
+// Whether neither the archive nor its parity file are damaged.
+func (r *Report) OK() bool {
+	return len(r.DamagedBlocks) == 0 && r.DamagedParity == 0 && !r.SizeMismatch
+}
+
+type header struct {
+	archiveSize  int64
+	stripeBlocks int // Data blocks per stripe.
+	stripeParity int // Parity blocks per stripe.
+	dataHashes   []uint64
+	parityHashes []uint64
+}
+
+func (h *header) blocks() int64 {
+	return (h.archiveSize + blockSize - 1) / blockSize
+}
+
+func (h *header) stripes() int64 {
+	return (h.blocks() + int64(h.stripeBlocks) - 1) / int64(h.stripeBlocks)
+}
+
+// Offset of the first parity block in the parity file.
+func (h *header) parityOffset() int64 {
+	return int64(headerSize) + int64(len(h.dataHashes)+len(h.parityHashes)+1)*8
+}
+
+func newHeader(archiveSize int64, percent float64) (*header, error) {
+	if percent <= 0 || percent > 100 {
+		return nil, fmt.Errorf("invalid parity percentage %v, must be more than 0 and at most 100", percent)
+	}
+	h := &header{archiveSize: archiveSize}
+	h.stripeBlocks = int(max(1, min(maxStripeBlocks, h.blocks())))
+	h.stripeParity = max(1, int(math.Ceil(float64(h.stripeBlocks)*percent/100)))
+	h.dataHashes = make([]uint64, h.blocks())
+	h.parityHashes = make([]uint64, h.stripes()*int64(h.stripeParity))
+	return h, nil
+}
+
+func (h *header) marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(formatVersion))
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(blockSize))
+	_ = binary.Write(&buf, binary.LittleEndian, uint64(h.archiveSize))
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(h.stripeBlocks))
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(h.stripeParity))
+	_ = binary.Write(&buf, binary.LittleEndian, h.dataHashes)
+	_ = binary.Write(&buf, binary.LittleEndian, h.parityHashes)
+	_ = binary.Write(&buf, binary.LittleEndian, hashBytes(buf.Bytes()))
+	return buf.Bytes()
+}
+
+// Read the metadata at the start of the parity file. The parity blocks follow.
+func readHeader(f *os.File) (*header, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fixed := make([]byte, headerSize)
+	if _, err := io.ReadFull(f, fixed); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+	if string(fixed[:len(magic)]) != magic {
+		return nil, fmt.Errorf("%w: not a parity file", ErrCorrupted)
+	}
+	le := binary.LittleEndian
+	fields := fixed[len(magic):]
+	if v := le.Uint32(fields[0:]); v != formatVersion {
+		return nil, fmt.Errorf("unsupported parity file version %d", v)
+	}
+	h := &header{
+		archiveSize:  int64(le.Uint64(fields[8:])),
+		stripeBlocks: int(le.Uint32(fields[16:])),
+		stripeParity: int(le.Uint32(fields[20:])),
+	}
+	if le.Uint32(fields[4:]) != blockSize || h.archiveSize < 0 || h.stripeBlocks <= 0 || h.stripeParity <= 0 ||
+		h.stripeBlocks+h.stripeParity > 256 {
+		return nil, fmt.Errorf("%w: invalid header", ErrCorrupted)
+	}
+
+	hashesSize := (h.blocks() + h.stripes()*int64(h.stripeParity) + 1) * 8
+	if int64(headerSize)+hashesSize > info.Size() {
+		return nil, fmt.Errorf("%w: truncated", ErrCorrupted)
+	}
+	hashes := make([]byte, hashesSize)
+	if _, err := io.ReadFull(f, hashes); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+	sum := le.Uint64(hashes[len(hashes)-8:])
+	if hashBytes(append(fixed, hashes[:len(hashes)-8]...)) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+	h.dataHashes = make([]uint64, h.blocks())
+	h.parityHashes = make([]uint64, h.stripes()*int64(h.stripeParity))
+	for i := range h.dataHashes {
+		h.dataHashes[i] = le.Uint64(hashes[i*8:])
+	}
+	for i := range h.parityHashes {
+		h.parityHashes[i] = le.Uint64(hashes[(len(h.dataHashes)+i)*8:])
+	}
+	return h, nil
+}
+
+func hashBytes(b []byte) uint64 {
+	h := fileutils.NewHash()
+	_, _ = h.Write(b)
+	return h.Sum64()
+}
+
+// Write the parity file of the archive, with parity blocks amounting to
+// percent of the archive size. An existing parity file is replaced.
+func Write(ctx context.Context, archivePath string, percent float64) error {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	h, err := newHeader(info.Size(), percent)
+	if err != nil {
+		return err
+	}
+	return writeParity(ctx, archivePath, h)
+}
+
+func writeParity(ctx context.Context, archivePath string, h *header) error {
+	c, err := newCodec(h.stripeBlocks, h.stripeParity)
+	if err != nil {
+		return err
+	}
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	return replaceFile(PathOf(archivePath), func(f *os.File) error {
+		if _, err := f.Seek(h.parityOffset(), io.SeekStart); err != nil {
+			return err
+		}
+		data := newBlocks(h.stripeBlocks)
+		parity := newBlocks(h.stripeParity)
+		for stripe := range h.stripes() {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			first := stripe * int64(h.stripeBlocks)
+			n := int(min(int64(h.stripeBlocks), h.blocks()-first))
+			for j := range n {
+				if _, err := readBlock(archive, data[j]); err != nil {
+					return err
+				}
+				h.dataHashes[first+int64(j)] = hashBytes(data[j])
+			}
+			c.encode(data[:n], parity)
+			for i, p := range parity {
+				h.parityHashes[stripe*int64(h.stripeParity)+int64(i)] = hashBytes(p)
+				if _, err := f.Write(p); err != nil {
+					return err
+				}
+			}
+		}
+		_, err := f.WriteAt(h.marshal(), 0)
+		return err
+	})
+}
+
+// Check the archive against its parity file.
+func Verify(ctx context.Context, archivePath string, parityPath string) (*Report, error) {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{Repairable: true}
+	h, err := scan(ctx, archivePath, parityPath, func(s *stripe) error {
+		report.DamagedParity += s.damagedParity()
+		if s.damagedData() > s.intactParity() {
+			report.Repairable = false
+		}
+		for j, bad := range s.dataDamaged {
+			if bad {
+				report.DamagedBlocks = append(report.DamagedBlocks, s.first+int64(j))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Blocks = h.blocks()
+	report.SizeMismatch = info.Size() != h.archiveSize
+	return report, nil
+}
+
+// Rebuild the damaged blocks of the archive from its parity file, and rewrite
+// the parity file if it is damaged. The archive is replaced once it is fully
+// repaired, and left untouched if it can't be.
+// The returned report describes the damage found before the repair.
+func Repair(ctx context.Context, archivePath string, parityPath string) (*Report, error) {
+	report, err := Verify(ctx, archivePath, parityPath)
+	if err != nil {
+		return nil, err
+	}
+	if report.OK() {
+		return report, nil
+	}
+	if !report.Repairable {
+		return report, errTooManyErasures
+	}
+
+	if len(report.DamagedBlocks) > 0 || report.SizeMismatch {
+		err = replaceFile(archivePath, func(f *os.File) error {
+			h, err := scan(ctx, archivePath, parityPath, func(s *stripe) error {
+				if err := s.codec.reconstruct(s.data, s.dataDamaged, s.parity, s.parityDamaged); err != nil {
+					return err
+				}
+				for _, d := range s.data {
+					if _, err := f.Write(d); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			// Remove the padding of the last block.
+			return f.Truncate(h.archiveSize)
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if report.DamagedParity > 0 {
+		f, err := os.Open(parityPath)
+		if err != nil {
+			return report, err
+		}
+		h, err := readHeader(f)
+		_ = f.Close()
+		if err != nil {
+			return report, err
+		}
+		if err := writeParity(ctx, archivePath, h); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// Blocks of a stripe, read from the archive and its parity file.
+type stripe struct {
+	codec         *codec
+	first         int64 // Index of the first data block in the archive.
+	data          [][]byte
+	dataDamaged   []bool
+	parity        [][]byte
+	parityDamaged []bool
+}
+
+func (s *stripe) damagedData() int {
+	return countTrue(s.dataDamaged)
+}
+
+func (s *stripe) damagedParity() int {
+	return countTrue(s.parityDamaged)
+}
+
+func (s *stripe) intactParity() int {
+	return len(s.parityDamaged) - s.damagedParity()
+}
+
+func countTrue(values []bool) int {
+	var n int
+	for _, v := range values {
+		if v {
+			n++
+		}
+	}
+	return n
+}
+
+// Read the archive and its parity file stripe by stripe, flagging the blocks
+// not matching their checksum. Blocks missing from a truncated archive are damaged.
+func scan(
+	ctx context.Context,
+	archivePath string,
+	parityPath string,
+	fn func(s *stripe) error,
+) (*header, error) {
+	parityFile, err := os.Open(parityPath)
+	if err != nil {
+		return nil, err
+	}
+	defer parityFile.Close()
+	h, err := readHeader(parityFile)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newCodec(h.stripeBlocks, h.stripeParity)
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	data := newBlocks(h.stripeBlocks)
+	parity := newBlocks(h.stripeParity)
+	for index := range h.stripes() {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		s := &stripe{codec: c, first: index * int64(h.stripeBlocks)}
+		n := int(min(int64(h.stripeBlocks), h.blocks()-s.first))
+		s.data = data[:n]
+		s.dataDamaged = make([]bool, n)
+		for j, d := range s.data {
+			read, err := readBlock(archive, d)
+			if err != nil {
+				return nil, err
+			}
+			block := s.first + int64(j)
+			expected := min(blockSize, h.archiveSize-block*blockSize)
+			s.dataDamaged[j] = int64(read) < expected || hashBytes(d) != h.dataHashes[block]
+		}
+		s.parity = parity
+		s.parityDamaged = make([]bool, h.stripeParity)
+		for i, p := range s.parity {
+			read, err := readBlock(parityFile, p)
+			if err != nil {
+				return nil, err
+			}
+			s.parityDamaged[i] = read < blockSize || hashBytes(p) != h.parityHashes[index*int64(h.stripeParity)+int64(i)]
+		}
+		if err := fn(s); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func newBlocks(n int) [][]byte {
+	blocks := make([][]byte, n)
+	for i := range blocks {
+		blocks[i] = make([]byte, blockSize)
+	}
+	return blocks
+}
+
+// Read a block, padded with zeros past the end of the file.
+func readBlock(r io.Reader, block []byte) (int, error) {
+	n, err := io.ReadFull(r, block)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		clear(block[n:])
+		return n, nil
+	}
+	return n, err
+}
+
+// Write the file at path to a temporary file, and move it into place once
+// complete. The permissions of the file replaced are kept. The temporary file
+// is removed if writing fails or is cancelled.
+func replaceFile(path string, write func(f *os.File) error) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	closed := false
+	defer func() {
+		if err == nil {
+			return
+		}
+		if !closed {
+			err = errors.Join(err, f.Close())
+		}
+		err = errors.Join(err, os.Remove(f.Name()))
+	}()
+
+	if info, err := os.Stat(path); err == nil {
+		if err := f.Chmod(info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	if err := write(f); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	closed = true
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
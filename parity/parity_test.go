@@ -0,0 +1,150 @@
+package parity_test
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stupid-simple/backup/parity"
+)
+
+// Write a file of random contents with its parity file.
+func writeArchive(t *testing.T, size int, percent float64) (string, []byte) {
+	t.Helper()
+	contents := make([]byte, size)
+	_, err := rand.Read(contents)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "backup.zip")
+	require.NoError(t, os.WriteFile(path, contents, 0644))
+	require.NoError(t, parity.Write(context.Background(), path, percent))
+	return path, contents
+}
+
+func damage(t *testing.T, path string, offsets ...int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	for _, offset := range offsets {
+		b := make([]byte, 1)
+		_, err := f.ReadAt(b, offset)
+		require.NoError(t, err)
+		b[0] ^= 0xff
+		_, err = f.WriteAt(b, offset)
+		require.NoError(t, err)
+	}
+}
+
+func TestVerify_Intact(t *testing.T) {
+	path, _ := writeArchive(t, 1000*1000, 5)
+
+	report, err := parity.Verify(context.Background(), path, parity.PathOf(path))
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, int64(245), report.Blocks)
+
+	// The parity blocks are about the requested share of the archive.
+	info, err := os.Stat(parity.PathOf(path))
+	require.NoError(t, err)
+	assert.Less(t, info.Size(), int64(1000*1000/10))
+}
+
+func TestWrite_Cancelled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backup.zip")
+	require.NoError(t, os.WriteFile(path, make([]byte, 1000*1000), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, parity.Write(ctx, path, 5), context.Canceled)
+
+	// No temporary file is left behind.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "backup.zip", entries[0].Name())
+}
+
+func TestRepair_DamagedBlocks(t *testing.T) {
+	path, contents := writeArchive(t, 1000*1000, 5)
+	damage(t, path, 10, 4096*3+7, 4096*130, int64(len(contents)-1))
+
+	report, err := parity.Verify(context.Background(), path, parity.PathOf(path))
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.True(t, report.Repairable)
+	assert.Equal(t, []int64{0, 3, 130, 244}, report.DamagedBlocks)
+
+	_, err = parity.Repair(context.Background(), path, parity.PathOf(path))
+	require.NoError(t, err)
+	repaired, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, contents, repaired)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+}
+
+func TestRepair_Truncated(t *testing.T) {
+	path, contents := writeArchive(t, 100*1000, 10)
+	require.NoError(t, os.Truncate(path, int64(len(contents)-5000)))
+
+	report, err := parity.Repair(context.Background(), path, parity.PathOf(path))
+	require.NoError(t, err)
+	assert.True(t, report.SizeMismatch)
+	repaired, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, contents, repaired)
+}
+
+func TestRepair_TooManyDamagedBlocks(t *testing.T) {
+	path, contents := writeArchive(t, 100*1000, 5)
+	damage(t, path, 0, 4096*2, 4096*4)
+
+	report, err := parity.Repair(context.Background(), path, parity.PathOf(path))
+	require.Error(t, err)
+	assert.False(t, report.Repairable)
+
+	// The archive is left as it was.
+	damaged, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Len(t, damaged, len(contents))
+	assert.NotEqual(t, contents, damaged)
+}
+
+func TestRepair_DamagedParity(t *testing.T) {
+	path, contents := writeArchive(t, 1000*1000, 5)
+	parityPath := parity.PathOf(path)
+	info, err := os.Stat(parityPath)
+	require.NoError(t, err)
+	damage(t, parityPath, info.Size()-1)
+	damage(t, path, 100)
+
+	report, err := parity.Repair(context.Background(), path, parityPath)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.DamagedParity)
+	assert.Equal(t, []int64{0}, report.DamagedBlocks)
+
+	report, err = parity.Verify(context.Background(), path, parityPath)
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+	repaired, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, contents, repaired)
+}
+
+func TestVerify_CorruptedMetadata(t *testing.T) {
+	path, _ := writeArchive(t, 10*1000, 5)
+	damage(t, parity.PathOf(path), 40)
+
+	_, err := parity.Verify(context.Background(), path, parity.PathOf(path))
+	assert.ErrorIs(t, err, parity.ErrCorrupted)
+
+	require.NoError(t, os.WriteFile(parity.PathOf(path), []byte("not parity"), 0600))
+	_, err = parity.Verify(context.Background(), path, parity.PathOf(path))
+	assert.ErrorIs(t, err, parity.ErrCorrupted)
+}
@@ -0,0 +1,184 @@
+package parity
+
+import "errors"
+
+// Arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1.
+const gfPolynomial = 0x11d
+
+var (
+	gfExp [510]byte
+	gfLog [256]int
+	// Products of every pair of field elements, to multiply blocks quickly.
+	gfMulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := range 255 {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPolynomial
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMulTable[a][b] = gfExp[gfLog[a]+gfLog[b]]
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	return gfMulTable[a][b]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// Add c times src to dst.
+func mulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	table := &gfMulTable[c]
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+var errTooManyErasures = errors.New("too many damaged blocks to repair")
+
+// codec is a systematic Reed-Solomon erasure code with dataShards data blocks
+// and parityShards parity blocks. The parity blocks are computed with a Cauchy
+// matrix, whose square submatrices are all invertible, so that any dataShards
+// intact blocks are enough to rebuild the others.
+type codec struct {
+	dataShards   int
+	parityShards int
+	matrix       [][]byte // Coefficients of the data blocks in each parity block.
+}
+
+func newCodec(dataShards, parityShards int) (*codec, error) {
+	if dataShards <= 0 || parityShards <= 0 || dataShards+parityShards > 256 {
+		return nil, errors.New("invalid number of blocks per stripe")
+	}
+	matrix := make([][]byte, parityShards)
+	for i := range matrix {
+		matrix[i] = make([]byte, dataShards)
+		for j := range matrix[i] {
+			matrix[i][j] = gfInv(byte(dataShards+i) ^ byte(j))
+		}
+	}
+	return &codec{dataShards: dataShards, parityShards: parityShards, matrix: matrix}, nil
+}
+
+// Compute the parity blocks of the data blocks. The stripe may have fewer
+// data blocks than the codec, the missing ones being zeros.
+func (c *codec) encode(data, parity [][]byte) {
+	for i, p := range parity {
+		clear(p)
+		for j, d := range data {
+			mulAdd(p, d, c.matrix[i][j])
+		}
+	}
+}
+
+// Rebuild the data blocks flagged as damaged from the other data blocks and
+// the intact parity blocks.
+func (c *codec) reconstruct(data [][]byte, damaged []bool, parity [][]byte, parityDamaged []bool) error {
+	var erased []int
+	for j, bad := range damaged {
+		if bad {
+			erased = append(erased, j)
+		}
+	}
+	if len(erased) == 0 {
+		return nil
+	}
+	var rows []int
+	for i, bad := range parityDamaged {
+		if !bad {
+			rows = append(rows, i)
+		}
+		if len(rows) == len(erased) {
+			break
+		}
+	}
+	if len(rows) < len(erased) {
+		return errTooManyErasures
+	}
+
+	// Remove the contribution of the intact data blocks from the parity
+	// blocks, leaving a linear system in the damaged blocks.
+	size := len(parity[0])
+	syndromes := make([][]byte, len(rows))
+	for k, i := range rows {
+		syndromes[k] = make([]byte, size)
+		copy(syndromes[k], parity[i])
+		for j, d := range data {
+			if !damaged[j] {
+				mulAdd(syndromes[k], d, c.matrix[i][j])
+			}
+		}
+	}
+
+	sub := make([][]byte, len(rows))
+	for k, i := range rows {
+		sub[k] = make([]byte, len(erased))
+		for l, j := range erased {
+			sub[k][l] = c.matrix[i][j]
+		}
+	}
+	inv, err := invert(sub)
+	if err != nil {
+		return err
+	}
+	for l, j := range erased {
+		clear(data[j])
+		for k := range syndromes {
+			mulAdd(data[j], syndromes[k], inv[l][k])
+		}
+	}
+	return nil
+}
+
+// Invert a square matrix with Gauss-Jordan elimination.
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for i := range m {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+	for col := range n {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if work[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		scale := gfInv(work[col][col])
+		for k := range work[col] {
+			work[col][k] = gfMul(work[col][k], scale)
+		}
+		for row := range n {
+			if row != col && work[row][col] != 0 {
+				mulAdd(work[row], work[col], work[row][col])
+			}
+		}
+	}
+	inv := make([][]byte, n)
+	for i := range work {
+		inv[i] = work[i][n:]
+	}
+	return inv, nil
+}
@@ -0,0 +1,60 @@
+package parity
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodec_ReconstructAnyErasures(t *testing.T) {
+	const dataShards, parityShards = 6, 3
+	c, err := newCodec(dataShards, parityShards)
+	require.NoError(t, err)
+
+	data := make([][]byte, dataShards)
+	for i := range data {
+		data[i] = make([]byte, 64)
+		_, err := rand.Read(data[i])
+		require.NoError(t, err)
+	}
+	parity := make([][]byte, parityShards)
+	for i := range parity {
+		parity[i] = make([]byte, 64)
+	}
+	c.encode(data, parity)
+
+	// Every combination of damaged blocks, up to the number of parity blocks.
+	for mask := range 1 << (dataShards + parityShards) {
+		var damaged, parityDamaged []bool
+		for i := range dataShards + parityShards {
+			bad := mask&(1<<i) != 0
+			if i < dataShards {
+				damaged = append(damaged, bad)
+			} else {
+				parityDamaged = append(parityDamaged, bad)
+			}
+		}
+		erased := 0
+		for _, bad := range append(damaged, parityDamaged...) {
+			if bad {
+				erased++
+			}
+		}
+
+		work := make([][]byte, dataShards)
+		for i := range work {
+			work[i] = make([]byte, 64)
+			if !damaged[i] {
+				copy(work[i], data[i])
+			}
+		}
+		err := c.reconstruct(work, damaged, parity, parityDamaged)
+		if erased > parityShards {
+			continue
+		}
+		require.NoError(t, err, "mask %b", mask)
+		assert.Equal(t, data, work, "mask %b", mask)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Read the password of the encrypted archives from a file, or from an
+// environment variable. Nil if neither is given. The trailing line break of
+// the file is not part of the password.
+func readPassword(file string, env string) ([]byte, error) {
+	var password string
+	switch {
+	case file != "" && env != "":
+		return nil, fmt.Errorf("the password can be read from a file or an environment variable, not both")
+	case file != "":
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read password file: %w", err)
+		}
+		password = strings.TrimRight(string(content), "\r\n")
+	case env != "":
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("password environment variable %s is not set", env)
+		}
+		password = value
+	default:
+		return nil, nil
+	}
+	if password == "" {
+		return nil, fmt.Errorf("the password is empty")
+	}
+	return []byte(password), nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/database"
+	"github.com/stupid-simple/backup/ziparchiver"
+)
+
+func reindexCommand(ctx context.Context, args ReindexCommand, logger zerolog.Logger) error {
+	if args.DryRun {
+		logger = logger.With().Bool("dryrun", true).Logger()
+	}
+
+	startTime := time.Now()
+	logger.Info().Str("archives", args.Archives).Msg("starting reindex")
+	defer func() {
+		tookSeconds := time.Since(startTime).Seconds()
+		if ctx.Err() != nil {
+			logger.Info().Float64("seconds", tookSeconds).Msg("reindex cancelled")
+		} else {
+			logger.Info().Float64("seconds", tookSeconds).Msg("reindex done")
+		}
+	}()
+
+	password, err := readPassword(args.PasswordFile, args.PasswordEnv)
+	if err != nil {
+		return err
+	}
+
+	dbCli, err := newSQLite(args.Database, logger)
+	if err != nil {
+		return err
+	}
+
+	db := &database.Database{
+		Cli:    dbCli,
+		Logger: logger,
+		DryRun: args.DryRun,
+	}
+
+	return reindexArchives(ctx, reindexParams{
+		archivesPath: args.Archives,
+		sourcePath:   args.Source,
+		password:     password,
+		dryRun:       args.DryRun,
+		db:           db,
+		logger:       logger,
+	})
+}
+
+type reindexParams struct {
+	archivesPath string
+	sourcePath   string
+	password     []byte // Nil if the archives aren't encrypted.
+	dryRun       bool
+	db           *database.Database
+	logger       zerolog.Logger
+}
+
+// Register the archives of a directory that are missing from the database.
+func reindexArchives(ctx context.Context, p reindexParams) error {
+	entries, err := os.ReadDir(p.archivesPath)
+	if err != nil {
+		return fmt.Errorf("could not read archives directory: %w", err)
+	}
+
+	var archives []*ziparchiver.IndexedArchive
+	var failed []string
+	var skipped int
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if e.IsDir() || !ziparchiver.IsArchiveFile(e.Name()) {
+			continue
+		}
+
+		path := filepath.Join(p.archivesPath, e.Name())
+		logger := p.logger.With().Str("path", path).Logger()
+
+		registered, err := p.db.HasArchive(ctx, path)
+		if err != nil {
+			return err
+		}
+		if registered {
+			logger.Debug().Msg("archive already registered, skipping")
+			skipped++
+			continue
+		}
+
+		archive, err := ziparchiver.ReadArchiveIndex(path, p.sourcePath, ziparchiver.WithPassword(p.password))
+		if err != nil {
+			logger.Error().Err(err).Msg("could not read archive")
+			failed = append(failed, path)
+			continue
+		}
+		if !archive.Embedded {
+			logger.Warn().Str("source", archive.Manifest.SourcePath).Msg("archive has no manifest, indexed from its contents")
+		}
+		archives = append(archives, archive)
+	}
+
+	// Register in creation order, so the latest version of each file is found.
+	slices.SortStableFunc(archives, func(a, b *ziparchiver.IndexedArchive) int {
+		if c := a.Manifest.CreatedAt.Compare(b.Manifest.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	var indexed int
+	for _, archive := range archives {
+		if ctx.Err() != nil {
+			return nil
+		}
+		logger := p.logger.With().
+			Str("path", archive.Path).
+			Str("source", archive.Manifest.SourcePath).
+			Time("created_at", archive.Manifest.CreatedAt).
+			Logger()
+
+		if p.dryRun {
+			logger.Info().Int("assets", len(archive.Manifest.Entries)).Msg("found archive to index")
+			indexed++
+			continue
+		}
+
+		src, err := p.db.GetSource(ctx, archive.Manifest.SourcePath)
+		if err != nil {
+			return err
+		}
+		count, err := src.RegisterArchive(ctx, archive.Path, archive.Manifest.CreatedAt, archive.Assets())
+		if err != nil {
+			logger.Error().Err(err).Msg("could not register archive")
+			failed = append(failed, archive.Path)
+			continue
+		}
+		logger.Info().Int("assets", count).Msg("indexed archive")
+		indexed++
+	}
+
+	p.logger.Info().
+		Int("indexed", indexed).
+		Int("skipped", skipped).
+		Int("failed", len(failed)).
+		Msg("done indexing archives")
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not index %d archives: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
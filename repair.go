@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/database"
+	"github.com/stupid-simple/backup/fileutils"
+	"github.com/stupid-simple/backup/parity"
+)
+
+func repairCommand(ctx context.Context, args RepairCommand, logger zerolog.Logger) error {
+	if args.DryRun {
+		logger = logger.With().Bool("dryrun", true).Logger()
+	}
+	archivePath, err := filepath.Abs(args.Archive)
+	if err != nil {
+		return err
+	}
+	logger = logger.With().Str("archive", archivePath).Logger()
+
+	startTime := time.Now()
+	logger.Info().Msg("starting repair")
+	defer func() {
+		tookSeconds := time.Since(startTime).Seconds()
+		if ctx.Err() != nil {
+			logger.Info().Float64("seconds", tookSeconds).Msg("repair cancelled")
+		} else {
+			logger.Info().Float64("seconds", tookSeconds).Msg("repair done")
+		}
+	}()
+
+	// The parity file is next to the archive, so archives copied off the
+	// machine can be repaired without the database.
+	parityPath := parity.PathOf(archivePath)
+	if !fileutils.Exists(parityPath) {
+		return fmt.Errorf("archive has no parity file: %s", archivePath)
+	}
+
+	var src *database.BackupSource
+	var archive *database.Archive
+	if args.Database != "" {
+		src, archive, err = findRepairedArchive(ctx, args, archivePath, logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	var report *parity.Report
+	if args.DryRun {
+		report, err = parity.Verify(ctx, archivePath, parityPath)
+	} else {
+		report, err = parity.Repair(ctx, archivePath, parityPath)
+	}
+	if report != nil {
+		logger.Info().
+			Int64("blocks", report.Blocks).
+			Int("damaged_blocks", len(report.DamagedBlocks)).
+			Int("damaged_parity", report.DamagedParity).
+			Bool("size_mismatch", report.SizeMismatch).
+			Bool("repairable", report.Repairable).
+			Msg("checked archive against its parity file")
+	}
+	if err != nil {
+		return err
+	}
+	if report.OK() {
+		logger.Info().Msg("archive is not damaged")
+		return nil
+	}
+	if args.DryRun {
+		if !report.Repairable {
+			return fmt.Errorf("too many damaged blocks to repair the archive")
+		}
+		logger.Info().Msg("would repair archive (dry run)")
+		return nil
+	}
+
+	// Assets found damaged by a scrub can be restored from the archive again.
+	if src != nil {
+		if err := src.MarkRepaired(ctx, archive.Path); err != nil {
+			return err
+		}
+	}
+	logger.Info().Msg("repaired archive")
+	return nil
+}
+
+// Find the archive to repair in the database, by its absolute path or the path
+// as given. Returns nil if it isn't registered.
+func findRepairedArchive(
+	ctx context.Context,
+	args RepairCommand,
+	archivePath string,
+	logger zerolog.Logger,
+) (*database.BackupSource, *database.Archive, error) {
+	dbCli, err := newSQLite(args.Database, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	db := &database.Database{
+		Cli:    dbCli,
+		Logger: logger,
+		DryRun: args.DryRun,
+	}
+
+	for _, path := range []string{archivePath, args.Archive} {
+		archive, err := db.GetArchive(ctx, path)
+		if errors.Is(err, database.ErrArchiveNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		src, err := db.GetSource(ctx, archive.SourcePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return src, archive, nil
+	}
+	logger.Warn().Msg("archive not found in the database, the repair won't be recorded")
+	return nil, nil, nil
+}
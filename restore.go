@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
+	"path/filepath"
 	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/config"
 	"github.com/stupid-simple/backup/database"
+	"github.com/stupid-simple/backup/signing"
 	"github.com/stupid-simple/backup/ziparchiver"
 )
 
@@ -19,10 +23,32 @@ func restoreCommand(ctx context.Context, args RestoreCommand, logger zerolog.Log
 		return fmt.Errorf("must specify database")
 	}
 
-	destPath := args.Dest
+	if err := database.ValidatePathPatterns(args.Include); err != nil {
+		return err
+	}
+	if err := database.ValidatePathPatterns(args.Exclude); err != nil {
+		return err
+	}
+	if args.Snapshot != 0 && !args.AsOf.IsZero() {
+		return fmt.Errorf("can't restore both a snapshot and as of a time")
+	}
+	if args.Path != "" && !filepath.IsLocal(args.Path) {
+		return fmt.Errorf("path must be relative to the source directory: %s", args.Path)
+	}
+
+	srcPath := args.Source
+	if args.Dest != "" {
+		// Before --target, files were restored to the source directory given by --dest.
+		logger.Warn().Msg("--dest is deprecated, use --source, and --target to restore into another directory")
+		srcPath = args.Dest
+	}
+	destPath := srcPath
+	if args.Target != "" {
+		destPath = args.Target
+	}
 
 	startTime := time.Now()
-	logger.Info().Str("dest", destPath).Msg("starting restore")
+	logger.Info().Str("source", srcPath).Str("dest", destPath).Msg("starting restore")
 	defer func() {
 		tookSeconds := time.Since(startTime).Seconds()
 		if ctx.Err() != nil {
@@ -43,20 +69,94 @@ func restoreCommand(ctx context.Context, args RestoreCommand, logger zerolog.Log
 		DryRun: args.DryRun,
 	}
 
-	restoreDest, err := db.GetSource(ctx, args.Dest)
+	restoreSource, err := db.GetSource(ctx, srcPath)
 	if err != nil {
 		return err
 	}
 
-	assets, err := restoreDest.FindArchivedAssets(ctx)
+	asOf := args.AsOf
+	if args.Snapshot != 0 {
+		snapshot, err := restoreSource.FindSnapshot(ctx, args.Snapshot)
+		if err != nil {
+			return err
+		}
+		logger = logger.With().Uint("snapshot", snapshot.ID).Logger()
+		asOf = snapshot.CreatedAt
+	}
+
+	findOpts := []database.FindArchivedAssetsOptions{}
+	if !asOf.IsZero() {
+		logger = logger.With().Time("as_of", asOf).Logger()
+		findOpts = append(findOpts, database.WithFindArchivedAssetsAsOf(asOf))
+	}
+	if args.IncludeDeleted {
+		logger = logger.With().Bool("include_deleted", true).Logger()
+		findOpts = append(findOpts, database.WithFindArchivedAssetsIncludeDeleted(true))
+	}
+
+	if args.Path != "" {
+		logger = logger.With().Str("path", args.Path).Logger()
+		findOpts = append(findOpts, database.WithFindArchivedAssetsPathPrefix(args.Path))
+	}
+	if len(args.Include) > 0 || len(args.Exclude) > 0 {
+		logger = logger.With().Strs("include", args.Include).Strs("exclude", args.Exclude).Logger()
+		findOpts = append(findOpts, database.WithFindArchivedAssetsMatch(args.Include, args.Exclude))
+	}
+
+	assets, err := restoreSource.FindArchivedAssets(ctx, findOpts...)
 	if err != nil {
 		return err
 	}
 
+	restoreOpts := []ziparchiver.RestoreOption{
+		ziparchiver.WithRestoreDryRun(args.DryRun),
+		ziparchiver.WithRestoreConflictPolicy(ziparchiver.ConflictPolicy(args.OnConflict)),
+	}
+	if args.Target != "" {
+		restoreOpts = append(restoreOpts, ziparchiver.WithRestoreTargetDir(args.Target))
+	}
+	publicKey, err := restorePublicKey(args, srcPath)
+	if err != nil {
+		return err
+	}
+	if publicKey != nil {
+		restoreOpts = append(restoreOpts, ziparchiver.WithRestorePublicKey(publicKey))
+	}
+	password, err := readPassword(args.PasswordFile, args.PasswordEnv)
+	if err != nil {
+		return err
+	}
+	restoreOpts = append(restoreOpts, ziparchiver.WithRestorePassword(password))
+
 	return ziparchiver.Restore(
 		ctx,
 		assets,
 		logger.With().Str("dest", destPath).Logger(),
-		ziparchiver.WithRestoreDryRun(args.DryRun),
+		restoreOpts...,
 	)
 }
+
+// The public key checking the signature of the archives: the one given, or else
+// the one of the signing key of the source in the config file, if any.
+func restorePublicKey(args RestoreCommand, srcPath string) (ed25519.PublicKey, error) {
+	if args.PublicKey != "" {
+		return signing.LoadPublicKey(args.PublicKey)
+	}
+	if args.Config == "" {
+		return nil, nil
+	}
+	cfg, err := config.LoadFromFile(args.Config)
+	if err != nil {
+		return nil, fmt.Errorf("could not load config: %w", err)
+	}
+	for _, source := range cfg.Sources {
+		if filepath.Clean(source.SourceDir) != filepath.Clean(srcPath) {
+			continue
+		}
+		if source.SigningKey == "" {
+			return nil, nil
+		}
+		return signing.LoadPublicKey(source.SigningKey)
+	}
+	return nil, fmt.Errorf("source not found in config: %s", srcPath)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/database"
+)
+
+func runsCommand(ctx context.Context, args RunsCommand, logger zerolog.Logger) error {
+	dbCli, err := newSQLite(args.Database, logger)
+	if err != nil {
+		return err
+	}
+
+	db := &database.Database{
+		Cli:    dbCli,
+		Logger: logger,
+	}
+
+	findOpts := []database.FindBackupRunsOptions{}
+	if args.Source != "" {
+		findOpts = append(findOpts, database.WithFindBackupRunsSource(args.Source))
+	}
+	if !args.Since.IsZero() {
+		findOpts = append(findOpts, database.WithFindBackupRunsSince(args.Since))
+	}
+
+	runs, err := db.FindBackupRuns(ctx, findOpts...)
+	if err != nil {
+		return err
+	}
+
+	if args.Format == "json" {
+		return writeRunsJSON(os.Stdout, runs)
+	}
+	return writeRunsTable(os.Stdout, runs)
+}
+
+type runOutput struct {
+	ID         uint                     `json:"id"`
+	Source     string                   `json:"source"`
+	Trigger    string                   `json:"trigger"`
+	StartedAt  time.Time                `json:"started_at"`
+	FinishedAt *time.Time               `json:"finished_at,omitempty"`
+	Seconds    float64                  `json:"seconds"`
+	Status     database.BackupRunStatus `json:"status"`
+	Error      string                   `json:"error,omitempty"`
+	Scanned    int                      `json:"scanned"`
+	New        int                      `json:"new"`
+	Modified   int                      `json:"modified"`
+	Moved      int                      `json:"moved"`
+	Repaired   int                      `json:"repaired"`
+	Unchanged  int                      `json:"unchanged"`
+	Skipped    int                      `json:"skipped"`
+	Stored     int                      `json:"stored"`
+	Deleted    int                      `json:"deleted"`
+	Size       int64                    `json:"size"`
+	Written    int64                    `json:"written"`
+	SnapshotID *uint                    `json:"snapshot_id,omitempty"`
+}
+
+func writeRunsJSON(w io.Writer, runs []database.BackupRun) error {
+	out := make([]runOutput, 0, len(runs))
+	for _, r := range runs {
+		o := runOutput{
+			ID:         r.ID,
+			Source:     r.SourcePath,
+			Trigger:    r.Trigger,
+			StartedAt:  r.StartedAt,
+			Seconds:    r.Duration().Seconds(),
+			Status:     r.Status,
+			Error:      r.Error,
+			Scanned:    r.Scanned,
+			New:        r.New,
+			Modified:   r.Modified,
+			Moved:      r.Moved,
+			Repaired:   r.Repaired,
+			Unchanged:  r.Unchanged,
+			Skipped:    r.Skipped,
+			Stored:     r.Stored,
+			Deleted:    r.Deleted,
+			Size:       r.Size,
+			Written:    r.Written,
+			SnapshotID: r.SnapshotID,
+		}
+		if !r.FinishedAt.IsZero() {
+			o.FinishedAt = &r.FinishedAt
+		}
+		out = append(out, o)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func writeRunsTable(w io.Writer, runs []database.BackupRun) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSOURCE\tTRIGGER\tSTARTED\tDURATION\tSTATUS\tNEW\tMODIFIED\tMOVED\tUNCHANGED\tSKIPPED\tDELETED\tWRITTEN\tERROR")
+	for _, r := range runs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			r.ID,
+			r.SourcePath,
+			r.Trigger,
+			r.StartedAt.Local().Format(time.RFC3339),
+			r.Duration().Round(time.Second),
+			r.Status,
+			r.New,
+			r.Modified,
+			r.Moved,
+			r.Unchanged,
+			r.Skipped,
+			r.Deleted,
+			r.Written,
+			r.Error,
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/database"
+	"github.com/stupid-simple/backup/ziparchiver"
+)
+
+// Share of the archives scrubbed by each run when no budget is configured.
+const defaultScrubPercent = 5
+
+type scrubParams struct {
+	sourcePath string
+	percent    float64           // Share of the archives scrubbed, zero for no limit.
+	maxBytes   int64             // Archived bytes scrubbed, zero for no limit.
+	publicKey  ed25519.PublicKey // Nil to not check the signatures of the archives.
+	password   []byte            // Nil to skip the encrypted archives.
+	db         *database.Database
+	logger     zerolog.Logger
+}
+
+// Read back the next archives of the source and record the assets whose
+// contents are damaged. The next backup archives them again.
+func scrubArchives(ctx context.Context, p scrubParams) error {
+	startTime := time.Now()
+	p.logger.Info().Str("source", p.sourcePath).Msg("starting scrub")
+	defer func() {
+		tookSeconds := time.Since(startTime).Seconds()
+		if ctx.Err() != nil {
+			p.logger.Info().Str("source", p.sourcePath).Float64("seconds", tookSeconds).Msg("scrub cancelled")
+		} else {
+			p.logger.Info().Str("source", p.sourcePath).Float64("seconds", tookSeconds).Msg("scrub done")
+		}
+	}()
+
+	src, err := p.db.GetSource(ctx, p.sourcePath)
+	if err != nil {
+		return err
+	}
+
+	archives, err := src.FindArchivesToScrub(ctx, p.percent, p.maxBytes)
+	if err != nil {
+		return err
+	}
+
+	var damaged, parityProblems, signatureProblems, scrubbed int
+	for _, archive := range archives {
+		logger := p.logger.With().Str("archive", archive.Path).Logger()
+		if archive.Encrypted && p.password == nil {
+			logger.Warn().Msg("archive is encrypted and the source has no password, skipping")
+			continue
+		}
+		assets, err := src.FindArchiveAssets(ctx, archive.Path)
+		if err != nil {
+			return err
+		}
+		report, err := ziparchiver.Verify(ctx, slices.Values(assets), logger, ziparchiver.WithVerifyDeep(true), ziparchiver.WithVerifyPassword(p.password))
+		if err != nil {
+			return err
+		}
+		if archive.ParityPath != "" {
+			problems := ziparchiver.VerifyParity(ctx, archive.Path, archive.ParityPath, logger)
+			if len(problems) > 0 {
+				logger.Error().Msg("archive or parity file damaged, run ssbak repair on the archive")
+			}
+			parityProblems += len(problems)
+		}
+		if p.publicKey != nil {
+			signatureProblems += len(ziparchiver.VerifySignature(archive.Path, p.publicKey, logger))
+		}
+		// Partially read archives are scrubbed again next time.
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		paths := make([]string, 0, len(report.Damaged))
+		for _, a := range report.Damaged {
+			paths = append(paths, a.Path())
+		}
+		if err := src.MarkScrubbed(ctx, archive.Path, paths); err != nil {
+			return err
+		}
+		if len(paths) > 0 {
+			logger.Error().Int("damaged", len(paths)).Msg("damaged assets will be archived again by the next backup")
+		}
+		damaged += len(paths)
+		scrubbed++
+	}
+
+	p.logger.Info().Str("source", p.sourcePath).Int("archives", scrubbed).Int("damaged", damaged).Int("parity_problems", parityProblems).Int("signature_problems", signatureProblems).Msg("scrubbed archives")
+	return nil
+}
+
+// Validate the scrub budget of a source. The default one is used if none is set.
+func scrubBudget(percent float64, maxBytes int64) (float64, int64, error) {
+	if percent < 0 || percent > 100 {
+		return 0, 0, fmt.Errorf("scrub percent must be more than 0 and at most 100")
+	}
+	if maxBytes < 0 {
+		return 0, 0, fmt.Errorf("scrub max size must be positive")
+	}
+	if percent == 0 && maxBytes == 0 {
+		percent = defaultScrubPercent
+	}
+	return percent, maxBytes, nil
+}
+
+type scrubJob struct {
+	ctx    context.Context
+	params scrubParams
+}
+
+func (s *scrubJob) Run() {
+	err := scrubArchives(s.ctx, s.params)
+	if err != nil {
+		s.params.logger.Error().Err(err).Str("source", s.params.sourcePath).Msg("scrub job failed")
+	}
+}
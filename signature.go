@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/signing"
+	"github.com/stupid-simple/backup/ziparchiver"
+)
+
+// Check the signatures of archives, with the public key only. Archives can be
+// checked wherever they were copied, without the database.
+func checkSignatureCommand(args CheckSignatureCommand, logger zerolog.Logger) error {
+	publicKey, err := signing.LoadPublicKey(args.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	var problems []ziparchiver.Problem
+	for _, archivePath := range args.Archives {
+		if _, err := os.Stat(archivePath); err != nil {
+			problem := ziparchiver.Problem{Kind: ziparchiver.ProblemMissingArchive, ArchivePath: archivePath, Err: err}
+			logger.Error().Object("problem", problem).Msg("archive problem found")
+			problems = append(problems, problem)
+			continue
+		}
+		problems = append(problems, ziparchiver.VerifySignature(archivePath, publicKey, logger)...)
+	}
+	logger.Info().Int("archives", len(args.Archives)).Int("problems", len(problems)).Msg("checked signatures")
+
+	if err := writeProblems(os.Stdout, problems); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems in the signatures", len(problems))
+	}
+	return nil
+}
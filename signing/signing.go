@@ -0,0 +1,236 @@
+// Package signing signs archives with ed25519 keys, in detached signature
+// files written next to them. The public key is enough to check that an
+// archive wasn't modified since it was signed.
+//
+// Archives are signed with Ed25519ph, over the SHA-512 hash of their contents,
+// so they are read once without being held in memory.
+package signing
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Suffix of the signature file of an archive.
+const Suffix = ".sig"
+
+// Suffix of the public key file written next to a private key.
+const PublicKeySuffix = ".pub"
+
+const (
+	signatureType = "SSBAK SIGNATURE"
+	algorithm     = "Ed25519ph"
+	// Separates the archive signatures from other uses of the keys.
+	signatureContext = "ssbak archive"
+)
+
+var (
+	ErrMissingSignature = errors.New("missing signature")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// Path of the signature file of the archive.
+func PathOf(archivePath string) string {
+	return archivePath + Suffix
+}
+
+// Generate a key pair. The private key is written to privatePath, readable by
+// the owner only, and the public key next to it with PublicKeySuffix. Existing
+// files are not overwritten. Returns the path of the public key.
+func GenerateKey(privatePath string) (string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	publicPath := privatePath + PublicKeySuffix
+	if _, err := os.Stat(publicPath); err == nil {
+		return "", fmt.Errorf("public key file already exists: %s", publicPath)
+	}
+	if err := writeNewFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600); err != nil {
+		return "", err
+	}
+	if err := writeNewFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644); err != nil {
+		_ = os.Remove(privatePath)
+		return "", err
+	}
+	return publicPath, nil
+}
+
+func writeNewFile(path string, content []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+// Load a PEM encoded ed25519 private key, as written by GenerateKey.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s is not a private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse private key %s: %w", path, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+	return privateKey, nil
+}
+
+// Load a PEM encoded ed25519 public key, as written by GenerateKey. The public
+// key of a private key file is loaded too.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "PRIVATE KEY" {
+		privateKey, err := LoadPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		return privateKey.Public().(ed25519.PublicKey), nil
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s is not a public key", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse public key %s: %w", path, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+	return publicKey, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM encoded key", path)
+	}
+	return block, nil
+}
+
+// Sign the archive, writing its signature file next to it.
+func Sign(archivePath string, key ed25519.PrivateKey) error {
+	digest, err := hashFile(archivePath)
+	if err != nil {
+		return err
+	}
+	signature, err := key.Sign(nil, digest, signerOptions())
+	if err != nil {
+		return err
+	}
+
+	publicKey := key.Public().(ed25519.PublicKey)
+	content := pem.EncodeToMemory(&pem.Block{
+		Type: signatureType,
+		Headers: map[string]string{
+			"Algorithm":  algorithm,
+			"Public-Key": base64.StdEncoding.EncodeToString(publicKey),
+		},
+		Bytes: signature,
+	})
+
+	// Replace any previous signature at once.
+	tmpPath := PathOf(archivePath) + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, PathOf(archivePath)); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// Check the signature file of the archive with the public key. Returns
+// ErrMissingSignature if the archive has none, and ErrInvalidSignature if it
+// doesn't match the archive or was made with another key.
+func Verify(archivePath string, key ed25519.PublicKey) error {
+	// A missing archive is reported before its signature.
+	digest, err := hashFile(archivePath)
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(PathOf(archivePath))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrMissingSignature
+	} else if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != signatureType {
+		return fmt.Errorf("%w: not a signature file", ErrInvalidSignature)
+	}
+	if block.Headers["Algorithm"] != algorithm {
+		return fmt.Errorf("%w: unknown algorithm %q", ErrInvalidSignature, block.Headers["Algorithm"])
+	}
+	signer, err := base64.StdEncoding.DecodeString(block.Headers["Public-Key"])
+	if err != nil || !bytes.Equal(signer, key) {
+		return fmt.Errorf("%w: signed with another key", ErrInvalidSignature)
+	}
+	if err := ed25519.VerifyWithOptions(key, digest, block.Bytes, signerOptions()); err != nil {
+		return fmt.Errorf("%w: archive modified since it was signed", ErrInvalidSignature)
+	}
+	return nil
+}
+
+func signerOptions() *ed25519.Options {
+	return &ed25519.Options{Hash: crypto.SHA512, Context: signatureContext}
+}
+
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := sha512.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
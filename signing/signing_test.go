@@ -0,0 +1,81 @@
+package signing_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stupid-simple/backup/signing"
+)
+
+func generateKey(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ssbak.key")
+	publicPath, err := signing.GenerateKey(path)
+	require.NoError(t, err)
+	assert.Equal(t, path+signing.PublicKeySuffix, publicPath)
+	return path
+}
+
+func TestGenerateKey(t *testing.T) {
+	path := generateKey(t)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	privateKey, err := signing.LoadPrivateKey(path)
+	require.NoError(t, err)
+	publicKey, err := signing.LoadPublicKey(path + signing.PublicKeySuffix)
+	require.NoError(t, err)
+	assert.Equal(t, privateKey.Public(), publicKey)
+
+	// The public key of a private key file.
+	fromPrivate, err := signing.LoadPublicKey(path)
+	require.NoError(t, err)
+	assert.Equal(t, publicKey, fromPrivate)
+
+	_, err = signing.LoadPrivateKey(path + signing.PublicKeySuffix)
+	assert.Error(t, err)
+
+	// Existing keys are not overwritten.
+	_, err = signing.GenerateKey(path)
+	assert.Error(t, err)
+}
+
+func TestSignAndVerify(t *testing.T) {
+	keyPath := generateKey(t)
+	privateKey, err := signing.LoadPrivateKey(keyPath)
+	require.NoError(t, err)
+	publicKey, err := signing.LoadPublicKey(keyPath + signing.PublicKeySuffix)
+	require.NoError(t, err)
+
+	archivePath := filepath.Join(t.TempDir(), "backup.zip")
+	require.NoError(t, os.WriteFile(archivePath, []byte("archive contents"), 0644))
+
+	assert.ErrorIs(t, signing.Verify(archivePath, publicKey), signing.ErrMissingSignature)
+
+	require.NoError(t, signing.Sign(archivePath, privateKey))
+	assert.FileExists(t, signing.PathOf(archivePath))
+	require.NoError(t, signing.Verify(archivePath, publicKey))
+
+	// Signed with another key.
+	otherPublicKey, err := signing.LoadPublicKey(generateKey(t))
+	require.NoError(t, err)
+	assert.ErrorIs(t, signing.Verify(archivePath, otherPublicKey), signing.ErrInvalidSignature)
+
+	// Modified archive.
+	require.NoError(t, os.WriteFile(archivePath, []byte("archive Contents"), 0644))
+	assert.ErrorIs(t, signing.Verify(archivePath, publicKey), signing.ErrInvalidSignature)
+
+	// Corrupted signature file.
+	require.NoError(t, os.WriteFile(signing.PathOf(archivePath), []byte("not a signature"), 0644))
+	assert.ErrorIs(t, signing.Verify(archivePath, publicKey), signing.ErrInvalidSignature)
+
+	// A missing archive isn't a signature problem.
+	require.NoError(t, os.Remove(archivePath))
+	err = signing.Verify(archivePath, publicKey)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/config"
+	"github.com/stupid-simple/backup/database"
+)
+
+// Sources failing this many times in a row are reported, even if they are not stale yet.
+const maxConsecutiveFailures = 3
+
+func statusCommand(ctx context.Context, args StatusCommand, logger zerolog.Logger) error {
+	cfg, err := config.LoadFromFile(args.Config)
+	if err != nil {
+		return fmt.Errorf("could not load config: %w", err)
+	}
+
+	dbCli, err := newSQLite(args.Database, logger)
+	if err != nil {
+		return err
+	}
+
+	db := &database.Database{
+		Cli:    dbCli,
+		Logger: logger,
+	}
+
+	health, err := checkSources(ctx, cfg, db, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if args.Format == "json" {
+		err = writeHealthJSON(os.Stdout, health)
+	} else {
+		err = writeHealthTable(os.Stdout, health)
+	}
+	if err != nil {
+		return err
+	}
+
+	var unhealthy int
+	for _, h := range health {
+		if !h.healthy() {
+			unhealthy++
+		}
+	}
+	if unhealthy > 0 {
+		return fmt.Errorf("%d of %d sources are stale or failing", unhealthy, len(health))
+	}
+	return nil
+}
+
+// Freshness of the backups of a configured source.
+type sourceHealth struct {
+	source  string
+	maxAge  time.Duration
+	age     time.Duration // Since the last successful backup, if any.
+	status  database.BackupStatus
+	stale   bool // Not backed up successfully within its max age.
+	failing bool // Failed too many times since its last successful backup.
+}
+
+func (h sourceHealth) healthy() bool {
+	return !h.stale && !h.failing
+}
+
+func (h sourceHealth) state() string {
+	switch {
+	case h.stale:
+		return "stale"
+	case h.failing:
+		return "failing"
+	default:
+		return "ok"
+	}
+}
+
+// Check the backups of the enabled sources of the config.
+func checkSources(ctx context.Context, cfg *config.Config, db *database.Database, now time.Time) ([]sourceHealth, error) {
+	var health []sourceHealth
+	for _, source := range cfg.Sources {
+		if !source.Enable || source.SourceDir == "" {
+			continue
+		}
+		status, err := db.GetBackupStatus(ctx, source.SourceDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not get backup status of %s: %w", source.SourceDir, err)
+		}
+
+		h := sourceHealth{
+			source:  source.SourceDir,
+			maxAge:  source.MaxAge.Duration,
+			status:  status,
+			failing: status.Failures >= maxConsecutiveFailures,
+		}
+		if !status.LastSuccess.IsZero() {
+			h.age = now.Sub(status.LastSuccess)
+		}
+		h.stale = h.maxAge > 0 && (status.LastSuccess.IsZero() || h.age > h.maxAge)
+		health = append(health, h)
+	}
+	return health, nil
+}
+
+// Log an error for each source that is stale or failing.
+func logSourceHealth(health []sourceHealth, logger zerolog.Logger) {
+	for _, h := range health {
+		if h.healthy() {
+			logger.Debug().Str("source", h.source).Time("last_success", h.status.LastSuccess).Msg("source backups are up to date")
+			continue
+		}
+		e := logger.Error().
+			Str("source", h.source).
+			Str("state", h.state()).
+			Int("failures", h.status.Failures)
+		if h.status.LastSuccess.IsZero() {
+			e = e.Bool("never_backed_up", true)
+		} else {
+			e = e.Time("last_success", h.status.LastSuccess).Dur("age", h.age)
+		}
+		if h.maxAge > 0 {
+			e = e.Dur("max_age", h.maxAge)
+		}
+		if h.status.LastRun != nil && h.status.LastRun.Error != "" {
+			e = e.Str("last_error", h.status.LastRun.Error)
+		}
+		e.Msg("source backups are stale or failing")
+	}
+}
+
+// Check the sources at every interval until the context is done. The config
+// can change in the meantime.
+func startHealthChecks(ctx context.Context, interval time.Duration, getConfig func() *config.Config, db *database.Database, logger zerolog.Logger) {
+	check := func() {
+		health, err := checkSources(ctx, getConfig(), db, time.Now())
+		if err != nil {
+			logger.Error().Err(err).Msg("could not check sources")
+			return
+		}
+		logSourceHealth(health, logger)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		check()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+}
+
+type healthOutput struct {
+	Source        string     `json:"source"`
+	State         string     `json:"state"`
+	LastSuccess   *time.Time `json:"last_success,omitempty"`
+	AgeSeconds    float64    `json:"age_seconds,omitempty"`
+	MaxAgeSeconds float64    `json:"max_age_seconds,omitempty"`
+	Failures      int        `json:"failures"`
+	LastRunStatus string     `json:"last_run_status,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+func writeHealthJSON(w io.Writer, health []sourceHealth) error {
+	out := make([]healthOutput, 0, len(health))
+	for _, h := range health {
+		o := healthOutput{
+			Source:        h.source,
+			State:         h.state(),
+			AgeSeconds:    h.age.Seconds(),
+			MaxAgeSeconds: h.maxAge.Seconds(),
+			Failures:      h.status.Failures,
+		}
+		if !h.status.LastSuccess.IsZero() {
+			o.LastSuccess = &h.status.LastSuccess
+		}
+		if h.status.LastRun != nil {
+			o.LastRunStatus = string(h.status.LastRun.Status)
+			o.LastError = h.status.LastRun.Error
+		}
+		out = append(out, o)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func writeHealthTable(w io.Writer, health []sourceHealth) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tSTATE\tLAST SUCCESS\tAGE\tMAX AGE\tFAILURES\tLAST RUN\tLAST ERROR")
+	for _, h := range health {
+		lastSuccess, age := "never", "-"
+		if !h.status.LastSuccess.IsZero() {
+			lastSuccess = h.status.LastSuccess.Local().Format(time.RFC3339)
+			age = h.age.Round(time.Minute).String()
+		}
+		maxAge := "-"
+		if h.maxAge > 0 {
+			maxAge = h.maxAge.String()
+		}
+		lastRun, lastError := "-", ""
+		if h.status.LastRun != nil {
+			lastRun = string(h.status.LastRun.Status)
+			lastError = h.status.LastRun.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			h.source, h.state(), lastSuccess, age, maxAge, h.status.Failures, lastRun, lastError)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/database"
+	"github.com/stupid-simple/backup/signing"
+	"github.com/stupid-simple/backup/ziparchiver"
+)
+
+func verifyCommand(ctx context.Context, args VerifyCommand, logger zerolog.Logger) error {
+	sample := 100.0
+	if args.Sample != "" {
+		var err error
+		sample, err = parsePercentage(args.Sample)
+		if err != nil {
+			return err
+		}
+	}
+
+	var publicKey ed25519.PublicKey
+	if args.PublicKey != "" {
+		var err error
+		publicKey, err = signing.LoadPublicKey(args.PublicKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	password, err := readPassword(args.PasswordFile, args.PasswordEnv)
+	if err != nil {
+		return err
+	}
+
+	startTime := time.Now()
+	logger.Info().Float64("sample", sample).Bool("deep", args.Deep).Bool("signatures", publicKey != nil).Msg("starting verify")
+	defer func() {
+		tookSeconds := time.Since(startTime).Seconds()
+		if ctx.Err() != nil {
+			logger.Info().Float64("seconds", tookSeconds).Msg("verify cancelled")
+		} else {
+			logger.Info().Float64("seconds", tookSeconds).Msg("verify done")
+		}
+	}()
+
+	dbCli, err := newSQLite(args.Database, logger)
+	if err != nil {
+		return err
+	}
+
+	db := &database.Database{
+		Cli:    dbCli,
+		Logger: logger,
+	}
+
+	sources, err := db.IterSources(ctx)
+	if err != nil {
+		return err
+	}
+
+	var problems []ziparchiver.Problem
+	var found bool
+	for src := range sources {
+		if args.Source != "" && src.Path() != args.Source {
+			continue
+		}
+		found = true
+		report, err := verifySource(ctx, src, sample, args.Deep, publicKey, password, logger.With().Str("source", src.Path()).Logger())
+		if err != nil {
+			return err
+		}
+		problems = append(problems, report.Problems...)
+	}
+	if args.Source != "" && !found {
+		return fmt.Errorf("source not found: %s", args.Source)
+	}
+
+	if err := writeProblems(os.Stdout, problems); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems in the archives", len(problems))
+	}
+	return nil
+}
+
+// Verify a sample of the archives of the source, in percent. Their signatures
+// are checked too if a public key is given. Encrypted archives are decrypted
+// with the password.
+func verifySource(ctx context.Context, src *database.BackupSource, sample float64, deep bool, publicKey ed25519.PublicKey, password []byte, logger zerolog.Logger) (*ziparchiver.VerifyReport, error) {
+	archives, err := src.FindArchives(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var sampled []database.BackupArchive
+	for a := range archives {
+		sampled = append(sampled, a)
+	}
+	if sample < 100 {
+		rand.Shuffle(len(sampled), func(i, j int) {
+			sampled[i], sampled[j] = sampled[j], sampled[i]
+		})
+		sampled = sampled[:int(math.Ceil(float64(len(sampled))*sample/100))]
+	}
+	logger.Info().Int("archives", len(sampled)).Msg("verifying archives")
+
+	var archiveProblems []ziparchiver.Problem
+	var assets []asset.ArchivedAsset
+	for _, archive := range sampled {
+		if _, err := os.Stat(archive.Path); err != nil {
+			problem := ziparchiver.Problem{Kind: ziparchiver.ProblemMissingArchive, ArchivePath: archive.Path, Err: err}
+			logger.Error().Object("problem", problem).Msg("archive problem found")
+			archiveProblems = append(archiveProblems, problem)
+			continue
+		}
+		if archive.ParityPath != "" {
+			archiveProblems = append(archiveProblems, ziparchiver.VerifyParity(ctx, archive.Path, archive.ParityPath, logger)...)
+		}
+		if publicKey != nil {
+			archiveProblems = append(archiveProblems, ziparchiver.VerifySignature(archive.Path, publicKey, logger)...)
+		}
+		archiveAssets, err := src.FindArchiveAssets(ctx, archive.Path)
+		if err != nil {
+			return nil, err
+		}
+		assets = append(assets, archiveAssets...)
+	}
+
+	report, err := ziparchiver.Verify(ctx, slices.Values(assets), logger, ziparchiver.WithVerifyDeep(deep), ziparchiver.WithVerifyPassword(password))
+	if err != nil {
+		return nil, err
+	}
+	report.Problems = append(archiveProblems, report.Problems...)
+	return report, nil
+}
+
+// Parse a percentage like "5%" or "5". It must be more than 0 and at most 100.
+func parsePercentage(s string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || p <= 0 || p > 100 {
+		return 0, fmt.Errorf("invalid percentage %q, must be more than 0%% and at most 100%%", s)
+	}
+	return p, nil
+}
+
+func writeProblems(w io.Writer, problems []ziparchiver.Problem) error {
+	if len(problems) == 0 {
+		_, err := fmt.Fprintln(w, "no problems found")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROBLEM\tARCHIVE\tPATH\tERROR")
+	for _, p := range problems {
+		var cause string
+		if p.Err != nil {
+			cause = p.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p.Kind, p.ArchivePath, p.Path, cause)
+	}
+	return tw.Flush()
+}
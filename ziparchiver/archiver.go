@@ -1,18 +1,27 @@
 package ziparchiver
 
 import (
-	"archive/zip"
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"iter"
+	"maps"
+	"os"
 	"path/filepath"
-	"sync"
+	"slices"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/stupid-simple/backup/asset"
 	"github.com/stupid-simple/backup/fileutils"
+	"github.com/stupid-simple/backup/parity"
+	"github.com/stupid-simple/backup/signing"
 	"github.com/stupid-simple/backup/ziparchiver/zipwriter"
 )
 
@@ -29,7 +38,10 @@ func StoreAssets(
 	logger zerolog.Logger,
 	opts ...StoreOption,
 ) error {
-	o := storeOptions{}
+	o := storeOptions{
+		format:      FormatZip,
+		compression: Compression{Method: CompressionDeflate},
+	}
 	for _, applyOpts := range opts {
 		applyOpts(&o)
 	}
@@ -37,19 +49,36 @@ func StoreAssets(
 	logger = logger.With().Str("source", sourcePath).Str("dest", dest.Dir).Logger()
 	logger.Info().Msg("backing up assets")
 
-	var wg sync.WaitGroup
 	var storedAssets int
+	var stats compressionStats
 	defer func() {
-		wg.Wait()
+		if o.stats != nil {
+			*o.stats = Stats{Stored: storedAssets, Size: stats.size, Written: stats.compressedSize}
+		}
 		if ctx.Err() != nil {
 			logger.Info().Int("stored", storedAssets).Msg("cancelled backup")
 		} else if storedAssets == 0 {
 			logger.Info().Msg("no assets backed up")
 		} else {
-			logger.Info().Int("stored", storedAssets).Msg("done backing up assets")
+			logger.Info().
+				Int("stored", storedAssets).
+				Int64("files_size", stats.size).
+				Object("compression", stats).
+				Msg("done backing up assets")
 		}
 	}()
 
+	if _, err := fileutils.ParseHashAlgorithm(string(o.strongHash)); err != nil {
+		return err
+	}
+	if o.password != nil && o.format != FormatZip {
+		return fmt.Errorf("encryption is only supported by %s archives", FormatZip)
+	}
+
+	if !o.dryRun {
+		removePartialArchives(dest, logger)
+	}
+
 	if o.onlyNewAssets != nil {
 		var err error
 		assets, err = o.onlyNewAssets.FindMissingAssets(ctx, assets)
@@ -58,146 +87,525 @@ func StoreAssets(
 		}
 	}
 
-	var onArchived func(a asset.ArchivedAsset)
-	if o.registerAssets != nil {
-		storedCh := make(chan asset.ArchivedAsset)
-		defer close(storedCh)
-		onArchived = func(a asset.ArchivedAsset) {
-			storedCh <- a
-			storedAssets++
-		}
-
-		wg.Add(1)
-		go func() {
-			err := o.registerAssets.Register(ctx, iterChannel(ctx, storedCh))
+	// Assets are registered once their archive is complete, so the database
+	// never references an archive that could be truncated.
+	onArchived := func(archived []asset.ArchivedAsset, archiveStats compressionStats) error {
+		// Archives only holding parts of split files are registered with the asset.
+		if o.registerAssets != nil && len(archived) > 0 {
+			// The archive is already in place, record it even if the backup was cancelled.
+			err := o.registerAssets.Register(context.WithoutCancel(ctx), slices.Values(archived))
 			if err != nil {
-				logger.Error().Err(err).Msg("could not register backup assets")
-				// Drain the channel.
-				for range storedCh {
-				}
+				return fmt.Errorf("could not register backup assets: %w", err)
 			}
-			wg.Done()
-		}()
-	} else {
-		onArchived = func(asset.ArchivedAsset) {
-			storedAssets++
 		}
+		storedAssets += len(archived)
+		stats.add(archiveStats)
+		return nil
 	}
 
 	fullPrefix := filepath.Join(dest.Dir, fmt.Sprintf("%s%d", dest.Prefix, time.Now().UTC().UnixMilli()))
 
-	return writeAssetsToZip(ctx, sourcePath, fullPrefix, seqToReadableFileAssets(assets), onArchived, logger, writeOptions{
+	host, err := os.Hostname()
+	if err != nil {
+		logger.Warn().Err(err).Msg("could not get host name")
+	}
+
+	return writeAssetsToArchive(ctx, sourcePath, fullPrefix, seqToReadableFileAssets(assets), onArchived, logger, writeOptions{
+		format:            o.format,
 		dryRun:            o.dryRun,
 		maxFileBytes:      o.maxFileBytes,
 		includeLargeFiles: o.includeLargeFiles,
+		splitLargeFiles:   o.splitLargeFiles,
+		version:           o.version,
+		host:              host,
+		checksums:         o.checksums,
+		compression:       o.compression,
+		policy:            o.compressionPolicy,
+		workers:           o.workers,
+		findContent:       o.findContent,
+		parity:            o.parity,
+		strongHash:        o.strongHash,
+		signingKey:        o.signingKey,
+		password:          o.password,
 	})
 }
 
+// Removes the archives left incomplete by a backup that was interrupted. The
+// archives still being written by another backup to the same destination are
+// kept.
+func removePartialArchives(dest ArchiveDescriptor, logger zerolog.Logger) {
+	paths, err := findPartialArchives(dest.Dir, dest.Prefix)
+	if err != nil {
+		logger.Warn().Err(err).Msg("could not look for incomplete archives")
+		return
+	}
+	for _, path := range paths {
+		removed, err := fileutils.RemoveStalePartialFile(path)
+		if err != nil {
+			logger.Warn().Err(err).Str("path", path).Msg("could not remove incomplete archive")
+			continue
+		}
+		if removed {
+			logger.Warn().Str("path", path).Msg("removed incomplete archive from an interrupted backup")
+		}
+	}
+}
+
 type writeOptions struct {
+	format            Format
 	dryRun            bool
 	maxFileBytes      int64
 	includeLargeFiles bool
+	splitLargeFiles   bool
+	version           string
+	host              string
+	checksums         bool
+	compression       Compression
+	policy            *CompressionPolicy
+	workers           int
+	findContent       FindArchivedContent
+	parity            float64
+	strongHash        fileutils.HashAlgorithm
+	signingKey        ed25519.PrivateKey
+	password          []byte
+}
+
+// Identifies the contents of regular files.
+type contentKey struct {
+	hash       uint64
+	size       int64
+	strongHash string // Empty if not computed.
 }
 
-func writeAssetsToZip(
+func writeAssetsToArchive(
 	ctx context.Context,
 	sourcePath string,
 	fullPrefix string,
 	assets iter.Seq[readableAsset],
-	onArchived func(asset.ArchivedAsset),
+	onArchived func([]asset.ArchivedAsset, compressionStats) error,
 	logger zerolog.Logger,
 	o writeOptions,
 ) error {
-	var zipFile *zipwriter.ZipFile
-	zipFile = newZipFilePart(fullPrefix, 0, o.dryRun)
-	logger.Info().Str("path", zipFile.Path()).Msg("open archive")
+	w := newBackupWriter(ctx, sourcePath, fullPrefix, onArchived, logger, o)
 
-	var written int64
-	var storedAssets int
-	defer func() {
-		if err := zipFile.Close(); err != nil {
-			logger.Warn().Err(err).Msg("could not close backup file")
-		} else {
-			logger.Info().
-				Int64("files_size", written).
-				Int("files_count", storedAssets).
-				Msg("successfully written backup file")
-		}
-	}()
+	pending := pendingAssets(sourcePath, assets, o, logger)
+	if o.workers > 1 && o.format.compressesEntries() {
+		pending = compressInParallel(ctx, pending, w.policy, w.spoolDir, o)
+	}
 
-	var err error
-	var part int
-	for asset := range assets {
+	for p := range pending {
 		if ctx.Err() != nil {
-			return nil
+			break
 		}
-		if o.maxFileBytes > 0 && asset.Size() >= o.maxFileBytes && !o.includeLargeFiles {
-			logger.Warn().
-				Object("asset", asset).
-				Int64("max_size", o.maxFileBytes).
-				Msg("asset larger than max file size. Will be skipped")
-			continue
+		w.add(p)
+	}
+	return w.finish()
+}
+
+// backupWriter writes the assets of a backup to its archives, and opens a new
+// part once the current archive is full.
+type backupWriter struct {
+	ctx        context.Context
+	sourcePath string
+	fullPrefix string
+	onArchived func([]asset.ArchivedAsset, compressionStats) error
+	logger     zerolog.Logger
+	o          writeOptions
+	policy     *CompressionPolicy // Nil if the entries are all compressed, or all stored.
+	storeAll   bool
+	// Compresses the contents of the files to deduplicate before they are
+	// written, in spoolDir if they are large.
+	compressor *zipwriter.Compressor
+	spoolDir   string
+
+	// The archive being written, and what it holds.
+	archive  ArchiveWriter
+	part     int
+	manifest *Manifest
+	stats    compressionStats
+	archived []asset.ArchivedAsset
+	chunks   int // Parts of split files in the archive.
+
+	// Contents written during this backup, to store them once when deduplicating.
+	written map[contentKey]asset.ContentRef
+	// Errors of the archives that could not be completed or registered. The
+	// backup fails with them, unlike with the errors of single assets.
+	errs []error
+}
+
+func newBackupWriter(
+	ctx context.Context,
+	sourcePath string,
+	fullPrefix string,
+	onArchived func([]asset.ArchivedAsset, compressionStats) error,
+	logger zerolog.Logger,
+	o writeOptions,
+) *backupWriter {
+	w := &backupWriter{
+		ctx:        ctx,
+		sourcePath: sourcePath,
+		fullPrefix: fullPrefix,
+		onArchived: onArchived,
+		logger:     logger,
+		o:          o,
+		policy:     o.policy,
+		storeAll:   o.format.compressesEntries() && o.compression.Method == CompressionStore,
+		spoolDir:   filepath.Dir(fullPrefix),
+		written:    map[contentKey]asset.ContentRef{},
+	}
+	if o.findContent != nil {
+		w.compressor = zipwriter.NewCompressor(zipwriter.Compression{Level: o.compression.Level})
+	}
+	if !o.format.compressesEntries() || w.storeAll {
+		w.policy = nil
+	}
+	w.openArchive()
+	return w
+}
+
+// Start the archive of the current part.
+func (w *backupWriter) openArchive() {
+	w.archive = newArchivePart(w.fullPrefix, w.part, w.o)
+	w.manifest = &Manifest{
+		Version:    w.o.version,
+		SourcePath: w.sourcePath,
+		Host:       w.o.host,
+		CreatedAt:  time.Now().UTC(),
+	}
+	w.stats = compressionStats{}
+	w.archived = nil
+	w.chunks = 0
+	w.logger.Info().Str("path", w.archive.Path()).Int("part", w.part).Msg("open archive")
+}
+
+// Complete the archive being written and register its assets. Archives
+// holding nothing are discarded, and the ones that can't be completed removed.
+func (w *backupWriter) closeArchive() error {
+	path := w.archive.Path()
+	if len(w.archived) == 0 && w.chunks == 0 {
+		// Only holds parts of split files that failed, if anything.
+		if err := w.archive.Discard(); err != nil {
+			w.logger.Warn().Err(err).Str("path", path).Msg("could not remove backup file")
 		}
-		if o.maxFileBytes > 0 && written+asset.Size() >= o.maxFileBytes {
-			logger.Debug().
-				Int64("size", asset.Size()).
-				Msg("archive size larger than max file size. Will open a new file")
-			if err = zipFile.Close(); err != nil {
-				logger.Warn().Err(err).Msg("could not close backup file")
-			} else {
-				logger.Info().
-					Int64("files_size", written).
-					Int("files_count", storedAssets).
-					Msg("successfully written backup file")
+		return nil
+	}
+
+	if err := writeManifest(w.archive, w.manifest, w.o.checksums); err != nil {
+		w.forgetWritten(path)
+		return errors.Join(fmt.Errorf("could not write manifest of %s: %w", path, err), w.archive.Discard())
+	}
+	if err := w.archive.Close(); err != nil {
+		w.forgetWritten(path)
+		return fmt.Errorf("could not close %s: %w", path, err)
+	}
+	// The archive is complete without its signature and parity files, keep it if writing them fails.
+	var errs []error
+	if w.o.signingKey != nil && !w.o.dryRun {
+		if err := signing.Sign(path, w.o.signingKey); err != nil {
+			errs = append(errs, fmt.Errorf("could not sign %s: %w", path, err))
+		}
+	}
+	if w.o.parity > 0 && !w.o.dryRun {
+		if err := parity.Write(context.WithoutCancel(w.ctx), path, w.o.parity); err != nil {
+			errs = append(errs, fmt.Errorf("could not write parity file of %s: %w", path, err))
+		}
+	}
+	w.stats.compressedSize = w.archive.CompressedSize()
+	w.logger.Info().
+		Int64("files_size", w.stats.size).
+		Int("files_count", len(w.archived)).
+		Int("chunks", w.chunks).
+		Object("compression", w.stats).
+		Msg("successfully written backup file")
+	errs = append(errs, w.onArchived(w.archived, w.stats))
+	return errors.Join(errs...)
+}
+
+// Complete the archive being written and start the next part. The next part
+// is started even if the archive can't be completed, the error is kept for
+// the end of the backup.
+func (w *backupWriter) nextArchive() error {
+	err := w.closeArchive()
+	if err != nil {
+		w.logger.Error().Err(err).Msg("could not complete backup file")
+		w.errs = append(w.errs, err)
+	}
+	w.part++
+	w.openArchive()
+	return err
+}
+
+// Complete the last archive. Returns the errors of all the archives that could
+// not be completed or registered.
+func (w *backupWriter) finish() error {
+	if err := w.closeArchive(); err != nil {
+		w.logger.Error().Err(err).Msg("could not complete backup file")
+		w.errs = append(w.errs, err)
+	}
+	return errors.Join(w.errs...)
+}
+
+// Contents written to an archive that could not be completed can't be referenced.
+func (w *backupWriter) forgetWritten(archivePath string) {
+	maps.DeleteFunc(w.written, func(_ contentKey, ref asset.ContentRef) bool {
+		return ref.ArchivePath == archivePath
+	})
+}
+
+// Add an asset to the archives. Assets that can't be archived are logged and skipped.
+func (w *backupWriter) add(p *pendingAsset) {
+	w.logger.Debug().Str("relative_path", p.entry.Name).Msg("asset to archive")
+	// Contents compressed ahead of time are only kept until written.
+	defer p.release()
+
+	err := p.err
+	if err == nil && p.movedFrom != nil {
+		var moved *zipAsset
+		if sameEncryption(p.movedFrom, w.sourcePath, w.o.password != nil) {
+			moved, err = referenceMovedAsset(w.sourcePath, w.archive.Path(), p, w.o.dryRun)
+		} else {
+			w.logger.Debug().Object("asset", p.asset).Str("moved_from", p.movedFrom.Path()).
+				Msg("previous contents are not encrypted like the backup, archiving again")
+		}
+		if moved != nil {
+			w.logger.Info().Object("asset", moved).Str("moved_from", p.movedFrom.Path()).Msg("asset was moved, referenced")
+			w.stats.moved++
+			w.record(p, moved, "")
+			return
+		}
+		if err == nil {
+			// The contents are written again, like the ones of a new asset.
+			p.movedFrom = nil
+			var ok bool
+			p.split, ok = fitAsset(p.asset, w.o, w.logger)
+			if !ok {
+				return
 			}
+		}
+	}
+	if err == nil && w.o.findContent != nil && !p.split && !p.repair && p.asset.Attributes().Mode.IsRegular() {
+		if p.compressed == nil {
+			// The contents are hashed while compressed, so the file is only read once.
+			p.compressed, err = compressAsset(p, w.compressor, w.policy, w.spoolDir, w.o)
+		}
+		var reference *zipAsset
+		if err == nil {
+			reference, err = w.lookupContent(p)
+		}
+		if reference != nil {
+			w.logger.Debug().Object("asset", reference).Msg("asset contents already archived, referenced")
+			w.stats.deduplicated++
+			w.record(p, reference, "")
+			return
+		}
+	}
+	// Only assets whose contents are written can fill the archive.
+	if err == nil && !p.split && w.o.maxFileBytes > 0 && w.stats.size+p.asset.Size() >= w.o.maxFileBytes {
+		w.logger.Debug().
+			Int64("size", p.asset.Size()).
+			Msg("archive size larger than max file size. Will open a new file")
+		// The asset is written to the next part even if the archive failed, whose error is kept.
+		_ = w.nextArchive()
+	}
 
-			written = 0
-			storedAssets = 0
-			part++
-			zipFile = newZipFilePart(fullPrefix, part, o.dryRun)
-			logger.Info().Str("path", zipFile.Path()).Int("part", part).Msg("open archive")
+	var archivedAsset *zipAsset
+	var choice compressionChoice
+	var sum string
+	if err == nil && p.split {
+		archivedAsset, choice, sum, err = w.writeChunks(p)
+	} else if err == nil && p.compressed != nil {
+		archivedAsset, err = appendCompressedAsset(w.sourcePath, w.archive, p)
+		choice, sum = p.compressed.choice, p.compressed.sha256
+	} else if err == nil {
+		archivedAsset, choice, sum, err = archiveAsset(w.sourcePath, w.archive, p.entry, p.asset, w.policy, w.o.checksums, w.o.strongHash, w.logger)
+	}
+	if err != nil {
+		w.logger.Warn().Err(err).Object("asset", p.asset).
+			Msg("could not backup asset")
+		return
+	}
+	w.logger.Debug().Object("asset", p.asset).Bool("stored", choice.store).Str("store_reason", choice.reason).
+		Msg("backed up asset")
 
+	if p.asset.Attributes().Mode.IsRegular() {
+		if choice.store || w.storeAll {
+			w.stats.stored++
+		} else {
+			w.stats.compressed++
+		}
+	}
+	if !p.split {
+		// The parts of split files are counted as they are written.
+		w.stats.size += p.asset.Size()
+	}
+	w.record(p, archivedAsset, sum)
+	if w.o.findContent != nil && !p.split && p.asset.Attributes().Mode.IsRegular() {
+		strongHash, _ := asset.StrongHashOf(archivedAsset)
+		w.written[contentKey{archivedAsset.StoredHash(), p.asset.Size(), strongHash}] = asset.ContentRef{
+			ArchivePath: w.archive.Path(),
+			Entry:       p.entry.Name,
 		}
+	}
+}
+
+// Add the archived asset to the archive being written, and to its manifest.
+func (w *backupWriter) record(p *pendingAsset, a *zipAsset, sum string) {
+	a.password = w.o.password
+	w.archived = append(w.archived, a)
+	w.manifest.Entries = append(w.manifest.Entries, newManifestEntry(p.entry.Name, a, sum))
+}
 
-		header := &zip.FileHeader{
-			UncompressedSize64: uint64(asset.Size()),
-			Modified:           asset.ModTime(),
-			Method:             zip.Deflate,
+// Write a file larger than the archives in parts filling them. The asset
+// belongs to the archive with the last part.
+func (w *backupWriter) writeChunks(p *pendingAsset) (_ *zipAsset, choice compressionChoice, _ string, err error) {
+	// Parts written to the current archive, and the archives only holding
+	// parts of the file. They are registered with the asset, so they are
+	// removed if it fails.
+	var parts int
+	var partArchives []string
+	defer func() {
+		if err == nil {
+			return
 		}
-		header.Name, err = filepath.Rel(sourcePath, asset.Path())
-		if err != nil {
-			logger.Warn().Err(err).Object("asset", asset).Msg("could not backup asset")
-			continue
+		w.chunks -= parts
+		for _, path := range partArchives {
+			if w.o.dryRun {
+				break
+			}
+			if err := removeArchiveFiles(path); err != nil {
+				w.logger.Warn().Err(err).Str("path", path).Msg("could not remove archive of the parts of a failed file")
+				continue
+			}
+			w.logger.Info().Str("path", path).Msg("removed archive of the parts of a failed file")
 		}
+	}()
 
-		logger.Debug().Str("relative_path", header.Name).Msg("asset to zip")
+	reader, err := p.asset.Open()
+	if err != nil {
+		return nil, compressionChoice{}, "", err
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			w.logger.Warn().Err(err).Msg("failed to close asset file")
+		}
+	}()
 
-		w, err := zipFile.CreateHeader(header)
+	choice, content, err := w.policy.choose(p.entry.Name, reader)
+	if err != nil {
+		return nil, choice, "", err
+	}
+	h := fileutils.NewHash()
+	var out io.Writer = h
+	var checksum hash.Hash
+	if w.o.checksums {
+		checksum = sha256.New()
+		out = io.MultiWriter(h, checksum)
+	}
+	strong := newStrongHash(w.o.strongHash, p.asset.Attributes().Mode)
+	if strong != nil {
+		out = io.MultiWriter(out, strong)
+	}
+	content = io.TeeReader(content, out)
+
+	var written []asset.Chunk
+	size := p.asset.Size()
+	for offset := int64(0); offset < size; {
+		room := w.o.maxFileBytes - 1 - w.stats.size
+		if room <= 0 {
+			if len(w.archived) == 0 && w.chunks == parts {
+				partArchives = append(partArchives, w.archive.Path())
+			}
+			if err := w.nextArchive(); err != nil {
+				return nil, choice, "", err
+			}
+			parts = 0
+			room = max(w.o.maxFileBytes-1, 1)
+		}
+		entry := *p.entry
+		entry.Name = chunkEntryName(p.entry.Name, len(written))
+		entry.Size = min(room, size-offset)
+		entry.Store = choice.store
+		ew, err := w.archive.Create(&entry)
 		if err != nil {
-			logger.Warn().Err(err).Object("asset", asset).Msg("could not backup asset")
-			continue
+			return nil, choice, "", err
 		}
-		archivedAsset, err := writeAsset(sourcePath, zipFile.Path(), asset, w, logger)
+		// The file is archived with the size it had when found.
+		n, err := io.CopyN(ew, content, entry.Size)
 		if err != nil {
-			logger.Warn().Err(err).Object("asset", asset).
-				Msg("could not backup asset")
-			continue
-		} else {
-			logger.Debug().Object("asset", asset).
-				Msg("backed up asset")
+			return nil, choice, "", fmt.Errorf("could not write part %d: %w", len(written)+1, err)
+		}
+		written = append(written, asset.Chunk{ArchivePath: w.archive.Path(), Offset: offset, Size: n})
+		w.logger.Debug().Str("relative_path", entry.Name).Str("path", w.archive.Path()).Msg("archived asset part")
+		w.stats.size += n
+		w.chunks++
+		parts++
+		offset += n
+	}
+
+	var sum string
+	if checksum != nil {
+		sum = hex.EncodeToString(checksum.Sum(nil))
+	}
+	a := newZipAsset(w.sourcePath, w.archive.Path(), p.asset, h.Sum64())
+	a.strongHash = strongHashSum(w.o.strongHash, strong)
+	a.chunks = written
+	return a, choice, sum, nil
+}
+
+// Find identical contents already archived, to reference them instead of
+// writing them again. The asset must be compressed ahead of time, which
+// hashes its contents. Returns nil if there are none.
+func (w *backupWriter) lookupContent(p *pendingAsset) (*zipAsset, error) {
+	h, strongHash := p.compressed.hash, p.compressed.strongHash
+
+	ref, ok := w.written[contentKey{h, p.asset.Size(), strongHash}]
+	if !ok {
+		found, foundOK, err := w.o.findContent.FindArchivedContent(w.ctx, h, p.asset.Size())
+		if err != nil {
+			return nil, err
+		}
+		if foundOK && !sameEncryption(found, w.sourcePath, w.o.password != nil) {
+			w.logger.Debug().Object("asset", p.asset).Object("archived", found).
+				Msg("archived contents are not encrypted like the backup, archiving again")
+			foundOK = false
+		}
+		if foundOK && !sameStrongHash(found, strongHash) {
+			w.logger.Warn().Object("asset", p.asset).Object("archived", found).
+				Msg("archived contents have the same xxhash but not the same strong hash, archiving again")
+			foundOK = false
+		}
+		if foundOK {
+			ref, ok, err = contentRef(found, w.o.dryRun)
+			if err != nil {
+				return nil, err
+			}
 		}
-		written += asset.Size()
-		storedAssets++
-		onArchived(archivedAsset)
+	}
+	if !ok {
+		return nil, nil
 	}
 
-	return nil
+	a := newZipAsset(w.sourcePath, w.archive.Path(), p.asset, h)
+	a.strongHash = strongHash
+	a.content = &ref
+	return a, nil
 }
 
-func writeAsset(sourcePath string, archivePath string, asset readableAsset, w io.Writer, logger zerolog.Logger) (asset.ArchivedAsset, error) {
+// Add the asset to the archive. The checksum, if enabled, is computed from the
+// contents of regular files, and the strong hash from the ones of symbolic links too.
+func archiveAsset(
+	sourcePath string,
+	archive ArchiveWriter,
+	entry *Entry,
+	asset readableAsset,
+	policy *CompressionPolicy,
+	checksums bool,
+	strongHashAlg fileutils.HashAlgorithm,
+	logger zerolog.Logger,
+) (*zipAsset, compressionChoice, string, error) {
 	reader, err := asset.Open()
 	if err != nil {
-		return nil, err
+		return nil, compressionChoice{}, "", err
 	}
 	startTime := time.Now()
 	defer func() {
@@ -208,51 +616,155 @@ func writeAsset(sourcePath string, archivePath string, asset readableAsset, w io
 		logger.Debug().Object("asset", asset).Float64("seconds", tookSeconds).Msg("archived asset")
 	}()
 
-	// Write to zip as well as compute hash.
-	tee := io.TeeReader(reader, w)
-	h, err := fileutils.ComputeHash(tee)
+	var choice compressionChoice
+	var content io.Reader = reader
+	if asset.Attributes().Mode.IsRegular() {
+		choice, content, err = policy.choose(entry.Name, reader)
+		if err != nil {
+			return nil, choice, "", err
+		}
+	}
+	entry.Store = choice.store
+
+	w, err := archive.Create(entry)
+	if err != nil {
+		return nil, choice, "", err
+	}
+	entryWriter := w
+	var checksum hash.Hash
+	if checksums && asset.Attributes().Mode.IsRegular() {
+		checksum = sha256.New()
+		w = io.MultiWriter(w, checksum)
+	}
+	strong := newStrongHash(strongHashAlg, asset.Attributes().Mode)
+	if strong != nil {
+		w = io.MultiWriter(w, strong)
+	}
+
+	// Write to the archive as well as compute hash.
+	h, err := fileutils.ComputeHash(io.TeeReader(content, w))
+	if err != nil {
+		return nil, choice, "", err
+	}
+	// Entries written with the size found by the scan fail if the file shrank.
+	if e, ok := entryWriter.(*tarEntryWriter); ok {
+		if err := e.finish(); err != nil {
+			return nil, choice, "", err
+		}
+	}
+
+	var sum string
+	if checksum != nil {
+		sum = hex.EncodeToString(checksum.Sum(nil))
+	}
+	a := newZipAsset(sourcePath, archive.Path(), asset, h)
+	a.strongHash = strongHashSum(strongHashAlg, strong)
+	return a, choice, sum, nil
+}
+
+// Start the strong hash of the contents of an asset. Nil if disabled, or for
+// directories which have no contents.
+func newStrongHash(alg fileutils.HashAlgorithm, mode fs.FileMode) hash.Hash {
+	if alg == "" || !(mode.IsRegular() || mode&fs.ModeSymlink != 0) {
+		return nil
+	}
+	// The algorithm is checked before archiving.
+	h, _ := fileutils.NewStrongHash(alg)
+	return h
+}
+
+func strongHashSum(alg fileutils.HashAlgorithm, h hash.Hash) string {
+	if h == nil {
+		return ""
+	}
+	return fileutils.FormatStrongHash(alg, h)
+}
+
+// Whether the archived contents have the strong hash. Hashes computed with
+// different algorithms, or missing, can't tell them apart.
+func sameStrongHash(a asset.ArchivedAsset, strongHash string) bool {
+	archived, ok := asset.StrongHashOf(a)
+	if !ok || strongHash == "" {
+		return true
+	}
+	archivedAlg, err := fileutils.StrongHashAlgorithm(archived)
 	if err != nil {
+		return true
+	}
+	alg, err := fileutils.StrongHashAlgorithm(strongHash)
+	if err != nil || alg != archivedAlg {
+		return true
+	}
+	return archived == strongHash
+}
+
+// Whether archived contents can be referenced by a backup, encrypted or not.
+// Encrypted backups only reference the contents encrypted for the same source,
+// the others only the contents that aren't encrypted.
+func sameEncryption(a asset.ArchivedAsset, sourcePath string, encrypted bool) bool {
+	if asset.IsEncrypted(a) != encrypted {
+		return false
+	}
+	return !encrypted || a.SourcePath() == sourcePath
+}
+
+// Where the contents of an archived asset are, if its archive is still there.
+func contentRef(a asset.ArchivedAsset, dryRun bool) (asset.ContentRef, bool, error) {
+	ref, ok := asset.ContentRefOf(a)
+	if !ok {
+		name, err := entryName(a)
+		if err != nil {
+			return ref, false, err
+		}
+		ref = asset.ContentRef{ArchivePath: a.ArchivePath(), Entry: name}
+	}
+	// The archive could have been removed without cleaning the database.
+	return ref, dryRun || fileutils.Exists(ref.ArchivePath), nil
+}
+
+// Record a moved asset with a reference to the contents archived for its
+// previous path. Returns nil if they are no longer available.
+func referenceMovedAsset(sourcePath string, archivePath string, p *pendingAsset, dryRun bool) (*zipAsset, error) {
+	ref, ok, err := contentRef(p.movedFrom, dryRun)
+	if err != nil || !ok {
 		return nil, err
 	}
+	a := newZipAsset(sourcePath, archivePath, p.asset, p.movedFrom.StoredHash())
+	a.strongHash, _ = asset.StrongHashOf(p.movedFrom)
+	a.content = &ref
+	a.movedFrom = p.movedFrom.Path()
+	return a, nil
+}
 
+func newZipAsset(sourcePath string, archivePath string, a asset.Asset, hash uint64) *zipAsset {
 	return &zipAsset{
 		sourcePath:       sourcePath,
 		archivePath:      archivePath,
-		name:             asset.Name(),
-		path:             asset.Path(),
-		hash:             h,
-		modTime:          asset.ModTime(),
-		uncompressedSize: asset.Size(),
-	}, nil
-}
-
-func newZipFilePart(fullPrefix string, part int, dryRun bool) *zipwriter.ZipFile {
-	if dryRun {
-		return zipwriter.NewNullZipFile()
+		name:             a.Name(),
+		path:             a.Path(),
+		hash:             hash,
+		modTime:          a.ModTime(),
+		uncompressedSize: a.Size(),
+		attributes:       a.Attributes(),
 	}
+}
 
-	if part == 0 {
-		return zipwriter.NewLazyZipFile(fmt.Sprintf("%s.zip", fullPrefix))
+// Remove a complete archive, and its signature and parity files.
+func removeArchiveFiles(path string) error {
+	var errs []error
+	for _, p := range []string{path, signing.PathOf(path), parity.PathOf(path)} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
 	}
-	return zipwriter.NewLazyZipFile(fmt.Sprintf("%s.%d.zip", fullPrefix, part))
+	return errors.Join(errs...)
 }
 
-func iterChannel[T any](ctx context.Context, ch <-chan T) iter.Seq[T] {
-	return func(yield func(T) bool) {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case item, ok := <-ch:
-				if !ok {
-					return
-				}
-				if !yield(item) {
-					return
-				}
-			}
-		}
+func newArchivePart(fullPrefix string, part int, o writeOptions) ArchiveWriter {
+	if part == 0 {
+		return newArchiveWriter(o.format, fmt.Sprintf("%s%s", fullPrefix, o.format.Extension()), o.dryRun, o.compression, o.password)
 	}
+	return newArchiveWriter(o.format, fmt.Sprintf("%s.%d%s", fullPrefix, part, o.format.Extension()), o.dryRun, o.compression, o.password)
 }
 
 func seqToReadableFileAssets(assets iter.Seq[asset.Asset]) iter.Seq[readableAsset] {
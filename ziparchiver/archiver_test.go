@@ -3,11 +3,18 @@ package ziparchiver_test
 import (
 	"archive/zip"
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"iter"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -16,6 +23,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/fileutils"
+	"github.com/stupid-simple/backup/parity"
+	"github.com/stupid-simple/backup/signing"
 	"github.com/stupid-simple/backup/ziparchiver"
 )
 
@@ -31,6 +41,9 @@ func (m *MockAsset) Path() string       { return m.path }
 func (m *MockAsset) Name() string       { return m.name }
 func (m *MockAsset) Size() int64        { return m.size }
 func (m *MockAsset) ModTime() time.Time { return m.modTime }
+func (m *MockAsset) Attributes() asset.Attributes {
+	return asset.Attributes{}
+}
 func (m *MockAsset) MarshalZerologObject(e *zerolog.Event) {
 	e.Str("path", m.path)
 	e.Str("name", m.name)
@@ -40,9 +53,13 @@ func (m *MockAsset) MarshalZerologObject(e *zerolog.Event) {
 // MockArchivedAssetRegistry implements ziparchiver.RegisterArchivedAssets
 type MockArchivedAssetRegistry struct {
 	assets []asset.ArchivedAsset
+	err    error // Returned by Register if set.
 }
 
 func (r *MockArchivedAssetRegistry) Register(ctx context.Context, assets iter.Seq[asset.ArchivedAsset]) error {
+	if r.err != nil {
+		return r.err
+	}
 	for a := range assets {
 		r.assets = append(r.assets, a)
 	}
@@ -66,6 +83,17 @@ func (f *MockOnlyNewAssets) FindMissingAssets(ctx context.Context, from iter.Seq
 	}, nil
 }
 
+// Helper to filter out the archive metadata entries
+func assetEntries(files []*zip.File) []*zip.File {
+	var entries []*zip.File
+	for _, f := range files {
+		if !ziparchiver.IsMetadataEntry(f.Name) {
+			entries = append(entries, f)
+		}
+	}
+	return entries
+}
+
 // Helper to create test assets
 func createTestAssets(t *testing.T, baseDir string, count int) []asset.Asset {
 	assets := make([]asset.Asset, 0, count)
@@ -106,12 +134,14 @@ func TestStoreAssets_Basic(t *testing.T) {
 
 	logger := zerolog.New(io.Discard)
 
+	var stats ziparchiver.Stats
 	err := ziparchiver.StoreAssets(
 		context.Background(),
 		sourceDir,
 		ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: "backup-"},
 		assetSeq,
 		logger,
+		ziparchiver.WithStats(&stats),
 	)
 
 	require.NoError(t, err)
@@ -119,6 +149,17 @@ func TestStoreAssets_Basic(t *testing.T) {
 	files, err := os.ReadDir(destDir)
 	require.NoError(t, err)
 	assert.Len(t, files, 1)
+
+	info, err := files[0].Info()
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Stored)
+	var size int64
+	for _, a := range assets {
+		size += a.Size()
+	}
+	assert.Equal(t, size, stats.Size)
+	assert.Positive(t, stats.Written)
+	assert.LessOrEqual(t, stats.Written, info.Size())
 }
 
 func TestStoreAssets_WithRegistry(t *testing.T) {
@@ -225,8 +266,9 @@ func TestStoreAssets_WithFiltering(t *testing.T) {
 		_ = r.Close()
 	}()
 
-	assert.Len(t, r.File, 1, "Zip should contain only small assets")
-	assert.Equal(t, "file0.txt", filepath.Base(r.File[0].Name), "Should only contain the smallest file")
+	entries := assetEntries(r.File)
+	assert.Len(t, entries, 1, "Zip should contain only small assets")
+	assert.Equal(t, "file0.txt", filepath.Base(entries[0].Name), "Should only contain the smallest file")
 }
 
 func TestStoreAssets_WithMaxFileSize(t *testing.T) {
@@ -367,8 +409,9 @@ func TestStoreAssets_WithLargeFileHandling(t *testing.T) {
 		_ = r.Close()
 	}()
 
-	assert.Len(t, r.File, 1, "Should only include the small file")
-	assert.Equal(t, "small.txt", filepath.Base(r.File[0].Name), "Should be the small file")
+	entries := assetEntries(r.File)
+	assert.Len(t, entries, 1, "Should only include the small file")
+	assert.Equal(t, "small.txt", filepath.Base(entries[0].Name), "Should be the small file")
 
 	// Test 2: Store with max size 1KB, but include large files.
 	destDir2 := t.TempDir()
@@ -396,7 +439,7 @@ func TestStoreAssets_WithLargeFileHandling(t *testing.T) {
 		zipPath := filepath.Join(destDir2, f.Name())
 		r, err := zip.OpenReader(zipPath)
 		require.NoError(t, err)
-		totalFiles += len(r.File)
+		totalFiles += len(assetEntries(r.File))
 		_ = r.Close()
 	}
 
@@ -511,5 +554,998 @@ func TestStoreAssets_Cancellation(t *testing.T) {
 		_ = r.Close()
 	}()
 
-	assert.Less(t, len(r.File), count, "Should contain fewer than all assets due to cancellation")
+	assert.Less(t, len(assetEntries(r.File)), count, "Should contain fewer than all assets due to cancellation")
+}
+
+func TestStoreAssets_Attributes(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+
+	path := filepath.Join(sourceDir, "file.txt")
+	require.NoError(t, os.WriteFile(path, []byte("content"), 0600))
+	require.NoError(t, os.Chmod(path, 0640))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	a, err := asset.NewFromFS(path, info)
+	require.NoError(t, err)
+
+	registry := &MockArchivedAssetRegistry{}
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: "backup-"},
+		func(yield func(asset.Asset) bool) { yield(a) },
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+	)
+	require.NoError(t, err)
+
+	require.Len(t, registry.assets, 1)
+	attrs := registry.assets[0].Attributes()
+	assert.Equal(t, os.FileMode(0640), attrs.Mode)
+	assert.Equal(t, os.Getuid(), attrs.UID)
+	assert.Equal(t, os.Getgid(), attrs.GID)
+
+	r, err := zip.OpenReader(registry.assets[0].ArchivePath())
+	require.NoError(t, err)
+	defer func() {
+		_ = r.Close()
+	}()
+	entries := assetEntries(r.File)
+	require.Len(t, entries, 1)
+	assert.Equal(t, os.FileMode(0640), entries[0].Mode())
+}
+
+func TestStoreAssets_SymlinksAndEmptyDirs(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(sourceDir, "file.txt"), []byte("content"), 0644))
+	require.NoError(t, os.Symlink("file.txt", filepath.Join(sourceDir, "link.txt")))
+	require.NoError(t, os.Mkdir(filepath.Join(sourceDir, "empty"), 0750))
+
+	assets, err := asset.ScanDirectory(context.Background(), sourceDir, zerolog.New(io.Discard))
+	require.NoError(t, err)
+
+	registry := &MockArchivedAssetRegistry{}
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: "backup-"},
+		assets,
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, 3)
+
+	r, err := zip.OpenReader(registry.assets[0].ArchivePath())
+	require.NoError(t, err)
+	defer func() {
+		_ = r.Close()
+	}()
+	entries := map[string]*zip.File{}
+	for _, f := range r.File {
+		entries[f.Name] = f
+	}
+
+	require.Contains(t, entries, "empty/")
+	assert.True(t, entries["empty/"].Mode().IsDir())
+
+	require.Contains(t, entries, "link.txt")
+	assert.NotZero(t, entries["link.txt"].Mode()&os.ModeSymlink)
+	rc, err := entries["link.txt"].Open()
+	require.NoError(t, err)
+	target, err := io.ReadAll(rc)
+	_ = rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "file.txt", string(target))
+
+	err = ziparchiver.Restore(
+		context.Background(),
+		slices.Values(registry.assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRestoreTargetDir(targetDir),
+	)
+	require.NoError(t, err)
+
+	restoredTarget, err := os.Readlink(filepath.Join(targetDir, "link.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "file.txt", restoredTarget)
+
+	info, err := os.Stat(filepath.Join(targetDir, "empty"))
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+}
+
+func TestStoreAssets_RegisterCompleteArchives(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+
+	assets := createTestAssets(t, sourceDir, 3)
+
+	// Leftover from an interrupted backup.
+	leftover := filepath.Join(destDir, "backup-1000.zip.partial")
+	require.NoError(t, os.WriteFile(leftover, []byte("truncated"), 0600))
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(leftover, old, old))
+	// Belongs to another prefix.
+	otherPartial := filepath.Join(destDir, "other-1000.zip.partial")
+	require.NoError(t, os.WriteFile(otherPartial, []byte("truncated"), 0600))
+	require.NoError(t, os.Chtimes(otherPartial, old, old))
+	// Still being written by another backup.
+	writing, err := fileutils.CreatePartialFile(filepath.Join(destDir, "backup-2000.zip"))
+	require.NoError(t, err)
+	defer func() {
+		_ = writing.Close()
+	}()
+	require.NoError(t, os.Chtimes(writing.Name(), old, old))
+
+	var registered []asset.ArchivedAsset
+	registry := &registerFunc{func(assets iter.Seq[asset.ArchivedAsset]) error {
+		for a := range assets {
+			// The archive must be complete by the time assets are registered.
+			r, err := zip.OpenReader(a.ArchivePath())
+			require.NoError(t, err)
+			_ = r.Close()
+			registered = append(registered, a)
+		}
+		return nil
+	}}
+
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: "backup-"},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithMaxFileBytes(40),
+		ziparchiver.WithIncludeLargeFiles(true),
+	)
+	require.NoError(t, err)
+	assert.Len(t, registered, 3)
+
+	files, err := os.ReadDir(destDir)
+	require.NoError(t, err)
+	for _, f := range files {
+		assert.False(t, strings.HasPrefix(f.Name(), "backup-") && strings.HasSuffix(f.Name(), ".partial") && f.Name() != filepath.Base(writing.Name()),
+			"Should not leave partial files: %s", f.Name())
+	}
+	assert.NoFileExists(t, leftover)
+	assert.FileExists(t, otherPartial)
+	assert.FileExists(t, writing.Name())
+}
+
+func TestStoreAssets_Parity(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+
+	assets := createTestAssets(t, sourceDir, 3)
+
+	parityFiles := map[string]bool{}
+	registry := &registerFunc{func(assets iter.Seq[asset.ArchivedAsset]) error {
+		for a := range assets {
+			// The parity file is written before the assets are registered.
+			assert.FileExists(t, parity.PathOf(a.ArchivePath()))
+			parityFiles[parity.PathOf(a.ArchivePath())] = true
+		}
+		return nil
+	}}
+
+	err := ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: "backup-"},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithMaxFileBytes(40),
+		ziparchiver.WithIncludeLargeFiles(true),
+		ziparchiver.WithParity(10),
+	)
+	require.NoError(t, err)
+	require.NotEmpty(t, parityFiles)
+
+	files, err := os.ReadDir(destDir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2*len(parityFiles))
+	for path := range parityFiles {
+		archivePath := strings.TrimSuffix(path, parity.Suffix)
+		report, err := parity.Verify(context.Background(), archivePath, path)
+		require.NoError(t, err)
+		assert.True(t, report.OK())
+	}
+}
+
+func TestStoreAssets_StrongHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []ziparchiver.StoreOption
+	}{
+		{"sequential", nil},
+		{"workers", []ziparchiver.StoreOption{ziparchiver.WithWorkers(2)}},
+		{"split", []ziparchiver.StoreOption{ziparchiver.WithMaxFileBytes(10), ziparchiver.WithSplitLargeFiles(true)}},
+	}
+	for _, alg := range []fileutils.HashAlgorithm{fileutils.HashSHA256, fileutils.HashBLAKE3} {
+		for _, tt := range tests {
+			t.Run(string(alg)+"/"+tt.name, func(t *testing.T) {
+				sourceDir := t.TempDir()
+				destDir := t.TempDir()
+				assets := createTestAssets(t, sourceDir, 3)
+
+				registry := &MockArchivedAssetRegistry{}
+				options := append([]ziparchiver.StoreOption{
+					ziparchiver.WithRegisterArchivedAssets(registry),
+					ziparchiver.WithStrongHash(alg),
+				}, tt.options...)
+				err := ziparchiver.StoreAssets(
+					context.Background(),
+					sourceDir,
+					ziparchiver.ArchiveDescriptor{Dir: destDir},
+					slices.Values(assets),
+					zerolog.New(io.Discard),
+					options...,
+				)
+				require.NoError(t, err)
+				require.Len(t, registry.assets, 3)
+
+				for _, a := range registry.assets {
+					f, err := os.Open(a.Path())
+					require.NoError(t, err)
+					expected, err := fileutils.ComputeStrongHash(alg, f)
+					_ = f.Close()
+					require.NoError(t, err)
+
+					strongHash, ok := asset.StrongHashOf(a)
+					require.True(t, ok)
+					assert.Equal(t, expected, strongHash)
+				}
+			})
+		}
+	}
+
+	err := ziparchiver.StoreAssets(
+		context.Background(),
+		t.TempDir(),
+		ziparchiver.ArchiveDescriptor{Dir: t.TempDir()},
+		slices.Values([]asset.Asset{}),
+		zerolog.New(io.Discard),
+		ziparchiver.WithStrongHash("md5"),
+	)
+	assert.Error(t, err)
+}
+
+func TestStoreAssets_Signed(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	targetDir := t.TempDir()
+	assets := createTestAssets(t, sourceDir, 3)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	registry := &MockArchivedAssetRegistry{}
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithMaxFileBytes(40),
+		ziparchiver.WithIncludeLargeFiles(true),
+		ziparchiver.WithSigningKey(privateKey),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, 3)
+	for _, a := range registry.assets {
+		require.NoError(t, signing.Verify(a.ArchivePath(), publicKey))
+	}
+
+	// The files of a modified archive are not restored.
+	tampered := registry.assets[0]
+	f, err := os.OpenFile(tampered.ArchivePath(), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("tampered"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	err = ziparchiver.Restore(
+		context.Background(),
+		slices.Values(registry.assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRestoreTargetDir(targetDir),
+		ziparchiver.WithRestorePublicKey(publicKey),
+	)
+	require.NoError(t, err)
+	for _, a := range registry.assets {
+		restoredPath := filepath.Join(targetDir, a.Name())
+		if a.ArchivePath() == tampered.ArchivePath() {
+			assert.NoFileExists(t, restoredPath)
+		} else {
+			assert.FileExists(t, restoredPath)
+		}
+	}
+}
+
+func TestOpenArchive_PublicKey(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	assets := createTestAssets(t, sourceDir, 1)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	registry := &MockArchivedAssetRegistry{}
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithSigningKey(privateKey),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, 1)
+	archivePath := registry.assets[0].ArchivePath()
+
+	reader, err := ziparchiver.OpenArchive(archivePath, ziparchiver.WithPublicKey(publicKey))
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	_, err = ziparchiver.OpenArchive(archivePath, ziparchiver.WithPublicKey(otherKey))
+	assert.ErrorIs(t, err, signing.ErrInvalidSignature)
+
+	require.NoError(t, os.Remove(signing.PathOf(archivePath)))
+	_, err = ziparchiver.OpenArchive(archivePath, ziparchiver.WithPublicKey(publicKey))
+	assert.ErrorIs(t, err, signing.ErrMissingSignature)
+}
+
+func TestStoreAssets_Encrypted(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	assets := createTestAssets(t, sourceDir, 3)
+	// Larger than the archives, split in several parts.
+	largePath := filepath.Join(sourceDir, "large.txt")
+	require.NoError(t, os.WriteFile(largePath, []byte(strings.Repeat("large file ", 10)), 0644))
+	info, err := os.Stat(largePath)
+	require.NoError(t, err)
+	large, err := asset.NewFromFS(largePath, info)
+	require.NoError(t, err)
+	assets = append(assets, large)
+	password := []byte("secret")
+
+	registry := &MockArchivedAssetRegistry{}
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithMaxFileBytes(60),
+		ziparchiver.WithSplitLargeFiles(true),
+		ziparchiver.WithWorkers(2),
+		ziparchiver.WithEncryption(password),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, 4)
+
+	archivePaths, err := filepath.Glob(filepath.Join(destDir, "*.zip"))
+	require.NoError(t, err)
+	require.Greater(t, len(archivePaths), 1)
+	for _, path := range archivePaths {
+		r, err := zip.OpenReader(path)
+		require.NoError(t, err)
+		for _, f := range r.File {
+			assert.NotZero(t, f.Flags&0x1, "entry %s of %s is not encrypted", f.Name, path)
+		}
+		require.NoError(t, r.Close())
+	}
+	for _, a := range registry.assets {
+		assert.True(t, asset.IsEncrypted(a))
+		hash, err := a.ComputeHash()
+		require.NoError(t, err)
+		assert.Equal(t, a.StoredHash(), hash)
+	}
+
+	restore := func(password []byte) string {
+		targetDir := t.TempDir()
+		err := ziparchiver.Restore(
+			context.Background(),
+			slices.Values(registry.assets),
+			zerolog.New(io.Discard),
+			ziparchiver.WithRestoreTargetDir(targetDir),
+			ziparchiver.WithRestorePassword(password),
+		)
+		require.NoError(t, err)
+		return targetDir
+	}
+	for _, wrong := range [][]byte{nil, []byte("wrong")} {
+		targetDir := restore(wrong)
+		for _, a := range assets {
+			assert.NoFileExists(t, filepath.Join(targetDir, a.Name()))
+		}
+	}
+	targetDir := restore(password)
+	for _, a := range assets {
+		expected, err := os.ReadFile(a.Path())
+		require.NoError(t, err)
+		restored, err := os.ReadFile(filepath.Join(targetDir, a.Name()))
+		require.NoError(t, err)
+		assert.Equal(t, expected, restored)
+	}
+
+	// The manifest is encrypted too.
+	archivePath := registry.assets[0].ArchivePath()
+	_, err = ziparchiver.ReadArchiveIndex(archivePath, "")
+	assert.ErrorIs(t, err, ziparchiver.ErrPasswordRequired)
+	index, err := ziparchiver.ReadArchiveIndex(archivePath, "", ziparchiver.WithPassword(password))
+	require.NoError(t, err)
+	assert.True(t, index.Embedded)
+	assert.True(t, index.Encrypted)
+	for a := range index.Assets() {
+		assert.True(t, asset.IsEncrypted(a))
+		hash, err := a.ComputeHash()
+		require.NoError(t, err)
+		assert.Equal(t, a.StoredHash(), hash)
+	}
+
+	// Only zip archives can be encrypted.
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: t.TempDir()},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithFormat(ziparchiver.FormatTarZstd),
+		ziparchiver.WithEncryption(password),
+	)
+	assert.Error(t, err)
+}
+
+type registerFunc struct {
+	register func(assets iter.Seq[asset.ArchivedAsset]) error
+}
+
+func (r *registerFunc) Register(ctx context.Context, assets iter.Seq[asset.ArchivedAsset]) error {
+	return r.register(assets)
+}
+
+func TestStoreAssets_Manifest(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+
+	assets := createTestAssets(t, sourceDir, 2)
+	require.NoError(t, os.Mkdir(filepath.Join(sourceDir, "empty"), 0755))
+	dirInfo, err := os.Stat(filepath.Join(sourceDir, "empty"))
+	require.NoError(t, err)
+	dirAsset, err := asset.NewFromFS(filepath.Join(sourceDir, "empty"), dirInfo)
+	require.NoError(t, err)
+	assets = append(assets, dirAsset)
+
+	registry := &MockArchivedAssetRegistry{}
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: "backup-"},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithVersion("1.2.3"),
+		ziparchiver.WithChecksums(true),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, 3)
+
+	r, err := zip.OpenReader(registry.assets[0].ArchivePath())
+	require.NoError(t, err)
+	defer func() {
+		_ = r.Close()
+	}()
+
+	readEntry := func(name string) []byte {
+		f, err := r.Open(name)
+		require.NoError(t, err)
+		defer func() {
+			_ = f.Close()
+		}()
+		content, err := io.ReadAll(f)
+		require.NoError(t, err)
+		return content
+	}
+
+	var manifest ziparchiver.Manifest
+	require.NoError(t, json.Unmarshal(readEntry(ziparchiver.ManifestPath), &manifest))
+	assert.Equal(t, "1.2.3", manifest.Version)
+	assert.Equal(t, sourceDir, manifest.SourcePath)
+	assert.NotEmpty(t, manifest.Host)
+	assert.False(t, manifest.CreatedAt.IsZero())
+	require.Len(t, manifest.Entries, 3)
+
+	var expectedSums strings.Builder
+	for i, a := range registry.assets {
+		entry := manifest.Entries[i]
+		assert.Equal(t, fmt.Sprintf("%016x", a.StoredHash()), entry.Hash)
+		assert.Equal(t, a.Size(), entry.Size)
+		assert.True(t, a.ModTime().Equal(entry.ModTime))
+		assert.Equal(t, uint32(a.Attributes().Mode), entry.Mode)
+
+		if a.Attributes().Mode.IsDir() {
+			assert.Equal(t, "empty/", entry.Name)
+			assert.Empty(t, entry.SHA256)
+			continue
+		}
+		sum := sha256.Sum256(readEntry(entry.Name))
+		assert.Equal(t, hex.EncodeToString(sum[:]), entry.SHA256)
+		fmt.Fprintf(&expectedSums, "%s  %s\n", entry.SHA256, entry.Name)
+	}
+
+	assert.Equal(t, expectedSums.String(), string(readEntry(ziparchiver.ChecksumsPath)))
+}
+
+func TestStoreAssets_MetadataDirInSource(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	files := map[string]string{
+		".ssbak/manifest.json": "not the manifest",
+		".ssbak~/notes.txt":    "notes",
+		"file.txt":             "content",
+	}
+	for name, content := range files {
+		path := filepath.Join(sourceDir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	assets, err := asset.ScanDirectory(context.Background(), sourceDir, zerolog.New(io.Discard))
+	require.NoError(t, err)
+
+	registry := &MockArchivedAssetRegistry{}
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir},
+		assets,
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+	)
+	require.NoError(t, err)
+	archivePath := registry.assets[0].ArchivePath()
+
+	// The files of the source don't collide with the metadata of the archive.
+	r, err := zip.OpenReader(archivePath)
+	require.NoError(t, err)
+	var names []string
+	for _, f := range assetEntries(r.File) {
+		names = append(names, f.Name)
+	}
+	require.NoError(t, r.Close())
+	assert.Contains(t, names, ".ssbak~/manifest.json")
+	assert.Contains(t, names, ".ssbak~~/notes.txt")
+
+	index, err := ziparchiver.ReadArchiveIndex(archivePath, "")
+	require.NoError(t, err)
+	assert.Equal(t, sourceDir, index.Manifest.SourcePath)
+	var paths []string
+	for a := range index.Assets() {
+		paths = append(paths, a.Path())
+	}
+	for name := range files {
+		assert.Contains(t, paths, filepath.Join(sourceDir, name))
+	}
+
+	err = ziparchiver.Restore(
+		context.Background(),
+		slices.Values(registry.assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRestoreTargetDir(targetDir),
+	)
+	require.NoError(t, err)
+	for name, content := range files {
+		restored, err := os.ReadFile(filepath.Join(targetDir, name))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(restored))
+	}
+}
+
+// MockArchivedContent implements ziparchiver.FindArchivedContent with the assets of a registry.
+type MockArchivedContent struct {
+	registry *MockArchivedAssetRegistry
+}
+
+func (m *MockArchivedContent) FindArchivedContent(ctx context.Context, hash uint64, size int64) (asset.ArchivedAsset, bool, error) {
+	for _, a := range slices.Backward(m.registry.assets) {
+		if a.StoredHash() == hash && a.Size() == size {
+			return a, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func TestStoreAssets_Deduplication(t *testing.T) {
+	firstSource := t.TempDir()
+	secondSource := t.TempDir()
+	destDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	writeAssets := func(dir string, contents map[string]string) []asset.Asset {
+		var assets []asset.Asset
+		for _, name := range slices.Sorted(maps.Keys(contents)) {
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.WriteFile(path, []byte(contents[name]), 0644))
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			a, err := asset.NewFromFS(path, info)
+			require.NoError(t, err)
+			assets = append(assets, a)
+		}
+		return assets
+	}
+	registry := &MockArchivedAssetRegistry{}
+	backup := func(source string, assets []asset.Asset) {
+		err := ziparchiver.StoreAssets(
+			context.Background(),
+			source,
+			ziparchiver.ArchiveDescriptor{Dir: destDir},
+			slices.Values(assets),
+			zerolog.New(io.Discard),
+			ziparchiver.WithRegisterArchivedAssets(registry),
+			ziparchiver.WithDeduplication(&MockArchivedContent{registry}),
+		)
+		require.NoError(t, err)
+	}
+	entries := func(archivePath string) []string {
+		r, err := zip.OpenReader(archivePath)
+		require.NoError(t, err)
+		defer func() {
+			_ = r.Close()
+		}()
+		var names []string
+		for _, f := range assetEntries(r.File) {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+
+	backup(firstSource, writeAssets(firstSource, map[string]string{
+		"a.jpg": "same photo",
+		"b.jpg": "same photo",
+		"c.jpg": "other photo",
+	}))
+	require.Len(t, registry.assets, 3)
+	first := registry.assets[0].ArchivePath()
+	assert.Equal(t, []string{"a.jpg", "c.jpg"}, entries(first))
+	ref, ok := asset.ContentRefOf(registry.assets[1])
+	require.True(t, ok)
+	assert.Equal(t, asset.ContentRef{ArchivePath: first, Entry: "a.jpg"}, ref)
+
+	// Another source with a copy of an archived file.
+	time.Sleep(2 * time.Millisecond)
+	backup(secondSource, writeAssets(secondSource, map[string]string{
+		"d.jpg": "other photo",
+		"e.jpg": "new photo",
+	}))
+	require.Len(t, registry.assets, 5)
+	second := registry.assets[3].ArchivePath()
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, []string{"e.jpg"}, entries(second))
+	ref, ok = asset.ContentRefOf(registry.assets[3])
+	require.True(t, ok)
+	assert.Equal(t, asset.ContentRef{ArchivePath: first, Entry: "c.jpg"}, ref)
+
+	for _, a := range registry.assets {
+		hash, err := a.ComputeHash()
+		require.NoError(t, err)
+		assert.Equal(t, a.StoredHash(), hash)
+	}
+
+	// The references are kept in the manifest.
+	index, err := ziparchiver.ReadArchiveIndex(second, "")
+	require.NoError(t, err)
+	var indexed []asset.ArchivedAsset
+	for a := range index.Assets() {
+		indexed = append(indexed, a)
+	}
+	require.Len(t, indexed, 2)
+	ref, ok = asset.ContentRefOf(indexed[0])
+	require.True(t, ok)
+	assert.Equal(t, asset.ContentRef{ArchivePath: first, Entry: "c.jpg"}, ref)
+	assert.True(t, index.Manifest.Entries[0].Reference)
+	assert.False(t, index.Manifest.Entries[1].Reference)
+
+	err = ziparchiver.Restore(
+		context.Background(),
+		slices.Values(indexed),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRestoreTargetDir(targetDir),
+	)
+	require.NoError(t, err)
+	restored, err := os.ReadFile(filepath.Join(targetDir, "d.jpg"))
+	require.NoError(t, err)
+	assert.Equal(t, "other photo", string(restored))
+}
+
+// movedTestAsset implements asset.MovedAsset.
+type movedTestAsset struct {
+	asset.Asset
+	from asset.ArchivedAsset
+}
+
+func (m movedTestAsset) MovedFrom() asset.ArchivedAsset { return m.from }
+
+func TestStoreAssets_MovedAssets(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	oldPath := filepath.Join(sourceDir, "a.jpg")
+	require.NoError(t, os.WriteFile(oldPath, []byte("a photo"), 0644))
+	info, err := os.Stat(oldPath)
+	require.NoError(t, err)
+	a, err := asset.NewFromFS(oldPath, info)
+	require.NoError(t, err)
+
+	registry := &MockArchivedAssetRegistry{}
+	backup := func(assets ...asset.Asset) {
+		err := ziparchiver.StoreAssets(
+			context.Background(),
+			sourceDir,
+			ziparchiver.ArchiveDescriptor{Dir: destDir},
+			slices.Values(assets),
+			zerolog.New(io.Discard),
+			ziparchiver.WithRegisterArchivedAssets(registry),
+		)
+		require.NoError(t, err)
+	}
+	backup(a)
+	require.Len(t, registry.assets, 1)
+	first := registry.assets[0].ArchivePath()
+
+	newPath := filepath.Join(sourceDir, "photos", "b.jpg")
+	require.NoError(t, os.Mkdir(filepath.Dir(newPath), 0755))
+	require.NoError(t, os.Rename(oldPath, newPath))
+	info, err = os.Stat(newPath)
+	require.NoError(t, err)
+	b, err := asset.NewFromFS(newPath, info)
+	require.NoError(t, err)
+
+	time.Sleep(2 * time.Millisecond)
+	backup(movedTestAsset{Asset: b, from: registry.assets[0]})
+	require.Len(t, registry.assets, 2)
+	moved := registry.assets[1]
+	assert.Equal(t, newPath, moved.Path())
+	assert.Equal(t, registry.assets[0].StoredHash(), moved.StoredHash())
+	assert.Equal(t, oldPath, moved.(asset.MovedArchivedAsset).PreviousPath())
+	ref, ok := asset.ContentRefOf(moved)
+	require.True(t, ok)
+	assert.Equal(t, asset.ContentRef{ArchivePath: first, Entry: "a.jpg"}, ref)
+
+	// Only the manifest is written, with the move.
+	r, err := zip.OpenReader(moved.ArchivePath())
+	require.NoError(t, err)
+	assert.Empty(t, assetEntries(r.File))
+	require.NoError(t, r.Close())
+	index, err := ziparchiver.ReadArchiveIndex(moved.ArchivePath(), "")
+	require.NoError(t, err)
+	require.Len(t, index.Manifest.Entries, 1)
+	assert.Equal(t, "a.jpg", index.Manifest.Entries[0].MovedFrom)
+
+	err = ziparchiver.Restore(
+		context.Background(),
+		slices.Values([]asset.ArchivedAsset{moved}),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRestoreTargetDir(targetDir),
+	)
+	require.NoError(t, err)
+	restored, err := os.ReadFile(filepath.Join(targetDir, "photos", "b.jpg"))
+	require.NoError(t, err)
+	assert.Equal(t, "a photo", string(restored))
+}
+
+func TestStoreAssets_MovedAssetsArchiveRemoved(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+
+	oldPath := filepath.Join(sourceDir, "a.bin")
+	require.NoError(t, os.WriteFile(oldPath, make([]byte, 100), 0644))
+	info, err := os.Stat(oldPath)
+	require.NoError(t, err)
+	a, err := asset.NewFromFS(oldPath, info)
+	require.NoError(t, err)
+
+	registry := &MockArchivedAssetRegistry{}
+	backup := func(a asset.Asset, opts ...ziparchiver.StoreOption) {
+		err := ziparchiver.StoreAssets(
+			context.Background(),
+			sourceDir,
+			ziparchiver.ArchiveDescriptor{Dir: destDir},
+			slices.Values([]asset.Asset{a}),
+			zerolog.New(io.Discard),
+			append(opts, ziparchiver.WithRegisterArchivedAssets(registry))...,
+		)
+		require.NoError(t, err)
+	}
+	backup(a)
+	require.Len(t, registry.assets, 1)
+	previous := registry.assets[0]
+	require.NoError(t, os.Remove(previous.ArchivePath()))
+
+	newPath := filepath.Join(sourceDir, "b.bin")
+	require.NoError(t, os.Rename(oldPath, newPath))
+	info, err = os.Stat(newPath)
+	require.NoError(t, err)
+	b, err := asset.NewFromFS(newPath, info)
+	require.NoError(t, err)
+	moved := movedTestAsset{Asset: b, from: previous}
+
+	// The contents are written again, so the file is too large for the archives.
+	time.Sleep(2 * time.Millisecond)
+	backup(moved, ziparchiver.WithMaxFileBytes(40))
+	require.Len(t, registry.assets, 1)
+
+	time.Sleep(2 * time.Millisecond)
+	backup(moved, ziparchiver.WithMaxFileBytes(40), ziparchiver.WithSplitLargeFiles(true))
+	require.Len(t, registry.assets, 2)
+	assert.Equal(t, newPath, registry.assets[1].Path())
+	assert.Len(t, asset.ChunksOf(registry.assets[1]), 3)
+	hash, err := registry.assets[1].ComputeHash()
+	require.NoError(t, err)
+	assert.Equal(t, previous.StoredHash(), hash)
+}
+
+func TestStoreAssets_MovedAssetsEncrypted(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+
+	oldPath := filepath.Join(sourceDir, "a.txt")
+	require.NoError(t, os.WriteFile(oldPath, []byte("secret contents"), 0644))
+	info, err := os.Stat(oldPath)
+	require.NoError(t, err)
+	a, err := asset.NewFromFS(oldPath, info)
+	require.NoError(t, err)
+
+	registry := &MockArchivedAssetRegistry{}
+	backup := func(a asset.Asset, opts ...ziparchiver.StoreOption) {
+		err := ziparchiver.StoreAssets(
+			context.Background(),
+			sourceDir,
+			ziparchiver.ArchiveDescriptor{Dir: destDir},
+			slices.Values([]asset.Asset{a}),
+			zerolog.New(io.Discard),
+			append(opts, ziparchiver.WithRegisterArchivedAssets(registry))...,
+		)
+		require.NoError(t, err)
+	}
+	backup(a)
+	require.Len(t, registry.assets, 1)
+
+	newPath := filepath.Join(sourceDir, "b.txt")
+	require.NoError(t, os.Rename(oldPath, newPath))
+	info, err = os.Stat(newPath)
+	require.NoError(t, err)
+	b, err := asset.NewFromFS(newPath, info)
+	require.NoError(t, err)
+
+	// The file was archived without encryption, its contents are written again.
+	time.Sleep(2 * time.Millisecond)
+	backup(movedTestAsset{Asset: b, from: registry.assets[0]}, ziparchiver.WithEncryption([]byte("password")))
+	require.Len(t, registry.assets, 2)
+	moved := registry.assets[1]
+	assert.True(t, asset.IsEncrypted(moved))
+	_, ok := asset.ContentRefOf(moved)
+	assert.False(t, ok)
+
+	r, err := zip.OpenReader(moved.ArchivePath())
+	require.NoError(t, err)
+	entries := assetEntries(r.File)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "b.txt", entries[0].Name)
+	assert.NotZero(t, entries[0].Flags&0x1)
+	require.NoError(t, r.Close())
+}
+
+func TestStoreAssets_RegisterFailed(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	assets := createTestAssets(t, sourceDir, 3)
+
+	registerErr := errors.New("database is locked")
+	var stats ziparchiver.Stats
+	err := ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(&MockArchivedAssetRegistry{err: registerErr}),
+		ziparchiver.WithStats(&stats),
+	)
+	require.ErrorIs(t, err, registerErr)
+	assert.Zero(t, stats.Stored)
+}
+
+func TestStoreAssets_ParityFailed(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	assets := createTestAssets(t, sourceDir, 3)
+
+	// The archive is kept and registered, but the backup fails.
+	registry := &MockArchivedAssetRegistry{}
+	err := ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithParity(1000),
+	)
+	require.ErrorContains(t, err, "could not write parity file")
+	assert.Len(t, registry.assets, 3)
+}
+
+func TestStoreAssets_DeduplicatedNoRollover(t *testing.T) {
+	for _, format := range ziparchiver.Formats {
+		t.Run(string(format), func(t *testing.T) {
+			sourceDir := t.TempDir()
+			destDir := t.TempDir()
+
+			// The copy would not fit in the archive if its contents were written.
+			contents := strings.Repeat("same photo ", 60)
+			var assets []asset.Asset
+			for _, name := range []string{"a.jpg", "b.jpg"} {
+				path := filepath.Join(sourceDir, name)
+				require.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+				info, err := os.Stat(path)
+				require.NoError(t, err)
+				a, err := asset.NewFromFS(path, info)
+				require.NoError(t, err)
+				assets = append(assets, a)
+			}
+
+			registry := &MockArchivedAssetRegistry{}
+			err := ziparchiver.StoreAssets(
+				context.Background(),
+				sourceDir,
+				ziparchiver.ArchiveDescriptor{Dir: destDir},
+				slices.Values(assets),
+				zerolog.New(io.Discard),
+				ziparchiver.WithFormat(format),
+				ziparchiver.WithMaxFileBytes(1024),
+				ziparchiver.WithRegisterArchivedAssets(registry),
+				ziparchiver.WithDeduplication(&MockArchivedContent{registry}),
+			)
+			require.NoError(t, err)
+
+			dirEntries, err := os.ReadDir(destDir)
+			require.NoError(t, err)
+			require.Len(t, dirEntries, 1)
+			require.Len(t, registry.assets, 2)
+			ref, ok := asset.ContentRefOf(registry.assets[1])
+			require.True(t, ok)
+			assert.Equal(t, asset.ContentRef{ArchivePath: registry.assets[0].ArchivePath(), Entry: "a.jpg"}, ref)
+			assert.Equal(t, registry.assets[0].ArchivePath(), registry.assets[1].ArchivePath())
+
+			restored := t.TempDir()
+			err = ziparchiver.Restore(
+				context.Background(),
+				slices.Values(registry.assets),
+				zerolog.New(io.Discard),
+				ziparchiver.WithRestoreTargetDir(restored),
+			)
+			require.NoError(t, err)
+			for _, name := range []string{"a.jpg", "b.jpg"} {
+				data, err := os.ReadFile(filepath.Join(restored, name))
+				require.NoError(t, err)
+				assert.Equal(t, contents, string(data))
+			}
+		})
+	}
 }
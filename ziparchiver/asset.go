@@ -1,10 +1,13 @@
 package ziparchiver
 
 import (
-	"archive/zip"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -18,8 +21,14 @@ type zipAsset struct {
 	name             string
 	path             string
 	hash             uint64
+	strongHash       string // Empty if not computed.
 	uncompressedSize int64
 	modTime          time.Time
+	attributes       asset.Attributes
+	chunks           []asset.Chunk
+	content          *asset.ContentRef
+	movedFrom        string // Previous path of a moved asset.
+	password         []byte // Password of the archives, nil if not encrypted.
 }
 
 func (z *zipAsset) SourcePath() string {
@@ -34,29 +43,49 @@ func (z *zipAsset) StoredHash() uint64 {
 	return z.hash
 }
 
-func (z *zipAsset) ComputeHash() (uint64, error) {
-	reader, err := zip.OpenReader(z.archivePath)
-	if err != nil {
-		return 0, err
-	}
+// ComputeHash returns the hash of the archived contents.
+func (z *zipAsset) ComputeHash() (hash uint64, err error) {
+	archives := Open(WithPassword(z.password))
 	defer func() {
-		closeErr := reader.Close()
-		err = errors.Join(err, closeErr)
+		err = errors.Join(err, archives.Close())
 	}()
 
-	file, err := reader.Open(z.name)
+	file, err := archives.Open(z)
 	if err != nil {
 		return 0, err
 	}
 	defer func() {
-		closeErr := file.Close()
-		err = errors.Join(err, closeErr)
+		err = errors.Join(err, file.Close())
 	}()
-	hash, err := fileutils.ComputeHash(file)
-	if err != nil {
-		return 0, err
+	return fileutils.ComputeHash(file)
+}
+
+// StrongHash implements asset.StrongHashedAsset.
+func (z *zipAsset) StrongHash() string {
+	return z.strongHash
+}
+
+// Encrypted implements asset.EncryptedAsset.
+func (z *zipAsset) Encrypted() bool {
+	return z.password != nil
+}
+
+// Chunks implements asset.ChunkedAsset.
+func (z *zipAsset) Chunks() []asset.Chunk {
+	return z.chunks
+}
+
+// ContentRef implements asset.ReferencingAsset.
+func (z *zipAsset) ContentRef() (asset.ContentRef, bool) {
+	if z.content == nil {
+		return asset.ContentRef{}, false
 	}
-	return hash, err
+	return *z.content, true
+}
+
+// PreviousPath implements asset.MovedArchivedAsset.
+func (z *zipAsset) PreviousPath() string {
+	return z.movedFrom
 }
 
 // MarshalZerologObject implements asset.Asset.
@@ -67,6 +96,15 @@ func (z *zipAsset) MarshalZerologObject(e *zerolog.Event) {
 	e.Int64("size", z.uncompressedSize)
 	e.Str("archive", z.archivePath)
 	e.Str("source", z.sourcePath)
+	if len(z.chunks) > 0 {
+		e.Int("chunks", len(z.chunks))
+	}
+	if z.content != nil {
+		e.Str("content_archive", z.content.ArchivePath)
+	}
+	if z.movedFrom != "" {
+		e.Str("moved_from", z.movedFrom)
+	}
 }
 
 // ModTime implements asset.Asset.
@@ -74,6 +112,11 @@ func (z *zipAsset) ModTime() time.Time {
 	return z.modTime
 }
 
+// Attributes implements asset.Asset.
+func (z *zipAsset) Attributes() asset.Attributes {
+	return z.attributes
+}
+
 // Name implements asset.Asset.
 func (z *zipAsset) Name() string {
 	return z.name
@@ -89,6 +132,43 @@ func (z *zipAsset) Size() int64 {
 	return z.uncompressedSize
 }
 
+// relocatedAsset is an archived asset restored to a path other than the original one.
+type relocatedAsset struct {
+	asset.ArchivedAsset
+	path string
+}
+
+func relocateAsset(a asset.ArchivedAsset, targetDir string) (*relocatedAsset, error) {
+	rel, err := filepath.Rel(a.SourcePath(), a.Path())
+	if err != nil {
+		return nil, err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("asset path %s is outside of source %s", a.Path(), a.SourcePath())
+	}
+
+	return &relocatedAsset{
+		ArchivedAsset: a,
+		path:          filepath.Join(targetDir, rel),
+	}, nil
+}
+
+// Path implements asset.Asset.
+func (r *relocatedAsset) Path() string {
+	return r.path
+}
+
+// ComputeHash implements asset.Asset.
+func (r *relocatedAsset) ComputeHash() (uint64, error) {
+	return fileutils.ComputeFileHash(r.path)
+}
+
+// MarshalZerologObject implements asset.Asset.
+func (r *relocatedAsset) MarshalZerologObject(e *zerolog.Event) {
+	r.ArchivedAsset.MarshalZerologObject(e)
+	e.Str("target", r.path)
+}
+
 type readableAsset interface {
 	asset.Asset
 	Open() (io.ReadCloser, error)
@@ -98,6 +178,16 @@ type readableFileAsset struct {
 	asset.Asset
 }
 
+// Open returns the contents to archive. The target is archived for symbolic links,
+// like zip tools do, and nothing for directories.
 func (r readableFileAsset) Open() (io.ReadCloser, error) {
-	return os.Open(r.Path())
+	attrs := r.Attributes()
+	switch {
+	case attrs.Mode.IsDir():
+		return io.NopCloser(strings.NewReader("")), nil
+	case attrs.Mode&fs.ModeSymlink != 0:
+		return io.NopCloser(strings.NewReader(attrs.LinkTarget)), nil
+	default:
+		return os.Open(r.Path())
+	}
 }
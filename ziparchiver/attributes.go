@@ -0,0 +1,168 @@
+package ziparchiver
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/fileutils"
+	"golang.org/x/sys/unix"
+)
+
+// Info-ZIP "New Unix" extra field, holds the numeric owner of an entry.
+const unixOwnerExtraID = 0x7875
+
+// Set the mode and ownership of an asset in a zip header.
+// Unzip tools use them to restore permissions and, when allowed, ownership.
+func setHeaderAttributes(header *zip.FileHeader, attrs asset.Attributes) {
+	if attrs.Mode == 0 {
+		return
+	}
+	header.SetMode(attrs.Mode)
+	header.Extra = append(header.Extra, unixOwnerExtra(attrs.UID, attrs.GID)...)
+}
+
+func unixOwnerExtra(uid int, gid int) []byte {
+	b := make([]byte, 0, 15)
+	b = binary.LittleEndian.AppendUint16(b, unixOwnerExtraID)
+	b = binary.LittleEndian.AppendUint16(b, 11)
+	b = append(b, 1) // version
+	b = append(b, 4)
+	b = binary.LittleEndian.AppendUint32(b, uint32(uid))
+	b = append(b, 4)
+	b = binary.LittleEndian.AppendUint32(b, uint32(gid))
+	return b
+}
+
+// Read the numeric owner from the Info-ZIP "New Unix" extra field, if present.
+func parseUnixOwnerExtra(extra []byte) (uid int, gid int, ok bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return 0, 0, false
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if id != unixOwnerExtraID || len(field) < 1 || field[0] != 1 {
+			continue
+		}
+
+		field = field[1:]
+		var ids []int
+		for range 2 {
+			if len(field) < 1 || len(field) < 1+int(field[0]) {
+				return 0, 0, false
+			}
+			n := int(field[0])
+			var v uint64
+			for i := n; i > 0; i-- {
+				v = v<<8 | uint64(field[i])
+			}
+			ids = append(ids, int(v))
+			field = field[1+n:]
+		}
+		return ids[0], ids[1], true
+	}
+	return 0, 0, false
+}
+
+// Apply the archived attributes to a restored file.
+// Ownership is only changed when running as root.
+func applyAttributes(path string, a asset.Asset) error {
+	attrs := a.Attributes()
+
+	var err error
+	if os.Geteuid() == 0 {
+		if uid, gid, ok := restoredOwner(attrs); ok {
+			err = errors.Join(err, os.Lchown(path, uid, gid))
+		}
+	}
+
+	if attrs.Mode&fs.ModeSymlink != 0 {
+		// Symbolic links have no permissions and their times are set without following them.
+		if !a.ModTime().IsZero() {
+			ts := []unix.Timespec{
+				unix.NsecToTimespec(a.ModTime().UnixNano()),
+				unix.NsecToTimespec(a.ModTime().UnixNano()),
+			}
+			err = errors.Join(err, unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW))
+		}
+		return err
+	}
+
+	if attrs.Mode != 0 {
+		err = errors.Join(err, os.Chmod(path, restoredPerm(attrs.Mode)))
+	}
+	if !a.ModTime().IsZero() {
+		err = errors.Join(err, os.Chtimes(path, a.ModTime(), a.ModTime()))
+	}
+	return err
+}
+
+// Create the missing parent directories of a restored file.
+// The created directories get the owner of the file and its permissions,
+// plus the execute bit where the file is readable. The owner always has full access.
+func mkdirAllForAsset(dir string, a asset.Asset) error {
+	if fileutils.Exists(dir) {
+		return nil
+	}
+	if err := mkdirAllForAsset(filepath.Dir(dir), a); err != nil {
+		return err
+	}
+
+	attrs := a.Attributes()
+	perm := fs.ModePerm
+	if attrs.Mode != 0 {
+		filePerm := attrs.Mode.Perm()
+		perm = filePerm | (filePerm&0444)>>2 | 0700
+	}
+
+	if err := os.Mkdir(dir, perm); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	if attrs.Mode != 0 {
+		// Mkdir applies the umask.
+		if err := os.Chmod(dir, perm); err != nil {
+			return err
+		}
+	}
+	if os.Geteuid() == 0 {
+		if uid, gid, ok := restoredOwner(attrs); ok {
+			return os.Lchown(dir, uid, gid)
+		}
+	}
+	return nil
+}
+
+// Returns the owner to restore. User and group names take precedence
+// over numeric ids so files restored in another system get the matching owner.
+func restoredOwner(attrs asset.Attributes) (int, int, bool) {
+	if attrs.Mode == 0 {
+		// Unknown attributes, backed up by an older version.
+		return 0, 0, false
+	}
+	uid, gid := attrs.UID, attrs.GID
+	if attrs.User != "" {
+		if id, ok := fileutils.LookupUserID(attrs.User); ok {
+			uid = id
+		}
+	}
+	if attrs.Group != "" {
+		if id, ok := fileutils.LookupGroupID(attrs.Group); ok {
+			gid = id
+		}
+	}
+	return uid, gid, true
+}
+
+func restoredPerm(mode fs.FileMode) fs.FileMode {
+	return mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+}
@@ -0,0 +1,174 @@
+package ziparchiver
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"regexp"
+	"time"
+
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/fileutils"
+)
+
+// Suffix of the entries holding a part of a file split across archives,
+// followed by the number of the part, starting at 1.
+// Extract all the parts and run `cat name.ssbak-chunk-* > name` to rebuild the file.
+const ChunkSuffix = ".ssbak-chunk-"
+
+var chunkEntryPattern = regexp.MustCompile(regexp.QuoteMeta(ChunkSuffix) + `\d{3,}$`)
+
+var errHashMismatch = errors.New("restored contents don't match the archived hash")
+
+var errStrongHashMismatch = errors.New("restored contents don't match the archived strong hash")
+
+// Whether the entry name is a part of a file split across archives.
+func IsChunkEntry(name string) bool {
+	return chunkEntryPattern.MatchString(name)
+}
+
+// Name of the entry holding the part of a file at the given index.
+func chunkEntryName(name string, index int) string {
+	return fmt.Sprintf("%s%s%03d", name, ChunkSuffix, index+1)
+}
+
+// chunkedFile reads the parts of a file split across archives, in order.
+// The hash of the contents is checked once they are all read.
+type chunkedFile struct {
+	asset    asset.ArchivedAsset
+	name     string
+	chunks   []asset.Chunk
+	open     func(archivePath string) (ArchiveReader, error)
+	current  fs.File
+	read     int64 // Bytes read from the current part.
+	hash     hash.Hash64
+	verified bool
+}
+
+func openChunkedFile(a asset.ArchivedAsset, chunks []asset.Chunk, open func(archivePath string) (ArchiveReader, error)) (*chunkedFile, error) {
+	name, err := entryName(a)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkedFile{
+		asset:  a,
+		name:   name,
+		chunks: chunks,
+		open:   open,
+		hash:   fileutils.NewHash(),
+	}, nil
+}
+
+func (f *chunkedFile) Read(p []byte) (int, error) {
+	for {
+		if f.current == nil {
+			if len(f.chunks) == 0 {
+				return 0, f.verify()
+			}
+			if err := f.openNext(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := f.current.Read(p)
+		f.read += int64(n)
+		_, _ = f.hash.Write(p[:n])
+		if errors.Is(err, io.EOF) {
+			if f.read != f.chunks[0].Size {
+				return n, fmt.Errorf("part %s%s has %d bytes, expected %d", f.name, ChunkSuffix, f.read, f.chunks[0].Size)
+			}
+			err = f.current.Close()
+			f.current = nil
+			f.chunks = f.chunks[1:]
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (f *chunkedFile) openNext() error {
+	reader, err := f.open(f.chunks[0].ArchivePath)
+	if err != nil {
+		return err
+	}
+	index := len(asset.ChunksOf(f.asset)) - len(f.chunks)
+	f.current, err = reader.Open(chunkEntryName(f.name, index))
+	if err != nil {
+		return err
+	}
+	f.read = 0
+	return nil
+}
+
+func (f *chunkedFile) verify() error {
+	if !f.verified && f.hash.Sum64() != f.asset.StoredHash() {
+		return errHashMismatch
+	}
+	f.verified = true
+	return io.EOF
+}
+
+func (f *chunkedFile) Stat() (fs.FileInfo, error) {
+	return assetFileInfo{f.asset}, nil
+}
+
+func (f *chunkedFile) Close() error {
+	if f.current == nil {
+		return nil
+	}
+	return f.current.Close()
+}
+
+// strongHashFile checks the strong hash of the contents of a file once they are all read.
+type strongHashFile struct {
+	fs.File
+	alg      fileutils.HashAlgorithm
+	hash     hash.Hash
+	expected string
+	verified bool
+}
+
+func checkStrongHash(f fs.File, a asset.ArchivedAsset) (fs.File, error) {
+	expected, ok := asset.StrongHashOf(a)
+	if !ok {
+		return f, nil
+	}
+	alg, err := fileutils.StrongHashAlgorithm(expected)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	h, err := fileutils.NewStrongHash(alg)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &strongHashFile{File: f, alg: alg, hash: h, expected: expected}, nil
+}
+
+func (f *strongHashFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	_, _ = f.hash.Write(p[:n])
+	if errors.Is(err, io.EOF) && !f.verified {
+		if fileutils.FormatStrongHash(f.alg, f.hash) != f.expected {
+			return n, errStrongHashMismatch
+		}
+		f.verified = true
+	}
+	return n, err
+}
+
+// assetFileInfo describes an archived asset as a file.
+type assetFileInfo struct {
+	asset asset.Asset
+}
+
+func (i assetFileInfo) Name() string       { return i.asset.Name() }
+func (i assetFileInfo) Size() int64        { return i.asset.Size() }
+func (i assetFileInfo) Mode() fs.FileMode  { return i.asset.Attributes().Mode }
+func (i assetFileInfo) ModTime() time.Time { return i.asset.ModTime() }
+func (i assetFileInfo) IsDir() bool        { return i.asset.Attributes().Mode.IsDir() }
+func (i assetFileInfo) Sys() any           { return nil }
@@ -0,0 +1,213 @@
+package ziparchiver_test
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/ziparchiver"
+)
+
+func TestStoreAssets_SplitLargeFiles(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("workers %d", workers), func(t *testing.T) {
+			sourceDir := t.TempDir()
+			destDir := t.TempDir()
+			targetDir := t.TempDir()
+
+			assets := createTestAssets(t, sourceDir, 3)
+			large := make([]byte, 1024*1024)
+			_, err := rand.Read(large)
+			require.NoError(t, err)
+			largePath := filepath.Join(sourceDir, "large.bin")
+			require.NoError(t, os.WriteFile(largePath, large, 0644))
+			info, err := os.Stat(largePath)
+			require.NoError(t, err)
+			largeAsset, err := asset.NewFromFS(largePath, info)
+			require.NoError(t, err)
+			assets = append(assets, largeAsset)
+
+			const maxFileBytes = 300 * 1024
+			registry := &MockArchivedAssetRegistry{}
+			err = ziparchiver.StoreAssets(
+				context.Background(),
+				sourceDir,
+				ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: "backup-"},
+				slices.Values(assets),
+				zerolog.New(io.Discard),
+				ziparchiver.WithRegisterArchivedAssets(registry),
+				ziparchiver.WithMaxFileBytes(maxFileBytes),
+				ziparchiver.WithSplitLargeFiles(true),
+				ziparchiver.WithCompression(ziparchiver.Compression{Method: ziparchiver.CompressionStore}),
+				ziparchiver.WithWorkers(workers),
+			)
+			require.NoError(t, err)
+			require.Len(t, registry.assets, 4)
+
+			split := registry.assets[3]
+			chunks := asset.ChunksOf(split)
+			require.Len(t, chunks, 4)
+			var offset int64
+			for i, c := range chunks {
+				assert.Equal(t, offset, c.Offset)
+				offset += c.Size
+				if i > 0 {
+					assert.NotEqual(t, chunks[i-1].ArchivePath, c.ArchivePath)
+				}
+			}
+			assert.Equal(t, int64(len(large)), offset)
+			assert.Equal(t, chunks[len(chunks)-1].ArchivePath, split.ArchivePath())
+
+			// No archive holds more than the maximum size.
+			dirEntries, err := os.ReadDir(destDir)
+			require.NoError(t, err)
+			require.Len(t, dirEntries, 4)
+			for _, d := range dirEntries {
+				r, err := zip.OpenReader(filepath.Join(destDir, d.Name()))
+				require.NoError(t, err)
+				var size uint64
+				for _, f := range assetEntries(r.File) {
+					size += f.UncompressedSize64
+				}
+				assert.Less(t, size, uint64(maxFileBytes), d.Name())
+				require.NoError(t, r.Close())
+			}
+
+			hash, err := split.ComputeHash()
+			require.NoError(t, err)
+			assert.Equal(t, split.StoredHash(), hash)
+
+			// The parts are found back from the manifest of the last archive.
+			index, err := ziparchiver.ReadArchiveIndex(split.ArchivePath(), "")
+			require.NoError(t, err)
+			var indexed []asset.ArchivedAsset
+			for a := range index.Assets() {
+				indexed = append(indexed, a)
+			}
+			require.Len(t, indexed, 1)
+			assert.Equal(t, chunks, asset.ChunksOf(indexed[0]))
+
+			err = ziparchiver.Restore(
+				context.Background(),
+				slices.Values(indexed),
+				zerolog.New(io.Discard),
+				ziparchiver.WithRestoreTargetDir(targetDir),
+			)
+			require.NoError(t, err)
+			restored, err := os.ReadFile(filepath.Join(targetDir, "large.bin"))
+			require.NoError(t, err)
+			assert.Equal(t, large, restored)
+		})
+	}
+}
+
+func TestRestore_SplitFileHashMismatch(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	path := filepath.Join(sourceDir, "large.bin")
+	require.NoError(t, os.WriteFile(path, make([]byte, 1000), 0644))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	a, err := asset.NewFromFS(path, info)
+	require.NoError(t, err)
+
+	registry := &MockArchivedAssetRegistry{}
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir},
+		slices.Values([]asset.Asset{a}),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithMaxFileBytes(300),
+		ziparchiver.WithSplitLargeFiles(true),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, 1)
+	require.Len(t, asset.ChunksOf(registry.assets[0]), 4)
+
+	err = ziparchiver.Restore(
+		context.Background(),
+		slices.Values([]asset.ArchivedAsset{wrongHashAsset{registry.assets[0].(asset.ChunkedAsset)}}),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRestoreTargetDir(targetDir),
+	)
+	require.NoError(t, err)
+
+	// The corrupted file is not kept.
+	_, err = os.Stat(filepath.Join(targetDir, "large.bin"))
+	assert.True(t, os.IsNotExist(err))
+
+	err = ziparchiver.Restore(
+		context.Background(),
+		slices.Values(registry.assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRestoreTargetDir(targetDir),
+	)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(targetDir, "large.bin"))
+	assert.NoError(t, err)
+}
+
+func TestStoreAssets_SplitFileFailed(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+
+	assets := createTestAssets(t, sourceDir, 2)
+	path := filepath.Join(sourceDir, "large.bin")
+	require.NoError(t, os.WriteFile(path, make([]byte, 1000), 0644))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	large, err := asset.NewFromFS(path, info)
+	require.NoError(t, err)
+	// The file shrinks after being scanned, its third part can't be written.
+	require.NoError(t, os.Truncate(path, 700))
+
+	registry := &MockArchivedAssetRegistry{}
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir},
+		slices.Values([]asset.Asset{assets[0], large, assets[1]}),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithMaxFileBytes(300),
+		ziparchiver.WithSplitLargeFiles(true),
+		ziparchiver.WithCompression(ziparchiver.Compression{Method: ziparchiver.CompressionStore}),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, 2)
+
+	// The archive only holding a part of the failed file is removed.
+	var registered []string
+	for _, a := range registry.assets {
+		registered = append(registered, filepath.Base(a.ArchivePath()))
+	}
+	dirEntries, err := os.ReadDir(destDir)
+	require.NoError(t, err)
+	var names []string
+	for _, d := range dirEntries {
+		names = append(names, d.Name())
+	}
+	assert.ElementsMatch(t, slices.Compact(registered), names)
+}
+
+type wrongHashAsset struct {
+	asset.ChunkedAsset
+}
+
+func (w wrongHashAsset) StoredHash() uint64 {
+	return w.ChunkedAsset.StoredHash() + 1
+}
@@ -0,0 +1,240 @@
+package ziparchiver
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/fileutils"
+	"github.com/stupid-simple/backup/ziparchiver/zipwriter"
+)
+
+// Compressor of the archive entries.
+type CompressionMethod string
+
+const (
+	CompressionDeflate CompressionMethod = "deflate"
+	// Zstd entries in zip archives use method 93, which not all unzip tools support.
+	CompressionZstd  CompressionMethod = "zstd"
+	CompressionStore CompressionMethod = "store"
+)
+
+// How the archive entries are compressed.
+type Compression struct {
+	Method CompressionMethod
+	Level  int // Zero for the default level of the method.
+}
+
+// Parse the compression settings. An empty method is deflate.
+// Deflate levels go from 1 to 9 and zstd levels from 1 to 22. The zstd encoder
+// only has 4 levels, zstd levels 1-2, 3-5, 6-9 and 10-22 compress the same.
+func ParseCompression(method string, level int) (Compression, error) {
+	c := Compression{Method: CompressionMethod(method), Level: level}
+	if c.Method == "" {
+		c.Method = CompressionDeflate
+	}
+
+	var maxLevel int
+	switch c.Method {
+	case CompressionDeflate:
+		maxLevel = 9
+	case CompressionZstd:
+		maxLevel = 22
+	case CompressionStore:
+		if level != 0 {
+			return Compression{}, fmt.Errorf("store compression has no level")
+		}
+		return c, nil
+	default:
+		return Compression{}, fmt.Errorf("unknown compression method: %s", method)
+	}
+	if level < 0 || level > maxLevel {
+		return Compression{}, fmt.Errorf("%s compression level must be between 1 and %d", c.Method, maxLevel)
+	}
+	return c, nil
+}
+
+// Method of the compressed entries in zip archives.
+func (c Compression) zipMethod() uint16 {
+	switch c.Method {
+	case CompressionZstd:
+		return zipwriter.Zstd
+	case CompressionStore:
+		return zip.Store
+	default:
+		return zip.Deflate
+	}
+}
+
+// Number of bytes read from the start of an asset to decide how to write it.
+const compressionSampleSize = 64 * 1024
+
+// Assets whose sample doesn't shrink below this ratio are stored without compression.
+const minCompressionRatio = 0.9
+
+// Decides which assets are written to zip archives without compression.
+// Compressing media files or archives costs time for almost no gain.
+type CompressionPolicy struct {
+	extensions map[string]bool
+	mimeTypes  []string
+	auto       bool
+}
+
+// Returns a policy that stores without compression the assets matching store,
+// which holds file extensions, like ".jpg", or MIME types, like "video/mp4" or
+// "image/*". If auto is true, the first bytes of the other assets are compressed
+// and the assets are stored if they don't compress well.
+func NewCompressionPolicy(store []string, auto bool) (*CompressionPolicy, error) {
+	p := &CompressionPolicy{
+		extensions: map[string]bool{},
+		auto:       auto,
+	}
+	for _, s := range store {
+		s = strings.ToLower(strings.TrimSpace(s))
+		switch {
+		case s == "":
+			continue
+		case strings.Contains(s, "/"):
+			if _, err := path.Match(s, ""); err != nil {
+				return nil, fmt.Errorf("invalid MIME type pattern %s: %w", s, err)
+			}
+			p.mimeTypes = append(p.mimeTypes, s)
+		default:
+			p.extensions["."+strings.TrimPrefix(s, ".")] = true
+		}
+	}
+	return p, nil
+}
+
+// How an asset was written.
+type compressionChoice struct {
+	store  bool
+	reason string // Why the asset is stored without compression.
+}
+
+// Decide how to write the asset with the given name. The returned reader has
+// the same contents as r, including the bytes read to decide.
+func (p *CompressionPolicy) choose(name string, r io.Reader) (compressionChoice, io.Reader, error) {
+	if p == nil {
+		return compressionChoice{}, r, nil
+	}
+	ext := strings.ToLower(path.Ext(name))
+	if p.extensions[ext] {
+		return compressionChoice{store: true, reason: "extension"}, r, nil
+	}
+	if len(p.mimeTypes) == 0 && !p.auto {
+		return compressionChoice{}, r, nil
+	}
+
+	sample := make([]byte, compressionSampleSize)
+	n, err := io.ReadFull(r, sample)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return compressionChoice{}, nil, err
+	}
+	sample = sample[:n]
+	r = io.MultiReader(bytes.NewReader(sample), r)
+
+	if len(p.mimeTypes) > 0 && p.matchesMIMEType(ext, sample) {
+		return compressionChoice{store: true, reason: "mime type"}, r, nil
+	}
+	if p.auto && len(sample) > 0 {
+		ratio, err := sampleCompressionRatio(sample)
+		if err != nil {
+			return compressionChoice{}, nil, err
+		}
+		if ratio > minCompressionRatio {
+			return compressionChoice{store: true, reason: "incompressible"}, r, nil
+		}
+	}
+	return compressionChoice{}, r, nil
+}
+
+// The MIME type is found both from the extension and from the contents.
+func (p *CompressionPolicy) matchesMIMEType(ext string, sample []byte) bool {
+	types := []string{http.DetectContentType(sample)}
+	if t := mime.TypeByExtension(ext); t != "" {
+		types = append(types, t)
+	}
+	for _, t := range types {
+		t, _, _ = strings.Cut(t, ";")
+		t = strings.ToLower(strings.TrimSpace(t))
+		for _, pattern := range p.mimeTypes {
+			if ok, _ := path.Match(pattern, t); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var samplers = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(io.Discard, flate.DefaultCompression)
+		return w
+	},
+}
+
+// Compressed size of the sample divided by its size.
+func sampleCompressionRatio(sample []byte) (float64, error) {
+	counter := &fileutils.CountingWriter{W: io.Discard}
+	w := samplers.Get().(*flate.Writer)
+	defer samplers.Put(w)
+	w.Reset(counter)
+	if _, err := w.Write(sample); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return float64(counter.Count) / float64(len(sample)), nil
+}
+
+// Sizes of the files written to archives, and how they were written.
+type compressionStats struct {
+	stored         int   // Files written without compression.
+	compressed     int   // Files written with compression.
+	deduplicated   int   // Files referencing identical contents instead of being written.
+	moved          int   // Files referencing the contents of their previous path.
+	size           int64 // Size of the files.
+	compressedSize int64 // Size of the files in the archives.
+}
+
+func (s *compressionStats) add(o compressionStats) {
+	s.stored += o.stored
+	s.compressed += o.compressed
+	s.deduplicated += o.deduplicated
+	s.moved += o.moved
+	s.size += o.size
+	s.compressedSize += o.compressedSize
+}
+
+// Compressed size divided by the size of the files.
+func (s compressionStats) ratio() float64 {
+	if s.size == 0 {
+		return 1
+	}
+	return float64(s.compressedSize) / float64(s.size)
+}
+
+// MarshalZerologObject implements zerolog.LogObjectMarshaler.
+func (s compressionStats) MarshalZerologObject(e *zerolog.Event) {
+	e.Int("uncompressed_files", s.stored)
+	e.Int("compressed_files", s.compressed)
+	if s.deduplicated > 0 {
+		e.Int("deduplicated_files", s.deduplicated)
+	}
+	if s.moved > 0 {
+		e.Int("moved_files", s.moved)
+	}
+	e.Int64("compressed_size", s.compressedSize)
+	e.Float64("ratio", s.ratio())
+}
@@ -0,0 +1,217 @@
+package ziparchiver_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/ziparchiver"
+)
+
+func TestParseCompression(t *testing.T) {
+	c, err := ziparchiver.ParseCompression("", 0)
+	require.NoError(t, err)
+	assert.Equal(t, ziparchiver.Compression{Method: ziparchiver.CompressionDeflate}, c)
+
+	c, err = ziparchiver.ParseCompression("zstd", 19)
+	require.NoError(t, err)
+	assert.Equal(t, ziparchiver.Compression{Method: ziparchiver.CompressionZstd, Level: 19}, c)
+
+	_, err = ziparchiver.ParseCompression("deflate", 10)
+	assert.Error(t, err)
+	_, err = ziparchiver.ParseCompression("zstd", 23)
+	assert.Error(t, err)
+	_, err = ziparchiver.ParseCompression("store", 1)
+	assert.Error(t, err)
+	_, err = ziparchiver.ParseCompression("lzma", 0)
+	assert.Error(t, err)
+}
+
+func TestStoreAssets_Compression(t *testing.T) {
+	tests := []struct {
+		compression ziparchiver.Compression
+		method      uint16
+	}{
+		{ziparchiver.Compression{Method: ziparchiver.CompressionDeflate, Level: 1}, zip.Deflate},
+		{ziparchiver.Compression{Method: ziparchiver.CompressionZstd, Level: 19}, 93},
+		{ziparchiver.Compression{Method: ziparchiver.CompressionStore}, zip.Store},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.compression.Method), func(t *testing.T) {
+			sourceDir := t.TempDir()
+			destDir := t.TempDir()
+			targetDir := t.TempDir()
+
+			assets := createTestAssets(t, sourceDir, 3)
+
+			registry := &MockArchivedAssetRegistry{}
+			err := ziparchiver.StoreAssets(
+				context.Background(),
+				sourceDir,
+				ziparchiver.ArchiveDescriptor{Dir: destDir},
+				slices.Values(assets),
+				zerolog.New(io.Discard),
+				ziparchiver.WithRegisterArchivedAssets(registry),
+				ziparchiver.WithCompression(tt.compression),
+			)
+			require.NoError(t, err)
+			require.Len(t, registry.assets, 3)
+
+			r, err := zip.OpenReader(registry.assets[0].ArchivePath())
+			require.NoError(t, err)
+			for _, f := range assetEntries(r.File) {
+				assert.Equal(t, tt.method, f.Method, f.Name)
+			}
+			require.NoError(t, r.Close())
+
+			for _, a := range registry.assets {
+				hash, err := a.ComputeHash()
+				require.NoError(t, err)
+				assert.Equal(t, a.StoredHash(), hash)
+			}
+
+			err = ziparchiver.Restore(
+				context.Background(),
+				slices.Values(registry.assets),
+				zerolog.New(io.Discard),
+				ziparchiver.WithRestoreTargetDir(targetDir),
+			)
+			require.NoError(t, err)
+			for _, a := range assets {
+				expected, err := os.ReadFile(a.Path())
+				require.NoError(t, err)
+				actual, err := os.ReadFile(filepath.Join(targetDir, filepath.Base(a.Path())))
+				require.NoError(t, err)
+				assert.Equal(t, string(expected), string(actual))
+			}
+		})
+	}
+}
+
+func TestNewCompressionPolicy_Invalid(t *testing.T) {
+	_, err := ziparchiver.NewCompressionPolicy([]string{"image/["}, false)
+	assert.Error(t, err)
+
+	_, err = ziparchiver.NewCompressionPolicy([]string{"jpg", ".MP4", "video/*", ""}, true)
+	assert.NoError(t, err)
+}
+
+func TestStoreAssets_CompressionPolicy(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+
+	random := make([]byte, 100*1024)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+	text := []byte(strings.Repeat("some text that compresses well\n", 4096))
+	png := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), text...)
+
+	contents := map[string][]byte{
+		"photo.JPG":   text,   // Stored by extension.
+		"picture.dat": png,    // Stored by sniffed MIME type.
+		"random.bin":  random, // Stored because it doesn't compress.
+		"notes.txt":   text,
+		"empty.txt":   nil,
+	}
+	var assets []asset.Asset
+	for name, content := range contents {
+		path := filepath.Join(sourceDir, name)
+		require.NoError(t, os.WriteFile(path, content, 0644))
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		a, err := asset.NewFromFS(path, info)
+		require.NoError(t, err)
+		assets = append(assets, a)
+	}
+
+	policy, err := ziparchiver.NewCompressionPolicy([]string{"jpg", "image/*"}, true)
+	require.NoError(t, err)
+
+	registry := &MockArchivedAssetRegistry{}
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: "backup-"},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithCompressionPolicy(policy),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, len(contents))
+
+	r, err := zip.OpenReader(registry.assets[0].ArchivePath())
+	require.NoError(t, err)
+	defer func() {
+		_ = r.Close()
+	}()
+
+	methods := map[string]uint16{}
+	for _, f := range assetEntries(r.File) {
+		methods[f.Name] = f.Method
+
+		rc, err := f.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.True(t, bytes.Equal(contents[f.Name], content), "content of %s", f.Name)
+	}
+	assert.Equal(t, map[string]uint16{
+		"photo.JPG":   zip.Store,
+		"picture.dat": zip.Store,
+		"random.bin":  zip.Store,
+		"notes.txt":   zip.Deflate,
+		"empty.txt":   zip.Deflate,
+	}, methods)
+
+	for _, a := range registry.assets {
+		hash, err := a.ComputeHash()
+		require.NoError(t, err)
+		assert.Equal(t, a.StoredHash(), hash)
+	}
+}
+
+func TestStoreAssets_DefaultCompression(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+
+	path := filepath.Join(sourceDir, "photo.jpg")
+	require.NoError(t, os.WriteFile(path, []byte("not really a photo"), 0644))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	a, err := asset.NewFromFS(path, info)
+	require.NoError(t, err)
+
+	registry := &MockArchivedAssetRegistry{}
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir},
+		slices.Values([]asset.Asset{a}),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, 1)
+
+	r, err := zip.OpenReader(registry.assets[0].ArchivePath())
+	require.NoError(t, err)
+	defer func() {
+		_ = r.Close()
+	}()
+	entries := assetEntries(r.File)
+	require.Len(t, entries, 1)
+	assert.Equal(t, zip.Deflate, entries[0].Method)
+}
@@ -0,0 +1,186 @@
+package ziparchiver
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/fileutils"
+	"github.com/stupid-simple/backup/signing"
+)
+
+// File format of the backup archives.
+type Format string
+
+const (
+	FormatZip     Format = "zip"
+	FormatTarZstd Format = "tar.zst"
+)
+
+// All the supported formats.
+var Formats = []Format{FormatZip, FormatTarZstd}
+
+// Parse a format name. An empty name is the default zip format.
+func ParseFormat(name string) (Format, error) {
+	if name == "" {
+		return FormatZip, nil
+	}
+	for _, f := range Formats {
+		if string(f) == name {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unknown archive format: %s", name)
+}
+
+// File extension of the archives, including the leading dot.
+func (f Format) Extension() string {
+	return "." + string(f)
+}
+
+// Whether each entry is compressed on its own, so it can be stored without compression.
+func (f Format) compressesEntries() bool {
+	return f == FormatZip
+}
+
+// Returns the format of an archive from its file name.
+func FormatOf(path string) (Format, bool) {
+	for _, f := range Formats {
+		if strings.HasSuffix(path, f.Extension()) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// Whether the file name is the one of an archive, in any of the formats.
+func IsArchiveFile(path string) bool {
+	_, ok := FormatOf(path)
+	return ok
+}
+
+// An entry of an archive.
+type Entry struct {
+	Name       string // Slash separated path in the archive. Directories end with a slash.
+	Size       int64
+	ModTime    time.Time
+	Attributes asset.Attributes
+	// Write the contents without compression, for formats that compress each entry.
+	Store bool
+}
+
+// A new archive being written.
+type ArchiveWriter interface {
+	// Path of the archive once complete.
+	Path() string
+	// Add an entry to the archive. Its contents are written to the returned writer.
+	Create(e *Entry) (io.Writer, error)
+	// Complete the archive and move it to its path.
+	Close() error
+	// Remove the archive without completing it.
+	Discard() error
+	// Number of bytes written for the entries, after compression.
+	CompressedSize() int64
+}
+
+// An existing archive being read.
+type ArchiveReader interface {
+	// Open the entry with the given name.
+	Open(name string) (fs.File, error)
+	// Call fn with each entry of the archive, in order, and a reader of its contents.
+	List(fn func(e *Entry, r io.Reader) error) error
+	// Whether the entries are encrypted.
+	Encrypted() bool
+	Close() error
+}
+
+// Returned when reading an encrypted entry without a password.
+var ErrPasswordRequired = errors.New("archive is encrypted, a password is required")
+
+type OpenOption func(o *openOptions)
+
+type openOptions struct {
+	password  []byte
+	publicKey ed25519.PublicKey
+}
+
+// Decrypt the entries of encrypted zip archives with the password.
+func WithPassword(password []byte) OpenOption {
+	return func(o *openOptions) {
+		o.password = password
+	}
+}
+
+// Check the signature of the archives with the public key before reading them.
+// Archives without a valid signature for the key are not opened.
+func WithPublicKey(key ed25519.PublicKey) OpenOption {
+	return func(o *openOptions) {
+		o.publicKey = key
+	}
+}
+
+// Open an archive for reading. Its format is given by its file name.
+func OpenArchive(path string, opts ...OpenOption) (ArchiveReader, error) {
+	o := openOptions{}
+	for _, applyOpts := range opts {
+		applyOpts(&o)
+	}
+	format, ok := FormatOf(path)
+	if !ok {
+		return nil, fmt.Errorf("unknown archive format: %s", path)
+	}
+	if o.publicKey != nil {
+		if err := signing.Verify(path, o.publicKey); err != nil {
+			return nil, err
+		}
+	}
+	switch format {
+	case FormatTarZstd:
+		return openTarZstdArchive(path)
+	default:
+		return openZipArchive(path, o.password)
+	}
+}
+
+// Create a new archive. Nothing is written until the first entry is added.
+// The entries are encrypted with the password if set, zip archives only.
+func newArchiveWriter(format Format, path string, dryRun bool, compression Compression, password []byte) ArchiveWriter {
+	switch format {
+	case FormatTarZstd:
+		return newTarZstdArchive(path, dryRun, compression)
+	default:
+		return newZipArchive(path, dryRun, compression, password)
+	}
+}
+
+// Finds the temporary files left behind by archives that were never completed.
+func findPartialArchives(dir string, prefix string) ([]string, error) {
+	var paths []string
+	for _, f := range Formats {
+		pattern := filepath.Join(dir, escapeGlob(prefix)+"*"+f.Extension()+fileutils.PartialSuffix)
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+func escapeGlob(s string) string {
+	var escaped []byte
+	for i := range len(s) {
+		switch s[i] {
+		case '*', '?', '[', '\\':
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, s[i])
+	}
+	return string(escaped)
+}
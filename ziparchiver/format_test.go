@@ -0,0 +1,198 @@
+package ziparchiver_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/ziparchiver"
+)
+
+func TestParseFormat(t *testing.T) {
+	format, err := ziparchiver.ParseFormat("")
+	require.NoError(t, err)
+	assert.Equal(t, ziparchiver.FormatZip, format)
+
+	format, err = ziparchiver.ParseFormat("tar.zst")
+	require.NoError(t, err)
+	assert.Equal(t, ziparchiver.FormatTarZstd, format)
+
+	_, err = ziparchiver.ParseFormat("rar")
+	assert.Error(t, err)
+
+	format, ok := ziparchiver.FormatOf("/archives/backup-1700000000000.1.tar.zst")
+	assert.True(t, ok)
+	assert.Equal(t, ziparchiver.FormatTarZstd, format)
+	format, ok = ziparchiver.FormatOf("backup-1700000000000.zip")
+	assert.True(t, ok)
+	assert.Equal(t, ziparchiver.FormatZip, format)
+	_, ok = ziparchiver.FormatOf("backup-1700000000000.zip.partial")
+	assert.False(t, ok)
+}
+
+func TestStoreAssets_TarZstd(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	longDir := filepath.Join(sourceDir, strings.Repeat("d", 120))
+	require.NoError(t, os.MkdirAll(longDir, 0755))
+	modTime := time.Date(2024, 5, 1, 10, 30, 0, 123456789, time.UTC)
+	files := map[string]string{
+		"file.txt": "content",
+		filepath.Join(filepath.Base(longDir), strings.Repeat("f", 80)): "long path content",
+	}
+	for name, content := range files {
+		path := filepath.Join(sourceDir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0640))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	require.NoError(t, os.Symlink("file.txt", filepath.Join(sourceDir, "link.txt")))
+	require.NoError(t, os.Mkdir(filepath.Join(sourceDir, "empty"), 0750))
+
+	assets, err := asset.ScanDirectory(context.Background(), sourceDir, zerolog.New(io.Discard))
+	require.NoError(t, err)
+
+	registry := &MockArchivedAssetRegistry{}
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: "backup-"},
+		assets,
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithFormat(ziparchiver.FormatTarZstd),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, 4)
+	archivePath := registry.assets[0].ArchivePath()
+	assert.True(t, strings.HasSuffix(archivePath, ".tar.zst"), "Unexpected archive name %s", archivePath)
+
+	// The archive can be listed, with the manifest at the end.
+	reader, err := ziparchiver.OpenArchive(archivePath)
+	require.NoError(t, err)
+	var names []string
+	err = reader.List(func(e *ziparchiver.Entry, r io.Reader) error {
+		names = append(names, e.Name)
+		if e.Name == "link.txt" {
+			assert.NotZero(t, e.Attributes.Mode&os.ModeSymlink)
+			assert.Equal(t, "file.txt", e.Attributes.LinkTarget)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Contains(t, names, "empty/")
+	assert.Equal(t, ziparchiver.ManifestPath, names[len(names)-1])
+
+	err = ziparchiver.Restore(
+		context.Background(),
+		slices.Values(registry.assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRestoreTargetDir(targetDir),
+	)
+	require.NoError(t, err)
+
+	for name, content := range files {
+		path := filepath.Join(targetDir, name)
+		restored, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(restored))
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+		assert.True(t, modTime.Equal(info.ModTime()), "Expected mod time %s, got %s", modTime, info.ModTime())
+	}
+	target, err := os.Readlink(filepath.Join(targetDir, "link.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "file.txt", target)
+	info, err := os.Stat(filepath.Join(targetDir, "empty"))
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+}
+
+func TestRestore_MixedFormats(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	assets := createTestAssets(t, sourceDir, 4)
+
+	registry := &MockArchivedAssetRegistry{}
+	for i, format := range []ziparchiver.Format{ziparchiver.FormatZip, ziparchiver.FormatTarZstd} {
+		err := ziparchiver.StoreAssets(
+			context.Background(),
+			sourceDir,
+			ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: string(format) + "-"},
+			slices.Values(assets[i*2:i*2+2]),
+			zerolog.New(io.Discard),
+			ziparchiver.WithRegisterArchivedAssets(registry),
+			ziparchiver.WithFormat(format),
+		)
+		require.NoError(t, err)
+	}
+	require.Len(t, registry.assets, 4)
+
+	// Restored in reverse order, as found in the database.
+	restored := slices.Clone(registry.assets)
+	slices.Reverse(restored)
+	err := ziparchiver.Restore(
+		context.Background(),
+		slices.Values(restored),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRestoreTargetDir(targetDir),
+	)
+	require.NoError(t, err)
+
+	for _, a := range assets {
+		expected, err := os.ReadFile(a.Path())
+		require.NoError(t, err)
+		actual, err := os.ReadFile(filepath.Join(targetDir, filepath.Base(a.Path())))
+		require.NoError(t, err)
+		assert.Equal(t, string(expected), string(actual))
+	}
+}
+
+func TestStoreAssets_TarZstdFileShrank(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+
+	assets := createTestAssets(t, sourceDir, 3)
+	// The file shrinks after being scanned.
+	require.NoError(t, os.WriteFile(assets[1].Path(), []byte("short"), 0644))
+
+	registry := &MockArchivedAssetRegistry{}
+	err := ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: "backup-"},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithFormat(ziparchiver.FormatTarZstd),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, 2)
+	for _, a := range registry.assets {
+		assert.NotEqual(t, assets[1].Path(), a.Path())
+	}
+
+	// The files after it are still readable.
+	err = ziparchiver.Restore(
+		context.Background(),
+		slices.Values(registry.assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRestoreTargetDir(t.TempDir()),
+	)
+	require.NoError(t, err)
+}
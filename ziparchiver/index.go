@@ -0,0 +1,234 @@
+package ziparchiver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/fileutils"
+)
+
+// An archive read back from the archive directory.
+type IndexedArchive struct {
+	Path     string
+	Manifest *Manifest
+	// Whether the manifest was embedded in the archive. Otherwise it was built
+	// from the entries headers and contents.
+	Embedded bool
+	// Whether the entries of the archive are encrypted.
+	Encrypted bool
+	password  []byte
+}
+
+// Archive names end with the creation time in Unix milliseconds, and the part number if any.
+var archiveNameTime = regexp.MustCompile(`(\d{13})(\.\d+)?\.(zip|tar\.zst)$`)
+
+// Read the description of an archive. The embedded manifest is used when present.
+// Otherwise, the archive is described from its entries headers and the entries
+// are hashed, sourcePath is then required to know where the entries come from.
+// The format of the archive is given by its file name. Encrypted archives
+// require the password.
+func ReadArchiveIndex(archivePath string, sourcePath string, opts ...OpenOption) (*IndexedArchive, error) {
+	o := openOptions{}
+	for _, applyOpts := range opts {
+		applyOpts(&o)
+	}
+	reader, err := OpenArchive(archivePath, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	indexed := &IndexedArchive{Path: archivePath}
+	if reader.Encrypted() {
+		indexed.Encrypted = true
+		indexed.password = o.password
+	}
+
+	manifest, err := readEmbeddedManifest(reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest: %w", err)
+	}
+	if manifest != nil {
+		indexed.Manifest = manifest
+		indexed.Embedded = true
+		return indexed, nil
+	}
+
+	if sourcePath == "" {
+		return nil, fmt.Errorf("archive has no manifest and no source path was given")
+	}
+	manifest, err = describeArchive(reader, archivePath, sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	indexed.Manifest = manifest
+	return indexed, nil
+}
+
+// Assets stored in the archive.
+func (a *IndexedArchive) Assets() iter.Seq[asset.ArchivedAsset] {
+	return func(yield func(asset.ArchivedAsset) bool) {
+		for _, e := range a.Manifest.Entries {
+			hash, err := strconv.ParseUint(e.Hash, 16, 64)
+			if err != nil {
+				continue
+			}
+			name := unescapeEntryName(strings.TrimSuffix(e.Name, "/"))
+			var chunks []asset.Chunk
+			for _, c := range e.Chunks {
+				chunks = append(chunks, asset.Chunk{
+					ArchivePath: filepath.Join(filepath.Dir(a.Path), c.Archive),
+					Offset:      c.Offset,
+					Size:        c.Size,
+				})
+			}
+			var movedFrom string
+			if e.MovedFrom != "" {
+				movedFrom = filepath.Join(a.Manifest.SourcePath, filepath.FromSlash(e.MovedFrom))
+			}
+			var content *asset.ContentRef
+			if e.Content != nil {
+				content = &asset.ContentRef{
+					ArchivePath: filepath.Join(filepath.Dir(a.Path), e.Content.Archive),
+					Entry:       e.Content.Name,
+				}
+			}
+			if !yield(&zipAsset{
+				sourcePath:       a.Manifest.SourcePath,
+				archivePath:      a.Path,
+				name:             path.Base(name),
+				path:             filepath.Join(a.Manifest.SourcePath, filepath.FromSlash(name)),
+				hash:             hash,
+				strongHash:       e.StrongHash,
+				uncompressedSize: e.Size,
+				modTime:          e.ModTime,
+				attributes: asset.Attributes{
+					Mode:       os.FileMode(e.Mode),
+					UID:        e.UID,
+					GID:        e.GID,
+					User:       e.User,
+					Group:      e.Group,
+					LinkTarget: e.LinkTarget,
+				},
+				chunks:    chunks,
+				content:   content,
+				movedFrom: movedFrom,
+				password:  a.password,
+			}) {
+				return
+			}
+		}
+	}
+}
+
+func readEmbeddedManifest(reader ArchiveReader) (*Manifest, error) {
+	f, err := reader.Open(ManifestPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	manifest := &Manifest{}
+	if err := json.NewDecoder(f).Decode(manifest); err != nil {
+		return nil, err
+	}
+	if manifest.SourcePath == "" {
+		return nil, fmt.Errorf("manifest has no source path")
+	}
+	for _, e := range manifest.Entries {
+		if _, err := strconv.ParseUint(e.Hash, 16, 64); err != nil {
+			return nil, fmt.Errorf("invalid hash for entry %s: %w", e.Name, err)
+		}
+	}
+	return manifest, nil
+}
+
+// Build a manifest from the entries of an archive written without one.
+func describeArchive(reader ArchiveReader, archivePath string, sourcePath string) (*Manifest, error) {
+	manifest := &Manifest{
+		SourcePath: sourcePath,
+		CreatedAt:  archiveCreationTime(archivePath),
+	}
+
+	err := reader.List(func(e *Entry, r io.Reader) error {
+		if IsMetadataEntry(e.Name) {
+			return nil
+		}
+		if IsChunkEntry(e.Name) {
+			// Without the manifest, the parts of split files can't be put back together.
+			return nil
+		}
+		if !filepath.IsLocal(filepath.FromSlash(strings.TrimSuffix(e.Name, "/"))) {
+			return fmt.Errorf("invalid entry name: %s", e.Name)
+		}
+
+		entry, err := describeEntry(e, r)
+		if err != nil {
+			return fmt.Errorf("could not read entry %s: %w", e.Name, err)
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func describeEntry(e *Entry, r io.Reader) (ManifestEntry, error) {
+	attrs := e.Attributes
+	if attrs.Mode&os.ModeSymlink != 0 {
+		// Links are hashed by their target.
+		r = strings.NewReader(attrs.LinkTarget)
+	}
+	hash, err := fileutils.ComputeHash(r)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+
+	return ManifestEntry{
+		Name:       e.Name,
+		Hash:       formatHash(hash),
+		Size:       e.Size,
+		ModTime:    e.ModTime.UTC(),
+		Mode:       uint32(attrs.Mode),
+		UID:        attrs.UID,
+		GID:        attrs.GID,
+		User:       attrs.User,
+		Group:      attrs.Group,
+		LinkTarget: attrs.LinkTarget,
+	}, nil
+}
+
+// The creation time of an archive without manifest, from its name if possible
+// or from its modification time otherwise.
+func archiveCreationTime(archivePath string) time.Time {
+	if m := archiveNameTime.FindStringSubmatch(filepath.Base(archivePath)); m != nil {
+		if ms, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+			return time.UnixMilli(ms).UTC()
+		}
+	}
+	if info, err := os.Stat(archivePath); err == nil {
+		return info.ModTime().UTC()
+	}
+	return time.Time{}
+}
@@ -0,0 +1,149 @@
+package ziparchiver_test
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/ziparchiver"
+)
+
+func TestReadArchiveIndex_Manifest(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+
+	assets := createTestAssets(t, sourceDir, 2)
+	require.NoError(t, os.Symlink("file0.txt", filepath.Join(sourceDir, "link")))
+	linkInfo, err := os.Lstat(filepath.Join(sourceDir, "link"))
+	require.NoError(t, err)
+	link, err := asset.NewFromFS(filepath.Join(sourceDir, "link"), linkInfo)
+	require.NoError(t, err)
+	assets = append(assets, link)
+
+	registry := &MockArchivedAssetRegistry{}
+	err = ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: "backup-"},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, 3)
+	archivePath := registry.assets[0].ArchivePath()
+
+	// The source path is not needed with an embedded manifest.
+	index, err := ziparchiver.ReadArchiveIndex(archivePath, "")
+	require.NoError(t, err)
+	assert.True(t, index.Embedded)
+	assert.Equal(t, sourceDir, index.Manifest.SourcePath)
+
+	indexed := slices.Collect(index.Assets())
+	require.Len(t, indexed, 3)
+	for i, a := range registry.assets {
+		assert.Equal(t, a.Path(), indexed[i].Path())
+		assert.Equal(t, a.Name(), indexed[i].Name())
+		assert.Equal(t, a.StoredHash(), indexed[i].StoredHash())
+		assert.Equal(t, a.Size(), indexed[i].Size())
+		assert.True(t, a.ModTime().Equal(indexed[i].ModTime()))
+		assert.Equal(t, a.Attributes(), indexed[i].Attributes())
+		assert.Equal(t, archivePath, indexed[i].ArchivePath())
+		assert.Equal(t, sourceDir, indexed[i].SourcePath())
+	}
+}
+
+func TestReadArchiveIndex_WithoutManifest(t *testing.T) {
+	sourceDir, _, archiveDir := setupTestEnvironment(t)
+	defer func() {
+		_ = os.RemoveAll(sourceDir)
+		_ = os.RemoveAll(archiveDir)
+	}()
+
+	archivePath, assets := createTestArchive(t, sourceDir, archiveDir)
+	legacyPath := filepath.Join(archiveDir, "backup-1700000000000.1.zip")
+	require.NoError(t, os.Rename(archivePath, legacyPath))
+
+	_, err := ziparchiver.ReadArchiveIndex(legacyPath, "")
+	assert.Error(t, err, "Should require a source path without manifest")
+
+	index, err := ziparchiver.ReadArchiveIndex(legacyPath, sourceDir)
+	require.NoError(t, err)
+	assert.False(t, index.Embedded)
+	assert.Equal(t, time.UnixMilli(1700000000000).UTC(), index.Manifest.CreatedAt)
+
+	indexed := slices.Collect(index.Assets())
+	require.Len(t, indexed, len(assets))
+	for _, a := range indexed {
+		rel, err := filepath.Rel(sourceDir, a.Path())
+		require.NoError(t, err)
+		expected, ok := assets[rel]
+		require.True(t, ok, "Unexpected asset %s", a.Path())
+		assert.Equal(t, expected.hash, a.StoredHash())
+		assert.Equal(t, expected.size, a.Size())
+		assert.Equal(t, legacyPath, a.ArchivePath())
+	}
+}
+
+func TestReadArchiveIndex_Invalid(t *testing.T) {
+	dir := t.TempDir()
+
+	notZip := filepath.Join(dir, "broken.zip")
+	require.NoError(t, os.WriteFile(notZip, []byte("not a zip file"), 0644))
+	_, err := ziparchiver.ReadArchiveIndex(notZip, dir)
+	assert.Error(t, err)
+
+	badManifest := filepath.Join(dir, "bad-manifest.zip")
+	f, err := os.Create(badManifest)
+	require.NoError(t, err)
+	w := zip.NewWriter(f)
+	entry, err := w.Create(ziparchiver.ManifestPath)
+	require.NoError(t, err)
+	_, err = entry.Write([]byte("{"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, f.Close())
+	_, err = ziparchiver.ReadArchiveIndex(badManifest, dir)
+	assert.Error(t, err)
+}
+
+func TestReadArchiveIndex_TarZstd(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+
+	assets := createTestAssets(t, sourceDir, 3)
+
+	registry := &MockArchivedAssetRegistry{}
+	err := ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: "backup-"},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithFormat(ziparchiver.FormatTarZstd),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, 3)
+
+	index, err := ziparchiver.ReadArchiveIndex(registry.assets[0].ArchivePath(), "")
+	require.NoError(t, err)
+	assert.True(t, index.Embedded)
+
+	indexed := slices.Collect(index.Assets())
+	require.Len(t, indexed, 3)
+	for i, a := range registry.assets {
+		assert.Equal(t, a.Path(), indexed[i].Path())
+		assert.Equal(t, a.StoredHash(), indexed[i].StoredHash())
+		assert.Equal(t, a.Attributes(), indexed[i].Attributes())
+	}
+}
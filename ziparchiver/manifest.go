@@ -0,0 +1,195 @@
+package ziparchiver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stupid-simple/backup/asset"
+)
+
+// Directory holding the files that describe an archive. The files of a source
+// under a top level directory of the same name are stored escaped, see
+// escapeEntryName.
+const MetadataDir = ".ssbak/"
+
+// Path of the manifest inside every archive.
+const ManifestPath = MetadataDir + "manifest.json"
+
+// Path of the checksum file inside archives, in `sha256sum` format.
+// Run `sha256sum -c .ssbak/SHA256SUMS` from the extracted archive directory to verify it.
+const ChecksumsPath = MetadataDir + "SHA256SUMS"
+
+// Describes an archive and its entries, so it can be checked without the database.
+type Manifest struct {
+	Version    string          `json:"version"`
+	SourcePath string          `json:"source_path"`
+	Host       string          `json:"host"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Entries    []ManifestEntry `json:"entries"`
+}
+
+type ManifestEntry struct {
+	Name       string    `json:"name"`   // Path of the entry in the archive.
+	Hash       string    `json:"xxhash"` // Hexadecimal xxHash64 of the content.
+	SHA256     string    `json:"sha256,omitempty"`
+	StrongHash string    `json:"strong_hash,omitempty"` // "<algorithm>:<hexadecimal sum>" of the content.
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mtime"`
+	Mode       uint32    `json:"mode"` // Go fs.FileMode bits.
+	UID        int       `json:"uid"`
+	GID        int       `json:"gid"`
+	User       string    `json:"user,omitempty"`
+	Group      string    `json:"group,omitempty"`
+	LinkTarget string    `json:"link_target,omitempty"`
+	// Parts of a file split across archives, in order. The entry itself is
+	// then only made of the parts, named after it with ChunkSuffix.
+	Chunks []ManifestChunk `json:"chunks,omitempty"`
+	// Where the contents are when they are stored once for several identical
+	// files, or for a moved file. The entry itself is then not in the archive.
+	Content *ManifestContent `json:"content,omitempty"`
+	// Set when the entry is not in the archive, only referencing its contents.
+	Reference bool `json:"reference,omitempty"`
+	// Previous name of a file that was moved or renamed.
+	MovedFrom string `json:"moved_from,omitempty"`
+}
+
+// The entry holding the contents of identical files.
+type ManifestContent struct {
+	Archive string `json:"archive"` // Name of the archive file, in the same directory.
+	Name    string `json:"name"`
+}
+
+// A part of a file split across archives.
+type ManifestChunk struct {
+	Archive string `json:"archive"` // Name of the archive file, in the same directory.
+	Offset  int64  `json:"offset"`
+	Size    int64  `json:"size"`
+}
+
+// Whether the zip entry name is part of the archive metadata instead of a backed up asset.
+func IsMetadataEntry(name string) bool {
+	return strings.HasPrefix(name, MetadataDir)
+}
+
+// Name of the archive entry of a path relative to the source. A top level
+// directory or file named like MetadataDir, followed by any number of "~", is
+// stored with one more "~" so it doesn't collide with the metadata.
+// Example: .ssbak/notes.txt -> .ssbak~/notes.txt, .ssbak~ -> .ssbak~~
+func escapeEntryName(name string) string {
+	first, _, _ := strings.Cut(name, "/")
+	if !isMetadataDirName(first) {
+		return name
+	}
+	return first + "~" + name[len(first):]
+}
+
+// Path relative to the source of an archive entry, reverting escapeEntryName.
+func unescapeEntryName(name string) string {
+	first, _, _ := strings.Cut(name, "/")
+	if first == strings.TrimSuffix(MetadataDir, "/") || !isMetadataDirName(first) {
+		return name
+	}
+	return first[:len(first)-1] + name[len(first):]
+}
+
+func isMetadataDirName(name string) bool {
+	return strings.TrimRight(name, "~") == strings.TrimSuffix(MetadataDir, "/")
+}
+
+func newManifestEntry(name string, a asset.ArchivedAsset, sha256 string) ManifestEntry {
+	var movedFrom string
+	if m, ok := a.(asset.MovedArchivedAsset); ok && m.PreviousPath() != "" {
+		if rel, err := filepath.Rel(a.SourcePath(), m.PreviousPath()); err == nil {
+			movedFrom = filepath.ToSlash(rel)
+		}
+	}
+	attrs := a.Attributes()
+	var chunks []ManifestChunk
+	for _, c := range asset.ChunksOf(a) {
+		chunks = append(chunks, ManifestChunk{
+			Archive: filepath.Base(c.ArchivePath),
+			Offset:  c.Offset,
+			Size:    c.Size,
+		})
+	}
+	var content *ManifestContent
+	if ref, ok := asset.ContentRefOf(a); ok {
+		content = &ManifestContent{Archive: filepath.Base(ref.ArchivePath), Name: ref.Entry}
+	}
+	strongHash, _ := asset.StrongHashOf(a)
+	return ManifestEntry{
+		Name:       name,
+		Hash:       formatHash(a.StoredHash()),
+		SHA256:     sha256,
+		StrongHash: strongHash,
+		Size:       a.Size(),
+		ModTime:    a.ModTime().UTC(),
+		Mode:       uint32(attrs.Mode),
+		UID:        attrs.UID,
+		GID:        attrs.GID,
+		User:       attrs.User,
+		Group:      attrs.Group,
+		LinkTarget: attrs.LinkTarget,
+		Chunks:     chunks,
+		Content:    content,
+		Reference:  content != nil,
+		MovedFrom:  movedFrom,
+	}
+}
+
+// Write the manifest and, if enabled, the checksum file into the archive.
+func writeManifest(archive ArchiveWriter, m *Manifest, checksums bool) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeMetadataEntry(archive, ManifestPath, m.CreatedAt, append(content, '\n')); err != nil {
+		return err
+	}
+
+	if !checksums {
+		return nil
+	}
+
+	var sums bytes.Buffer
+	for _, e := range m.Entries {
+		// Split files only exist once their parts are put back together.
+		if e.SHA256 == "" || len(e.Chunks) > 0 || e.Reference {
+			continue
+		}
+		sums.WriteString(checksumLine(e.SHA256, e.Name))
+	}
+	return writeMetadataEntry(archive, ChecksumsPath, m.CreatedAt, sums.Bytes())
+}
+
+func writeMetadataEntry(archive ArchiveWriter, name string, modTime time.Time, content []byte) error {
+	w, err := archive.Create(&Entry{
+		Name:    name,
+		Size:    int64(len(content)),
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+// Format a line of the checksum file. Like sha256sum, names with backslashes or
+// new lines are escaped and the line starts with a backslash.
+func checksumLine(sum string, name string) string {
+	if !strings.ContainsAny(name, "\\\n") {
+		return fmt.Sprintf("%s  %s\n", sum, name)
+	}
+	name = strings.ReplaceAll(name, "\\", "\\\\")
+	name = strings.ReplaceAll(name, "\n", "\\n")
+	return fmt.Sprintf("\\%s  %s\n", sum, name)
+}
+
+func formatHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
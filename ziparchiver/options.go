@@ -2,9 +2,11 @@ package ziparchiver
 
 import (
 	"context"
+	"crypto/ed25519"
 	"iter"
 
 	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/fileutils"
 )
 
 type StoreOption func(o *storeOptions)
@@ -15,6 +17,19 @@ type storeOptions struct {
 	onlyNewAssets     OnlyNewAssets
 	maxFileBytes      int64
 	includeLargeFiles bool
+	splitLargeFiles   bool
+	version           string
+	checksums         bool
+	format            Format
+	compression       Compression
+	compressionPolicy *CompressionPolicy
+	workers           int
+	findContent       FindArchivedContent
+	parity            float64
+	strongHash        fileutils.HashAlgorithm
+	signingKey        ed25519.PrivateKey
+	password          []byte
+	stats             *Stats
 }
 
 func WithDryRun(dryRun bool) StoreOption {
@@ -37,6 +52,120 @@ func WithIncludeLargeFiles(include bool) StoreOption {
 	}
 }
 
+// If true, files larger than maxFileBytes are split across several archives,
+// so that no archive holds more than maxFileBytes.
+func WithSplitLargeFiles(split bool) StoreOption {
+	return func(o *storeOptions) {
+		o.splitLargeFiles = split
+	}
+}
+
+// The ssbak version written in the archive manifests.
+func WithVersion(version string) StoreOption {
+	return func(o *storeOptions) {
+		o.version = version
+	}
+}
+
+// If true, a sha256sum compatible checksum file is written in the archives.
+func WithChecksums(checksums bool) StoreOption {
+	return func(o *storeOptions) {
+		o.checksums = checksums
+	}
+}
+
+// The format of the new archives. Zip by default.
+func WithFormat(format Format) StoreOption {
+	return func(o *storeOptions) {
+		o.format = format
+	}
+}
+
+// Decides which assets are stored without compression in zip archives.
+// By default, all files are compressed.
+func WithCompressionPolicy(policy *CompressionPolicy) StoreOption {
+	return func(o *storeOptions) {
+		o.compressionPolicy = policy
+	}
+}
+
+// How the entries of zip archives are compressed. Deflate with its default level by default.
+// For tar.zst archives, the level is used if the method is zstd.
+func WithCompression(compression Compression) StoreOption {
+	return func(o *storeOptions) {
+		o.compression = compression
+	}
+}
+
+// The number of assets compressed at the same time in zip archives.
+// By default, assets are compressed one at a time.
+func WithWorkers(workers int) StoreOption {
+	return func(o *storeOptions) {
+		o.workers = workers
+	}
+}
+
+// Write a parity file next to each archive once it is complete, with parity
+// blocks amounting to percent of the archive size. None by default.
+func WithParity(percent float64) StoreOption {
+	return func(o *storeOptions) {
+		o.parity = percent
+	}
+}
+
+// Compute a cryptographic hash of the contents of regular files and symbolic
+// links, while they are archived. None by default.
+func WithStrongHash(alg fileutils.HashAlgorithm) StoreOption {
+	return func(o *storeOptions) {
+		o.strongHash = alg
+	}
+}
+
+// Sign each archive once it is complete, in a signature file next to it.
+// Archives are not signed by default.
+func WithSigningKey(key ed25519.PrivateKey) StoreOption {
+	return func(o *storeOptions) {
+		o.signingKey = key
+	}
+}
+
+// Encrypt the entries of zip archives with the password, with the WinZip AES
+// extension, so they can still be opened by 7-Zip and other tools. Archives
+// are not encrypted by default.
+func WithEncryption(password []byte) StoreOption {
+	return func(o *storeOptions) {
+		o.password = password
+	}
+}
+
+// Summary of a backup.
+type Stats struct {
+	Stored  int   // Assets stored in the archives, including moved and deduplicated ones.
+	Size    int64 // Size of the stored assets.
+	Written int64 // Bytes written to the archives.
+}
+
+// Fill stats once the assets are stored, even if the backup fails or is cancelled.
+func WithStats(stats *Stats) StoreOption {
+	return func(o *storeOptions) {
+		o.stats = stats
+	}
+}
+
+type FindArchivedContent interface {
+	FindArchivedContent(ctx context.Context, hash uint64, size int64) (asset.ArchivedAsset, bool, error)
+}
+
+// Reference the contents of regular files already archived, here or found by
+// find, instead of storing them again. The contents of new files are then
+// compressed before they are written, in memory or in a temporary file next to
+// the archives if they are large, so they are only read once.
+func WithDeduplication(find FindArchivedContent) StoreOption {
+	return func(o *storeOptions) {
+		o.findContent = find
+	}
+}
+
 type RegisterArchivedAssets interface {
 	Register(ctx context.Context, assets iter.Seq[asset.ArchivedAsset]) error
 }
@@ -61,7 +190,11 @@ func WithOnlyNewAssets(only OnlyNewAssets) StoreOption {
 type RestoreOption func(o *restoreOptions)
 
 type restoreOptions struct {
-	dryRun bool
+	dryRun         bool
+	targetDir      string
+	conflictPolicy ConflictPolicy
+	publicKey      ed25519.PublicKey
+	password       []byte
 }
 
 func WithRestoreDryRun(dryRun bool) RestoreOption {
@@ -69,3 +202,47 @@ func WithRestoreDryRun(dryRun bool) RestoreOption {
 		o.dryRun = dryRun
 	}
 }
+
+// Restore assets into targetDir instead of their original paths.
+// The path of each asset relative to its source is kept inside targetDir.
+func WithRestoreTargetDir(targetDir string) RestoreOption {
+	return func(o *restoreOptions) {
+		o.targetDir = targetDir
+	}
+}
+
+// What to do when a file to restore already exists and differs from the archived version.
+type ConflictPolicy string
+
+const (
+	// Keep the existing file. This is the default.
+	ConflictSkip ConflictPolicy = "skip"
+	// Replace the existing file with the archived version.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// Replace the existing file only if it is older than the archived version.
+	ConflictKeepNewer ConflictPolicy = "keep-newer"
+	// Restore the archived version next to the existing file, as name.restored-<timestamp>.ext.
+	ConflictRename ConflictPolicy = "rename"
+)
+
+// Set the policy applied to existing files that differ from the archived version.
+func WithRestoreConflictPolicy(policy ConflictPolicy) RestoreOption {
+	return func(o *restoreOptions) {
+		o.conflictPolicy = policy
+	}
+}
+
+// Check the signature of each archive with the public key before reading it.
+// The assets of archives without a valid signature are not restored.
+func WithRestorePublicKey(key ed25519.PublicKey) RestoreOption {
+	return func(o *restoreOptions) {
+		o.publicKey = key
+	}
+}
+
+// Decrypt the entries of encrypted archives with the password.
+func WithRestorePassword(password []byte) RestoreOption {
+	return func(o *restoreOptions) {
+		o.password = password
+	}
+}
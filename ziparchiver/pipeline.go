@@ -0,0 +1,359 @@
+package ziparchiver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/fileutils"
+	"github.com/stupid-simple/backup/ziparchiver/zipwriter"
+)
+
+// Compressed contents larger than this are kept in a temporary file instead of memory.
+const spoolMemoryBytes = 4 * 1024 * 1024
+
+var errRawUnsupported = errors.New("archive format can't add entries compressed ahead of time")
+
+// An asset to add to an archive.
+type pendingAsset struct {
+	asset readableAsset
+	entry *Entry
+	// The asset is split across archives, it is never compressed ahead of time.
+	split bool
+	// The archived file with the same contents, when the asset was moved.
+	// Its contents are then not written again.
+	movedFrom asset.ArchivedAsset
+	// The asset is archived again since its archived contents were damaged,
+	// its contents are not deduplicated.
+	repair bool
+	// Set when the asset was compressed ahead of time, or failed to.
+	compressed *compressedEntry
+	err        error
+	done       chan struct{}
+}
+
+// Contents of an entry compressed ahead of time, ready to be added to an archive.
+type compressedEntry struct {
+	method         uint16
+	crc32          uint32
+	size           int64
+	compressedSize int64
+	hash           uint64
+	sha256         string
+	strongHash     string
+	choice         compressionChoice
+	data           *spool
+}
+
+// Archives whose entries can be compressed ahead of time, then added as they are.
+type rawArchiveWriter interface {
+	ArchiveWriter
+	CreateRaw(e *Entry, c *compressedEntry) (io.Writer, error)
+}
+
+// The assets to archive, with their entry. Assets that can't be archived are
+// logged and skipped.
+func pendingAssets(sourcePath string, assets iter.Seq[readableAsset], o writeOptions, logger zerolog.Logger) iter.Seq[*pendingAsset] {
+	return func(yield func(*pendingAsset) bool) {
+		for a := range assets {
+			var movedFrom asset.ArchivedAsset
+			var repair bool
+			if r, ok := a.(readableFileAsset); ok {
+				if m, ok := r.Asset.(asset.MovedAsset); ok {
+					movedFrom = m.MovedFrom()
+				}
+				_, repair = r.Asset.(asset.RepairedAsset)
+			}
+
+			// The contents of moved assets are not written again.
+			var split bool
+			if movedFrom == nil {
+				var ok bool
+				split, ok = fitAsset(a, o, logger)
+				if !ok {
+					continue
+				}
+			}
+
+			relPath, err := filepath.Rel(sourcePath, a.Path())
+			if err != nil {
+				logger.Warn().Err(err).Object("asset", a).Msg("could not backup asset")
+				continue
+			}
+			entry := &Entry{
+				Name:       escapeEntryName(filepath.ToSlash(relPath)),
+				Size:       a.Size(),
+				ModTime:    a.ModTime(),
+				Attributes: a.Attributes(),
+			}
+			if a.Attributes().Mode.IsDir() {
+				// Directory entries are marked by a trailing slash.
+				entry.Name += "/"
+			}
+
+			if !yield(&pendingAsset{asset: a, entry: entry, split: split, movedFrom: movedFrom, repair: repair}) {
+				return
+			}
+		}
+	}
+}
+
+// Whether an asset larger than the archives is split across archives. Returns
+// false if the asset is skipped instead.
+func fitAsset(a readableAsset, o writeOptions, logger zerolog.Logger) (split bool, ok bool) {
+	large := o.maxFileBytes > 0 && a.Size() >= o.maxFileBytes
+	split = large && o.splitLargeFiles && a.Attributes().Mode.IsRegular()
+	if large && !split && !o.includeLargeFiles {
+		logger.Warn().
+			Object("asset", a).
+			Int64("max_size", o.maxFileBytes).
+			Msg("asset larger than max file size. Will be skipped")
+		return false, false
+	}
+	return split, true
+}
+
+// Compress the assets with a pool of workers. The assets are yielded in the
+// same order, once compressed, so the archives are the same as without workers.
+// Only a few assets are compressed ahead of the one being yielded.
+func compressInParallel(
+	ctx context.Context,
+	pending iter.Seq[*pendingAsset],
+	policy *CompressionPolicy,
+	spoolDir string,
+	o writeOptions,
+) iter.Seq[*pendingAsset] {
+	return func(yield func(*pendingAsset) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+
+		jobs := make(chan *pendingAsset)
+		// Assets in the order they must be yielded.
+		queue := make(chan *pendingAsset, o.workers)
+
+		var wg sync.WaitGroup
+		for range o.workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				compressor := zipwriter.NewCompressor(zipwriter.Compression{Level: o.compression.Level})
+				for p := range jobs {
+					if ctx.Err() != nil {
+						p.err = ctx.Err()
+					} else if !p.split && p.movedFrom == nil {
+						p.compressed, p.err = compressAsset(p, compressor, policy, spoolDir, o)
+					}
+					close(p.done)
+				}
+			}()
+		}
+
+		go func() {
+			defer close(queue)
+			defer close(jobs)
+			for p := range pending {
+				p.done = make(chan struct{})
+				select {
+				case queue <- p:
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case jobs <- p:
+				case <-ctx.Done():
+					p.err = ctx.Err()
+					close(p.done)
+					return
+				}
+			}
+		}()
+
+		defer func() {
+			cancel()
+			for p := range queue {
+				<-p.done
+				p.release()
+			}
+			wg.Wait()
+		}()
+
+		for p := range queue {
+			<-p.done
+			ok := yield(p)
+			p.release()
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+func (p *pendingAsset) release() {
+	if p.compressed != nil {
+		p.compressed.data.release()
+	}
+}
+
+func compressAsset(
+	p *pendingAsset,
+	compressor *zipwriter.Compressor,
+	policy *CompressionPolicy,
+	spoolDir string,
+	o writeOptions,
+) (*compressedEntry, error) {
+	reader, err := p.asset.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	regular := p.asset.Attributes().Mode.IsRegular()
+	var choice compressionChoice
+	var content io.Reader = reader
+	if regular {
+		choice, content, err = policy.choose(p.entry.Name, reader)
+		if err != nil {
+			return nil, err
+		}
+	} else if p.asset.Attributes().Mode.IsDir() {
+		choice.store = true
+	}
+
+	c := &compressedEntry{
+		method: o.compression.zipMethod(),
+		choice: choice,
+		data:   &spool{dir: spoolDir, discard: o.dryRun},
+	}
+	if choice.store || !o.format.compressesEntries() {
+		// The entries of tar archives are compressed with the whole archive.
+		c.method = zip.Store
+	}
+
+	compressed := &fileutils.CountingWriter{W: c.data}
+	w, err := compressor.Compress(c.method, compressed)
+	if err != nil {
+		c.data.release()
+		return nil, err
+	}
+	crc := crc32.NewIEEE()
+	uncompressed := &fileutils.CountingWriter{W: io.MultiWriter(w, crc)}
+	var out io.Writer = uncompressed
+	var checksum hash.Hash
+	if o.checksums && regular {
+		checksum = sha256.New()
+		out = io.MultiWriter(uncompressed, checksum)
+	}
+	strong := newStrongHash(o.strongHash, p.asset.Attributes().Mode)
+	if strong != nil {
+		out = io.MultiWriter(out, strong)
+	}
+
+	c.hash, err = fileutils.ComputeHash(io.TeeReader(content, out))
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		c.data.release()
+		return nil, err
+	}
+
+	c.crc32 = crc.Sum32()
+	c.size = uncompressed.Count
+	c.compressedSize = compressed.Count
+	if checksum != nil {
+		c.sha256 = hex.EncodeToString(checksum.Sum(nil))
+	}
+	c.strongHash = strongHashSum(o.strongHash, strong)
+	return c, nil
+}
+
+// Add an asset compressed ahead of time to the archive.
+func appendCompressedAsset(sourcePath string, archive ArchiveWriter, p *pendingAsset) (*zipAsset, error) {
+	raw, ok := archive.(rawArchiveWriter)
+	if !ok {
+		return nil, errRawUnsupported
+	}
+	w, err := raw.CreateRaw(p.entry, p.compressed)
+	if err != nil {
+		return nil, err
+	}
+	r, err := p.compressed.data.reader()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	// Entries written with the size found by the scan fail if the file shrank.
+	if e, ok := w.(*tarEntryWriter); ok {
+		if err := e.finish(); err != nil {
+			return nil, err
+		}
+	}
+	a := newZipAsset(sourcePath, archive.Path(), p.asset, p.compressed.hash)
+	a.strongHash = p.compressed.strongHash
+	return a, nil
+}
+
+// spool holds compressed contents until they are added to the archive.
+// Small contents are kept in memory and larger ones in a temporary file.
+type spool struct {
+	dir     string
+	discard bool // Keep nothing, the archive is not written.
+	buf     bytes.Buffer
+	file    *os.File
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.discard {
+		return len(p), nil
+	}
+	if s.file == nil && s.buf.Len()+len(p) > spoolMemoryBytes {
+		f, err := os.CreateTemp(s.dir, ".ssbak-spool-*")
+		if err != nil {
+			return 0, err
+		}
+		// Removed right away, the space is freed once the file is closed.
+		_ = os.Remove(f.Name())
+		s.file = f
+		if _, err := s.file.Write(s.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		s.buf = bytes.Buffer{}
+	}
+	if s.file != nil {
+		return s.file.Write(p)
+	}
+	return s.buf.Write(p)
+}
+
+func (s *spool) reader() (io.Reader, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.buf.Bytes()), nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+func (s *spool) release() {
+	if s.file != nil {
+		_ = s.file.Close()
+		s.file = nil
+	}
+	s.buf = bytes.Buffer{}
+}
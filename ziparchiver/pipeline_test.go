@@ -0,0 +1,145 @@
+package ziparchiver_test
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/ziparchiver"
+)
+
+func TestStoreAssets_Workers(t *testing.T) {
+	sourceDir := t.TempDir()
+
+	var assets []asset.Asset
+	addAsset := func(name string, content []byte) {
+		path := filepath.Join(sourceDir, name)
+		require.NoError(t, os.WriteFile(path, content, 0644))
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		a, err := asset.NewFromFS(path, info)
+		require.NoError(t, err)
+		assets = append(assets, a)
+	}
+	for i := range 40 {
+		addAsset(fmt.Sprintf("file%02d.txt", i), []byte(strings.Repeat(fmt.Sprintf("line %d\n", i), 100*i)))
+	}
+	// Larger than what is kept in memory while waiting to be archived.
+	large := make([]byte, 6*1024*1024)
+	_, err := rand.Read(large)
+	require.NoError(t, err)
+	addAsset("large.bin", large)
+	require.NoError(t, os.Mkdir(filepath.Join(sourceDir, "empty"), 0755))
+	info, err := os.Stat(filepath.Join(sourceDir, "empty"))
+	require.NoError(t, err)
+	dirAsset, err := asset.NewFromFS(filepath.Join(sourceDir, "empty"), info)
+	require.NoError(t, err)
+	assets = append(assets, dirAsset)
+
+	type archivedEntry struct {
+		archive string
+		name    string
+		crc32   uint32
+		method  uint16
+	}
+	backup := func(workers int) ([]archivedEntry, []asset.ArchivedAsset) {
+		destDir := t.TempDir()
+		registry := &MockArchivedAssetRegistry{}
+		err := ziparchiver.StoreAssets(
+			context.Background(),
+			sourceDir,
+			ziparchiver.ArchiveDescriptor{Dir: destDir, Prefix: "backup-"},
+			slices.Values(assets),
+			zerolog.New(io.Discard),
+			ziparchiver.WithRegisterArchivedAssets(registry),
+			ziparchiver.WithMaxFileBytes(64*1024),
+			ziparchiver.WithIncludeLargeFiles(true),
+			ziparchiver.WithChecksums(true),
+			ziparchiver.WithWorkers(workers),
+		)
+		require.NoError(t, err)
+
+		dirEntries, err := os.ReadDir(destDir)
+		require.NoError(t, err)
+		var entries []archivedEntry
+		for _, d := range dirEntries {
+			require.True(t, ziparchiver.IsArchiveFile(d.Name()), d.Name())
+			r, err := zip.OpenReader(filepath.Join(destDir, d.Name()))
+			require.NoError(t, err)
+			for _, f := range assetEntries(r.File) {
+				rc, err := f.Open()
+				require.NoError(t, err)
+				_, err = io.Copy(io.Discard, rc)
+				require.NoError(t, err, f.Name)
+				require.NoError(t, rc.Close())
+
+				// Archive names only differ by their creation time.
+				archive := d.Name()[strings.Index(d.Name(), "."):]
+				entries = append(entries, archivedEntry{archive, f.Name, f.CRC32, f.Method})
+			}
+			require.NoError(t, r.Close())
+		}
+		return entries, registry.assets
+	}
+
+	expectedEntries, expectedAssets := backup(1)
+	entries, archived := backup(4)
+
+	assert.Equal(t, expectedEntries, entries)
+	require.Len(t, archived, len(assets))
+	for i, a := range archived {
+		assert.Equal(t, expectedAssets[i].Path(), a.Path())
+		assert.Equal(t, expectedAssets[i].StoredHash(), a.StoredHash())
+		if a.Attributes().Mode.IsDir() {
+			continue
+		}
+		hash, err := a.ComputeHash()
+		require.NoError(t, err)
+		assert.Equal(t, a.StoredHash(), hash)
+	}
+}
+
+func TestStoreAssets_WorkersCancellation(t *testing.T) {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+
+	assets := createTestAssets(t, sourceDir, 100)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	registry := &registerFunc{func(assets iter.Seq[asset.ArchivedAsset]) error {
+		cancel()
+		return nil
+	}}
+	err := ziparchiver.StoreAssets(
+		ctx,
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithMaxFileBytes(100),
+		ziparchiver.WithWorkers(4),
+	)
+	require.NoError(t, err)
+
+	// The backup stops after the archive being written, without leftovers.
+	entries, err := os.ReadDir(destDir)
+	require.NoError(t, err)
+	assert.NotEmpty(t, entries)
+	assert.Less(t, len(entries), 5)
+	for _, e := range entries {
+		assert.True(t, ziparchiver.IsArchiveFile(e.Name()), e.Name())
+	}
+}
@@ -0,0 +1,384 @@
+package ziparchiver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/fileutils"
+)
+
+var (
+	errFileGrew   = errors.New("file grew while being archived")
+	errFileShrank = errors.New("file shrank while being archived")
+)
+
+// tarZstdArchiveWriter writes tar archives compressed with zstd.
+// Entries use the PAX format, so long paths, owner names and sub-second
+// modification times are kept.
+type tarZstdArchiveWriter struct {
+	path      string
+	dryRun    bool
+	init      bool
+	closed    bool
+	file      *os.File
+	written   fileutils.CountingWriter
+	encoder   *zstd.Encoder
+	writer    *tar.Writer
+	entry     *tarEntryWriter
+	committed bool
+	level     int
+}
+
+// The archive is compressed with the zstd level of the compression settings, if any.
+func newTarZstdArchive(path string, dryRun bool, compression Compression) *tarZstdArchiveWriter {
+	t := &tarZstdArchiveWriter{path: path, dryRun: dryRun}
+	if compression.Method == CompressionZstd {
+		t.level = compression.Level
+	}
+	return t
+}
+
+// Path implements ArchiveWriter.
+func (t *tarZstdArchiveWriter) Path() string {
+	if t.dryRun {
+		return "/dev/null"
+	}
+	return t.path
+}
+
+// Create implements ArchiveWriter.
+func (t *tarZstdArchiveWriter) Create(e *Entry) (io.Writer, error) {
+	if t.closed {
+		return nil, fmt.Errorf("archive already closed: %s", t.path)
+	}
+	if !t.init {
+		if err := t.open(); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.finishEntry(); err != nil {
+		return nil, err
+	}
+
+	header := tarHeader(e)
+	if err := t.writer.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	if header.Typeflag != tar.TypeReg {
+		// Only regular files have contents, links keep their target in the header.
+		return io.Discard, nil
+	}
+	t.entry = &tarEntryWriter{w: t.writer, remaining: header.Size}
+	return t.entry, nil
+}
+
+// CreateRaw adds an entry with contents read ahead of time. They must not be
+// compressed, the entries are compressed with the whole archive.
+func (t *tarZstdArchiveWriter) CreateRaw(e *Entry, c *compressedEntry) (io.Writer, error) {
+	if c.method != zip.Store {
+		return nil, errRawUnsupported
+	}
+	return t.Create(e)
+}
+
+// Close implements ArchiveWriter.
+func (t *tarZstdArchiveWriter) Close() error {
+	if !t.init || t.closed {
+		return nil
+	}
+	t.closed = true
+
+	err := t.finishEntry()
+	err = errors.Join(err, t.writer.Close(), t.encoder.Close())
+	if err != nil {
+		return errors.Join(err, t.file.Close(), t.remove())
+	}
+	if t.dryRun {
+		return t.file.Close()
+	}
+	if err := fileutils.CommitPartialFile(t.file, t.path); err != nil {
+		return errors.Join(err, t.remove())
+	}
+	t.committed = true
+	return nil
+}
+
+// CompressedSize implements ArchiveWriter. The whole archive is compressed at
+// once, so this is the size of the archive, headers included.
+func (t *tarZstdArchiveWriter) CompressedSize() int64 {
+	return t.written.Count
+}
+
+// Discard implements ArchiveWriter.
+func (t *tarZstdArchiveWriter) Discard() error {
+	if !t.init || t.closed {
+		return nil
+	}
+	t.closed = true
+	return errors.Join(t.encoder.Close(), t.file.Close(), t.remove())
+}
+
+func (t *tarZstdArchiveWriter) open() error {
+	var err error
+	if t.dryRun {
+		t.file, err = os.OpenFile("/dev/null", os.O_WRONLY, 0600)
+	} else {
+		t.file, err = fileutils.CreatePartialFile(t.path)
+	}
+	if err != nil {
+		return err
+	}
+	t.written.W = t.file
+	var opts []zstd.EOption
+	if t.level != 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(t.level)))
+	}
+	t.encoder, err = zstd.NewWriter(&t.written, opts...)
+	if err != nil {
+		return errors.Join(err, t.file.Close(), t.remove())
+	}
+	t.writer = tar.NewWriter(t.encoder)
+	t.init = true
+	return nil
+}
+
+func (t *tarZstdArchiveWriter) remove() error {
+	if t.dryRun {
+		return nil
+	}
+	return fileutils.RemovePartialFile(t.path)
+}
+
+func (t *tarZstdArchiveWriter) finishEntry() error {
+	if t.entry == nil {
+		return nil
+	}
+	err := t.entry.finish()
+	t.entry = nil
+	if errors.Is(err, errFileShrank) {
+		// Incomplete entries were already reported when writing them failed.
+		return nil
+	}
+	return err
+}
+
+// tarEntryWriter writes the contents of a tar entry, which must match the size in its header.
+type tarEntryWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (e *tarEntryWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > e.remaining {
+		n, err := e.w.Write(p[:e.remaining])
+		e.remaining -= int64(n)
+		if err != nil {
+			return n, err
+		}
+		return n, errFileGrew
+	}
+	n, err := e.w.Write(p)
+	e.remaining -= int64(n)
+	return n, err
+}
+
+// Complete the entry. If the file shrank while being archived, the rest of the
+// entry is filled with zeros, to keep the archive readable, and errFileShrank
+// is returned.
+func (e *tarEntryWriter) finish() error {
+	if e.remaining <= 0 {
+		return nil
+	}
+	_, err := io.CopyN(e.w, zeroReader{}, e.remaining)
+	e.remaining = 0
+	if err != nil {
+		return err
+	}
+	return errFileShrank
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func tarHeader(e *Entry) *tar.Header {
+	attrs := e.Attributes
+	mode := int64(attrs.Mode.Perm())
+	if attrs.Mode == 0 {
+		mode = 0644
+	}
+	if attrs.Mode&fs.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if attrs.Mode&fs.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if attrs.Mode&fs.ModeSticky != 0 {
+		mode |= 01000
+	}
+
+	header := &tar.Header{
+		Name:    e.Name,
+		Mode:    mode,
+		Uid:     attrs.UID,
+		Gid:     attrs.GID,
+		Uname:   attrs.User,
+		Gname:   attrs.Group,
+		ModTime: e.ModTime,
+		Format:  tar.FormatPAX,
+	}
+	switch {
+	case attrs.Mode.IsDir():
+		header.Typeflag = tar.TypeDir
+	case attrs.Mode&fs.ModeSymlink != 0:
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = attrs.LinkTarget
+	default:
+		header.Typeflag = tar.TypeReg
+		header.Size = e.Size
+	}
+	return header
+}
+
+// tarZstdArchiveReader reads tar archives compressed with zstd.
+// The archive can only be read forward, so opening an entry before the
+// current position reads the archive again from the start.
+type tarZstdArchiveReader struct {
+	file    *os.File
+	decoder *zstd.Decoder
+	reader  *tar.Reader
+	started bool
+}
+
+func openTarZstdArchive(path string) (*tarZstdArchiveReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(file)
+	if err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+	return &tarZstdArchiveReader{
+		file:    file,
+		decoder: decoder,
+		reader:  tar.NewReader(decoder),
+	}, nil
+}
+
+// Open implements ArchiveReader.
+func (t *tarZstdArchiveReader) Open(name string) (fs.File, error) {
+	name = path.Clean(strings.TrimSuffix(name, "/"))
+	for range 2 {
+		for {
+			header, err := t.next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if path.Clean(strings.TrimSuffix(header.Name, "/")) == name {
+				return &tarEntryFile{header: header, reader: t.reader}, nil
+			}
+		}
+		if err := t.rewind(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// List implements ArchiveReader.
+func (t *tarZstdArchiveReader) List(fn func(e *Entry, r io.Reader) error) error {
+	if err := t.rewind(); err != nil {
+		return err
+	}
+	for {
+		header, err := t.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := &Entry{
+			Name:    header.Name,
+			Size:    header.Size,
+			ModTime: header.ModTime,
+			Attributes: asset.Attributes{
+				Mode:       header.FileInfo().Mode(),
+				UID:        header.Uid,
+				GID:        header.Gid,
+				User:       header.Uname,
+				Group:      header.Gname,
+				LinkTarget: header.Linkname,
+			},
+		}
+		if err := fn(e, t.reader); err != nil {
+			return err
+		}
+	}
+}
+
+// Close implements ArchiveReader.
+func (t *tarZstdArchiveReader) Close() error {
+	t.decoder.Close()
+	return t.file.Close()
+}
+
+func (t *tarZstdArchiveReader) next() (*tar.Header, error) {
+	t.started = true
+	return t.reader.Next()
+}
+
+func (t *tarZstdArchiveReader) rewind() error {
+	if !t.started {
+		return nil
+	}
+	if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := t.decoder.Reset(t.file); err != nil {
+		return err
+	}
+	t.reader = tar.NewReader(t.decoder)
+	t.started = false
+	return nil
+}
+
+// Encrypted implements ArchiveReader. Tar archives are never encrypted.
+func (t *tarZstdArchiveReader) Encrypted() bool {
+	return false
+}
+
+// tarEntryFile is an entry opened from a tar archive. It can be read until
+// another entry is opened.
+type tarEntryFile struct {
+	header *tar.Header
+	reader io.Reader
+}
+
+func (f *tarEntryFile) Stat() (fs.FileInfo, error) {
+	return f.header.FileInfo(), nil
+}
+
+func (f *tarEntryFile) Read(p []byte) (int, error) {
+	return f.reader.Read(p)
+}
+
+func (f *tarEntryFile) Close() error {
+	return nil
+}
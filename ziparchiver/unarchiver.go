@@ -1,54 +1,98 @@
 package ziparchiver
 
 import (
-	"archive/zip"
+	"cmp"
 	"context"
+	"crypto/ed25519"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"iter"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/fileutils"
+	"github.com/stupid-simple/backup/signing"
 )
 
 var (
 	errSkippedSameFile = errors.New("skipped same file")
 	errSkippedModified = errors.New("skipped modified file")
+	errSkippedNewer    = errors.New("skipped newer file")
 )
 
+// How an asset was written to the file system.
+type restoreOutcome int
+
+const (
+	restoredCreated restoreOutcome = iota
+	restoredOverwritten
+	restoredRenamed
+)
+
+type restoreCounts struct {
+	created         int
+	overwritten     int
+	renamed         int
+	skippedSame     int
+	skippedModified int
+	skippedNewer    int
+	failed          int
+}
+
+func (c *restoreCounts) restored() int {
+	return c.created + c.overwritten + c.renamed
+}
+
+func (c *restoreCounts) skipped() int {
+	return c.skippedSame + c.skippedModified + c.skippedNewer
+}
+
+// MarshalZerologObject implements zerolog.LogObjectMarshaler.
+func (c *restoreCounts) MarshalZerologObject(e *zerolog.Event) {
+	e.Int("restored", c.restored())
+	e.Int("created", c.created)
+	e.Int("overwritten", c.overwritten)
+	e.Int("renamed", c.renamed)
+	e.Int("skipped", c.skipped())
+	e.Int("skipped_same", c.skippedSame)
+	e.Int("skipped_modified", c.skippedModified)
+	e.Int("skipped_newer", c.skippedNewer)
+	e.Int("failed", c.failed)
+}
+
 func Restore(ctx context.Context, assets iter.Seq[asset.ArchivedAsset], logger zerolog.Logger, opts ...RestoreOption) error {
-	o := restoreOptions{}
+	o := restoreOptions{
+		conflictPolicy: ConflictSkip,
+	}
 	for _, applyOpts := range opts {
 		applyOpts(&o)
 	}
 
-	logger.Info().Msg("start restoring assets")
+	logger.Info().Str("on_conflict", string(o.conflictPolicy)).Msg("start restoring assets")
 
-	var restoredAssets, skippedAssets int
+	counts := &restoreCounts{}
 	defer func() {
 		if ctx.Err() != nil {
-			logger.Info().
-				Int("restored", restoredAssets).
-				Int("skipped", skippedAssets).
-				Msg("cancelled restore")
-		} else if restoredAssets == 0 {
-			logger.Info().Int("skipped", skippedAssets).Msg("no assets restored")
+			logger.Info().EmbedObject(counts).Msg("cancelled restore")
+		} else if counts.restored() == 0 {
+			logger.Info().EmbedObject(counts).Msg("no assets restored")
 		} else {
-			logger.Info().
-				Int("restored", restoredAssets).
-				Int("skipped", skippedAssets).Msg("done restoring assets")
+			logger.Info().EmbedObject(counts).Msg("done restoring assets")
 		}
 	}()
 
-	zipFile := Open()
+	archives := Open(WithPassword(o.password), WithPublicKey(o.publicKey))
 	defer func() {
-		err := zipFile.Close()
+		err := archives.Close()
 		if err != nil {
-			logger.Warn().Err(err).Msg("failed to close zip file")
+			logger.Warn().Err(err).Msg("failed to close archive file")
 		}
 	}()
 
@@ -56,129 +100,341 @@ func Restore(ctx context.Context, assets iter.Seq[asset.ArchivedAsset], logger z
 		Burst:  1,
 		Period: 1 * time.Second,
 	})
-	for asset := range assets {
+	warnedSignature := false
+	for asset := range orderByArchive(assets) {
 		if ctx.Err() != nil {
 			return nil
 		}
 
-		f, err := zipFile.Open(asset)
+		f, err := archives.Open(asset)
+		if archives.uncheckedSignature && !warnedSignature {
+			logger.Warn().Msg("archives are signed but their signatures are not checked without a public key")
+			warnedSignature = true
+		}
 		if err != nil {
 			logger.Warn().Err(err).Object("asset", asset).Msg("could not restore asset")
+			counts.failed++
 			continue
 		}
-		defer func() {
-			err := f.Close()
+
+		if o.targetDir != "" {
+			asset, err = relocateAsset(asset, o.targetDir)
 			if err != nil {
-				logger.Warn().Err(err).Msg("failed to close file")
+				logger.Warn().Err(err).Msg("could not restore asset")
+				counts.failed++
+				closeRestoredFile(f, logger)
+				continue
 			}
-		}()
+		}
 
-		size, err := restoreAsset(f, asset, logger, false, o.dryRun)
-		if errors.Is(err, errSkippedSameFile) {
+		outcome, size, err := restoreAsset(f, asset, logger, o.conflictPolicy, o.dryRun)
+		closeRestoredFile(f, logger)
+		switch {
+		case errors.Is(err, errSkippedSameFile):
 			logger.Debug().Object("asset", asset).Msg("file already present, skipping")
-			skippedAssets++
-		} else if errors.Is(err, errSkippedModified) {
+			counts.skippedSame++
+		case errors.Is(err, errSkippedModified):
 			logger.Debug().Object("asset", asset).Msg("found existing file. The file has been modified, skipping")
-			skippedAssets++
-		} else if err != nil {
+			counts.skippedModified++
+		case errors.Is(err, errSkippedNewer):
+			logger.Debug().Object("asset", asset).Msg("found existing file. The file is newer, skipping")
+			counts.skippedNewer++
+		case err != nil:
 			logger.Warn().Err(err).Object("asset", asset).Msg("could not restore asset")
-		} else {
+			counts.failed++
+		case outcome == restoredOverwritten:
+			logger.Debug().Object("asset", asset).Int64("bytes", size).Msg("restored asset, overwritten existing file")
+			counts.overwritten++
+		case outcome == restoredRenamed:
+			logger.Debug().Object("asset", asset).Int64("bytes", size).Msg("restored asset next to existing file")
+			counts.renamed++
+		default:
 			logger.Debug().Object("asset", asset).Int64("bytes", size).Msg("restored asset")
-			restoredAssets++
+			counts.created++
 		}
 
 		throttledLogger.Info().
-			Int("restored", restoredAssets).
-			Int("skipped", skippedAssets).
+			Int("restored", counts.restored()).
+			Int("skipped", counts.skipped()).
 			Msg("restoring assets")
 	}
 
 	return nil
 }
 
-func restoreAsset(f fs.File, asset asset.ArchivedAsset, logger zerolog.Logger, overwrite bool, dryRun bool) (int64, error) {
-	if info, err := os.Stat(asset.Path()); err == nil {
-		logger.Debug().Str("path", asset.Path()).Msg("found existing file")
+func closeRestoredFile(f fs.File, logger zerolog.Logger) {
+	if err := f.Close(); err != nil {
+		logger.Warn().Err(err).Msg("failed to close file")
+	}
+}
+
+func restoreAsset(f fs.File, asset asset.ArchivedAsset, logger zerolog.Logger, policy ConflictPolicy, dryRun bool) (restoreOutcome, int64, error) {
+	mode := asset.Attributes().Mode
+	if mode.IsDir() {
+		return restoreDir(asset, logger, dryRun)
+	}
+	if mode&fs.ModeSymlink != 0 {
+		return restoreSymlink(f, asset, logger, policy, dryRun)
+	}
 
-		if info.IsDir() {
-			return 0, errors.New("file is a directory")
+	info, err := os.Stat(asset.Path())
+	if os.IsNotExist(err) {
+		logger.Debug().Str("path", asset.Path()).Msg("file not found, creating")
+		if dryRun {
+			return restoredCreated, 0, nil
+		}
+
+		if err := mkdirAllForAsset(filepath.Dir(asset.Path()), asset); err != nil {
+			return restoredCreated, 0, err
+		}
+
+		size, err := writeRestoredFile(asset.Path(), f, asset, os.O_EXCL, logger)
+		return restoredCreated, size, err
+	} else if err != nil {
+		return restoredCreated, 0, err
+	}
+
+	logger.Debug().Str("path", asset.Path()).Msg("found existing file")
+
+	if info.IsDir() {
+		return restoredCreated, 0, errors.New("file is a directory")
+	}
+
+	if info.ModTime().Compare(asset.ModTime()) == 0 && info.Size() == asset.Size() {
+		return restoredCreated, 0, errSkippedSameFile
+	}
+
+	// Check if the file on disk has been modified.
+	storedFileHash, err := asset.ComputeHash()
+	if err != nil {
+		return restoredCreated, 0, err
+	}
+	if storedFileHash == asset.StoredHash() {
+		return restoredCreated, 0, errSkippedSameFile
+	}
+
+	switch policy {
+	case ConflictOverwrite:
+		return overwriteRestoredFile(asset, f, logger, dryRun)
+	case ConflictKeepNewer:
+		if info.ModTime().After(asset.ModTime()) {
+			return restoredCreated, 0, errSkippedNewer
 		}
+		return overwriteRestoredFile(asset, f, logger, dryRun)
+	case ConflictRename:
+		renamedPath := restoredFileName(asset.Path(), time.Now())
+		logger.Info().Str("path", asset.Path()).Str("restored_path", renamedPath).Msg("found existing file, restoring next to it")
+		if dryRun {
+			return restoredRenamed, 0, nil
+		}
+		size, err := writeRestoredFile(renamedPath, f, asset, os.O_EXCL, logger)
+		return restoredRenamed, size, err
+	default:
+		return restoredCreated, 0, errSkippedModified
+	}
+}
 
-		if info.ModTime().Compare(asset.ModTime()) == 0 && info.Size() == asset.Size() {
-			return 0, errSkippedSameFile
+func restoreDir(asset asset.ArchivedAsset, logger zerolog.Logger, dryRun bool) (restoreOutcome, int64, error) {
+	info, err := os.Lstat(asset.Path())
+	if err == nil {
+		if !info.IsDir() {
+			return restoredCreated, 0, errors.New("file exists and is not a directory")
 		}
+		return restoredCreated, 0, errSkippedSameFile
+	} else if !os.IsNotExist(err) {
+		return restoredCreated, 0, err
+	}
+
+	logger.Debug().Str("path", asset.Path()).Msg("directory not found, creating")
+	if dryRun {
+		return restoredCreated, 0, nil
+	}
 
-		// Check if the file on disk has been modified.
-		storedFileHash, err := asset.ComputeHash()
+	if err := mkdirAllForAsset(filepath.Dir(asset.Path()), asset); err != nil {
+		return restoredCreated, 0, err
+	}
+	if err := os.Mkdir(asset.Path(), 0700); err != nil {
+		return restoredCreated, 0, err
+	}
+	if err := applyAttributes(asset.Path(), asset); err != nil {
+		logger.Warn().Err(err).Str("path", asset.Path()).Msg("could not restore file attributes")
+	}
+	return restoredCreated, 0, nil
+}
+
+func restoreSymlink(f fs.File, asset asset.ArchivedAsset, logger zerolog.Logger, policy ConflictPolicy, dryRun bool) (restoreOutcome, int64, error) {
+	target := asset.Attributes().LinkTarget
+	if target == "" {
+		// The archived contents of a link are its target.
+		b, err := io.ReadAll(f)
 		if err != nil {
-			return 0, err
+			return restoredCreated, 0, err
 		}
-		if storedFileHash != asset.StoredHash() && overwrite {
-			logger.Info().Str("path", asset.Path()).Msg("found existing file, overwriting")
-			if dryRun {
-				return 0, nil
-			}
+		target = string(b)
+	}
 
-			if err := os.Remove(asset.Path()); err != nil {
-				return 0, err
-			}
+	info, err := os.Lstat(asset.Path())
+	if os.IsNotExist(err) {
+		logger.Debug().Str("path", asset.Path()).Msg("symbolic link not found, creating")
+		if dryRun {
+			return restoredCreated, 0, nil
+		}
+		if err := mkdirAllForAsset(filepath.Dir(asset.Path()), asset); err != nil {
+			return restoredCreated, 0, err
+		}
+		return restoredCreated, 0, createRestoredSymlink(asset.Path(), target, asset, logger)
+	} else if err != nil {
+		return restoredCreated, 0, err
+	}
 
-			w, err := os.OpenFile(asset.Path(), os.O_CREATE|os.O_WRONLY, 0600)
-			if err != nil {
-				return 0, err
-			}
-			defer func() {
-				err := w.Close()
-				if err != nil {
-					logger.Warn().Err(err).Msg("failed to close file")
-				}
-			}()
-
-			return io.Copy(w, f)
-		} else if storedFileHash != asset.StoredHash() {
-			return 0, errSkippedModified
-		} else {
-			// Should be unreachable.
-			return 0, errSkippedSameFile
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if existing, err := os.Readlink(asset.Path()); err == nil && existing == target {
+			return restoredCreated, 0, errSkippedSameFile
 		}
-	} else if os.IsNotExist(err) {
-		logger.Debug().Str("path", asset.Path()).Msg("file not found, creating")
+	}
+	if info.IsDir() {
+		return restoredCreated, 0, errors.New("file is a directory")
+	}
+
+	overwrite := func() (restoreOutcome, int64, error) {
+		logger.Info().Str("path", asset.Path()).Msg("found existing file, overwriting")
 		if dryRun {
-			return 0, nil
+			return restoredOverwritten, 0, nil
+		}
+		// Create the link next to the existing file and rename it over.
+		tmpPath := fmt.Sprintf("%s.restore-%d", asset.Path(), time.Now().UnixNano())
+		if err := createRestoredSymlink(tmpPath, target, asset, logger); err != nil {
+			return restoredOverwritten, 0, err
 		}
+		if err := os.Rename(tmpPath, asset.Path()); err != nil {
+			_ = os.Remove(tmpPath)
+			return restoredOverwritten, 0, err
+		}
+		return restoredOverwritten, 0, nil
+	}
 
-		if err := os.MkdirAll(filepath.Dir(asset.Path()), os.ModePerm); err != nil {
-			return 0, err
+	switch policy {
+	case ConflictOverwrite:
+		return overwrite()
+	case ConflictKeepNewer:
+		if info.ModTime().After(asset.ModTime()) {
+			return restoredCreated, 0, errSkippedNewer
 		}
+		return overwrite()
+	case ConflictRename:
+		renamedPath := restoredFileName(asset.Path(), time.Now())
+		logger.Info().Str("path", asset.Path()).Str("restored_path", renamedPath).Msg("found existing file, restoring next to it")
+		if dryRun {
+			return restoredRenamed, 0, nil
+		}
+		return restoredRenamed, 0, createRestoredSymlink(renamedPath, target, asset, logger)
+	default:
+		return restoredCreated, 0, errSkippedModified
+	}
+}
 
-		w, err := os.OpenFile(asset.Path(), os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			return 0, err
+func createRestoredSymlink(path string, target string, a asset.Asset, logger zerolog.Logger) error {
+	if err := os.Symlink(target, path); err != nil {
+		return err
+	}
+	if err := applyAttributes(path, a); err != nil {
+		logger.Warn().Err(err).Str("path", path).Msg("could not restore file attributes")
+	}
+	return nil
+}
+
+// Replace the existing file with the restored contents.
+// The contents are written to a temporary file first so the existing file is kept on failure.
+func overwriteRestoredFile(a asset.Asset, f fs.File, logger zerolog.Logger, dryRun bool) (restoreOutcome, int64, error) {
+	path := a.Path()
+	logger.Info().Str("path", path).Msg("found existing file, overwriting")
+	if dryRun {
+		return restoredOverwritten, 0, nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".restore-*")
+	if err != nil {
+		return restoredOverwritten, 0, err
+	}
+	tmpPath := tmp.Name()
+	if err := tmp.Close(); err != nil {
+		return restoredOverwritten, 0, err
+	}
+
+	size, err := writeRestoredFile(tmpPath, f, a, os.O_TRUNC, logger)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		if removeErr := os.Remove(tmpPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			logger.Warn().Err(removeErr).Str("path", tmpPath).Msg("failed to remove temporary file")
 		}
-		defer func() {
-			err := w.Close()
-			if err != nil {
-				logger.Warn().Err(err).Msg("failed to close file")
-			}
-		}()
+		return restoredOverwritten, 0, err
+	}
+	return restoredOverwritten, size, nil
+}
 
-		return io.Copy(w, f)
-	} else {
+// Write the restored contents of an asset to path and apply the archived attributes.
+func writeRestoredFile(path string, f fs.File, a asset.Asset, flag int, logger zerolog.Logger) (int64, error) {
+	w, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|flag, 0600)
+	if err != nil {
 		return 0, err
 	}
+
+	size, err := io.Copy(w, f)
+	if closeErr := w.Close(); closeErr != nil {
+		logger.Warn().Err(closeErr).Msg("failed to close file")
+		err = errors.Join(err, closeErr)
+	}
+	if err != nil {
+		// Don't leave a truncated or corrupted file behind.
+		if removeErr := os.Remove(path); removeErr != nil && !os.IsNotExist(removeErr) {
+			logger.Warn().Err(removeErr).Str("path", path).Msg("failed to remove restored file")
+		}
+		return size, err
+	}
+
+	if err := applyAttributes(path, a); err != nil {
+		logger.Warn().Err(err).Str("path", path).Msg("could not restore file attributes")
+	}
+	return size, nil
+}
+
+// Returns the path used to restore a file next to an existing one.
+// Example: photo.jpg -> photo.restored-20260901T000000Z.jpg
+func restoredFileName(path string, now time.Time) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	return fmt.Sprintf("%s.restored-%s%s", base, now.UTC().Format("20060102T150405Z"), ext)
 }
 
-type zipArchive struct {
-	openReaders map[string]*zip.ReadCloser
+// archiveReaders keeps the archives open while restoring their assets.
+type archiveReaders struct {
+	openReaders map[string]ArchiveReader
+	// If set, archives are only read once their signature is checked.
+	publicKey ed25519.PublicKey
+	// Archives whose signature was checked, with the problem found if any.
+	signatures map[string]error
+	// Set once a signed archive is read without a public key to check it.
+	uncheckedSignature bool
+	// Password of the encrypted archives, if any.
+	password []byte
 }
 
-func Open() *zipArchive {
-	return &zipArchive{
-		openReaders: make(map[string]*zip.ReadCloser),
+func Open(opts ...OpenOption) *archiveReaders {
+	o := openOptions{}
+	for _, applyOpts := range opts {
+		applyOpts(&o)
+	}
+	return &archiveReaders{
+		openReaders: make(map[string]ArchiveReader),
+		publicKey:   o.publicKey,
+		signatures:  make(map[string]error),
+		password:    o.password,
 	}
 }
 
-func (z *zipArchive) Close() error {
+func (z *archiveReaders) Close() error {
 	for _, reader := range z.openReaders {
 		err := reader.Close()
 		if err != nil {
@@ -188,21 +444,169 @@ func (z *zipArchive) Close() error {
 	return nil
 }
 
-func (z *zipArchive) Open(asset asset.ArchivedAsset) (fs.File, error) {
-	var err error
-	reader, ok := z.openReaders[asset.ArchivePath()]
-	if !ok {
-		reader, err = zip.OpenReader(asset.ArchivePath())
+// Open the contents of an asset. The parts of a file split across archives are
+// read in order, and their hash is checked once they are all read. The contents
+// of a file stored once for several identical files are read from where they are.
+// The strong hash of the contents, if any, is checked once they are all read.
+func (z *archiveReaders) Open(a asset.ArchivedAsset) (fs.File, error) {
+	f, err := z.open(a)
+	if err != nil {
+		return nil, err
+	}
+	return checkStrongHash(f, a)
+}
+
+func (z *archiveReaders) open(a asset.ArchivedAsset) (fs.File, error) {
+	if chunks := asset.ChunksOf(a); len(chunks) > 0 {
+		return openChunkedFile(a, chunks, z.reader)
+	}
+	if ref, ok := asset.ContentRefOf(a); ok {
+		reader, err := z.reader(ref.ArchivePath)
 		if err != nil {
 			return nil, err
 		}
-		z.openReaders[asset.ArchivePath()] = reader
+		return reader.Open(ref.Entry)
+	}
+
+	reader, err := z.reader(a.ArchivePath())
+	if err != nil {
+		return nil, err
 	}
 
-	inArchivePath, err := filepath.Rel(asset.SourcePath(), asset.Path())
+	name, err := entryName(a)
 	if err != nil {
 		return nil, err
 	}
 
-	return reader.Open(inArchivePath)
+	return reader.Open(name)
+}
+
+// Compute the strong hash of the contents of an archived asset, checking that
+// they still match its stored hash. Used to hash the assets archived without one.
+func (z *archiveReaders) StrongHash(a asset.ArchivedAsset, alg fileutils.HashAlgorithm) (string, error) {
+	strong, err := fileutils.NewStrongHash(alg)
+	if err != nil {
+		return "", err
+	}
+	f, err := z.open(a)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	h := fileutils.NewHash()
+	if _, err := io.Copy(io.MultiWriter(h, strong), f); err != nil {
+		return "", err
+	}
+	if h.Sum64() != a.StoredHash() {
+		return "", errHashMismatch
+	}
+	return fileutils.FormatStrongHash(alg, strong), nil
+}
+
+func (z *archiveReaders) reader(archivePath string) (ArchiveReader, error) {
+	reader, ok := z.openReaders[archivePath]
+	if !ok {
+		if err := z.checkSignature(archivePath); err != nil {
+			return nil, &archiveOpenError{path: archivePath, err: err}
+		}
+		var err error
+		reader, err = OpenArchive(archivePath, WithPassword(z.password))
+		if err != nil {
+			return nil, &archiveOpenError{path: archivePath, err: err}
+		}
+		z.openReaders[archivePath] = reader
+	}
+	return reader, nil
+}
+
+// Check the signature of an archive once, if a public key is set.
+func (z *archiveReaders) checkSignature(archivePath string) error {
+	if z.publicKey == nil {
+		if _, err := os.Stat(signing.PathOf(archivePath)); err == nil {
+			z.uncheckedSignature = true
+		}
+		return nil
+	}
+	err, ok := z.signatures[archivePath]
+	if !ok {
+		err = signing.Verify(archivePath, z.publicKey)
+		z.signatures[archivePath] = err
+	}
+	return err
+}
+
+// An archive that could not be opened.
+type archiveOpenError struct {
+	path string
+	err  error
+}
+
+func (e *archiveOpenError) Error() string {
+	return fmt.Sprintf("could not open archive %s: %s", e.path, e.err)
+}
+
+func (e *archiveOpenError) Unwrap() error {
+	return e.err
+}
+
+// Name of the archive entry of an asset.
+func entryName(a asset.ArchivedAsset) (string, error) {
+	rel, err := filepath.Rel(a.SourcePath(), a.Path())
+	if err != nil {
+		return "", err
+	}
+	return escapeEntryName(filepath.ToSlash(rel)), nil
+}
+
+// Assets are ordered by batches of this size, so restoring a large source
+// doesn't hold all of its assets in memory.
+const orderBatchSize = 10000
+
+// Order the assets by archive, and by their position in the archive. Archives
+// that can only be read forward are then read once per batch.
+func orderByArchive(assets iter.Seq[asset.ArchivedAsset]) iter.Seq[asset.ArchivedAsset] {
+	return func(yield func(asset.ArchivedAsset) bool) {
+		var batch []asset.ArchivedAsset
+		for a := range assets {
+			batch = append(batch, a)
+			if len(batch) < orderBatchSize {
+				continue
+			}
+			if !yieldOrderedByArchive(batch, yield) {
+				return
+			}
+			batch = batch[:0]
+		}
+		yieldOrderedByArchive(batch, yield)
+	}
+}
+
+func yieldOrderedByArchive(batch []asset.ArchivedAsset, yield func(asset.ArchivedAsset) bool) bool {
+	archiveOrder := make(map[string]int)
+	for _, a := range batch {
+		if _, ok := archiveOrder[a.ArchivePath()]; !ok {
+			archiveOrder[a.ArchivePath()] = len(archiveOrder)
+		}
+	}
+
+	// Assets are archived in the order the source directory is walked.
+	slices.SortStableFunc(batch, func(a, b asset.ArchivedAsset) int {
+		if c := cmp.Compare(archiveOrder[a.ArchivePath()], archiveOrder[b.ArchivePath()]); c != 0 {
+			return c
+		}
+		return slices.Compare(
+			strings.Split(filepath.ToSlash(a.Path()), "/"),
+			strings.Split(filepath.ToSlash(b.Path()), "/"),
+		)
+	})
+
+	for _, a := range batch {
+		if !yield(a) {
+			return false
+		}
+	}
+	return true
 }
@@ -26,6 +26,7 @@ type MockArchivedAsset struct {
 	hash        uint64
 	size        int64
 	modTime     time.Time
+	attributes  asset.Attributes
 }
 
 func (m *MockArchivedAsset) SourcePath() string  { return m.sourcePath }
@@ -35,6 +36,9 @@ func (m *MockArchivedAsset) Path() string        { return m.filePath }
 func (m *MockArchivedAsset) Name() string        { return m.name }
 func (m *MockArchivedAsset) Size() int64         { return m.size }
 func (m *MockArchivedAsset) ModTime() time.Time  { return m.modTime }
+func (m *MockArchivedAsset) Attributes() asset.Attributes {
+	return m.attributes
+}
 func (m *MockArchivedAsset) ComputeHash() (uint64, error) {
 	return fileutils.ComputeFileHash(m.filePath)
 }
@@ -629,3 +633,304 @@ func TestRestore_TargetIsDirectory(t *testing.T) {
 		t.Errorf("Expected 1 warning about target being a directory, got %d", dirWarnings)
 	}
 }
+
+func TestRestore_TargetDir(t *testing.T) {
+	sourceDir, targetDir, archiveDir := setupTestEnvironment(t)
+	defer func() {
+		_ = os.RemoveAll(sourceDir)
+		_ = os.RemoveAll(targetDir)
+		_ = os.RemoveAll(archiveDir)
+	}()
+
+	_, assets := createTestArchive(t, sourceDir, archiveDir)
+
+	// Modify a source file to check that the original paths are left untouched.
+	if err := os.WriteFile(filepath.Join(sourceDir, "file1.txt"), []byte("Modified content"), 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	assetSeq := func(yield func(asset.ArchivedAsset) bool) {
+		for _, a := range assets {
+			if !yield(a) {
+				break
+			}
+		}
+	}
+
+	logger := zerolog.New(io.Discard)
+
+	err := ziparchiver.Restore(
+		context.Background(),
+		assetSeq,
+		logger,
+		ziparchiver.WithRestoreTargetDir(targetDir),
+	)
+	if err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+
+	for _, a := range assets {
+		targetPath := filepath.Join(targetDir, a.Name())
+
+		content, err := os.ReadFile(targetPath)
+		if err != nil {
+			t.Errorf("Failed to read file %s: %v", targetPath, err)
+			continue
+		}
+
+		hash, err := fileutils.ComputeHash(strings.NewReader(string(content)))
+		if err != nil {
+			t.Errorf("Failed to compute hash for %s: %v", targetPath, err)
+			continue
+		}
+		if hash != a.hash {
+			t.Errorf("File content mismatch for %s. Expected hash %d, got %d", targetPath, a.hash, hash)
+		}
+	}
+
+	content, err := os.ReadFile(filepath.Join(sourceDir, "file1.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if string(content) != "Modified content" {
+		t.Errorf("Source file was changed when restoring into a target directory")
+	}
+}
+
+func TestRestore_TargetDirExistingModifiedFiles(t *testing.T) {
+	sourceDir, targetDir, archiveDir := setupTestEnvironment(t)
+	defer func() {
+		_ = os.RemoveAll(sourceDir)
+		_ = os.RemoveAll(targetDir)
+		_ = os.RemoveAll(archiveDir)
+	}()
+
+	_, assets := createTestArchive(t, sourceDir, archiveDir)
+
+	// The file in the target directory has the same mod time but different content.
+	targetPath := filepath.Join(targetDir, "file1.txt")
+	if err := os.WriteFile(targetPath, []byte("Modified content"), 0644); err != nil {
+		t.Fatalf("Failed to write target file: %v", err)
+	}
+	if err := os.Chtimes(targetPath, assets["file1.txt"].modTime, assets["file1.txt"].modTime); err != nil {
+		t.Fatalf("Failed to set file time: %v", err)
+	}
+
+	assetSeq := func(yield func(asset.ArchivedAsset) bool) {
+		for _, a := range assets {
+			if !yield(a) {
+				break
+			}
+		}
+	}
+
+	var logOutput []string
+	logger := zerolog.New(
+		zerolog.ConsoleWriter{Out: io.Discard, NoColor: true},
+	).With().Timestamp().Logger().Hook(
+		zerolog.HookFunc(func(e *zerolog.Event, level zerolog.Level, message string) {
+			logOutput = append(logOutput, fmt.Sprintf("%s: %s", level, message))
+		}),
+	)
+
+	err := ziparchiver.Restore(
+		context.Background(),
+		assetSeq,
+		logger,
+		ziparchiver.WithRestoreTargetDir(targetDir),
+	)
+	if err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+
+	if !slices.Contains(logOutput, "debug: found existing file. The file has been modified, skipping") {
+		t.Errorf("Expected the relocated file to be skipped as modified")
+	}
+
+	content, err := os.ReadFile(targetPath)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if string(content) != "Modified content" {
+		t.Errorf("File content was changed when it should have been skipped")
+	}
+}
+
+func TestRestore_ConflictPolicy(t *testing.T) {
+	archivedContent := "This is file 1 content"
+
+	testCases := []struct {
+		name            string
+		policy          ziparchiver.ConflictPolicy
+		existingModTime func(archived time.Time) time.Time
+		expectedContent string
+		expectRenamed   bool
+	}{
+		{
+			name:            "skip",
+			policy:          ziparchiver.ConflictSkip,
+			existingModTime: func(archived time.Time) time.Time { return archived.Add(-time.Hour) },
+			expectedContent: "Modified content",
+		},
+		{
+			name:            "overwrite",
+			policy:          ziparchiver.ConflictOverwrite,
+			existingModTime: func(archived time.Time) time.Time { return archived.Add(time.Hour) },
+			expectedContent: archivedContent,
+		},
+		{
+			name:            "keep newer existing file",
+			policy:          ziparchiver.ConflictKeepNewer,
+			existingModTime: func(archived time.Time) time.Time { return archived.Add(time.Hour) },
+			expectedContent: "Modified content",
+		},
+		{
+			name:            "keep newer archived file",
+			policy:          ziparchiver.ConflictKeepNewer,
+			existingModTime: func(archived time.Time) time.Time { return archived.Add(-time.Hour) },
+			expectedContent: archivedContent,
+		},
+		{
+			name:            "rename",
+			policy:          ziparchiver.ConflictRename,
+			existingModTime: func(archived time.Time) time.Time { return archived.Add(-time.Hour) },
+			expectedContent: "Modified content",
+			expectRenamed:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sourceDir, targetDir, archiveDir := setupTestEnvironment(t)
+			defer func() {
+				_ = os.RemoveAll(sourceDir)
+				_ = os.RemoveAll(targetDir)
+				_ = os.RemoveAll(archiveDir)
+			}()
+
+			_, assets := createTestArchive(t, sourceDir, archiveDir)
+			archived := assets["file1.txt"]
+
+			targetPath := filepath.Join(targetDir, "file1.txt")
+			if err := os.WriteFile(targetPath, []byte("Modified content"), 0644); err != nil {
+				t.Fatalf("Failed to write target file: %v", err)
+			}
+			modTime := tc.existingModTime(archived.modTime)
+			if err := os.Chtimes(targetPath, modTime, modTime); err != nil {
+				t.Fatalf("Failed to set file time: %v", err)
+			}
+
+			assetSeq := func(yield func(asset.ArchivedAsset) bool) {
+				yield(archived)
+			}
+
+			err := ziparchiver.Restore(
+				context.Background(),
+				assetSeq,
+				zerolog.New(io.Discard),
+				ziparchiver.WithRestoreTargetDir(targetDir),
+				ziparchiver.WithRestoreConflictPolicy(tc.policy),
+			)
+			if err != nil {
+				t.Fatalf("Failed to restore: %v", err)
+			}
+
+			content, err := os.ReadFile(targetPath)
+			if err != nil {
+				t.Fatalf("Failed to read file: %v", err)
+			}
+			if string(content) != tc.expectedContent {
+				t.Errorf("Expected content %q, got %q", tc.expectedContent, string(content))
+			}
+
+			renamed, err := filepath.Glob(filepath.Join(targetDir, "file1.restored-*.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.expectRenamed {
+				if len(renamed) != 0 {
+					t.Errorf("Expected no renamed files, got %v", renamed)
+				}
+				return
+			}
+			if len(renamed) != 1 {
+				t.Fatalf("Expected 1 renamed file, got %v", renamed)
+			}
+			content, err = os.ReadFile(renamed[0])
+			if err != nil {
+				t.Fatalf("Failed to read file: %v", err)
+			}
+			if string(content) != archivedContent {
+				t.Errorf("Expected renamed file content %q, got %q", archivedContent, string(content))
+			}
+		})
+	}
+}
+
+func TestRestore_Attributes(t *testing.T) {
+	sourceDir, targetDir, archiveDir := setupTestEnvironment(t)
+	defer func() {
+		_ = os.RemoveAll(sourceDir)
+		_ = os.RemoveAll(targetDir)
+		_ = os.RemoveAll(archiveDir)
+	}()
+
+	_, assets := createTestArchive(t, sourceDir, archiveDir)
+	archived := assets["nested/file3.txt"]
+	archived.modTime = time.Date(2024, 5, 1, 10, 30, 0, 123456789, time.UTC)
+	archived.attributes = asset.Attributes{
+		Mode: 0640,
+		UID:  os.Getuid(),
+		GID:  os.Getgid(),
+	}
+
+	assetSeq := func(yield func(asset.ArchivedAsset) bool) {
+		yield(archived)
+	}
+
+	restore := func() []string {
+		var logOutput []string
+		logger := zerolog.New(io.Discard).Hook(
+			zerolog.HookFunc(func(e *zerolog.Event, level zerolog.Level, message string) {
+				logOutput = append(logOutput, fmt.Sprintf("%s: %s", level, message))
+			}),
+		)
+		err := ziparchiver.Restore(
+			context.Background(),
+			assetSeq,
+			logger,
+			ziparchiver.WithRestoreTargetDir(targetDir),
+		)
+		if err != nil {
+			t.Fatalf("Failed to restore: %v", err)
+		}
+		return logOutput
+	}
+	restore()
+
+	restoredPath := filepath.Join(targetDir, "nested", "file3.txt")
+	info, err := os.Stat(restoredPath)
+	if err != nil {
+		t.Fatalf("Failed to stat restored file: %v", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode 0640, got %s", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(archived.modTime) {
+		t.Errorf("Expected mod time %s, got %s", archived.modTime, info.ModTime())
+	}
+
+	dirInfo, err := os.Stat(filepath.Dir(restoredPath))
+	if err != nil {
+		t.Fatalf("Failed to stat restored directory: %v", err)
+	}
+	if dirInfo.Mode().Perm() != 0750 {
+		t.Errorf("Expected directory mode 0750, got %s", dirInfo.Mode().Perm())
+	}
+
+	// Restoring again finds the same file by mod time and size.
+	logOutput := restore()
+	if !slices.Contains(logOutput, "debug: file already present, skipping") {
+		t.Errorf("Expected restored file to be skipped as already present")
+	}
+}
@@ -0,0 +1,286 @@
+package ziparchiver
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/fileutils"
+	"github.com/stupid-simple/backup/parity"
+	"github.com/stupid-simple/backup/signing"
+	"github.com/stupid-simple/backup/ziparchiver/zipwriter"
+)
+
+// Kind of problem found by Verify.
+type ProblemKind string
+
+const (
+	ProblemMissingArchive ProblemKind = "missing_archive"
+	ProblemMissingEntry   ProblemKind = "missing_entry"
+	ProblemCorruptedEntry ProblemKind = "corrupted_entry"
+	// The blocks of the archive don't match its parity file.
+	ProblemDamagedArchive  ProblemKind = "damaged_archive"
+	ProblemMissingParity   ProblemKind = "missing_parity"
+	ProblemCorruptedParity ProblemKind = "corrupted_parity"
+	// The archive isn't signed, or was modified since it was signed.
+	ProblemMissingSignature ProblemKind = "missing_signature"
+	ProblemInvalidSignature ProblemKind = "invalid_signature"
+	// The archive is encrypted, and no password or a wrong one was given.
+	// Its assets aren't counted as damaged.
+	ProblemEncryptedArchive ProblemKind = "encrypted_archive"
+)
+
+// A problem found by Verify.
+type Problem struct {
+	Kind        ProblemKind
+	ArchivePath string
+	Path        string // Path of the asset. Empty for missing archives.
+	Err         error
+}
+
+// MarshalZerologObject implements zerolog.LogObjectMarshaler.
+func (p Problem) MarshalZerologObject(e *zerolog.Event) {
+	e.Str("kind", string(p.Kind))
+	e.Str("archive", p.ArchivePath)
+	if p.Path != "" {
+		e.Str("path", p.Path)
+	}
+	if p.Err != nil {
+		e.AnErr("cause", p.Err)
+	}
+}
+
+type VerifyReport struct {
+	Assets   int // Assets verified.
+	Problems []Problem
+	// Assets whose contents can't be read back, including the ones in a missing archive.
+	Damaged []asset.ArchivedAsset
+}
+
+type VerifyOption func(o *verifyOptions)
+
+type verifyOptions struct {
+	deep     bool
+	password []byte
+}
+
+// If true, the hash of the contents is computed and compared to the stored hash.
+// Otherwise, only the checksums of the archive format are checked.
+func WithVerifyDeep(deep bool) VerifyOption {
+	return func(o *verifyOptions) {
+		o.deep = deep
+	}
+}
+
+// Decrypt the entries of encrypted archives with the password.
+func WithVerifyPassword(password []byte) VerifyOption {
+	return func(o *verifyOptions) {
+		o.password = password
+	}
+}
+
+// Check that the contents of the assets are in their archives and can be read
+// back. The assets missing an archive are reported once for the archive.
+func Verify(ctx context.Context, assets iter.Seq[asset.ArchivedAsset], logger zerolog.Logger, opts ...VerifyOption) (*VerifyReport, error) {
+	o := verifyOptions{}
+	for _, applyOpts := range opts {
+		applyOpts(&o)
+	}
+
+	logger.Info().Bool("deep", o.deep).Msg("start verifying assets")
+
+	report := &VerifyReport{}
+	defer func() {
+		if ctx.Err() != nil {
+			logger.Info().Int("assets", report.Assets).Int("problems", len(report.Problems)).Msg("cancelled verify")
+		} else {
+			logger.Info().Int("assets", report.Assets).Int("problems", len(report.Problems)).Msg("done verifying assets")
+		}
+	}()
+
+	archives := Open(WithPassword(o.password))
+	defer func() {
+		err := archives.Close()
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to close archive file")
+		}
+	}()
+
+	// Archives missing or that can't be decrypted, reported once.
+	reportedArchives := map[ProblemKind]map[string]bool{
+		ProblemMissingArchive:   {},
+		ProblemEncryptedArchive: {},
+	}
+	throttledLogger := logger.Sample(&zerolog.BurstSampler{
+		Burst:  1,
+		Period: 1 * time.Second,
+	})
+	for a := range orderByArchive(assets) {
+		if ctx.Err() != nil {
+			return report, nil
+		}
+
+		problem, ok := verifyAsset(archives, a, o.deep)
+		report.Assets++
+		if !ok && problem.Kind != ProblemEncryptedArchive {
+			report.Damaged = append(report.Damaged, a)
+		}
+		reported := reportedArchives[problem.Kind]
+		switch {
+		case ok:
+			logger.Debug().Object("asset", a).Msg("asset verified")
+		case reported != nil && reported[problem.ArchivePath]:
+			// Already reported.
+		default:
+			if reported != nil {
+				reported[problem.ArchivePath] = true
+				problem.Path = ""
+			}
+			logger.Error().Object("problem", problem).Msg("archive problem found")
+			report.Problems = append(report.Problems, problem)
+		}
+
+		throttledLogger.Info().
+			Int("assets", report.Assets).
+			Int("problems", len(report.Problems)).
+			Msg("verifying assets")
+	}
+	return report, nil
+}
+
+// Check an archive against its parity file. A missing archive isn't reported,
+// Verify reports it with its assets. Nothing is reported if ctx is cancelled.
+func VerifyParity(ctx context.Context, archivePath string, parityPath string, logger zerolog.Logger) []Problem {
+	var problems []Problem
+	add := func(kind ProblemKind, err error) {
+		problem := Problem{Kind: kind, ArchivePath: archivePath, Err: err}
+		logger.Error().Object("problem", problem).Msg("archive problem found")
+		problems = append(problems, problem)
+	}
+
+	if !fileutils.Exists(archivePath) {
+		return nil
+	}
+	report, err := parity.Verify(ctx, archivePath, parityPath)
+	switch {
+	case ctx.Err() != nil:
+		return nil
+	case errors.Is(err, fs.ErrNotExist) && !fileutils.Exists(parityPath):
+		add(ProblemMissingParity, err)
+		return problems
+	case errors.Is(err, parity.ErrCorrupted):
+		add(ProblemCorruptedParity, err)
+		return problems
+	case err != nil:
+		add(ProblemDamagedArchive, err)
+		return problems
+	}
+
+	if report.DamagedParity > 0 {
+		add(ProblemCorruptedParity, fmt.Errorf("%d damaged parity blocks", report.DamagedParity))
+	}
+	if len(report.DamagedBlocks) > 0 || report.SizeMismatch {
+		err := fmt.Errorf("%d damaged blocks out of %d", len(report.DamagedBlocks), report.Blocks)
+		if report.SizeMismatch {
+			err = fmt.Errorf("size changed, %w", err)
+		}
+		if report.Repairable {
+			err = fmt.Errorf("%w, can be repaired", err)
+		} else {
+			err = fmt.Errorf("%w, too many to repair", err)
+		}
+		add(ProblemDamagedArchive, err)
+	}
+	if len(problems) == 0 {
+		logger.Debug().Str("archive", archivePath).Msg("parity verified")
+	}
+	return problems
+}
+
+// Check the signature of an archive with the public key. A missing archive
+// isn't reported, Verify reports it with its assets.
+func VerifySignature(archivePath string, key ed25519.PublicKey, logger zerolog.Logger) []Problem {
+	if !fileutils.Exists(archivePath) {
+		return nil
+	}
+	err := signing.Verify(archivePath, key)
+	var kind ProblemKind
+	switch {
+	case err == nil:
+		logger.Debug().Str("archive", archivePath).Msg("signature verified")
+		return nil
+	case errors.Is(err, signing.ErrMissingSignature):
+		kind = ProblemMissingSignature
+	default:
+		kind = ProblemInvalidSignature
+	}
+	problem := Problem{Kind: kind, ArchivePath: archivePath, Err: err}
+	logger.Error().Object("problem", problem).Msg("archive problem found")
+	return []Problem{problem}
+}
+
+// Read the contents of an asset. Returns false with the problem if they can't be read.
+func verifyAsset(archives *archiveReaders, a asset.ArchivedAsset, deep bool) (Problem, bool) {
+	problem := func(kind ProblemKind, archivePath string, err error) (Problem, bool) {
+		return Problem{Kind: kind, ArchivePath: archivePath, Path: a.Path(), Err: err}, false
+	}
+	classify := func(err error) (Problem, bool) {
+		var openErr *archiveOpenError
+		switch {
+		case errors.As(err, &openErr) && errors.Is(err, fs.ErrNotExist):
+			return problem(ProblemMissingArchive, openErr.path, err)
+		case errors.Is(err, ErrPasswordRequired) || errors.Is(err, zipwriter.ErrPassword):
+			return problem(ProblemEncryptedArchive, contentArchivePath(a), err)
+		case errors.As(err, &openErr):
+			return problem(ProblemCorruptedEntry, openErr.path, err)
+		case errors.Is(err, fs.ErrNotExist):
+			return problem(ProblemMissingEntry, contentArchivePath(a), err)
+		default:
+			return problem(ProblemCorruptedEntry, contentArchivePath(a), err)
+		}
+	}
+
+	f, err := archives.Open(a)
+	if err != nil {
+		return classify(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	mode := a.Attributes().Mode
+	if mode.IsDir() {
+		return Problem{}, true
+	}
+
+	// Reading the whole entry checks the checksums of the archive format.
+	var hash uint64
+	if deep && (mode.IsRegular() || mode&fs.ModeSymlink != 0) {
+		hash, err = fileutils.ComputeHash(f)
+	} else {
+		_, err = io.Copy(io.Discard, f)
+		hash = a.StoredHash()
+	}
+	if err != nil {
+		return classify(err)
+	}
+	if hash != a.StoredHash() {
+		return problem(ProblemCorruptedEntry, contentArchivePath(a), fmt.Errorf("hash %d doesn't match the stored hash %d", hash, a.StoredHash()))
+	}
+	return Problem{}, true
+}
+
+// Path of the archive holding the contents of an asset, or its last part.
+func contentArchivePath(a asset.ArchivedAsset) string {
+	if ref, ok := asset.ContentRefOf(a); ok {
+		return ref.ArchivePath
+	}
+	return a.ArchivePath()
+}
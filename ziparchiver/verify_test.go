@@ -0,0 +1,280 @@
+package ziparchiver_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/fileutils"
+	"github.com/stupid-simple/backup/parity"
+	"github.com/stupid-simple/backup/signing"
+	"github.com/stupid-simple/backup/ziparchiver"
+)
+
+// Store the test assets without compression, so their contents can be found in the archive.
+func storeVerifyTestAssets(t *testing.T, format ziparchiver.Format) []asset.ArchivedAsset {
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	assets := createTestAssets(t, sourceDir, 3)
+
+	registry := &MockArchivedAssetRegistry{}
+	err := ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: destDir},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithFormat(format),
+		ziparchiver.WithCompression(ziparchiver.Compression{Method: ziparchiver.CompressionStore}),
+	)
+	require.NoError(t, err)
+	require.Len(t, registry.assets, 3)
+	return registry.assets
+}
+
+func TestVerify(t *testing.T) {
+	for _, format := range ziparchiver.Formats {
+		t.Run(string(format), func(t *testing.T) {
+			assets := storeVerifyTestAssets(t, format)
+			for _, deep := range []bool{false, true} {
+				report, err := ziparchiver.Verify(context.Background(), slices.Values(assets), zerolog.New(io.Discard), ziparchiver.WithVerifyDeep(deep))
+				require.NoError(t, err)
+				assert.Equal(t, 3, report.Assets)
+				assert.Empty(t, report.Problems)
+			}
+		})
+	}
+}
+
+func TestVerify_CorruptedEntry(t *testing.T) {
+	assets := storeVerifyTestAssets(t, ziparchiver.FormatZip)
+
+	archivePath := assets[1].ArchivePath()
+	data, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	i := bytes.Index(data, []byte("Content for file 1"))
+	require.GreaterOrEqual(t, i, 0)
+	data[i] ^= 0xff
+	require.NoError(t, os.WriteFile(archivePath, data, 0644))
+
+	report, err := ziparchiver.Verify(context.Background(), slices.Values(assets), zerolog.New(io.Discard))
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	assert.Equal(t, ziparchiver.ProblemCorruptedEntry, report.Problems[0].Kind)
+	assert.Equal(t, assets[1].Path(), report.Problems[0].Path)
+	assert.Equal(t, archivePath, report.Problems[0].ArchivePath)
+	require.Len(t, report.Damaged, 1)
+	assert.Equal(t, assets[1].Path(), report.Damaged[0].Path())
+}
+
+func TestVerify_Deep(t *testing.T) {
+	assets := storeVerifyTestAssets(t, ziparchiver.FormatZip)
+	assets[0] = wrongStoredHashAsset{assets[0]}
+
+	report, err := ziparchiver.Verify(context.Background(), slices.Values(assets), zerolog.New(io.Discard))
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	report, err = ziparchiver.Verify(context.Background(), slices.Values(assets), zerolog.New(io.Discard), ziparchiver.WithVerifyDeep(true))
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	assert.Equal(t, ziparchiver.ProblemCorruptedEntry, report.Problems[0].Kind)
+	assert.Equal(t, assets[0].Path(), report.Problems[0].Path)
+}
+
+func TestVerify_MissingEntryAndArchive(t *testing.T) {
+	assets := storeVerifyTestAssets(t, ziparchiver.FormatZip)
+	assets[0] = renamedAsset{assets[0], filepath.Join(filepath.Dir(assets[0].Path()), "unknown.txt")}
+
+	report, err := ziparchiver.Verify(context.Background(), slices.Values(assets), zerolog.New(io.Discard))
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	assert.Equal(t, ziparchiver.ProblemMissingEntry, report.Problems[0].Kind)
+	assert.Equal(t, assets[0].Path(), report.Problems[0].Path)
+
+	// A missing archive is reported once.
+	require.NoError(t, os.Remove(assets[1].ArchivePath()))
+	report, err = ziparchiver.Verify(context.Background(), slices.Values(assets), zerolog.New(io.Discard))
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Assets)
+	require.Len(t, report.Problems, 1)
+	assert.Equal(t, ziparchiver.ProblemMissingArchive, report.Problems[0].Kind)
+	assert.Equal(t, assets[1].ArchivePath(), report.Problems[0].ArchivePath)
+	assert.Len(t, report.Damaged, 3)
+}
+
+func TestVerify_StrongHash(t *testing.T) {
+	sourceDir := t.TempDir()
+	assets := createTestAssets(t, sourceDir, 2)
+	registry := &MockArchivedAssetRegistry{}
+	err := ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: t.TempDir()},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithStrongHash(fileutils.HashBLAKE3),
+	)
+	require.NoError(t, err)
+	archived := registry.assets
+	require.Len(t, archived, 2)
+
+	report, err := ziparchiver.Verify(context.Background(), slices.Values(archived), zerolog.New(io.Discard))
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	// The xxhash matches, but not the strong hash.
+	archived[1] = wrongStrongHashAsset{archived[1]}
+	report, err = ziparchiver.Verify(context.Background(), slices.Values(archived), zerolog.New(io.Discard))
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	assert.Equal(t, ziparchiver.ProblemCorruptedEntry, report.Problems[0].Kind)
+	assert.Equal(t, archived[1].Path(), report.Problems[0].Path)
+}
+
+func TestVerify_Encrypted(t *testing.T) {
+	sourceDir := t.TempDir()
+	assets := createTestAssets(t, sourceDir, 2)
+	registry := &MockArchivedAssetRegistry{}
+	err := ziparchiver.StoreAssets(
+		context.Background(),
+		sourceDir,
+		ziparchiver.ArchiveDescriptor{Dir: t.TempDir()},
+		slices.Values(assets),
+		zerolog.New(io.Discard),
+		ziparchiver.WithRegisterArchivedAssets(registry),
+		ziparchiver.WithEncryption([]byte("secret")),
+	)
+	require.NoError(t, err)
+	archived := registry.assets
+	require.Len(t, archived, 2)
+
+	report, err := ziparchiver.Verify(context.Background(), slices.Values(archived), zerolog.New(io.Discard),
+		ziparchiver.WithVerifyDeep(true), ziparchiver.WithVerifyPassword([]byte("secret")))
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	// Reported once for the archive, whose assets aren't damaged.
+	for _, password := range [][]byte{nil, []byte("wrong")} {
+		report, err = ziparchiver.Verify(context.Background(), slices.Values(archived), zerolog.New(io.Discard),
+			ziparchiver.WithVerifyPassword(password))
+		require.NoError(t, err)
+		require.Len(t, report.Problems, 1)
+		assert.Equal(t, ziparchiver.ProblemEncryptedArchive, report.Problems[0].Kind)
+		assert.Equal(t, archived[0].ArchivePath(), report.Problems[0].ArchivePath)
+		assert.Empty(t, report.Damaged)
+	}
+}
+
+func TestArchiveReaders_StrongHash(t *testing.T) {
+	assets := storeVerifyTestAssets(t, ziparchiver.FormatZip)
+	archives := ziparchiver.Open()
+	defer archives.Close()
+
+	for _, alg := range []fileutils.HashAlgorithm{fileutils.HashSHA256, fileutils.HashBLAKE3} {
+		strongHash, err := archives.StrongHash(assets[0], alg)
+		require.NoError(t, err)
+		f, err := os.Open(assets[0].Path())
+		require.NoError(t, err)
+		expected, err := fileutils.ComputeStrongHash(alg, f)
+		_ = f.Close()
+		require.NoError(t, err)
+		assert.Equal(t, expected, strongHash)
+	}
+
+	// Contents that don't match their stored hash are not hashed.
+	_, err := archives.StrongHash(wrongStoredHashAsset{assets[0]}, fileutils.HashSHA256)
+	assert.Error(t, err)
+}
+
+type wrongStrongHashAsset struct {
+	asset.ArchivedAsset
+}
+
+func (w wrongStrongHashAsset) StrongHash() string {
+	return string(fileutils.HashBLAKE3) + ":" + strings.Repeat("00", 32)
+}
+
+type wrongStoredHashAsset struct {
+	asset.ArchivedAsset
+}
+
+func (w wrongStoredHashAsset) StoredHash() uint64 {
+	return w.ArchivedAsset.StoredHash() + 1
+}
+
+type renamedAsset struct {
+	asset.ArchivedAsset
+	path string
+}
+
+func (r renamedAsset) Path() string {
+	return r.path
+}
+
+func TestVerifyParity(t *testing.T) {
+	assets := storeVerifyTestAssets(t, ziparchiver.FormatZip)
+	archivePath := assets[0].ArchivePath()
+	parityPath := parity.PathOf(archivePath)
+	logger := zerolog.New(io.Discard)
+
+	problems := ziparchiver.VerifyParity(context.Background(), archivePath, parityPath, logger)
+	require.Len(t, problems, 1)
+	assert.Equal(t, ziparchiver.ProblemMissingParity, problems[0].Kind)
+
+	require.NoError(t, parity.Write(context.Background(), archivePath, 10))
+	problems = ziparchiver.VerifyParity(context.Background(), archivePath, parityPath, logger)
+	assert.Empty(t, problems)
+
+	data, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	data[10] ^= 0xff
+	require.NoError(t, os.WriteFile(archivePath, data, 0600))
+	problems = ziparchiver.VerifyParity(context.Background(), archivePath, parityPath, logger)
+	require.Len(t, problems, 1)
+	assert.Equal(t, ziparchiver.ProblemDamagedArchive, problems[0].Kind)
+
+	require.NoError(t, os.WriteFile(parityPath, []byte("damaged"), 0600))
+	problems = ziparchiver.VerifyParity(context.Background(), archivePath, parityPath, logger)
+	require.Len(t, problems, 1)
+	assert.Equal(t, ziparchiver.ProblemCorruptedParity, problems[0].Kind)
+}
+
+func TestVerifySignature(t *testing.T) {
+	assets := storeVerifyTestAssets(t, ziparchiver.FormatZip)
+	archivePath := assets[0].ArchivePath()
+	logger := zerolog.New(io.Discard)
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	problems := ziparchiver.VerifySignature(archivePath, publicKey, logger)
+	require.Len(t, problems, 1)
+	assert.Equal(t, ziparchiver.ProblemMissingSignature, problems[0].Kind)
+
+	require.NoError(t, signing.Sign(archivePath, privateKey))
+	assert.Empty(t, ziparchiver.VerifySignature(archivePath, publicKey, logger))
+
+	data, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	data[10] ^= 0xff
+	require.NoError(t, os.WriteFile(archivePath, data, 0600))
+	problems = ziparchiver.VerifySignature(archivePath, publicKey, logger)
+	require.Len(t, problems, 1)
+	assert.Equal(t, ziparchiver.ProblemInvalidSignature, problems[0].Kind)
+
+	// A missing archive is reported by Verify.
+	require.NoError(t, os.Remove(archivePath))
+	assert.Empty(t, ziparchiver.VerifySignature(archivePath, publicKey, logger))
+}
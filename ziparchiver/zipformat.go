@@ -0,0 +1,267 @@
+package ziparchiver
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stupid-simple/backup/asset"
+	"github.com/stupid-simple/backup/ziparchiver/zipwriter"
+)
+
+// zipArchiveWriter writes zip archives.
+type zipArchiveWriter struct {
+	*zipwriter.ZipFile
+	method uint16
+}
+
+func newZipArchive(path string, dryRun bool, compression Compression, password []byte) *zipArchiveWriter {
+	z := &zipArchiveWriter{ZipFile: zipwriter.NewLazyZipFile(path), method: compression.zipMethod()}
+	if dryRun {
+		z.ZipFile = zipwriter.NewNullZipFile()
+	}
+	z.SetCompression(zipwriter.Compression{Level: compression.Level})
+	if password != nil {
+		z.SetPassword(password)
+	}
+	return z
+}
+
+// Create implements ArchiveWriter.
+func (z *zipArchiveWriter) Create(e *Entry) (io.Writer, error) {
+	return z.CreateHeader(z.header(e))
+}
+
+// CreateRaw adds an entry with contents compressed ahead of time.
+func (z *zipArchiveWriter) CreateRaw(e *Entry, c *compressedEntry) (io.Writer, error) {
+	header := z.header(e)
+	if !e.Attributes.Mode.IsDir() {
+		header.Method = c.method
+		header.CRC32 = c.crc32
+		header.CompressedSize64 = uint64(c.compressedSize)
+		header.UncompressedSize64 = uint64(c.size)
+	}
+	return z.ZipFile.CreateRaw(header)
+}
+
+func (z *zipArchiveWriter) header(e *Entry) *zip.FileHeader {
+	header := &zip.FileHeader{
+		Name:               e.Name,
+		UncompressedSize64: uint64(e.Size),
+		Modified:           e.ModTime,
+		Method:             z.method,
+	}
+	setHeaderAttributes(header, e.Attributes)
+	if e.Store || e.Attributes.Mode.IsDir() {
+		header.Method = zip.Store
+	}
+	return header
+}
+
+// zipArchiveReader reads zip archives. Entries encrypted with the WinZip AES
+// extension are decrypted with the password.
+type zipArchiveReader struct {
+	reader   *zip.ReadCloser
+	password []byte
+	// Encrypted entries by name, without the trailing slash of directories.
+	encrypted map[string]*zip.File
+}
+
+func openZipArchive(path string, password []byte) (*zipArchiveReader, error) {
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	reader.RegisterDecompressor(zipwriter.Zstd, zstd.ZipDecompressor())
+	z := &zipArchiveReader{reader: reader, password: password, encrypted: make(map[string]*zip.File)}
+	for _, f := range reader.File {
+		if isEncrypted(f) {
+			z.encrypted[strings.TrimSuffix(f.Name, "/")] = f
+		}
+	}
+	return z, nil
+}
+
+func isEncrypted(f *zip.File) bool {
+	return f.Flags&0x1 != 0
+}
+
+// Open implements ArchiveReader.
+func (z *zipArchiveReader) Open(name string) (fs.File, error) {
+	name = strings.TrimSuffix(name, "/")
+	f, ok := z.encrypted[name]
+	if !ok {
+		return z.reader.Open(name)
+	}
+	rc, err := z.openEntry(f)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &zipEntryFile{ReadCloser: rc, file: f}, nil
+}
+
+// Encrypted implements ArchiveReader.
+func (z *zipArchiveReader) Encrypted() bool {
+	return len(z.encrypted) > 0
+}
+
+// List implements ArchiveReader.
+func (z *zipArchiveReader) List(fn func(e *Entry, r io.Reader) error) error {
+	for _, f := range z.reader.File {
+		if err := z.listEntry(f, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open the contents of an entry, decrypted if needed.
+func (z *zipArchiveReader) openEntry(f *zip.File) (io.ReadCloser, error) {
+	if !isEncrypted(f) {
+		return f.Open()
+	}
+	aes, ok, err := zipwriter.ParseAESExtra(f.Extra)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("unsupported encryption, only WinZip AES is supported")
+	}
+	if z.password == nil {
+		return nil, ErrPasswordRequired
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := zipwriter.NewAESReader(raw, int64(f.CompressedSize64), z.password)
+	if err != nil {
+		return nil, err
+	}
+	var contents io.ReadCloser
+	switch aes.Method {
+	case zip.Store:
+		contents = io.NopCloser(decrypted)
+	case zip.Deflate:
+		contents = flate.NewReader(decrypted)
+	case zipwriter.Zstd:
+		contents = zstd.ZipDecompressor()(decrypted)
+	default:
+		return nil, zip.ErrAlgorithm
+	}
+	e := &decryptedEntryReader{
+		contents:  contents,
+		decrypted: decrypted,
+		size:      f.UncompressedSize64,
+	}
+	if aes.CheckCRC {
+		e.crc32 = f.CRC32
+		e.hash = crc32.NewIEEE()
+	}
+	return e, nil
+}
+
+func (z *zipArchiveReader) listEntry(f *zip.File, fn func(e *Entry, r io.Reader) error) error {
+	rc, err := z.openEntry(f)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rc.Close()
+	}()
+
+	uid, gid, _ := parseUnixOwnerExtra(f.Extra)
+	e := &Entry{
+		Name:    f.Name,
+		Size:    int64(f.UncompressedSize64),
+		ModTime: f.Modified,
+		Attributes: asset.Attributes{
+			Mode: f.Mode(),
+			UID:  uid,
+			GID:  gid,
+		},
+	}
+
+	var r io.Reader = rc
+	if e.Attributes.Mode&fs.ModeSymlink != 0 {
+		// The contents of a link are its target.
+		target, err := io.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		e.Attributes.LinkTarget = string(target)
+		r = strings.NewReader(e.Attributes.LinkTarget)
+	}
+	return fn(e, r)
+}
+
+// Close implements ArchiveReader.
+func (z *zipArchiveReader) Close() error {
+	return z.reader.Close()
+}
+
+// zipEntryFile is an encrypted entry opened from a zip archive.
+type zipEntryFile struct {
+	io.ReadCloser
+	file *zip.File
+}
+
+func (f *zipEntryFile) Stat() (fs.FileInfo, error) {
+	return f.file.FileInfo(), nil
+}
+
+// decryptedEntryReader reads the contents of an encrypted entry. Once they are
+// all read, their size and CRC-32 are checked, like zip.File.Open does, and so
+// is the authentication code of the encrypted contents.
+type decryptedEntryReader struct {
+	contents  io.ReadCloser
+	decrypted io.Reader
+	size      uint64
+	read      uint64
+	crc32     uint32
+	hash      hash.Hash32 // Nil if the entry has no CRC-32.
+	err       error
+}
+
+func (r *decryptedEntryReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.contents.Read(p)
+	r.read += uint64(n)
+	if r.hash != nil {
+		_, _ = r.hash.Write(p[:n])
+	}
+	if r.read > r.size {
+		err = zip.ErrFormat
+	} else if errors.Is(err, io.EOF) {
+		err = r.verify()
+	}
+	r.err = err
+	return n, err
+}
+
+func (r *decryptedEntryReader) verify() error {
+	if r.read != r.size {
+		return io.ErrUnexpectedEOF
+	}
+	// The decompressor may stop before the end of the encrypted contents, the
+	// authentication code is only checked once they are all read.
+	if _, err := io.Copy(io.Discard, r.decrypted); err != nil {
+		return err
+	}
+	if r.hash != nil && r.hash.Sum32() != r.crc32 {
+		return zip.ErrChecksum
+	}
+	return io.EOF
+}
+
+func (r *decryptedEntryReader) Close() error {
+	return r.contents.Close()
+}
@@ -0,0 +1,250 @@
+package zipwriter
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Entries encrypted with the WinZip AES extension, as read by WinZip, 7-Zip
+// and libarchive. See https://www.winzip.com/en/support/aes-encryption/.
+//
+// The contents are compressed, then encrypted with AES-256 in counter mode,
+// with a key derived from the password and a random salt for each entry. An
+// authentication code of the encrypted contents follows them. The entries
+// are written as AE-2, without the CRC-32 of the contents, which would leak
+// information about them.
+
+// Method of the encrypted entries. Their actual method is in their AES extra field.
+const AES uint16 = 99
+
+// Header ID of the AES extra field.
+const aesExtraID = 0x9901
+
+const (
+	// Vendor version of AE-2, where the CRC-32 of the contents is set to 0.
+	aesVendorVersion = 2
+	// AES-256.
+	aesStrength   = 3
+	aesKeySize    = 32
+	aesSaltSize   = 16
+	aesVerifySize = 2
+	aesMACSize    = 10
+	// Iterations of the PBKDF2 key derivation, set by the extension.
+	aesIterations = 1000
+)
+
+// Bytes added to the compressed contents of an encrypted entry.
+const AESOverhead = aesSaltSize + aesVerifySize + aesMACSize
+
+var (
+	ErrPassword       = errors.New("wrong password")
+	ErrAuthentication = errors.New("encrypted contents failed authentication")
+)
+
+// Returns the extra field of an entry encrypted with its actual compression method.
+func aesExtra(method uint16) []byte {
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], aesExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], aesVendorVersion)
+	copy(extra[6:], "AE")
+	extra[8] = aesStrength
+	binary.LittleEndian.PutUint16(extra[9:], method)
+	return extra
+}
+
+// AESEntry describes the encryption of an entry, from its AES extra field.
+type AESEntry struct {
+	Method uint16 // Actual compression method of the contents.
+	// Whether the CRC-32 of the contents is kept. AE-2 entries have none.
+	CheckCRC bool
+}
+
+// Parse the AES extra field of an encrypted entry. Returns false if there is none.
+func ParseAESExtra(extra []byte) (AESEntry, bool, error) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra[0:])
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		if id == aesExtraID {
+			if size < 7 || string(extra[2:4]) != "AE" {
+				return AESEntry{}, false, errors.New("invalid AES extra field")
+			}
+			if extra[4] != aesStrength {
+				return AESEntry{}, false, errors.New("unsupported AES key size, only AES-256 is supported")
+			}
+			return AESEntry{
+				Method:   binary.LittleEndian.Uint16(extra[5:]),
+				CheckCRC: binary.LittleEndian.Uint16(extra[0:]) == 1,
+			}, true, nil
+		}
+		extra = extra[size:]
+	}
+	return AESEntry{}, false, nil
+}
+
+// Derive the encryption key, the authentication key and the password verifier.
+func deriveAESKeys(password []byte, salt []byte) (key []byte, macKey []byte, verifier []byte) {
+	derived := pbkdf2.Key(password, salt, aesIterations, 2*aesKeySize+aesVerifySize, sha1.New)
+	return derived[:aesKeySize], derived[aesKeySize : 2*aesKeySize], derived[2*aesKeySize:]
+}
+
+// winzipCTR is AES in counter mode with the little endian counter of the
+// extension, starting at 1.
+type winzipCTR struct {
+	block     cipher.Block
+	counter   uint64
+	keystream [aes.BlockSize]byte
+	used      int // Bytes of the keystream already used.
+}
+
+func newWinzipCTR(key []byte) (*winzipCTR, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &winzipCTR{block: block, used: aes.BlockSize}, nil
+}
+
+func (c *winzipCTR) XORKeyStream(dst, src []byte) {
+	for len(src) > 0 {
+		if c.used == aes.BlockSize {
+			c.counter++
+			var counter [aes.BlockSize]byte
+			binary.LittleEndian.PutUint64(counter[:], c.counter)
+			c.block.Encrypt(c.keystream[:], counter[:])
+			c.used = 0
+		}
+		n := subtle.XORBytes(dst, src, c.keystream[c.used:])
+		c.used += n
+		dst, src = dst[n:], src[n:]
+	}
+}
+
+// aesWriter encrypts the compressed contents of an entry. The salt and
+// password verifier are written with the first contents, or once closed if
+// there are none. The authentication code is written once closed.
+type aesWriter struct {
+	w      io.Writer
+	header []byte // Salt and password verifier, nil once written.
+	stream *winzipCTR
+	mac    hash.Hash
+	buf    []byte
+}
+
+func newAESWriter(w io.Writer, password []byte) (*aesWriter, error) {
+	salt := make([]byte, aesSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, macKey, verifier := deriveAESKeys(password, salt)
+	stream, err := newWinzipCTR(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aesWriter{
+		w:      w,
+		header: append(salt, verifier...),
+		stream: stream,
+		mac:    hmac.New(sha1.New, macKey),
+	}, nil
+}
+
+func (a *aesWriter) writeHeader() error {
+	if a.header == nil {
+		return nil
+	}
+	_, err := a.w.Write(a.header)
+	a.header = nil
+	return err
+}
+
+func (a *aesWriter) Write(p []byte) (int, error) {
+	if err := a.writeHeader(); err != nil {
+		return 0, err
+	}
+	if cap(a.buf) < len(p) {
+		a.buf = make([]byte, len(p))
+	}
+	encrypted := a.buf[:len(p)]
+	a.stream.XORKeyStream(encrypted, p)
+	a.mac.Write(encrypted)
+	return a.w.Write(encrypted)
+}
+
+func (a *aesWriter) Close() error {
+	if err := a.writeHeader(); err != nil {
+		return err
+	}
+	_, err := a.w.Write(a.mac.Sum(nil)[:aesMACSize])
+	return err
+}
+
+// aesReader decrypts the contents of an entry. The authentication code is
+// checked once the contents are read.
+type aesReader struct {
+	r        io.Reader // The encrypted contents, without the authentication code.
+	tail     io.Reader // The authentication code.
+	stream   *winzipCTR
+	mac      hash.Hash
+	verified bool
+}
+
+// Decrypt the raw contents of an encrypted entry, of the given size.
+func NewAESReader(r io.Reader, size int64, password []byte) (io.Reader, error) {
+	if size < AESOverhead {
+		return nil, io.ErrUnexpectedEOF
+	}
+	header := make([]byte, aesSaltSize+aesVerifySize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	key, macKey, verifier := deriveAESKeys(password, header[:aesSaltSize])
+	if subtle.ConstantTimeCompare(verifier, header[aesSaltSize:]) != 1 {
+		return nil, ErrPassword
+	}
+	stream, err := newWinzipCTR(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aesReader{
+		r:      io.LimitReader(r, size-AESOverhead),
+		tail:   r,
+		stream: stream,
+		mac:    hmac.New(sha1.New, macKey),
+	}, nil
+}
+
+func (a *aesReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	a.mac.Write(p[:n])
+	a.stream.XORKeyStream(p[:n], p[:n])
+	if errors.Is(err, io.EOF) && !a.verified {
+		expected := make([]byte, aesMACSize)
+		if _, err := io.ReadFull(a.tail, expected); err != nil {
+			if errors.Is(err, io.EOF) {
+				// The entry ends before its authentication code.
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		if !hmac.Equal(expected, a.mac.Sum(nil)[:aesMACSize]) {
+			return n, ErrAuthentication
+		}
+		a.verified = true
+	}
+	return n, err
+}
@@ -0,0 +1,73 @@
+package zipwriter
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Method of the entries compressed with zstd, as written by WinZip and 7-Zip.
+const Zstd uint16 = zstd.ZipMethodWinZip
+
+// How the contents of the entries are compressed.
+type Compression struct {
+	Level int // Level of the compressors. Zero for their default level.
+}
+
+// Compressor compresses the contents of entries, one at a time.
+// The compressors are reused between entries, so it must not be used
+// by several goroutines at once.
+type Compressor struct {
+	compression Compression
+	deflater    *flate.Writer
+	zstd        func(w io.Writer) (io.WriteCloser, error)
+}
+
+func NewCompressor(c Compression) *Compressor {
+	return &Compressor{compression: c}
+}
+
+// Returns a writer compressing to w with the given zip method.
+// It must be closed before compressing the next entry.
+func (c *Compressor) Compress(method uint16, w io.Writer) (io.WriteCloser, error) {
+	switch method {
+	case zip.Store:
+		return nopCloser{w}, nil
+	case zip.Deflate:
+		if c.deflater == nil {
+			level := flate.DefaultCompression
+			if c.compression.Level != 0 {
+				level = c.compression.Level
+			}
+			var err error
+			c.deflater, err = flate.NewWriter(w, level)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			c.deflater.Reset(w)
+		}
+		return c.deflater, nil
+	case Zstd:
+		if c.zstd == nil {
+			opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+			if c.compression.Level != 0 {
+				opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.compression.Level)))
+			}
+			c.zstd = zstd.ZipCompressor(opts...)
+		}
+		return c.zstd(w)
+	default:
+		return nil, zip.ErrAlgorithm
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
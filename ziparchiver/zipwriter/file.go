@@ -2,23 +2,36 @@ package zipwriter
 
 import (
 	"archive/zip"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/stupid-simple/backup/fileutils"
 )
 
 // Returns zip Writer helper that opens the file upon first write.
+// The archive is written to a temporary file with the fileutils.PartialSuffix,
+// which is renamed to the given path once the archive is complete.
 func NewLazyZipFile(path string) *ZipFile {
 	return &ZipFile{
 		path: path,
 		lazyOpenFunc: func() (*os.File, error) {
-			return openArchiveFile(path)
+			return fileutils.CreatePartialFile(path)
 		},
-		delFunc: func() error {
-			return os.Remove(path)
+		commitFunc: func(f *os.File) error {
+			return fileutils.CommitPartialFile(f, path)
+		},
+		delFunc: func(committed bool) error {
+			if committed {
+				return os.Remove(path)
+			}
+			return fileutils.RemovePartialFile(path)
 		},
 	}
 }
@@ -28,17 +41,39 @@ func NewNullZipFile() *ZipFile {
 	return &ZipFile{
 		path:         "/dev/null",
 		lazyOpenFunc: openNullFile,
-		delFunc:      func() error { return nil },
+		commitFunc:   func(f *os.File) error { return f.Close() },
+		delFunc:      func(bool) error { return nil },
 	}
 }
 
 type ZipFile struct {
 	init         bool
+	closed       bool
+	committed    bool
 	path         string
 	file         *os.File
 	writer       *zip.Writer
 	lazyOpenFunc func() (*os.File, error)
-	delFunc      func() error
+	commitFunc   func(f *os.File) error
+	delFunc      func(committed bool) error
+	compression  Compression
+	compressor   *Compressor
+	compressed   int64
+	password     []byte
+	// Encrypted entry being written, whose authentication code is written
+	// once the next entry is created or the archive closed.
+	pending io.Closer
+}
+
+// Set the compression of the entries. Must be called before the first entry is created.
+func (z *ZipFile) SetCompression(c Compression) {
+	z.compression = c
+}
+
+// Encrypt the entries with the password, with the WinZip AES extension. Must
+// be called before the first entry is created. Not encrypted by default.
+func (z *ZipFile) SetPassword(password []byte) {
+	z.password = password
 }
 
 func (z *ZipFile) Path() string {
@@ -46,12 +81,37 @@ func (z *ZipFile) Path() string {
 }
 
 // Close the file and writer if it was opened.
+// The archive is flushed to disk and moved to its final path. If this fails,
+// the temporary file is removed.
 func (z *ZipFile) Close() error {
-	if !z.init {
+	if !z.init || z.closed {
 		return nil
 	}
-	err := z.writer.Close()
-	return errors.Join(err, z.file.Close())
+	z.closed = true
+
+	err := z.closePending()
+	if err == nil {
+		err = z.writer.Close()
+	}
+	if err == nil {
+		err = z.commitFunc(z.file)
+	} else {
+		err = errors.Join(err, z.file.Close())
+	}
+	if err != nil {
+		return errors.Join(err, z.delFunc(false))
+	}
+	z.committed = true
+	return nil
+}
+
+// Discard the file if it was opened, without completing the archive.
+func (z *ZipFile) Discard() error {
+	if !z.init || z.closed {
+		return nil
+	}
+	z.closed = true
+	return errors.Join(z.file.Close(), z.delFunc(false))
 }
 
 // Delete the file if it was opened.
@@ -59,32 +119,238 @@ func (z *ZipFile) Delete() error {
 	if !z.init {
 		return nil
 	}
-	return z.delFunc()
+	if !z.closed {
+		return z.Discard()
+	}
+	return z.delFunc(z.committed)
 }
 
 // CreateHeader creates a new zip entry in the zip file.
 func (z *ZipFile) CreateHeader(fh *zip.FileHeader) (io.Writer, error) {
-	if !z.init {
-		var err error
-		z.file, err = z.lazyOpenFunc()
+	if z.closed {
+		return nil, fmt.Errorf("archive already closed: %s", z.path)
+	}
+	if err := z.open(); err != nil {
+		return nil, err
+	}
+	if err := z.closePending(); err != nil {
+		return nil, err
+	}
+	if z.encrypts(fh) {
+		return z.createEncrypted(fh)
+	}
+	return z.writer.CreateHeader(fh)
+}
+
+// Encrypted entries are written raw, since zip.Writer would set the CRC-32 of
+// their contents. Their sizes are set once their contents are written, and
+// written in the data descriptor following them.
+func (z *ZipFile) createEncrypted(fh *zip.FileHeader) (io.Writer, error) {
+	method := fh.Method
+	encryptHeader(fh)
+	fh.Flags |= 0x8
+	fh.CompressedSize64 = 0
+	fh.UncompressedSize64 = 0
+	prepareRawHeader(fh)
+	w, err := z.writer.CreateRaw(fh)
+	if err != nil {
+		return nil, err
+	}
+	e := &entryWriter{counter: fileutils.CountingWriter{W: w}, total: &z.compressed, header: fh}
+	e.encrypter, err = newAESWriter(&e.counter, z.password)
+	if err != nil {
+		return nil, err
+	}
+	// Entries are written one at a time, so a single compressor is reused.
+	e.compressor, err = z.compressor.Compress(method, e.encrypter)
+	if err != nil {
+		return nil, err
+	}
+	z.pending = e
+	return e, nil
+}
+
+// CreateRaw adds an entry whose contents were already compressed, with its
+// method, CRC-32 and sizes set in the header. The compressed contents are
+// written to the returned writer.
+func (z *ZipFile) CreateRaw(fh *zip.FileHeader) (io.Writer, error) {
+	if z.closed {
+		return nil, fmt.Errorf("archive already closed: %s", z.path)
+	}
+	if err := z.open(); err != nil {
+		return nil, err
+	}
+	if err := z.closePending(); err != nil {
+		return nil, err
+	}
+	encrypts := z.encrypts(fh)
+	if encrypts {
+		fh.CompressedSize64 += AESOverhead
+		encryptHeader(fh)
+	}
+	prepareRawHeader(fh)
+	w, err := z.writer.CreateRaw(fh)
+	if err != nil {
+		return nil, err
+	}
+	z.compressed += int64(fh.CompressedSize64)
+	if !encrypts {
+		return w, nil
+	}
+	encrypter, err := newAESWriter(w, z.password)
+	if err != nil {
+		return nil, err
+	}
+	z.pending = encrypter
+	return encrypter, nil
+}
+
+// Whether the entry is encrypted. Directories have no contents to encrypt.
+func (z *ZipFile) encrypts(fh *zip.FileHeader) bool {
+	return z.password != nil && !strings.HasSuffix(fh.Name, "/")
+}
+
+// Set the method, flag and extra field of an encrypted entry. AE-2 entries
+// have no CRC-32.
+func encryptHeader(fh *zip.FileHeader) {
+	fh.Extra = append(fh.Extra, aesExtra(fh.Method)...)
+	fh.Method = AES
+	fh.Flags |= 0x1
+	fh.CRC32 = 0
+}
+
+func (z *ZipFile) closePending() error {
+	if z.pending == nil {
+		return nil
+	}
+	err := z.pending.Close()
+	z.pending = nil
+	return err
+}
+
+func (z *ZipFile) open() error {
+	if z.init {
+		return nil
+	}
+	var err error
+	z.file, err = z.lazyOpenFunc()
+	if err != nil {
+		return err
+	}
+	z.writer = zip.NewWriter(z.file)
+	z.compressor = NewCompressor(z.compression)
+	for _, method := range []uint16{zip.Store, zip.Deflate, Zstd} {
+		z.writer.RegisterCompressor(method, z.countingCompressor(method))
+	}
+	z.init = true
+	return nil
+}
+
+// Sets the header fields that zip.Writer.CreateHeader sets, but CreateRaw doesn't.
+func prepareRawHeader(fh *zip.FileHeader) {
+	if !fh.NonUTF8 && utf8.ValidString(fh.Name) && requiresUTF8(fh.Name) {
+		fh.Flags |= 0x800
+	}
+	fh.CreatorVersion = fh.CreatorVersion&0xff00 | 20
+	fh.ReaderVersion = 20
+	if fh.CompressedSize64 > math.MaxUint32 || fh.UncompressedSize64 > math.MaxUint32 {
+		// Zip64 extensions are needed.
+		fh.ReaderVersion = 45
+	}
+	if fh.Modified.IsZero() {
+		return
+	}
+	fh.ModifiedDate, fh.ModifiedTime = msDosTime(fh.Modified)
+	// Extended timestamp, like zip.Writer.CreateHeader writes.
+	extra := make([]byte, 9)
+	binary.LittleEndian.PutUint16(extra[0:], 0x5455)
+	binary.LittleEndian.PutUint16(extra[2:], 5)
+	extra[4] = 1
+	binary.LittleEndian.PutUint32(extra[5:], uint32(fh.Modified.Unix()))
+	fh.Extra = append(fh.Extra, extra...)
+}
+
+// Whether the name has characters that aren't the same in CP-437 and the
+// encodings readers commonly use instead.
+func requiresUTF8(s string) bool {
+	for _, r := range s {
+		if r < 0x20 || r > 0x7d || r == 0x5c {
+			return true
+		}
+	}
+	return false
+}
+
+func msDosTime(t time.Time) (date uint16, tm uint16) {
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	tm = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, tm
+}
+
+// Number of bytes written for the contents of the entries, after compression.
+// The last entry is only counted once the archive is closed.
+func (z *ZipFile) CompressedSize() int64 {
+	return z.compressed
+}
+
+func (z *ZipFile) countingCompressor(method uint16) zip.Compressor {
+	return func(w io.Writer) (io.WriteCloser, error) {
+		e := &entryWriter{counter: fileutils.CountingWriter{W: w}, total: &z.compressed}
+		// Entries are written one at a time, so a single compressor is reused.
+		compressor, err := z.compressor.Compress(method, &e.counter)
 		if err != nil {
 			return nil, err
 		}
-		z.writer = zip.NewWriter(z.file)
-		z.init = true
+		e.compressor = compressor
+		return e, nil
 	}
+}
 
-	return z.writer.CreateHeader(fh)
+// entryWriter writes the contents of an entry through its compressor, and
+// encrypter if any, and adds the written bytes to the archive total once closed.
+type entryWriter struct {
+	compressor io.WriteCloser
+	encrypter  *aesWriter // Nil if the entry isn't encrypted.
+	counter    fileutils.CountingWriter
+	total      *int64
+	size       int64           // Bytes of the contents, before compression.
+	header     *zip.FileHeader // Header of an encrypted entry, whose sizes are set once closed.
 }
 
-func openNullFile() (*os.File, error) {
-	return os.OpenFile("/dev/null", os.O_WRONLY, 0600)
+func (e *entryWriter) Write(p []byte) (int, error) {
+	n, err := e.compressor.Write(p)
+	e.size += int64(n)
+	return n, err
 }
 
-func openArchiveFile(path string) (*os.File, error) {
-	if fileutils.Exists(path) {
-		return nil, fmt.Errorf("file or directory already exists with this name: %s", path)
+func (e *entryWriter) Close() error {
+	err := e.compressor.Close()
+	if err == nil && e.encrypter != nil {
+		err = e.encrypter.Close()
+	}
+	*e.total += e.counter.Count
+	if e.header != nil {
+		setEntrySizes(e.header, e.size, e.counter.Count)
 	}
+	return err
+}
 
-	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+// Set the sizes of an entry once written, like zip.Writer does for the
+// entries it compresses.
+func setEntrySizes(fh *zip.FileHeader, size int64, compressedSize int64) {
+	fh.UncompressedSize64 = uint64(size)
+	fh.CompressedSize64 = uint64(compressedSize)
+	if fh.CompressedSize64 > math.MaxUint32 || fh.UncompressedSize64 > math.MaxUint32 {
+		fh.CompressedSize = math.MaxUint32
+		fh.UncompressedSize = math.MaxUint32
+		// Zip64 extensions are needed.
+		fh.ReaderVersion = 45
+	} else {
+		fh.CompressedSize = uint32(fh.CompressedSize64)
+		fh.UncompressedSize = uint32(fh.UncompressedSize64)
+	}
+}
+
+func openNullFile() (*os.File, error) {
+	return os.OpenFile("/dev/null", os.O_WRONLY, 0600)
 }
@@ -2,10 +2,18 @@ package zipwriter_test
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stupid-simple/backup/fileutils"
 	"github.com/stupid-simple/backup/ziparchiver/zipwriter"
 )
@@ -139,3 +147,336 @@ func TestZipFile_CloseWithoutInit(t *testing.T) {
 		t.Errorf("Expected no error when deleting unopened file, got: %v", err)
 	}
 }
+
+func TestNewLazyZipFile_Partial(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	partialPath := zipPath + fileutils.PartialSuffix
+
+	zipFile := zipwriter.NewLazyZipFile(zipPath)
+	writer, err := zipFile.CreateHeader(&zip.FileHeader{Name: "test.txt"})
+	if err != nil {
+		t.Fatalf("Failed to create zip entry: %v", err)
+	}
+	if _, err := writer.Write([]byte("test content")); err != nil {
+		t.Fatalf("Failed to write content: %v", err)
+	}
+
+	// The archive is written to the partial file until it is closed.
+	if fileutils.Exists(zipPath) {
+		t.Errorf("Zip file should not exist before closing: %s", zipPath)
+	}
+	if !fileutils.Exists(partialPath) {
+		t.Errorf("Partial zip file was not created at %s", partialPath)
+	}
+
+	if err := zipFile.Close(); err != nil {
+		t.Fatalf("Failed to close zip file: %v", err)
+	}
+	if !fileutils.Exists(zipPath) {
+		t.Errorf("Zip file was not created at %s", zipPath)
+	}
+	if fileutils.Exists(partialPath) {
+		t.Errorf("Partial zip file was not removed from %s", partialPath)
+	}
+
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to open zip file: %v", err)
+	}
+	_ = r.Close()
+	if len(r.File) != 1 {
+		t.Errorf("Expected 1 file in zip, got %d", len(r.File))
+	}
+}
+
+func TestNewLazyZipFile_Discard(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+
+	zipFile := zipwriter.NewLazyZipFile(zipPath)
+	if _, err := zipFile.CreateHeader(&zip.FileHeader{Name: "test.txt"}); err != nil {
+		t.Fatalf("Failed to create zip entry: %v", err)
+	}
+
+	if err := zipFile.Discard(); err != nil {
+		t.Fatalf("Failed to discard zip file: %v", err)
+	}
+	if fileutils.Exists(zipPath) || fileutils.Exists(zipPath+fileutils.PartialSuffix) {
+		t.Errorf("Discarded zip file should not exist")
+	}
+
+	// Closing a discarded file does nothing.
+	if err := zipFile.Close(); err != nil {
+		t.Errorf("Expected no error when closing discarded file, got: %v", err)
+	}
+	if fileutils.Exists(zipPath) {
+		t.Errorf("Discarded zip file should not be created on close")
+	}
+}
+
+func TestZipFile_Compression(t *testing.T) {
+	tempDir := t.TempDir()
+	zipPath := filepath.Join(tempDir, "test.zip")
+	content := strings.Repeat("test content ", 1000)
+
+	zipFile := zipwriter.NewLazyZipFile(zipPath)
+	zipFile.SetCompression(zipwriter.Compression{Level: 9})
+	for _, method := range []uint16{zip.Store, zip.Deflate, zipwriter.Zstd} {
+		writer, err := zipFile.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("%d.txt", method), Method: method})
+		if err != nil {
+			t.Fatalf("Failed to create zip entry: %v", err)
+		}
+		if _, err := writer.Write([]byte(content)); err != nil {
+			t.Fatalf("Failed to write content: %v", err)
+		}
+	}
+	if err := zipFile.Close(); err != nil {
+		t.Fatalf("Failed to close zip file: %v", err)
+	}
+
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to open zip file: %v", err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	r.RegisterDecompressor(zipwriter.Zstd, zstd.ZipDecompressor())
+
+	var compressed int64
+	for _, f := range r.File {
+		compressed += int64(f.CompressedSize64)
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Failed to open entry %s: %v", f.Name, err)
+		}
+		actual, err := io.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			t.Fatalf("Failed to read entry %s: %v", f.Name, err)
+		}
+		if string(actual) != content {
+			t.Errorf("Unexpected content for entry %s", f.Name)
+		}
+	}
+	if zipFile.CompressedSize() != compressed {
+		t.Errorf("Expected compressed size %d, got %d", compressed, zipFile.CompressedSize())
+	}
+}
+
+func TestZipFile_Password(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.zip")
+	content := strings.Repeat("test content ", 1000)
+	password := []byte("secret")
+
+	zipFile := zipwriter.NewLazyZipFile(zipPath)
+	zipFile.SetPassword(password)
+	for _, method := range []uint16{zip.Store, zip.Deflate, zipwriter.Zstd} {
+		writer, err := zipFile.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("%d.txt", method), Method: method})
+		if err != nil {
+			t.Fatalf("Failed to create zip entry: %v", err)
+		}
+		if _, err := writer.Write([]byte(content)); err != nil {
+			t.Fatalf("Failed to write content: %v", err)
+		}
+	}
+	if _, err := zipFile.CreateHeader(&zip.FileHeader{Name: "empty.txt", Method: zip.Deflate}); err != nil {
+		t.Fatalf("Failed to create zip entry: %v", err)
+	}
+	if _, err := zipFile.CreateHeader(&zip.FileHeader{Name: "dir/"}); err != nil {
+		t.Fatalf("Failed to create zip entry: %v", err)
+	}
+	raw := []byte("raw content")
+	writer, err := zipFile.CreateRaw(&zip.FileHeader{
+		Name:               "raw.txt",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(raw),
+		CompressedSize64:   uint64(len(raw)),
+		UncompressedSize64: uint64(len(raw)),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create raw zip entry: %v", err)
+	}
+	if _, err := writer.Write(raw); err != nil {
+		t.Fatalf("Failed to write content: %v", err)
+	}
+	if err := zipFile.Close(); err != nil {
+		t.Fatalf("Failed to close zip file: %v", err)
+	}
+
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to open zip file: %v", err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	expected := map[string]string{
+		"0.txt":     content,
+		"8.txt":     content,
+		"93.txt":    content,
+		"empty.txt": "",
+		"raw.txt":   string(raw),
+	}
+	var compressed int64
+	for _, f := range r.File {
+		compressed += int64(f.CompressedSize64)
+		aes, ok, err := zipwriter.ParseAESExtra(f.Extra)
+		if err != nil {
+			t.Fatalf("Failed to parse extra field of entry %s: %v", f.Name, err)
+		}
+		if f.Name == "dir/" {
+			if ok || f.Flags&0x1 != 0 {
+				t.Errorf("Expected directory entry not to be encrypted")
+			}
+			continue
+		}
+		if !ok || f.Method != zipwriter.AES || f.Flags&0x1 == 0 {
+			t.Fatalf("Expected entry %s to be encrypted", f.Name)
+		}
+
+		actual := readEncryptedEntry(t, f, aes, password)
+		if actual != expected[f.Name] {
+			t.Errorf("Unexpected content for entry %s", f.Name)
+		}
+		if aes.CheckCRC || f.CRC32 != 0 {
+			t.Errorf("Expected entry %s to be written as AE-2, without CRC-32", f.Name)
+		}
+
+		rc, err := f.OpenRaw()
+		if err != nil {
+			t.Fatalf("Failed to open entry %s: %v", f.Name, err)
+		}
+		if _, err := zipwriter.NewAESReader(rc, int64(f.CompressedSize64), []byte("wrong")); !errors.Is(err, zipwriter.ErrPassword) {
+			t.Errorf("Expected wrong password error for entry %s, got %v", f.Name, err)
+		}
+	}
+	if zipFile.CompressedSize() != compressed {
+		t.Errorf("Expected compressed size %d, got %d", compressed, zipFile.CompressedSize())
+	}
+}
+
+func TestNewAESReader_Tampered(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.zip")
+	password := []byte("secret")
+
+	zipFile := zipwriter.NewLazyZipFile(zipPath)
+	zipFile.SetPassword(password)
+	writer, err := zipFile.CreateHeader(&zip.FileHeader{Name: "test.txt", Method: zip.Store})
+	if err != nil {
+		t.Fatalf("Failed to create zip entry: %v", err)
+	}
+	if _, err := writer.Write([]byte("test content")); err != nil {
+		t.Fatalf("Failed to write content: %v", err)
+	}
+	if err := zipFile.Close(); err != nil {
+		t.Fatalf("Failed to close zip file: %v", err)
+	}
+
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to open zip file: %v", err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	f := r.File[0]
+	rc, err := f.OpenRaw()
+	if err != nil {
+		t.Fatalf("Failed to open entry: %v", err)
+	}
+	encrypted, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Failed to read entry: %v", err)
+	}
+
+	// Flip a bit of the encrypted contents, after the salt and password verifier.
+	encrypted[20] ^= 1
+	decrypted, err := zipwriter.NewAESReader(bytes.NewReader(encrypted), int64(len(encrypted)), password)
+	if err != nil {
+		t.Fatalf("Failed to decrypt entry: %v", err)
+	}
+	if _, err := io.ReadAll(decrypted); !errors.Is(err, zipwriter.ErrAuthentication) {
+		t.Errorf("Expected authentication error, got %v", err)
+	}
+}
+
+func TestNewAESReader_Truncated(t *testing.T) {
+	zipPath := filepath.Join(t.TempDir(), "test.zip")
+	password := []byte("secret")
+
+	zipFile := zipwriter.NewLazyZipFile(zipPath)
+	zipFile.SetPassword(password)
+	writer, err := zipFile.CreateHeader(&zip.FileHeader{Name: "test.txt", Method: zip.Store})
+	if err != nil {
+		t.Fatalf("Failed to create zip entry: %v", err)
+	}
+	if _, err := writer.Write([]byte("test content")); err != nil {
+		t.Fatalf("Failed to write content: %v", err)
+	}
+	if err := zipFile.Close(); err != nil {
+		t.Fatalf("Failed to close zip file: %v", err)
+	}
+
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatalf("Failed to open zip file: %v", err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	rc, err := r.File[0].OpenRaw()
+	if err != nil {
+		t.Fatalf("Failed to open entry: %v", err)
+	}
+	encrypted, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Failed to read entry: %v", err)
+	}
+
+	// The entry ends before its authentication code, in full or in part.
+	for _, missing := range []int{10, 4} {
+		truncated := encrypted[:len(encrypted)-missing]
+		decrypted, err := zipwriter.NewAESReader(bytes.NewReader(truncated), int64(len(encrypted)), password)
+		if err != nil {
+			t.Fatalf("Failed to decrypt entry: %v", err)
+		}
+		if _, err := io.ReadAll(decrypted); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected unexpected EOF with %d bytes missing, got %v", missing, err)
+		}
+	}
+}
+
+func readEncryptedEntry(t *testing.T, f *zip.File, aes zipwriter.AESEntry, password []byte) string {
+	t.Helper()
+	rc, err := f.OpenRaw()
+	if err != nil {
+		t.Fatalf("Failed to open entry %s: %v", f.Name, err)
+	}
+	decrypted, err := zipwriter.NewAESReader(rc, int64(f.CompressedSize64), password)
+	if err != nil {
+		t.Fatalf("Failed to decrypt entry %s: %v", f.Name, err)
+	}
+	var contents io.Reader
+	switch aes.Method {
+	case zip.Store:
+		contents = decrypted
+	case zip.Deflate:
+		contents = flate.NewReader(decrypted)
+	case zipwriter.Zstd:
+		contents = zstd.ZipDecompressor()(decrypted)
+	default:
+		t.Fatalf("Unexpected method %d for entry %s", aes.Method, f.Name)
+	}
+	actual, err := io.ReadAll(contents)
+	if err != nil {
+		t.Fatalf("Failed to read entry %s: %v", f.Name, err)
+	}
+	// Read the authentication code.
+	if _, err := io.Copy(io.Discard, decrypted); err != nil {
+		t.Fatalf("Failed to authenticate entry %s: %v", f.Name, err)
+	}
+	return string(actual)
+}